@@ -1,31 +1,74 @@
 package main
 
 import (
-	"encoding/json"
-    "net/http"
+	"os"
+	"strconv"
 
-    "github.com/bsycorp/keymaster/km/ip_oracle"
-    "github.com/aws/aws-lambda-go/events"
-    "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/bsycorp/keymaster/km/ip_oracle"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
-type RequestPayLoad struct {
-    KMSKeyId string
-}
-
-func HandleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    var reqPayLoad RequestPayLoad
-    json.Unmarshal([]byte(req.Body), &reqPayLoad)
-    
-    sm := ip_oracle.NewSigningMethodKMS(reqPayLoad.KMSKeyId)
-    signedString, err := ip_oracle.MakeIPJWT(req.RequestContext.Identity.SourceIP, sm)
+// DefaultRateLimit is the sign requests allowed per client address per
+// minute, unless set by IP_ORACLE_RATE_LIMIT.
+const DefaultRateLimit = 30
 
-    return events.APIGatewayProxyResponse{
-        StatusCode: http.StatusOK,
-        Body:       signedString,
-    }, err
+// newHandler configures the sign handler from the environment:
+//   IP_ORACLE_SIGNER           "kms" (the default) or "local"
+//   IP_ORACLE_KEY              the KMS key id or ARN, or the local PEM private
+//                              key (anything util.Load can load)
+//   IP_ORACLE_ISSUER           the iss claim of issued tokens, optional
+//   IP_ORACLE_TRUSTED_PROXIES  comma separated CIDRs of proxies whose
+//                              X-Forwarded-For is believed, optional
+//   IP_ORACLE_RATE_LIMIT       sign requests per client address per minute,
+//                              0 for no limit
+func newHandler() (*ip_oracle.SignHandler, error) {
+	key := os.Getenv("IP_ORACLE_KEY")
+	if key == "" {
+		return nil, errors.New("IP_ORACLE_KEY is not set")
+	}
+	var signer ip_oracle.Signer
+	switch os.Getenv("IP_ORACLE_SIGNER") {
+	case "", "kms":
+		signer = ip_oracle.NewSigningMethodKMS(key)
+	case "local":
+		localSigner, err := ip_oracle.LoadLocalSigner(key)
+		if err != nil {
+			return nil, err
+		}
+		signer = localSigner
+	default:
+		return nil, errors.Errorf("unsupported IP_ORACLE_SIGNER: %s", os.Getenv("IP_ORACLE_SIGNER"))
+	}
+	proxies, err := ip_oracle.ParseTrustedProxies(os.Getenv("IP_ORACLE_TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+	rateLimit := DefaultRateLimit
+	if s := os.Getenv("IP_ORACLE_RATE_LIMIT"); s != "" {
+		rateLimit, err = strconv.Atoi(s)
+		if err != nil || rateLimit < 0 {
+			return nil, errors.Errorf("invalid IP_ORACLE_RATE_LIMIT: %s", s)
+		}
+	}
+	h := &ip_oracle.SignHandler{
+		Issuer: &ip_oracle.TokenIssuer{
+			Method: signer,
+			Issuer: os.Getenv("IP_ORACLE_ISSUER"),
+		},
+		TrustedProxies: proxies,
+	}
+	if rateLimit > 0 {
+		h.Limiter = ip_oracle.NewRateLimiter(rateLimit)
+	}
+	return h, nil
 }
 
 func main() {
-    lambda.Start(HandleRequest)
+	h, err := newHandler()
+	if err != nil {
+		log.Fatalf("error configuring ip oracle: %v", err)
+	}
+	lambda.Start(h.HandleRequest)
 }
@@ -2,31 +2,77 @@ package main
 
 import (
 	"encoding/json"
-    "net/http"
+	"os"
+	"strings"
 
-    "github.com/bsycorp/keymaster/km/ip_oracle"
-    "github.com/aws/aws-lambda-go/events"
-    "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/bsycorp/keymaster/km/ip_oracle"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
-type RequestPayLoad struct {
-    KMSKeyId string
-    SignedString string
-}
-
-func HandleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    var reqPayLoad RequestPayLoad
-    json.Unmarshal([]byte(req.Body), &reqPayLoad)
+// newHandler configures the verify handler from the environment:
+//   IP_ORACLE_SIGNER     "kms" (the default) or "local"
+//   IP_ORACLE_KEY        the KMS key id or ARN, or the local PEM public key
+//                        (anything util.Load can load)
+//   IP_ORACLE_JWKS_URL   verify against the oracle's JWKS instead, optional
+//   IP_ORACLE_ISSUER     the iss claim tokens must carry, optional
+//   IP_ORACLE_AUDIENCE   the aud claim tokens must carry, optional
+//   IP_ORACLE_WHITELIST  comma separated allowed CIDRs, addresses or ranges
+//   IP_ORACLE_DENYLIST   comma separated denied CIDRs, addresses or ranges
+//   IP_ORACLE_RANGES     named ranges, as a JSON object of name to CIDRs
+func newHandler() (*ip_oracle.VerifyHandler, error) {
+	verifier := &ip_oracle.Verifier{
+		Issuer:   os.Getenv("IP_ORACLE_ISSUER"),
+		Audience: os.Getenv("IP_ORACLE_AUDIENCE"),
+	}
+	key := os.Getenv("IP_ORACLE_KEY")
+	switch {
+	case os.Getenv("IP_ORACLE_JWKS_URL") != "":
+		verifier.Keys = idtoken.NewRemoteKeySet(os.Getenv("IP_ORACLE_JWKS_URL"))
+	case key == "":
+		return nil, errors.New("IP_ORACLE_KEY or IP_ORACLE_JWKS_URL must be set")
+	case os.Getenv("IP_ORACLE_SIGNER") == "local":
+		keys, err := ip_oracle.LoadPublicKeySet(key)
+		if err != nil {
+			return nil, err
+		}
+		verifier.Keys = keys
+	case os.Getenv("IP_ORACLE_SIGNER") == "" || os.Getenv("IP_ORACLE_SIGNER") == "kms":
+		verifier.Method = ip_oracle.NewSigningMethodKMS(key)
+	default:
+		return nil, errors.Errorf("unsupported IP_ORACLE_SIGNER: %s", os.Getenv("IP_ORACLE_SIGNER"))
+	}
 
-    sm := ip_oracle.NewSigningMethodKMS(reqPayLoad.KMSKeyId)
-    verifiedSourceIp, err := ip_oracle.VerifyIPJWT(reqPayLoad.SignedString, sm)
+	var ranges map[string][]string
+	if s := os.Getenv("IP_ORACLE_RANGES"); s != "" {
+		if err := json.Unmarshal([]byte(s), &ranges); err != nil {
+			return nil, errors.Wrap(err, "invalid IP_ORACLE_RANGES")
+		}
+	}
+	policy, err := ip_oracle.NewPolicy(splitList(os.Getenv("IP_ORACLE_WHITELIST")),
+		splitList(os.Getenv("IP_ORACLE_DENYLIST")), ranges)
+	if err != nil {
+		return nil, err
+	}
+	return &ip_oracle.VerifyHandler{Verifier: verifier, Policy: policy}, nil
+}
 
-    return events.APIGatewayProxyResponse{
-        StatusCode: http.StatusOK,
-        Body:       verifiedSourceIp,
-    }, err
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func main() {
-    lambda.Start(HandleRequest)
+	h, err := newHandler()
+	if err != nil {
+		log.Fatalf("error configuring ip oracle: %v", err)
+	}
+	lambda.Start(h.HandleRequest)
 }
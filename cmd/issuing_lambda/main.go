@@ -2,38 +2,56 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/bsycorp/keymaster/km/api"
 	"github.com/bsycorp/keymaster/km/server"
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"os"
 )
 
-func Handler(ctx context.Context, req api.Request) (interface{}, error) {
-	var km server.Server
-	err := km.Configure(os.Getenv("CONFIG"))
+// The configuration is kept across invocations of a warm lambda, and
+// reloaded when it changes. CONFIG_OVERLAY selects an overlay of it.
+var configHolder = newConfigHolder()
+
+func newConfigHolder() *server.ConfigHolder {
+	h := server.NewConfigHolder(os.Getenv("CONFIG"))
+	h.Overlay = os.Getenv("CONFIG_OVERLAY")
+	return h
+}
+
+// Handler serves both direct lambda invocations, with the api.Request
+// envelope as the event, and API Gateway proxy integration events.
+func Handler(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	var probe struct {
+		HTTPMethod string `json:"httpMethod"`
+	}
+	_ = json.Unmarshal(event, &probe)
+	if probe.HTTPMethod != "" {
+		var proxyReq events.APIGatewayProxyRequest
+		err := json.Unmarshal(event, &proxyReq)
+		if err != nil {
+			return nil, err
+		}
+		return configHolder.HandleApiGatewayProxy(&proxyReq), nil
+	}
+	var req api.Request
+	err := json.Unmarshal(event, &req)
 	if err != nil {
-		nerr := errors.Wrap(err,"Error loading km api configuration")
-		log.Println(nerr)
-		return nil, nerr
+		return nil, err
 	}
-	switch r := req.Payload.(type) {
-	case *api.DiscoveryRequest:
-		return km.HandleDiscovery(r)
-	case *api.ConfigRequest:
-		return km.HandleConfig(r)
-	case *api.DirectSamlAuthRequest:
-		return km.HandleDirectSamlAuth(r)
-	case *api.DirectOidcAuthRequest:
-		return km.HandleDirectOidcAuth(r)
-	case *api.WorkflowStartRequest:
-		return km.HandleWorkflowStart(r)
-	case *api.WorkflowAuthRequest:
-		return km.HandleWorkflowAuth(r)
-	default:
-		return nil, errors.New("unexpected request")
+	resp, err := configHolder.Dispatch(&req)
+	if err != nil {
+		log.Println(err)
+		// Clients that understand them get a typed error, rather than a
+		// function error they can only show as a string.
+		if api.HasErrorResponses(req.ApiVersion) {
+			return &api.ErrorResponse{Error: api.AsError(err)}, nil
+		}
+		return nil, err
 	}
+	return resp, nil
 }
 
 func main() {
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/server"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// keymaster-server serves the issuer api over HTTPS, for running the
+// issuer outside of lambda. km talks to it with --issuer https://...
+func main() {
+	listen := flag.String("listen", ":8443", "address to listen on")
+	config := flag.String("config", os.Getenv("CONFIG"), "issuer configuration (default $CONFIG)")
+	overlay := flag.String("config-overlay", os.Getenv("CONFIG_OVERLAY"), "overlay of the issuer configuration to serve (default $CONFIG_OVERLAY)")
+	tlsCert := flag.String("tls-cert", "", "server certificate (file://, s3://, data:// or literal PEM)")
+	tlsKey := flag.String("tls-key", "", "server certificate key (file://, s3://, data:// or literal PEM)")
+	clientCA := flag.String("client-ca", "", "CA bundle to require and verify client certificates with (mTLS)")
+	insecure := flag.Bool("insecure-http", false, "serve plain HTTP, e.g. behind a TLS terminating proxy")
+	flag.Parse()
+
+	configHolder := server.NewConfigHolder(*config)
+	configHolder.Overlay = *overlay
+	km, err := configHolder.Server()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Error loading km api configuration"))
+	}
+
+	srv := &http.Server{
+		Addr:         *listen,
+		Handler:      &server.HttpHandler{Config: configHolder},
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+	if *insecure {
+		log.Printf("serving %s over plain http on %s", km.Config.Name, *listen)
+		log.Fatal(srv.ListenAndServe())
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		log.Fatal("--tls-cert and --tls-key are required, unless --insecure-http")
+	}
+	srv.TLSConfig, err = tlsConfig(*tlsCert, *tlsKey, *clientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving %s over https on %s", km.Config.Name, *listen)
+	log.Fatal(srv.ListenAndServeTLS("", ""))
+}
+
+// tlsConfig loads the server certificate and, if given, the CA used to
+// verify client certificates, each with util.Load.
+func tlsConfig(certRef string, keyRef string, clientCARef string) (*tls.Config, error) {
+	certData, err := util.Load(certRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading tls cert")
+	}
+	keyData, err := util.Load(keyRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading tls key")
+	}
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading tls certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCARef != "" {
+		caData, err := util.Load(clientCARef)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found in client ca")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
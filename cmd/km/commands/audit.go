@@ -0,0 +1,169 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/audit"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with an issuer's audit log.",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <file>...",
+	Short: "Verify the hash chains in an audit log.",
+	Long: `Verify the hash chains in an audit log, reporting events that have
+been modified, removed or reordered. Files hold audit events as JSON
+lines, as written to stdout, a file or Firehose, or concatenated from S3.
+Use - to read standard input.
+
+Example:
+
+km audit verify audit.jsonl --hmac-key file://audit-hmac.key
+aws s3 cp --recursive s3://audit-bucket/keymaster/ audit/ && cat audit/*/*/*/*/*.json | km audit verify -
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var key []byte
+		if auditHmacKeyFlag != "" {
+			var err error
+			key, err = util.Load(auditHmacKeyFlag)
+			if err != nil {
+				return errors.Wrap(err, "loading hmac key")
+			}
+		}
+		var events []*audit.Event
+		for _, path := range args {
+			fileEvents, err := readAuditEvents(path)
+			if err != nil {
+				return err
+			}
+			events = append(events, fileEvents...)
+		}
+		problems := audit.Verify(events, key)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			return errors.Errorf("audit log failed verification: %d problems in %d events",
+				len(problems), len(events))
+		}
+		fmt.Printf("verified %d events\n", len(events))
+		return nil
+	},
+}
+
+var auditReviewsCmd = &cobra.Command{
+	Use:   "reviews <store>",
+	Short: "List reviews of break-glass requests.",
+	Long: `List reviews of break-glass requests, from an issuer's reviews store
+(audit.reviews in its config). Only pending reviews are listed, unless
+--all is given.
+
+Example:
+
+km audit reviews s3://audit-bucket/keymaster/reviews
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := audit.NewReviewStore(args[0])
+		if err != nil {
+			return err
+		}
+		reviews, err := store.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATUS\tOPENED\tENVIRONMENT\tROLE\tREQUESTER\tJUSTIFICATION")
+		for _, r := range reviews {
+			if r.Status != audit.ReviewPending && !auditAllFlag {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Id, r.Status, r.Opened.Format(time.RFC3339),
+				r.Environment, r.Role, r.Requester.Username, r.Justification)
+		}
+		return tw.Flush()
+	},
+}
+
+var auditSignOffCmd = &cobra.Command{
+	Use:   "sign-off <store> <review-id>",
+	Short: "Sign off the review of a break-glass request.",
+	Long: `Sign off the review of a break-glass request, once what was done with
+its credentials has been checked. The requester can't sign off their
+own request.
+
+Example:
+
+km audit sign-off s3://audit-bucket/keymaster/reviews 3f0c... \
+  --reviewer jonesa --notes "Restarted the stuck deploy, see INC-123"
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := audit.NewReviewStore(args[0])
+		if err != nil {
+			return err
+		}
+		review, err := store.Get(args[1])
+		if err != nil {
+			return err
+		}
+		err = review.SignOffBy(auditReviewerFlag, auditNotesFlag, time.Now())
+		if err != nil {
+			return err
+		}
+		err = store.Put(review)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("signed off review %s of %s's break-glass request for %s\n",
+			review.Id, review.Requester.Username, review.Role)
+		return nil
+	},
+}
+
+var auditHmacKeyFlag string
+var auditAllFlag bool
+var auditReviewerFlag string
+var auditNotesFlag string
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditVerifyCmd.Flags().StringVar(&auditHmacKeyFlag, "hmac-key", "",
+		"key the audit log was written with, if any (file://, s3://, data:// or literal)")
+	auditCmd.AddCommand(auditReviewsCmd)
+	auditReviewsCmd.Flags().BoolVar(&auditAllFlag, "all", false, "list signed off reviews too")
+	auditCmd.AddCommand(auditSignOffCmd)
+	auditSignOffCmd.Flags().StringVar(&auditReviewerFlag, "reviewer", "", "username of the reviewer")
+	auditSignOffCmd.Flags().StringVar(&auditNotesFlag, "notes", "", "what the review found")
+	_ = auditSignOffCmd.MarkFlagRequired("reviewer")
+	_ = auditSignOffCmd.MarkFlagRequired("notes")
+}
+
+func readAuditEvents(path string) ([]*audit.Event, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	events, err := audit.ReadEvents(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	return events, nil
+}
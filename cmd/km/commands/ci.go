@@ -8,6 +8,9 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -26,6 +29,11 @@ km --issuer <issuing-lambda> --role deployment \
   --url "https://github.com/bsycorp/keymaster/pull/7"
 
 All fields are required.
+
+In an emergency, e.g. when workflow is down, roles with a break-glass
+policy can be requested with --break-glass and a --justification. The
+request is announced, its credentials are short lived, and it must be
+reviewed afterwards (see km audit reviews).
 `,
 	Run: ci,
 }
@@ -37,11 +45,13 @@ var nameFlag string
 var emailFlag string
 var descriptionFlag string
 var detailsUrlFlag string
+var breakGlassFlag bool
+var justificationFlag string
 
 func init() {
 	rootCmd.AddCommand(ciCmd)
 
-	ciCmd.Flags().StringVar(&issuerFlag, "issuer", "", "target credential issuer")
+	ciCmd.Flags().StringVar(&issuerFlag, "issuer", "", "target credential issuer (lambda function or https:// url)")
 	ciCmd.Flags().StringVar(&roleFlag, "role", "", "role to apply for with issuer")
 
 	_ = ciCmd.MarkFlagRequired("issuer")
@@ -58,49 +68,95 @@ func init() {
 	_ = ciCmd.MarkFlagRequired("email")
 	_ = ciCmd.MarkFlagRequired("description")
 	_ = ciCmd.MarkFlagRequired("url")
+	addBreakGlassFlags(ciCmd)
+}
+
+// addBreakGlassFlags adds the flags to request break-glass access.
+func addBreakGlassFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&breakGlassFlag, "break-glass", false, "request emergency access under the role's break-glass policy")
+	cmd.Flags().StringVar(&justificationFlag, "justification", "", "why emergency access is needed (required with --break-glass)")
 }
 
 func ci(cmd *cobra.Command, args []string) {
-	kmApi := api.NewClient(issuerFlag)
+	authenticate("")
+}
+
+// authenticate runs the full km authentication flow using the issuer,
+// role and requester flags, with an optional CI identity token.
+func authenticate(identityToken string) {
+	kmApi, err := api.NewClient(issuerFlag)
+	if err != nil {
+		fatal(errors.Wrap(err, "error creating km api client"))
+	}
 	kmApi.Debug = debugFlag
 
-	discoveryReq := new(api.DiscoveryRequest)
-	_, err := kmApi.Discovery(discoveryReq)
+	discoveryResp, err := kmApi.Negotiate(api.RequestTypeConfig,
+		api.RequestTypeWorkflowStart, api.RequestTypeWorkflowAuth)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "error calling kmApi.Discovery"))
+		fatal(errors.Wrap(err, "error calling kmApi.Discovery"))
+	}
+	if identityToken != "" && len(discoveryResp.Features) > 0 && !discoveryResp.HasFeature(api.FeatureCIIdentity) {
+		fatal(api.NewError(api.ErrorCodeIncompatible, "issuer does not support CI identity tokens, please upgrade the issuer"))
+	}
+	var breakGlass *api.BreakGlassRequest
+	if breakGlassFlag {
+		// Older issuers would ignore the request and run workflow as usual
+		if !discoveryResp.HasFeature(api.FeatureBreakGlass) {
+			fatal(api.NewError(api.ErrorCodeIncompatible, "issuer does not support break-glass requests, please upgrade the issuer"))
+		}
+		if len(strings.TrimSpace(justificationFlag)) < api.MinJustificationLength {
+			fatal(api.NewError(api.ErrorCodeBadRequest, "--break-glass needs a --justification of at least %d characters",
+				api.MinJustificationLength))
+		}
+		breakGlass = &api.BreakGlassRequest{Justification: justificationFlag}
 	}
 
 	configReq := new(api.ConfigRequest)
 	configResp, err := kmApi.GetConfig(configReq)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "error calling kmApi.GetConfig"))
+		fatal(errors.Wrap(err, "error calling kmApi.GetConfig"))
 	}
 
 	// Now start workflow to get nonce
 	kmWorkflowStartResponse, err := kmApi.WorkflowStart(&api.WorkflowStartRequest{})
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "error calling kmApi.WorkflowStart"))
+		fatal(errors.Wrap(err, "error calling kmApi.WorkflowStart"))
 	}
 	log.Println("Started workflow with km api")
 
 	log.Println("Target role for authentication:", roleFlag)
 	targetRole := configResp.Config.FindRoleByName(roleFlag)
 	if targetRole == nil {
-		log.Fatalf("Target role #{roleFlag} not found in config")
+		fatal(api.NewError(api.ErrorCodeRoleNotFound, "target role %s not found in config", roleFlag))
+	}
+
+	// Issuers restricting where requests come from need our source
+	// address vouched for by their ip oracle.
+	var ipToken string
+	if configResp.Config.IPOracle != nil {
+		ipToken, err = client.FetchIPToken(&http.Client{Timeout: 30 * time.Second}, configResp.Config.IPOracle,
+			kmWorkflowStartResponse.IssuingNonce)
+		if err != nil {
+			fatal(err)
+		}
 	}
 
 	// Run workflow to get assertions.
-	assertions := runWorkflow(targetRole, &configResp.Config, kmWorkflowStartResponse.IdpNonce)
+	assertions := runWorkflow(targetRole, &configResp.Config, kmWorkflowStartResponse.IdpNonce, breakGlass != nil, identityToken != "")
 
 	creds, err := kmApi.WorkflowAuth(&api.WorkflowAuthRequest{
-		Username:     usernameFlag,
-		Role:         roleFlag,
-		IdpNonce:     kmWorkflowStartResponse.IdpNonce,
-		IssuingNonce: kmWorkflowStartResponse.IssuingNonce,
-		Assertions:   assertions,
+		Username:      usernameFlag,
+		Role:          roleFlag,
+		IdpNonce:      kmWorkflowStartResponse.IdpNonce,
+		IssuingNonce:  kmWorkflowStartResponse.IssuingNonce,
+		Assertions:    assertions,
+		IdentityToken: identityToken,
+		IpToken:       ipToken,
+		BreakGlass:    breakGlass,
+		Source:        requestSource(),
 	})
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "error calling kmApi.WorkflowAuth"))
+		fatal(errors.Wrap(err, "error calling kmApi.WorkflowAuth"))
 	}
 
 	credWriterOptions := client.CredWriterOptions{
@@ -113,22 +169,49 @@ func ci(cmd *cobra.Command, args []string) {
 	}
 }
 
-func runWorkflow(targetRole *api.RoleConfig, config *api.ConfigPublic, idpNonce string) []string {
+func runWorkflow(targetRole *api.RoleConfig, config *api.ConfigPublic, idpNonce string, breakGlass bool, ciIdentity bool) []string {
 	workflowPolicyName := targetRole.Workflow
 	configWorkflowPolicy := config.Workflow.FindPolicyByName(workflowPolicyName)
 	if configWorkflowPolicy == nil {
-		log.Fatalf("workflow policy %s not found in config", workflowPolicyName)
+		fatal(api.NewError(api.ErrorCodeConfiguration, "workflow policy %s not found in config", workflowPolicyName))
 	}
 	workflowPolicy := workflow.Policy{
 		Name:                configWorkflowPolicy.Name,
 		IdpName:             configWorkflowPolicy.IdpName,
 		RequesterCanApprove: configWorkflowPolicy.RequesterCanApprove,
 		IdentifyRoles:       configWorkflowPolicy.IdentifyRoles,
-		ApproverRoles:       configWorkflowPolicy.ApproverRoles,
+	}
+	if breakGlass {
+		// The break-glass policy's approvals replace the workflow
+		// policy's, and the role's schedule doesn't apply
+		if targetRole.BreakGlass == nil {
+			fatal(api.NewError(api.ErrorCodeBreakGlassNotAllowed, "role %s has no break-glass policy", targetRole.Name))
+		}
+		log.Warnln("Requesting BREAK GLASS access, this will be announced and must be reviewed")
+		workflowPolicy.IdentifyRoles = nil
+		workflowPolicy.ApproverRoles = targetRole.BreakGlass.ApproverRoles
+	} else {
+		// The role's schedule may block it now, or want more approvals
+		approverRoles, escalated, err := targetRole.ApproverRolesAt(configWorkflowPolicy, time.Now())
+		if err != nil {
+			fatal(err)
+		}
+		if escalated {
+			log.Println("Outside the role's time windows, extra approvals are required")
+		}
+		workflowPolicy.ApproverRoles = approverRoles
+	}
+	// Roles only some groups may request need the requester to identify
+	// as a member, unless they have a CI identity token instead
+	if e := targetRole.Eligibility; e != nil && e.NeedsIdentity() && !ciIdentity {
+		workflowPolicy.IdentifyRoles = make(map[string]int)
+		for _, group := range e.AllowGroups {
+			workflowPolicy.IdentifyRoles[group] = 1
+		}
 	}
 
-	// If no approval or identify required, skip all workflow. This may also
-	// be useful in emergencies if workflow is down...
+	// If no approval or identify required, skip all workflow, e.g. for
+	// break-glass requests when workflow is down
 	if len(workflowPolicy.IdentifyRoles) == 0 && len(workflowPolicy.ApproverRoles) == 0 {
 		log.Println("Skipping workflow - no identify or approval required")
 		return []string{}
@@ -138,7 +221,7 @@ func runWorkflow(targetRole *api.RoleConfig, config *api.ConfigPublic, idpNonce
 	log.Println("Using workflow engine:", workflowBaseUrl)
 	workflowApi, err := workflow.NewClient(workflowBaseUrl)
 	if err != nil {
-		log.Fatal(err)
+		fatal(api.WrapError(err, api.ErrorCodeConfiguration, "invalid workflow base url"))
 	}
 	workflowApi.Debug = debugFlag
 
@@ -161,7 +244,7 @@ func runWorkflow(targetRole *api.RoleConfig, config *api.ConfigPublic, idpNonce
 		Policy: workflowPolicy,
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal(api.WrapError(err, api.ErrorCodeInternal, "error starting workflow"))
 	}
 
 	// Now fix up the workflow URL
@@ -189,11 +272,20 @@ func runWorkflow(targetRole *api.RoleConfig, config *api.ConfigPublic, idpNonce
 		} else if getAssertionsResult.Status == "COMPLETED" {
 			break
 		} else if getAssertionsResult.Status == "REJECTED" {
-			log.Fatal("Your change request was REJECTED by a workflow approver. Exiting.")
+			log.Error("Your change request was REJECTED by a workflow approver. Exiting.")
+			os.Exit(ExitRejected)
 		} else {
-			log.Fatal("unexpected assertions result status:", getAssertionsResult.Status)
+			fatal(api.NewError(api.ErrorCodeIncompatible, "unexpected assertions result status: %s", getAssertionsResult.Status))
 		}
 	}
 	log.Printf("got: %d assertions from workflow", len(getAssertionsResult.Assertions))
 	return getAssertionsResult.Assertions
-}
\ No newline at end of file
+}
+
+// requestSource is where the request came from, for the issuer's policy.
+func requestSource() *api.RequestSource {
+	if descriptionFlag == "" && detailsUrlFlag == "" {
+		return nil
+	}
+	return &api.RequestSource{Description: descriptionFlag, DetailsURI: detailsUrlFlag}
+}
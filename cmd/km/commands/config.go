@@ -2,18 +2,204 @@ package commands
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/bsycorp/keymaster/km/client"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "Manage keymaster configuration.",
+	Long: `Manage keymaster configuration.
+
+The km config file holds named profiles of defaults for command line
+flags. Profile keys are: issuer, role, username, name, email,
+aws_credentials_file and aws_profile_name.
+
+Example:
+
+km config init nonprod-deploy --issuer <issuing-lambda> --role deployment
+km config set username smithb12
+km config use nonprod-deploy
+km ci --description "enhance the magic" --url "https://..."
+
+"km config lint", "km config render", "km config migrate" and
+"km config schema" are for issuer configs, rather than km config files.
+`,
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set <key> <value>",
+	Short: "Set a value in a profile (default the current profile).",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := configProfileName()
+		if name == "" {
+			return errors.New("no current profile, use --profile or 'km config use'")
+		}
+		err := kmConfig.EnsureProfile(name).Set(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if kmConfig.CurrentProfile == "" {
+			kmConfig.CurrentProfile = name
+		}
+		return kmConfig.Save(cfgFile)
+	},
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Get a value from a profile (default the current profile).",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		profile := kmConfig.Profile(configProfileName())
+		if profile == nil {
+			return errors.Errorf("no such profile: %s", configProfileName())
+		}
+		value, err := profile.Get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	},
+}
+
+var configListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List profiles and their settings.",
+	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("config command not yet implemented")
+		for _, name := range kmConfig.ProfileNames() {
+			marker := " "
+			if name == kmConfig.CurrentProfile {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\n", marker, name)
+			profile := kmConfig.Profile(name)
+			for _, key := range client.ProfileKeys {
+				value, _ := profile.Get(key)
+				if value != "" {
+					fmt.Printf("    %s: %s\n", key, value)
+				}
+			}
+		}
+	},
+}
+
+var configUseCmd = &cobra.Command{
+	Use:   "use <profile>",
+	Short: "Make a profile current.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := kmConfig.Use(args[0])
+		if err != nil {
+			return err
+		}
+		return kmConfig.Save(cfgFile)
+	},
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init [profile]",
+	Short: "Create a profile from an issuer's client defaults for a role.",
+	Long: `Create a profile from an issuer's client defaults for a role.
+
+The profile name defaults to the one suggested by the issuer, or else
+<environment>-<role>. Existing settings in the profile are kept.
+`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := fetchPublicConfig()
+		if err != nil {
+			return err
+		}
+		role := config.FindRoleByName(roleFlag)
+		if role == nil {
+			return errors.Errorf("role not found at issuer: %s", roleFlag)
+		}
+		name := role.ClientDefaults.ProfileName
+		if len(args) > 0 {
+			name = args[0]
+		}
+		if name == "" {
+			name = config.Name + "-" + role.Name
+		}
+		kmConfig.EnsureProfile(name).Seed(issuerFlag, role)
+		if kmConfig.CurrentProfile == "" {
+			kmConfig.CurrentProfile = name
+		}
+		log.Printf("Initialised profile: %s", name)
+		return kmConfig.Save(cfgFile)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configListCmd)
+	configCmd.AddCommand(configUseCmd)
+	configCmd.AddCommand(configInitCmd)
+
+	configInitCmd.Flags().StringVar(&issuerFlag, "issuer", "", "target credential issuer (lambda function or https:// url)")
+	configInitCmd.Flags().StringVar(&roleFlag, "role", "", "role to apply for with issuer")
+
+	_ = configInitCmd.MarkFlagRequired("issuer")
+	_ = configInitCmd.MarkFlagRequired("role")
+}
+
+// profileFlags maps command line flags to the profile keys that
+// provide their defaults.
+var profileFlags = map[string]string{
+	"issuer":               "issuer",
+	"role":                 "role",
+	"username":             "username",
+	"name":                 "name",
+	"email":                "email",
+	"aws-credentials-file": "aws_credentials_file",
+	"aws-set-profile-name": "aws_profile_name",
+}
+
+// configProfileName is the profile selected by --profile or $KM_PROFILE,
+// or else the current profile.
+func configProfileName() string {
+	if profileFlag != "" {
+		return profileFlag
+	}
+	if name := os.Getenv("KM_PROFILE"); name != "" {
+		return name
+	}
+	return kmConfig.CurrentProfile
+}
+
+// applyProfile fills in any flags not given on the command line, from
+// KM_* environment variables or else the active profile.
+func applyProfile(cmd *cobra.Command) error {
+	name := configProfileName()
+	profile := kmConfig.Profile(name)
+	if profile == nil && name != kmConfig.CurrentProfile && cmd.Parent() != configCmd {
+		return errors.Errorf("no such profile: %s", name)
+	}
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		key, ok := profileFlags[flag.Name]
+		if !ok || flag.Changed || err != nil {
+			return
+		}
+		value := os.Getenv("KM_" + strings.ToUpper(key))
+		if value == "" && profile != nil {
+			value, _ = profile.Get(key)
+		}
+		if value != "" {
+			err = cmd.Flags().Set(flag.Name, value)
+		}
+	})
+	return err
 }
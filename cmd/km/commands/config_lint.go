@@ -0,0 +1,257 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/creds"
+	"github.com/bsycorp/keymaster/km/policy"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var configLintCmd = &cobra.Command{
+	Use:   "lint <file>",
+	Short: "Check an issuer config for errors.",
+	Long: `Check an issuer config for errors, with the same validation the issuer
+applies when it loads its config: unknown credentials, workflow policies
+and idps, duplicate names, malformed ARNs, CIDRs and urls, bad durations
+and impossible approval counts, policy rules that don't compile, as
+well as fields that are unknown or of the wrong type (see "km config
+schema"). Warnings (e.g. unimplemented features) are reported but don't
+fail the lint unless --strict is given.
+
+The file may be a path, - for standard input, or s3:// file:// data://.
+It is rendered first, as by "km config render".
+
+Example:
+
+km config lint issuer-config.yaml
+km config lint --check-keys --overlay prod s3://config-bucket/issuer.yaml
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := renderConfigFile(args[0])
+		if err != nil {
+			return err
+		}
+		var problems []api.ConfigProblem
+		config, err := api.ParseConfig(data)
+		if errs, ok := err.(api.ConfigErrors); ok {
+			// The config doesn't match the schema, so there's no
+			// point checking it any further
+			problems = errs
+		} else if err != nil {
+			return err
+		} else {
+			config.Normalise()
+			problems = config.Lint()
+			problems = append(problems, config.CheckPolicy(func(rules string) error {
+				_, err := policy.Load(rules)
+				return err
+			})...)
+		}
+		if lintCheckKeysFlag && config != nil {
+			problems = append(problems, config.CheckCAKeys(creds.DefaultCAKeyLoader().Check)...)
+		}
+		errorCount := 0
+		for _, p := range problems {
+			fmt.Println(p)
+			if !p.Warning || lintStrictFlag {
+				errorCount++
+			}
+		}
+		if errorCount > 0 {
+			return errors.Errorf("config failed lint: %d problems", errorCount)
+		}
+		fmt.Printf("%s: ok\n", args[0])
+		return nil
+	},
+}
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of the issuer config.",
+	Long: `Print the JSON Schema (draft 2020-12) of the issuer config, for editors
+and CI checks. Idp and credential configs are validated according to
+their type, and unknown fields are rejected, as the issuer does. The
+schema is of the current config version unless --config-version is
+given.
+
+Example:
+
+km config schema > keymaster-config.schema.json
+km config schema --config-version 1.0 > keymaster-config-v1.schema.json
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schema, err := api.MarshalSchema(schemaVersionFlag)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(schema)
+		return err
+	},
+}
+
+var configRenderCmd = &cobra.Command{
+	Use:   "render <file>",
+	Short: "Print the effective issuer config, after includes, vars and overlays.",
+	Long: `Print the effective issuer config, as the issuer would load it: includes
+are merged in, the overlay (if given) is merged on top, and ${var} and
+${env:NAME} references are replaced.
+
+  include:                 # merged under this config, in order
+    - common/idps.yaml     # relative to this config
+    - s3://config-bucket/shared/roles.yaml
+  vars:
+    account: "062921715532"
+  name: fooproject_${env:KM_ENV}
+  credentials:
+    - name: aws-admin
+      type: iam_assume_role
+      config:
+        target_role: arn:aws:iam::${account}:role/admin
+  overlays:                # selected with --overlay, or CONFIG_OVERLAY
+    prod:
+      vars:
+        account: "140374123517"
+
+Maps are deep merged, lists of named items (roles, credentials, idps,
+policies) are merged by name, other lists are replaced, and null removes
+a key. The file may be a path, - for standard input, or s3:// file://
+data://.
+
+Example:
+
+km config render --overlay prod issuer-config.yaml
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := renderConfigFile(args[0])
+		if err != nil {
+			return err
+		}
+		if !renderJSONFlag {
+			data, err = yaml.JSONToYAML(data)
+		} else {
+			var buf bytes.Buffer
+			err = json.Indent(&buf, data, "", "  ")
+			buf.WriteByte('\n')
+			data = buf.Bytes()
+		}
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	},
+}
+
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate <file>",
+	Short: "Convert an issuer config to the current config version.",
+	Long: `Convert a version 1.0 issuer config to version 2, printing it as YAML.
+Version 2 renames what version 1.0 was ambiguous about:
+
+  roles:
+    - name: deployment
+      policy: deploy_with_approval    # was workflow:
+  workflow:
+    policies:
+      - name: deploy_with_approval
+        approvers:                    # was approver_roles: {admins: 1}
+          - group: admins
+            count: 1
+  credentials:
+    - name: ssh-all
+      type: ssh                       # was ssh_ca (and kube, iam were
+                                      # kubernetes, iam_assume_role)
+
+The config is converted as it is, not rendered, so includes, vars and
+overlays are kept; migrate included fragments too. Comments are not
+kept. Both versions can be loaded, so configs can be migrated one at a
+time. The file may be a path, - for standard input, or s3:// file://
+data://.
+
+Example:
+
+km config migrate issuer-config.yaml > issuer-config.v2.yaml
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := readConfigFile(args[0])
+		if err != nil {
+			return err
+		}
+		migrated, err := api.MigrateConfig(data)
+		if err != nil {
+			return err
+		}
+		migrated, err = yaml.JSONToYAML(migrated)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(migrated)
+		return err
+	},
+}
+
+var (
+	schemaVersionFlag string
+	lintCheckKeysFlag bool
+	lintStrictFlag    bool
+	overlayFlag       string
+	renderJSONFlag    bool
+)
+
+func init() {
+	configCmd.AddCommand(configLintCmd)
+	configCmd.AddCommand(configSchemaCmd)
+	configCmd.AddCommand(configRenderCmd)
+	configCmd.AddCommand(configMigrateCmd)
+	configSchemaCmd.Flags().StringVar(&schemaVersionFlag, "config-version", api.CurrentConfigVersion,
+		"config version to print the schema of ("+strings.Join(api.SupportedConfigVersions, ", ")+")")
+	configLintCmd.Flags().BoolVar(&lintCheckKeysFlag, "check-keys", false,
+		"load ssh and kubernetes CA keys (or find KMS keys), checking they are reachable and valid")
+	configLintCmd.Flags().BoolVar(&lintStrictFlag, "strict", false, "treat warnings as errors")
+	for _, cmd := range []*cobra.Command{configLintCmd, configRenderCmd} {
+		cmd.Flags().StringVar(&overlayFlag, "overlay", os.Getenv("CONFIG_OVERLAY"),
+			"overlay of the config to apply (default $CONFIG_OVERLAY)")
+	}
+	configRenderCmd.Flags().BoolVar(&renderJSONFlag, "json", false, "print JSON rather than YAML")
+}
+
+func readConfigFile(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	if strings.Contains(path, "://") {
+		return util.Load(path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// renderConfigFile renders an issuer config from a path, - for standard
+// input, or a reference (which relative includes are resolved against).
+func renderConfigFile(path string) ([]byte, error) {
+	renderer := &api.ConfigRenderer{Overlay: overlayFlag}
+	if path == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		return renderer.RenderData(data, path)
+	}
+	if !strings.Contains(path, "://") {
+		path = "file://" + path
+	}
+	return renderer.Render(path)
+}
@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes, so CI scripts can tell failures apart
+const (
+	ExitError = 1
+	// km and the issuer can't work together, or the request was bad
+	ExitIncompatible = 2
+	// The requested role doesn't exist
+	ExitRoleNotFound = 3
+	// The CI identity token was missing or not accepted for the role
+	ExitIdentityRejected = 4
+	// The approvals didn't meet the role's workflow policy
+	ExitNotEnoughApprovals = 5
+	// An approver rejected the request
+	ExitRejected = 6
+	// A transient failure, the same request may succeed if retried
+	ExitRetryable = 7
+	// The issuer is misconfigured or failed
+	ExitIssuerError = 8
+	// The requester's source address is not whitelisted for the role
+	ExitSourceNotAllowed = 9
+	// The role can't be used now, per its schedule
+	ExitOutsideSchedule = 10
+	// Break-glass was requested for a role without a break-glass policy
+	ExitBreakGlassNotAllowed = 11
+	// The requester isn't eligible for the role
+	ExitNotEligible = 12
+	// The issuer's policy denied the request
+	ExitPolicyDenied = 13
+	// The role's limits were reached; the request may succeed later
+	ExitRateLimited = 14
+)
+
+// exitCode maps an error to the exit code km should exit with.
+func exitCode(err error) int {
+	// Rate limited requests are retryable, but not straight away
+	if api.ErrorCode(err) == api.ErrorCodeRateLimited {
+		return ExitRateLimited
+	}
+	if api.IsRetryable(err) {
+		return ExitRetryable
+	}
+	switch api.ErrorCode(err) {
+	case api.ErrorCodeBadRequest, api.ErrorCodeIncompatible, api.ErrorCodeNotImplemented:
+		return ExitIncompatible
+	case api.ErrorCodeRoleNotFound:
+		return ExitRoleNotFound
+	case api.ErrorCodeIdentityRejected:
+		return ExitIdentityRejected
+	case api.ErrorCodeSourceNotAllowed:
+		return ExitSourceNotAllowed
+	case api.ErrorCodeOutsideSchedule:
+		return ExitOutsideSchedule
+	case api.ErrorCodeBreakGlassNotAllowed:
+		return ExitBreakGlassNotAllowed
+	case api.ErrorCodeNotEligible:
+		return ExitNotEligible
+	case api.ErrorCodePolicyDenied:
+		return ExitPolicyDenied
+	case api.ErrorCodeNotEnoughApprovals, api.ErrorCodeInvalidAssertion:
+		return ExitNotEnoughApprovals
+	case api.ErrorCodeConfiguration, api.ErrorCodeIssuance, api.ErrorCodeInternal:
+		return ExitIssuerError
+	}
+	return ExitError
+}
+
+// fatal logs an error and exits with its exit code.
+func fatal(err error) {
+	log.Error(err)
+	if e, ok := errors.Cause(err).(*api.Error); ok && e.Details != nil {
+		details, _ := json.Marshal(e.Details)
+		log.Errorf("details: %s", details)
+	}
+	os.Exit(exitCode(err))
+}
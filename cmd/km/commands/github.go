@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/bsycorp/keymaster/km/client"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var githubCmd = &cobra.Command{
+	Use:   "github",
+	Short: "Perform keymaster authentication, optimised for github actions.",
+	Long: `Perform keymaster authentication, optimised for github actions.
+
+Requester details are taken from the github actions environment, and an
+OIDC token for the job is sent to the issuer to prove the identity of the
+workflow. The job needs the "id-token: write" permission.
+
+Example:
+
+km github --issuer <issuing-lambda> --role deployment --audience keymaster
+`,
+	Run: githubCI,
+}
+
+var githubAudienceFlag string
+
+func init() {
+	rootCmd.AddCommand(githubCmd)
+
+	githubCmd.Flags().StringVar(&issuerFlag, "issuer", "", "target credential issuer (lambda function or https:// url)")
+	githubCmd.Flags().StringVar(&roleFlag, "role", "", "role to apply for with issuer")
+
+	_ = githubCmd.MarkFlagRequired("issuer")
+	_ = githubCmd.MarkFlagRequired("role")
+
+	githubCmd.Flags().StringVar(&usernameFlag, "username", "", "username to associate with access request (default $GITHUB_ACTOR)")
+	githubCmd.Flags().StringVar(&nameFlag, "name", "", "human name to associate with access request (default $GITHUB_ACTOR)")
+	githubCmd.Flags().StringVar(&emailFlag, "email", "", "email address to associate with access request (default actor's noreply address)")
+	githubCmd.Flags().StringVar(&descriptionFlag, "description", "", "describe the purpose of the access request (default from workflow and ref)")
+	githubCmd.Flags().StringVar(&detailsUrlFlag, "url", "", "url with further details for access request (default the workflow run)")
+	githubCmd.Flags().StringVar(&githubAudienceFlag, "audience", "", "audience to request for the OIDC token (default github's)")
+	addBreakGlassFlags(githubCmd)
+}
+
+func githubCI(cmd *cobra.Command, args []string) {
+	if os.Getenv("GITHUB_ACTIONS") == "" {
+		log.Warn("GITHUB_ACTIONS is not set, this does not look like a github actions job")
+	}
+	actor := os.Getenv("GITHUB_ACTOR")
+	defaultFromEnv(&usernameFlag, "GITHUB_ACTOR")
+	defaultFromEnv(&nameFlag, "GITHUB_ACTOR")
+	if emailFlag == "" && actor != "" {
+		emailFlag = actor + "@users.noreply.github.com"
+	}
+	if descriptionFlag == "" {
+		descriptionFlag = fmt.Sprintf("%s: %s (run %s, ref %s)",
+			os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_WORKFLOW"),
+			os.Getenv("GITHUB_RUN_ID"), os.Getenv("GITHUB_REF"))
+	}
+	if detailsUrlFlag == "" {
+		detailsUrlFlag = fmt.Sprintf("%s/%s/actions/runs/%s",
+			os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"),
+			os.Getenv("GITHUB_RUN_ID"))
+	}
+
+	token, err := client.FetchGithubIDToken(http.DefaultClient,
+		os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"),
+		os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN"),
+		githubAudienceFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Got github actions OIDC token")
+	authenticate(token)
+}
@@ -2,17 +2,89 @@ package commands
 
 import (
 	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var gitlabCmd = &cobra.Command{
 	Use:   "gitlab",
 	Short: "Perform keymaster authentication, optimised for gitlab CI.",
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("gitlab command not yet implemented")
-	},
+	Long: `Perform keymaster authentication, optimised for gitlab CI.
+
+Requester details are taken from the gitlab CI job environment, and the
+job's JWT is sent to the issuer to prove the identity of the pipeline.
+
+Example:
+
+km gitlab --issuer <issuing-lambda> --role deployment
+
+The job token is read from $KEYMASTER_ID_TOKEN (an ID token configured
+with "id_tokens" in .gitlab-ci.yml), falling back to $CI_JOB_JWT_V2 and
+then $CI_JOB_JWT. Use --token-var to read it from another variable.
+`,
+	Run: gitlabCI,
 }
 
+var gitlabTokenVarFlag string
+
+// gitlabTokenVars are the job token variables tried, in order, when no
+// --token-var is given.
+var gitlabTokenVars = []string{"KEYMASTER_ID_TOKEN", "CI_JOB_JWT_V2", "CI_JOB_JWT"}
+
 func init() {
 	rootCmd.AddCommand(gitlabCmd)
+
+	gitlabCmd.Flags().StringVar(&issuerFlag, "issuer", "", "target credential issuer (lambda function or https:// url)")
+	gitlabCmd.Flags().StringVar(&roleFlag, "role", "", "role to apply for with issuer")
+
+	_ = gitlabCmd.MarkFlagRequired("issuer")
+	_ = gitlabCmd.MarkFlagRequired("role")
+
+	gitlabCmd.Flags().StringVar(&usernameFlag, "username", "", "username to associate with access request (default $GITLAB_USER_LOGIN)")
+	gitlabCmd.Flags().StringVar(&nameFlag, "name", "", "human name to associate with access request (default $GITLAB_USER_NAME)")
+	gitlabCmd.Flags().StringVar(&emailFlag, "email", "", "email address to associate with access request (default $GITLAB_USER_EMAIL)")
+	gitlabCmd.Flags().StringVar(&descriptionFlag, "description", "", "describe the purpose of the access request (default from commit and job)")
+	gitlabCmd.Flags().StringVar(&detailsUrlFlag, "url", "", "url with further details for access request (default $CI_JOB_URL)")
+	gitlabCmd.Flags().StringVar(&gitlabTokenVarFlag, "token-var", "", "environment variable holding the gitlab job token")
+	addBreakGlassFlags(gitlabCmd)
+}
+
+func gitlabCI(cmd *cobra.Command, args []string) {
+	if os.Getenv("GITLAB_CI") == "" {
+		log.Warn("GITLAB_CI is not set, this does not look like a gitlab CI job")
+	}
+	defaultFromEnv(&usernameFlag, "GITLAB_USER_LOGIN")
+	defaultFromEnv(&nameFlag, "GITLAB_USER_NAME")
+	defaultFromEnv(&emailFlag, "GITLAB_USER_EMAIL")
+	defaultFromEnv(&detailsUrlFlag, "CI_JOB_URL")
+	if descriptionFlag == "" {
+		descriptionFlag = fmt.Sprintf("%s: %s (job %s, pipeline %s)",
+			os.Getenv("CI_PROJECT_PATH"), os.Getenv("CI_COMMIT_TITLE"),
+			os.Getenv("CI_JOB_NAME"), os.Getenv("CI_PIPELINE_ID"))
+	}
+
+	tokenVars := gitlabTokenVars
+	if gitlabTokenVarFlag != "" {
+		tokenVars = []string{gitlabTokenVarFlag}
+	}
+	var token string
+	for _, tokenVar := range tokenVars {
+		if token = os.Getenv(tokenVar); token != "" {
+			log.Println("Using gitlab job token from:", tokenVar)
+			break
+		}
+	}
+	if token == "" {
+		log.Fatalf("no gitlab job token found in any of: %v", tokenVars)
+	}
+	authenticate(token)
+}
+
+// defaultFromEnv sets an unset flag value from an environment variable.
+func defaultFromEnv(flag *string, envVar string) {
+	if *flag == "" {
+		*flag = os.Getenv(envVar)
+	}
 }
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/bsycorp/keymaster/km/policy"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Work with issuer policies.",
+}
+
+var policyTestCmd = &cobra.Command{
+	Use:   "test <policy> [<tests>...]",
+	Short: "Run the tests of an issuer policy.",
+	Long: `Compile an issuer policy (see "policy" in the issuer config) and run
+its tests, and any in the tests files given. A test is an input the
+policy should allow or deny, and optionally the rules that should deny
+it:
+
+  tests:
+    - name: prod hotfix without security approval
+      input:
+        environment: prod
+        role: deployment
+        requester: {username: smithb12, ci_claims: {project_path: [fooproject/app]}}
+        approvers: [{username: jonesa, groups: [ops]}]
+        required_approvals: {ops: 1}
+        source: {details_uri: "https://gitlab.example.com/fooproject/app/-/tree/hotfix/123"}
+        time: "2026-10-19T10:00:00+11:00"
+      allow: true
+    - name: prod change without security approval
+      input: {environment: prod, role: deployment}
+      allow: false
+      denied_by: [prod-security]
+
+Files may be paths, - for standard input, or s3:// file:// data://.
+
+Example:
+
+km policy test issuer-policy.yaml
+km policy test issuer-policy.yaml policy-tests/*.yaml
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := readConfigFile(args[0])
+		if err != nil {
+			return err
+		}
+		p, err := policy.Parse(data)
+		if err != nil {
+			return err
+		}
+		tests := p.Tests
+		for _, path := range args[1:] {
+			data, err := readConfigFile(path)
+			if err != nil {
+				return err
+			}
+			fileTests, err := policy.ParseTests(data)
+			if err != nil {
+				return errors.Wrap(err, path)
+			}
+			tests = append(tests, fileTests...)
+		}
+		failed := 0
+		for _, r := range p.RunTests(tests) {
+			if r.Passed {
+				fmt.Printf("PASS %s\n", r.Name)
+			} else {
+				failed++
+				fmt.Printf("FAIL %s: %s\n", r.Name, r.Message)
+			}
+		}
+		if failed > 0 {
+			return errors.Errorf("%d of %d policy tests failed", failed, len(tests))
+		}
+		fmt.Printf("%d policy tests passed\n", len(tests))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(policyTestCmd)
+}
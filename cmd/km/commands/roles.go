@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var rolesCmd = &cobra.Command{
+	Use:   "roles",
+	Short: "List the roles offered by an issuer.",
+	Long: `List the roles offered by an issuer, with their credentials, validity,
+workflow policy, required approvals and identity provider.
+
+Roles only some people may request can be filtered to those a member
+of some groups, or the holder of a CI identity token, is eligible for.
+
+Example:
+
+km roles --issuer <issuing-lambda>
+km roles --issuer <issuing-lambda> --output json
+km roles --issuer <issuing-lambda> --group engineers --group ops
+km roles --issuer <issuing-lambda> --identity-token-var CI_JOB_JWT_V2
+`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if outputFlag != "table" && outputFlag != "json" {
+			return errors.Errorf("unknown output format: %s", outputFlag)
+		}
+		config, err := fetchPublicConfig()
+		if err != nil {
+			return err
+		}
+		roles := client.SummariseRoles(config)
+		if len(groupsFlag) > 0 || identityTokenVarFlag != "" {
+			requester, err := rolesRequester(config)
+			if err != nil {
+				return err
+			}
+			roles = client.EligibleRoles(config, roles, requester)
+		}
+		if outputFlag == "json" {
+			return client.WriteJSON(os.Stdout, roles)
+		}
+		return client.WriteRolesTable(os.Stdout, roles)
+	},
+}
+
+var describeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Describe what an issuer offers.",
+}
+
+var describeRoleCmd = &cobra.Command{
+	Use:   "role <role>",
+	Short: "Explain what a request for a role will need.",
+	Long: `Explain what a request for a role will need: the approvals and
+identity required, and the credentials that will be issued.
+
+Example:
+
+km describe role deployment --issuer <issuing-lambda>
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if outputFlag != "table" && outputFlag != "json" {
+			return errors.Errorf("unknown output format: %s", outputFlag)
+		}
+		config, err := fetchPublicConfig()
+		if err != nil {
+			return err
+		}
+		role := config.FindRoleByName(args[0])
+		if role == nil {
+			return errors.Errorf("role not found at issuer: %s", args[0])
+		}
+		summary := client.SummariseRole(config, role)
+		if outputFlag == "json" {
+			return client.WriteJSON(os.Stdout, summary)
+		}
+		return client.DescribeRole(os.Stdout, &summary)
+	},
+}
+
+var outputFlag string
+var groupsFlag []string
+var identityTokenVarFlag string
+
+func init() {
+	rootCmd.AddCommand(rolesCmd)
+	rootCmd.AddCommand(describeCmd)
+	describeCmd.AddCommand(describeRoleCmd)
+
+	for _, cmd := range []*cobra.Command{rolesCmd, describeRoleCmd} {
+		cmd.Flags().StringVar(&issuerFlag, "issuer", "", "target credential issuer (lambda function or https:// url)")
+		cmd.Flags().StringVarP(&outputFlag, "output", "o", "table", "output format (table or json)")
+		_ = cmd.MarkFlagRequired("issuer")
+	}
+	rolesCmd.Flags().StringSliceVar(&groupsFlag, "group", nil, "only list roles a member of these groups may request")
+	rolesCmd.Flags().StringVar(&identityTokenVarFlag, "identity-token-var", "",
+		"only list roles the holder of the CI identity token in this environment variable may request")
+}
+
+// rolesRequester describes who to list roles for, from the flags.
+func rolesRequester(config *api.ConfigPublic) (*api.Requester, error) {
+	requester := &api.Requester{}
+	if identityTokenVarFlag != "" {
+		token := os.Getenv(identityTokenVarFlag)
+		if token == "" {
+			return nil, errors.Errorf("no identity token in $%s", identityTokenVarFlag)
+		}
+		var err error
+		requester, err = client.TokenRequester(config, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(groupsFlag) > 0 {
+		requester.Identified = true
+		requester.Groups = groupsFlag
+	}
+	return requester, nil
+}
+
+func fetchPublicConfig() (*api.ConfigPublic, error) {
+	kmApi, err := api.NewClient(issuerFlag)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating km api client")
+	}
+	kmApi.Debug = debugFlag
+	_, err = kmApi.Negotiate(api.RequestTypeConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling kmApi.Discovery")
+	}
+	configResp, err := kmApi.GetConfig(new(api.ConfigRequest))
+	if err != nil {
+		return nil, errors.Wrap(err, "error calling kmApi.GetConfig")
+	}
+	return &configResp.Config, nil
+}
@@ -3,13 +3,16 @@ package commands
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/bsycorp/keymaster/km/client"
 	"github.com/bsycorp/keymaster/km/util"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var cfgFile string
+var profileFlag string
+var kmConfig *client.Config
 var issuerFlag string
 var roleFlag string
 var debugFlag int
@@ -22,13 +25,20 @@ var rootCmd = &cobra.Command{
 	Short: "Keymaster authentication client",
 	Long: `Single sign-on for SSH, AWS IAM & Kubernetes, for humans and machines.
 
+Flags may be given defaults with named profiles in the config file (see
+"km config"). Values from the active profile are overridden by KM_*
+environment variables (e.g. KM_ISSUER, KM_AWS_PROFILE_NAME), which are in
+turn overridden by command line flags.
 `,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return applyProfile(cmd)
+	},
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -40,6 +50,7 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.keymaster.yaml)")
+	rootCmd.PersistentFlags().StringVar(&profileFlag, "profile", "", "config profile to use (default is the current profile, or $KM_PROFILE)")
 	rootCmd.PersistentFlags().IntVar(&debugFlag, "debug", 0, "debug level (0 to disable)")
 
 	homeDir, _ := util.UserHomeDir()
@@ -53,28 +64,21 @@ func init() {
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig reads in the km config file, if there is one.
 func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
+	if cfgFile == "" {
 		// Find home directory.
 		home, err := util.UserHomeDir()
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-
-		// Search config in home directory with name ".keymaster" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".keymaster")
+		cfgFile = filepath.Join(home, ".keymaster.yaml")
 	}
-
-	viper.AutomaticEnv() // read in environment variables that match
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	var err error
+	kmConfig, err = client.LoadConfig(cfgFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
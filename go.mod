@@ -10,6 +10,8 @@ require (
 	github.com/dexidp/dex v0.0.0-20200423181415-0a85a97ba9d8
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/ghodss/yaml v1.0.0
+	github.com/golang/protobuf v1.3.2
+	github.com/google/cel-go v0.4.1
 	github.com/google/uuid v1.1.1
 	github.com/hectane/go-acl v0.0.0-20190604041725-da78bae5fc95
 	github.com/jonboulle/clockwork v0.1.0
@@ -19,8 +21,9 @@ require (
 	github.com/sirupsen/logrus v1.4.2
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/spf13/cobra v0.0.5
-	github.com/spf13/viper v1.3.2
+	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.5.1
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
 	gopkg.in/ini.v1 v1.55.0
 )
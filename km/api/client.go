@@ -3,56 +3,72 @@ package api
 import (
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
-	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/lambda"
-	"github.com/bsycorp/keymaster/km/util"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/pkg/errors"
 )
 
 const RpcRetryInterval = 15 * time.Second
 
+// RpcMaxAttempts is how many times a transport tries a request that
+// keeps failing with a retryable status or error, doubling the wait each
+// time.
+const RpcMaxAttempts = 5
+
 type Client struct {
-	//    * Function name - my-function (name-only), my-function:v1 (with alias).
-	//    * Function ARN - arn:aws:lambda:us-west-2:123456789012:function:my-function.
-	//    * Partial ARN - 123456789012:function:my-function.
-	FunctionName string
-	lambdaClient *lambda.Lambda
-	Debug        int
+	// Target is the issuer, a lambda function name or ARN, or an https:// URL
+	Target string
+	// ApiVersion is sent with every request once negotiated
+	ApiVersion string
+	Transport  Transport
+	Debug      int
 }
 
-func NewClient(target string) *Client {
-	c := new(Client)
-	_, disableSSL := os.LookupEnv("KM_DISABLE_SSL")
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			EndpointResolver: endpoints.ResolverFunc(util.EndpointResolver),
-			DisableSSL:       &disableSSL,
-		},
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	c.FunctionName = target
-	c.lambdaClient = lambda.New(sess) // TODO: region? Or can that come from env?
-	return c
+// NewClient returns a client for an issuer, reached over HTTP if the
+// target is a URL or by invoking the lambda function otherwise.
+func NewClient(target string) (*Client, error) {
+	transport, err := NewTransport(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Target:    target,
+		Transport: transport,
+	}, nil
 }
 
 func (c *Client) Discovery(req *DiscoveryRequest) (*DiscoveryResponse, error) {
 	resp := new(DiscoveryResponse)
-	err := c.rpc(&Request{Type: "discovery", Payload: req}, resp)
+	err := c.rpc(&Request{Type: RequestTypeDiscovery, Payload: req}, resp)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
+// Negotiate performs discovery with the issuer and checks that it can
+// serve this client, including the given request types. The negotiated
+// api version is used for all later requests.
+func (c *Client) Negotiate(requestTypes ...string) (*DiscoveryResponse, error) {
+	resp, err := c.Discovery(&DiscoveryRequest{
+		ClientVersion: Version,
+		ApiVersions:   ApiVersions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	version, err := resp.Negotiate(ApiVersions, requestTypes...)
+	if err != nil {
+		return nil, err
+	}
+	c.ApiVersion = version
+	return resp, nil
+}
+
 func (c *Client) GetConfig(req *ConfigRequest) (*ConfigResponse, error) {
 	resp := new(ConfigResponse)
-	err := c.rpc(&Request{Type: "config", Payload: req}, resp)
+	err := c.rpc(&Request{Type: RequestTypeConfig, ApiVersion: c.ApiVersion, Payload: req}, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +81,7 @@ func (c *Client) DirectSamlAuth(req *DirectSamlAuthRequest) (*DirectAuthResponse
 
 func (c *Client) WorkflowStart(req *WorkflowStartRequest) (*WorkflowStartResponse, error) {
 	resp := new(WorkflowStartResponse)
-	err := c.rpc(&Request{Type: "workflow_start", Payload: req}, resp)
+	err := c.rpc(&Request{Type: RequestTypeWorkflowStart, ApiVersion: c.ApiVersion, Payload: req}, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -74,37 +90,13 @@ func (c *Client) WorkflowStart(req *WorkflowStartRequest) (*WorkflowStartRespons
 
 func (c *Client) WorkflowAuth(req *WorkflowAuthRequest) (*WorkflowAuthResponse, error) {
 	resp := new(WorkflowAuthResponse)
-	err := c.rpc(&Request{Type: "workflow_auth", Payload: req}, resp)
+	err := c.rpc(&Request{Type: RequestTypeWorkflowAuth, ApiVersion: c.ApiVersion, Payload: req}, resp)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func (c *Client) isError(resp *lambda.InvokeOutput) error {
-	if resp.FunctionError != nil {
-		return errors.Errorf("function error: %s: response payload: %s",
-			*resp.FunctionError, string(resp.Payload))
-	} else if *resp.StatusCode != 200 {
-		return errors.Errorf("bad status code: %d, response payload: %s",
-			*resp.StatusCode, string(resp.Payload))
-	}
-	return nil
-}
-
-func isRetryableLambdaException(e error) bool {
-	switch e.(type) {
-	default:
-		return false
-	case *lambda.ResourceNotReadyException:
-		return true
-	case *lambda.TooManyRequestsException:
-		return true
-	case *lambda.EC2ThrottledException:
-		return true
-	}
-}
-
 func (c *Client) rpc(req interface{}, resp interface{}) error {
 	if c.Debug > 0 {
 		log.Println("rpc request: ", spew.Sdump(req))
@@ -113,33 +105,25 @@ func (c *Client) rpc(req interface{}, resp interface{}) error {
 	if err != nil {
 		return errors.Wrap(err, "rpc marshal")
 	}
-	// Loop spins until a non-retryable error occurs
-	for {
-		result, err := c.lambdaClient.Invoke(&lambda.InvokeInput{
-			FunctionName: aws.String(c.FunctionName),
-			Payload:      payload,
-		})
-		if err != nil {
-			if isRetryableLambdaException(err) {
-				log.Printf("rpc: retryable error: %v, waiting for: %v", err, RpcRetryInterval)
-				time.Sleep(RpcRetryInterval)
-				continue // Retry
-			}
-			return errors.Wrap(err, "rpc invoke")
-		}
-		if err = c.isError(result); err != nil {
-			return errors.Wrap(err, "rpc error")
-		}
-		err = json.Unmarshal(result.Payload, resp)
-		if err != nil {
-			if c.Debug > 0 {
-				log.Println("rpc raw response:" + string(result.Payload))
-			}
-			return errors.Wrap(err, "rpc unmarshal")
+	result, err := c.Transport.RoundTrip(payload)
+	if err != nil {
+		return err
+	}
+	if apiErr := decodeErrorResponse(result); apiErr != nil {
+		if c.Debug > 0 {
+			log.Println("rpc error response:", spew.Sdump(apiErr))
 		}
+		return apiErr
+	}
+	err = json.Unmarshal(result, resp)
+	if err != nil {
 		if c.Debug > 0 {
-			log.Println("rpc response:", spew.Sdump(resp))
+			log.Println("rpc raw response:" + string(result))
 		}
-		return nil
+		return errors.Wrap(err, "rpc unmarshal")
 	}
+	if c.Debug > 0 {
+		log.Println("rpc response:", spew.Sdump(resp))
+	}
+	return nil
 }
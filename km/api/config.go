@@ -2,6 +2,12 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/idp/github"
+	"github.com/bsycorp/keymaster/km/idp/gitlab"
 	"github.com/bsycorp/keymaster/km/util"
 	"github.com/pkg/errors"
 )
@@ -14,45 +20,132 @@ type Config struct {
 	Workflow      WorkflowConfig      `json:"workflow"`
 	Credentials   []CredentialsConfig `json:"credentials"`
 	AccessControl AccessControlConfig `json:"access_control"`
+	Audit         AuditConfig         `json:"audit"`
+	Policy        PolicyConfig        `json:"policy"`
+	Limits        LimitsConfig        `json:"limits"`
 }
 
-func (c *Config) NormaliseAndLoad() error {
+// ParseConfig parses a YAML or JSON config, of any supported version,
+// returning ConfigErrors if it doesn't match the schema of its version,
+// e.g. because of an unknown field.
+func ParseConfig(data []byte) (*Config, error) {
+	doc, err := decodeConfigDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	version := configDocVersion(doc)
+	schema := ConfigSchemaFor(version)
+	if schema == nil {
+		return nil, ConfigErrors{{Path: "version", Message: fmt.Sprintf("unsupported version: %s (supported: %s)",
+			version, strings.Join(SupportedConfigVersions, ", "))}}
+	}
+	if problems := schema.Validate(doc); len(problems) > 0 {
+		return nil, ConfigErrors(problems)
+	}
+	jsonData, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing config")
+	}
+	if version == ConfigVersion2 {
+		var v2 ConfigV2
+		if err := json.Unmarshal(jsonData, &v2); err != nil {
+			return nil, errors.Wrap(err, "parsing config")
+		}
+		return v2.Config(), nil
+	}
+	var config Config
+	if err := json.Unmarshal(jsonData, &config); err != nil {
+		return nil, errors.Wrap(err, "parsing config")
+	}
+	return &config, nil
+}
+
+// Normalise fills in defaults, without loading anything.
+func (c *Config) Normalise() {
 	// We default to version 1.0 if not specified
 	if c.Version == "" {
-		c.Version = "1.0"
+		c.Version = ConfigVersion1
 	}
 
 	// If there's no IDP name specified in a policy we will
-	// just use the first IDP.
+	// just use the first SAML IDP, as approvals are SAML assertions.
 	policies := c.Workflow.Policies
-	if len(c.Idp) > 0 {
+	for _, idpConfig := range c.Idp {
+		if idpConfig.Type != "saml" {
+			continue
+		}
 		for i := range policies {
 			if policies[i].IdpName == "" {
-				policies[i].IdpName = c.Idp[0].Name
+				policies[i].IdpName = idpConfig.Name
 			}
 		}
+		break
 	}
+}
 
-	// SAML certificates may be indirect, load them if they are
+// NormaliseAndLoad fills in defaults and loads indirect certificates
+// and JWKS. Secrets (CA keys and the audit hmac key) are left as given,
+// to be loaded where they're used.
+func (c *Config) NormaliseAndLoad() error {
+	c.Normalise()
 	for _, idpConfig := range c.Idp {
-		if samlIdp, ok := idpConfig.Config.(*IdpConfigSaml); ok {
-			certData, err := util.Load(samlIdp.Certificate)
+		switch idp := idpConfig.Config.(type) {
+		case *IdpConfigSaml:
+			// SAML certificates may be indirect, load them if they are
+			certData, err := util.Load(idp.Certificate)
 			if err != nil {
 				return err
 			}
-			samlIdp.Certificate = string(certData)
+			idp.Certificate = string(certData)
+		case *IdpConfigGitlabJwt:
+			// As may a JWKS, if it is not fetched from the issuer
+			if err := loadJwks(&idp.Jwks); err != nil {
+				return err
+			}
+		case *IdpConfigGithubOidc:
+			if err := loadJwks(&idp.Jwks); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func (c *Config) Validate() error {
-	if c.Version != "1.0" {
-		return errors.Errorf("unsupported version: %s", c.Version)
+func loadJwks(jwks *string) error {
+	if *jwks == "" {
+		return nil
 	}
-	if len(c.Idp) > 1 {
-		// TODO: multiple IDP support
-		return errors.New("only 1 IDP is supported")
+	jwksData, err := util.Load(*jwks)
+	if err != nil {
+		return err
+	}
+	*jwks = string(jwksData)
+	return nil
+}
+
+// validateCidrs checks each entry is a CIDR, a single address, or the
+// name of a range.
+func validateCidrs(cidrs []string, ranges map[string][]string) error {
+	for _, cidr := range cidrs {
+		if _, ok := ranges[cidr]; ok {
+			continue
+		}
+		if strings.Contains(cidr, "/") {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return errors.Wrap(err, "invalid cidr")
+			}
+		} else if net.ParseIP(cidr) == nil {
+			return errors.Errorf("invalid cidr, address or range name: %s", cidr)
+		}
+	}
+	return nil
+}
+
+func (c *Config) FindIdpByName(name string) *IdpConfig {
+	for _, i := range c.Idp {
+		if i.Name == name {
+			return &i
+		}
 	}
 	return nil
 }
@@ -76,10 +169,28 @@ func (c *Config) FindRoleByName(name string) *RoleConfig {
 }
 
 type ConfigPublic struct {
-	Name     string         `json:"name"`
-	Idp      []IdpConfig    `json:"idp"`
-	Roles    []RoleConfig   `json:"roles"`
-	Workflow WorkflowConfig `json:"workflow"`
+	Name        string                    `json:"name"`
+	Idp         []IdpConfig               `json:"idp"`
+	Roles       []RoleConfig              `json:"roles"`
+	Workflow    WorkflowConfig            `json:"workflow"`
+	Credentials []CredentialsPublicConfig `json:"credentials"`
+	// Set if requests must carry an ip oracle token
+	IPOracle *IPOraclePublicConfig `json:"ip_oracle,omitempty"`
+}
+
+// IPOraclePublicConfig tells clients where to get ip oracle tokens.
+type IPOraclePublicConfig struct {
+	SignUrl string `json:"sign_url"`
+	KeyId   string `json:"key_id"`
+	// Audience tokens must be requested for, if any
+	Audience string `json:"audience,omitempty"`
+}
+
+// CredentialsPublicConfig describes a credential without any of its
+// (possibly secret) configuration.
+type CredentialsPublicConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
 }
 
 type IdpConfig struct {
@@ -101,13 +212,121 @@ type IdpConfigOidc struct {
 	// Not implemented
 }
 
+// IdpConfigGitlabJwt verifies GitLab CI job tokens (CI_JOB_JWT or
+// ID tokens) against the JWKS of a GitLab instance.
+type IdpConfigGitlabJwt struct {
+	// Issuer defaults to https://gitlab.com
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// JwksUrl defaults to the issuer's /-/jwks endpoint.
+	JwksUrl string `json:"jwks_url"`
+	// Jwks may be specified as s3:// file:// or raw data, and
+	// takes precedence over JwksUrl.
+	Jwks string `json:"jwks"`
+}
+
+// IssuerOrDefault is the issuer tokens are verified against, gitlab.com
+// if none is configured.
+func (c *IdpConfigGitlabJwt) IssuerOrDefault() string {
+	if c.Issuer == "" {
+		return gitlab.DefaultIssuer
+	}
+	return c.Issuer
+}
+
+// IdpConfigGithubOidc verifies GitHub Actions OIDC tokens.
+type IdpConfigGithubOidc struct {
+	// Issuer defaults to https://token.actions.githubusercontent.com
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// JwksUrl defaults to the issuer's /.well-known/jwks endpoint.
+	JwksUrl string `json:"jwks_url"`
+	// Jwks may be specified as s3:// file:// or raw data, and
+	// takes precedence over JwksUrl.
+	Jwks string `json:"jwks"`
+}
+
+// IssuerOrDefault is the issuer tokens are verified against, GitHub
+// Actions' if none is configured.
+func (c *IdpConfigGithubOidc) IssuerOrDefault() string {
+	if c.Issuer == "" {
+		return github.DefaultIssuer
+	}
+	return c.Issuer
+}
+
 type RoleConfig struct {
 	Name               string                       `json:"name"`
 	Workflow           string                       `json:"workflow"`
 	Credentials        []string                     `json:"credentials"`
 	ValidForSeconds    int                          `json:"valid_for_seconds"`
 	CredentialDelivery RoleCredentialDeliveryConfig `json:"credential_delivery"`
-	ClientDefaults     string                       `json:"client_defaults"`
+	ClientDefaults     RoleClientDefaultsConfig     `json:"client_defaults"`
+	CIIdentity         *RoleCIIdentityConfig        `json:"ci_identity,omitempty"`
+	IPOracle           *RoleIPOracleConfig          `json:"ip_oracle,omitempty"`
+	Schedule           *RoleScheduleConfig          `json:"schedule,omitempty"`
+	BreakGlass         *RoleBreakGlassConfig        `json:"break_glass,omitempty"`
+	Eligibility        *RoleEligibilityConfig       `json:"eligibility,omitempty"`
+	Limits             *RoleLimitsConfig            `json:"limits,omitempty"`
+}
+
+// RoleIPOracleConfig restricts the source addresses a role may be
+// requested from, in place of the access control whitelist.
+type RoleIPOracleConfig struct {
+	WhiteListCidrs []string `json:"whitelist_cidrs"`
+	// DenyListCidrs are denied as well as the access control deny list
+	DenyListCidrs []string `json:"denylist_cidrs,omitempty"`
+}
+
+// RoleCIIdentityConfig requires requests for a role to carry a CI
+// identity token from the named IDP, with claims matching the given
+// glob patterns. At least one pattern must match for each claim.
+type RoleCIIdentityConfig struct {
+	IdpName string              `json:"idp_name"`
+	Claims  map[string][]string `json:"claims"`
+}
+
+// RoleBreakGlassConfig lets a role be requested in an emergency, e.g.
+// when workflow is down, with its own (usually fewer, possibly no)
+// approvals and a justification. Break-glass requests ignore the role's
+// schedule, their credentials are short lived, and each one opens a
+// review in the audit reviews store that must be signed off afterwards.
+type RoleBreakGlassConfig struct {
+	// ApproverRoles replace the workflow policy's approvals, and may be
+	// empty for none
+	ApproverRoles map[string]int `json:"approver_roles,omitempty"`
+	// MaxValidForSeconds caps how long credentials are valid for
+	MaxValidForSeconds int `json:"max_valid_for_seconds"`
+	// Notify are where break-glass requests are announced: sns:// topic
+	// arns or https:// webhooks. They aren't published to clients.
+	Notify []string `json:"notify,omitempty"`
+}
+
+// RoleLimitsConfig caps how many credentials a role issues, to each
+// requester (by verified CI identity, or the username they identified as
+// with an assertion, so only for roles that ask them to prove who they
+// are) and to everyone together. Requests over a limit are refused until
+// they would be within it.
+type RoleLimitsConfig struct {
+	PerRequester *LimitConfig `json:"per_requester,omitempty"`
+	PerRole      *LimitConfig `json:"per_role,omitempty"`
+}
+
+// LimitConfig is a limit on issuances. Zero is no limit.
+type LimitConfig struct {
+	// IssuancesPerHour counts issuances in the last hour
+	IssuancesPerHour int `json:"issuances_per_hour,omitempty"`
+	// MaxActive counts issued credentials that haven't expired
+	MaxActive int `json:"max_active,omitempty"`
+}
+
+// ValidForSeconds is how long break-glass credentials for a role are
+// valid for.
+func (b *RoleBreakGlassConfig) ValidForSeconds(role *RoleConfig) int {
+	if b.MaxValidForSeconds > 0 && b.MaxValidForSeconds < role.ValidForSeconds {
+		return b.MaxValidForSeconds
+	}
+	return role.ValidForSeconds
 }
 
 func (c *ConfigPublic) FindRoleByName(name string) *RoleConfig {
@@ -119,6 +338,34 @@ func (c *ConfigPublic) FindRoleByName(name string) *RoleConfig {
 	return nil
 }
 
+func (c *ConfigPublic) FindCredentialByName(name string) *CredentialsPublicConfig {
+	for _, i := range c.Credentials {
+		if i.Name == name {
+			return &i
+		}
+	}
+	return nil
+}
+
+// RoleClientDefaultsConfig are suggested km client settings for a role,
+// used to seed client profiles.
+type RoleClientDefaultsConfig struct {
+	ProfileName    string `json:"profile_name,omitempty"`
+	AwsProfileName string `json:"aws_profile_name,omitempty"`
+}
+
+// UnmarshalJSON also accepts the version 1 form of client defaults, the
+// name of an aws profile.
+func (c *RoleClientDefaultsConfig) UnmarshalJSON(data []byte) error {
+	var awsProfileName string
+	if json.Unmarshal(data, &awsProfileName) == nil {
+		*c = RoleClientDefaultsConfig{AwsProfileName: awsProfileName}
+		return nil
+	}
+	type plain RoleClientDefaultsConfig
+	return json.Unmarshal(data, (*plain)(c))
+}
+
 type RoleCredentialDeliveryConfig struct {
 	KmsWrapWith string `json:"kms_wrap_with"`
 }
@@ -130,12 +377,18 @@ type CredentialsConfig struct {
 }
 
 type CredentialsConfigSSH struct {
+	// CAKey may be given by reference (see util.Load), and is only
+	// loaded to issue credentials.
 	CAKey      string   `json:"ca_key"`
 	Principals []string `json:"principals"`
 }
 
 type CredentialsConfigKube struct {
-	CAKey string `json:"ca_key"`
+	// CACert is the CA certificate, and CAKey its private key. Both may
+	// be given by reference (see util.Load), and are only loaded to
+	// issue credentials.
+	CACert string `json:"ca_cert"`
+	CAKey  string `json:"ca_key"`
 }
 
 type CredentialsConfigIAMAssumeRole struct {
@@ -168,44 +421,113 @@ type WorkflowPolicyConfig struct {
 	ApproverRoles       map[string]int `json:"approver_roles"`
 }
 
+// AuditConfig says where issuance decisions are audited. The hmac key,
+// which may be indirect (see util.Load), keys the audit hash chain.
+// Reviews of break-glass requests are kept in the reviews store
+// (file:// or s3://).
+type AuditConfig struct {
+	Sink    string `json:"sink,omitempty"`
+	HmacKey string `json:"hmac_key,omitempty"`
+	Reviews string `json:"reviews,omitempty"`
+}
+
+// Policy approvals modes
+const (
+	// Approvals are counted as usual, then the policy may deny
+	PolicyApprovalsBuiltin = "builtin"
+	// Approvals aren't counted, the policy decides
+	PolicyApprovalsPolicy = "policy"
+)
+
+// PolicyConfig turns on the policy-as-code hook when rules are set: a
+// policy document (see package policy), which may be indirect (see
+// util.Load), evaluated for every request. Approvals are counted as
+// usual before it unless approvals is "policy".
+type PolicyConfig struct {
+	Rules     string `json:"rules,omitempty"`
+	Approvals string `json:"approvals,omitempty"`
+}
+
+// Enabled reports whether requests are decided by a policy.
+func (c *PolicyConfig) Enabled() bool {
+	return c.Rules != ""
+}
+
+// LimitsConfig is where role limits are counted, "dynamodb://table" for
+// a DynamoDB table the issuer instances share. The default, "memory",
+// counts in each issuer instance, so can't be used with role limits.
+type LimitsConfig struct {
+	Store string `json:"store,omitempty"`
+}
+
 type AccessControlConfig struct {
 	IPOracle IPOracleConfig `json:"ip_oracle"`
 }
 
+// IPOracleConfig turns on ip oracle checks when a key or JWKS url is
+// set: requests must then carry an ip oracle token signed with the key,
+// for a source address in the whitelist (or the role's own whitelist).
 type IPOracleConfig struct {
+	// WhiteListCidrs and DenyListCidrs are CIDRs, single addresses or
+	// the names of Ranges, IPv4 or IPv6. Denied addresses are never
+	// allowed, and if there is a whitelist an address must be in it.
 	WhiteListCidrs []string `json:"whitelist_cidrs"`
+	DenyListCidrs  []string `json:"denylist_cidrs,omitempty"`
+	// Ranges are named lists of CIDRs, e.g. "ci-egress"
+	Ranges map[string][]string `json:"ranges,omitempty"`
+	// SignUrl is the ip oracle sign endpoint clients fetch tokens from
+	SignUrl string `json:"sign_url,omitempty"`
+	// Signer is how tokens are signed, "kms" (the default) or "local"
+	Signer string `json:"signer,omitempty"`
+	// Key is the KMS key id or ARN tokens are signed with, or for a
+	// local signer its PEM public key (anything util.Load can load)
+	Key string `json:"key,omitempty"`
+	// JwksUrl is the oracle's JWKS endpoint. If set tokens are verified
+	// against its keys, rather than with KMS or the configured key.
+	JwksUrl string `json:"jwks_url,omitempty"`
+	// Issuer is the iss claim tokens must carry, if set
+	Issuer string `json:"issuer,omitempty"`
+	// BindAudience requires tokens to be issued for this environment
+	// (the config name), so they can't be replayed against another.
+	BindAudience bool `json:"bind_audience,omitempty"`
+}
+
+// Enforced reports whether requests must carry an ip oracle token.
+func (c *IPOracleConfig) Enforced() bool {
+	return c.Key != "" || c.JwksUrl != ""
+}
+
+// IdpConfigTypes maps idp types to their config structs.
+var IdpConfigTypes = map[string]func() interface{}{
+	"saml":        func() interface{} { return &IdpConfigSaml{} },
+	"oidc":        func() interface{} { return &IdpConfigOidc{} },
+	"gitlab_jwt":  func() interface{} { return &IdpConfigGitlabJwt{} },
+	"github_oidc": func() interface{} { return &IdpConfigGithubOidc{} },
+}
+
+// CredentialsConfigTypes maps credential types to their config structs.
+var CredentialsConfigTypes = map[string]func() interface{}{
+	"ssh_ca":          func() interface{} { return &CredentialsConfigSSH{} },
+	"kubernetes":      func() interface{} { return &CredentialsConfigKube{} },
+	"iam_assume_role": func() interface{} { return &CredentialsConfigIAMAssumeRole{} },
+	"iam_user":        func() interface{} { return &CredentialsConfigIAMUser{} },
 }
 
 func (c *IdpConfig) UnmarshalJSON(data []byte) error {
-	var t struct {
-		Name          string          `json:"name"`
-		Type          string          `json:"type"`
-		UntypedConfig json.RawMessage `json:"config"`
-	}
-	err := json.Unmarshal(data, &t)
-	if err != nil {
-		return err
-	}
-	c.Name = t.Name
-	c.Type = t.Type
-	var config interface{}
-	switch c.Type {
-	case "saml":
-		config = &IdpConfigSaml{}
-	case "oidc":
-		config = &IdpConfigOidc{}
-	default:
-		return errors.New("unknown idp type: " + c.Type)
-	}
-	err = json.Unmarshal(t.UntypedConfig, config)
-	if err != nil {
-		return err
-	}
-	c.Config = config
-	return nil
+	var err error
+	c.Name, c.Type, c.Config, err = unmarshalTypedConfig(data, "idp", IdpConfigTypes)
+	return err
 }
 
 func (c *CredentialsConfig) UnmarshalJSON(data []byte) error {
+	var err error
+	c.Name, c.Type, c.Config, err = unmarshalTypedConfig(data, "credential", CredentialsConfigTypes)
+	return err
+}
+
+// unmarshalTypedConfig unmarshals a named item whose config struct
+// depends on its type.
+func unmarshalTypedConfig(data []byte, kind string, types map[string]func() interface{}) (string, string, interface{}, error) {
 	var t struct {
 		Name          string          `json:"name"`
 		Type          string          `json:"type"`
@@ -213,27 +535,16 @@ func (c *CredentialsConfig) UnmarshalJSON(data []byte) error {
 	}
 	err := json.Unmarshal(data, &t)
 	if err != nil {
-		return err
+		return "", "", nil, err
 	}
-	c.Name = t.Name
-	c.Type = t.Type
-	var config interface{}
-	switch c.Type {
-	case "ssh_ca":
-		config = &CredentialsConfigSSH{}
-	case "kubernetes":
-		config = &CredentialsConfigKube{}
-	case "iam_assume_role":
-		config = &CredentialsConfigIAMAssumeRole{}
-	case "iam_user":
-		config = &CredentialsConfigIAMUser{}
-	default:
-		return errors.New("unknown credential type: " + c.Type)
+	newConfig, ok := types[t.Type]
+	if !ok {
+		return t.Name, t.Type, nil, errors.New("unknown " + kind + " type: " + t.Type)
 	}
+	config := newConfig()
 	err = json.Unmarshal(t.UntypedConfig, config)
 	if err != nil {
-		return err
+		return t.Name, t.Type, nil, err
 	}
-	c.Config = config
-	return nil
+	return t.Name, t.Type, config, nil
 }
@@ -70,14 +70,16 @@ func TestLoadSampleConfigs(t *testing.T) {
 				Name: "kube-user",
 				Type: "kubernetes",
 				Config: &CredentialsConfigKube{
-					CAKey: "s3://my-bucket/kubeca.key",
+					CACert: "s3://my-bucket/kubeca.crt",
+					CAKey:  "s3://my-bucket/kubeca.key",
 				},
 			},
 			{
 				Name: "kube-admin",
 				Type: "kubernetes",
 				Config: &CredentialsConfigKube{
-					CAKey: "s3://my-bucket/kubeca.key",
+					CACert: "s3://my-bucket/kubeca.crt",
+					CAKey:  "s3://my-bucket/kubeca.key",
 				},
 			},
 			{
@@ -205,6 +207,22 @@ func TestIdpConfig_UnmarshalJSON(t *testing.T) {
 				RedirectURI:  "https://workflow.int.btr.place/1/saml/approve",
 			},
 		},
+		"gitlab": {
+			Type: "gitlab_jwt",
+			Name: "my-gitlab",
+			Config: &IdpConfigGitlabJwt{
+				Issuer:   "https://gitlab.example.com",
+				Audience: "keymaster",
+				JwksUrl:  "https://gitlab.example.com/-/jwks",
+			},
+		},
+		"github": {
+			Type: "github_oidc",
+			Name: "my-github",
+			Config: &IdpConfigGithubOidc{
+				Audience: "keymaster",
+			},
+		},
 	}
 
 	// Unmarshal c -> c2, check c == c2
@@ -221,6 +239,18 @@ func TestIdpConfig_UnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestIdpConfig_IssuerOrDefault(t *testing.T) {
+	assert.Equal(t, "https://gitlab.com", (&IdpConfigGitlabJwt{}).IssuerOrDefault())
+	assert.Equal(t, "https://gitlab.example.com",
+		(&IdpConfigGitlabJwt{Issuer: "https://gitlab.example.com"}).IssuerOrDefault())
+	assert.Equal(t, "https://token.actions.githubusercontent.com", (&IdpConfigGithubOidc{}).IssuerOrDefault())
+
+	// Lint takes an unset issuer to mean the default, as the issuer does
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	config.Idp[1].Config.(*IdpConfigGitlabJwt).Issuer = ""
+	assert.NoError(t, config.Validate())
+}
+
 func TestCredentialsConfig_UnmarshalJSON(t *testing.T) {
 	testCases := map[string]CredentialsConfig{
 		"ssh1": {
@@ -281,3 +311,66 @@ func TestCertificateLoading(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "foo", c.Idp[0].Config.(*IdpConfigSaml).Certificate)
 }
+
+func TestConfig_ValidateIPOracle(t *testing.T) {
+	config := Config{
+		Name:    "nonprod",
+		Version: "1.0",
+		AccessControl: AccessControlConfig{
+			IPOracle: IPOracleConfig{
+				WhiteListCidrs: []string{"10.0.0.0/8", "2001:db8::/32"},
+				Key:            "alias/ip-oracle",
+			},
+		},
+		Roles: []RoleConfig{
+			{
+				Name:            "deployment",
+				Workflow:        "auto",
+				Credentials:     []string{"aws-admin"},
+				ValidForSeconds: 3600,
+				IPOracle:        &RoleIPOracleConfig{WhiteListCidrs: []string{"192.168.0.0/16"}},
+			},
+		},
+		Workflow: WorkflowConfig{
+			Policies: []WorkflowPolicyConfig{{Name: "auto"}},
+		},
+		Credentials: []CredentialsConfig{
+			{
+				Name:   "aws-admin",
+				Type:   "iam_assume_role",
+				Config: &CredentialsConfigIAMAssumeRole{TargetRole: "Administrator"},
+			},
+		},
+	}
+	assert.NoError(t, config.Validate())
+	assert.True(t, config.AccessControl.IPOracle.Enforced())
+
+	// Single addresses and named ranges, IPv4 or IPv6
+	config.AccessControl.IPOracle.Ranges = map[string][]string{
+		"ci-egress": {"203.0.113.0/24", "2001:db8:c1::/48"},
+	}
+	config.AccessControl.IPOracle.DenyListCidrs = []string{"10.66.0.0/16"}
+	config.Roles[0].IPOracle.WhiteListCidrs = []string{"192.168.0.1", "2001:db8::1", "ci-egress"}
+	config.Roles[0].IPOracle.DenyListCidrs = []string{"203.0.113.66"}
+	assert.NoError(t, config.Validate())
+
+	config.Roles[0].IPOracle.WhiteListCidrs = []string{"192.168.0.1/33"}
+	assert.Error(t, config.Validate())
+	config.Roles[0].IPOracle.WhiteListCidrs = []string{"office"}
+	assert.Error(t, config.Validate())
+	config.Roles[0].IPOracle.WhiteListCidrs = nil
+	config.Roles[0].IPOracle.DenyListCidrs = []string{"bogus"}
+	assert.Error(t, config.Validate())
+	config.Roles[0].IPOracle = nil
+	config.AccessControl.IPOracle.Ranges["bad"] = []string{"ci-egress"}
+	assert.Error(t, config.Validate())
+	delete(config.AccessControl.IPOracle.Ranges, "bad")
+
+	config.AccessControl.IPOracle.Signer = "local"
+	assert.NoError(t, config.Validate())
+	config.AccessControl.IPOracle.Signer = "hsm"
+	assert.Error(t, config.Validate())
+
+	jwksOnly := IPOracleConfig{JwksUrl: "https://ip-oracle.example.com/jwks"}
+	assert.True(t, jwksOnly.Enforced())
+}
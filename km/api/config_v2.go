@@ -0,0 +1,394 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Config format versions. Version 1 is the original format, and what
+// Config itself (and ConfigPublic) still looks like. Version 2 renames
+// the fields version 1 was ambiguous about, and both load into Config.
+const (
+	ConfigVersion1 = "1.0"
+	ConfigVersion2 = "2"
+	// CurrentConfigVersion is the version new configs should use
+	CurrentConfigVersion = ConfigVersion2
+)
+
+// SupportedConfigVersions are the config versions that can be loaded.
+var SupportedConfigVersions = []string{ConfigVersion1, ConfigVersion2}
+
+// ConfigV2 is version 2 of the config format. It differs from version 1
+// in that:
+//
+//   - roles name their workflow policy with "policy", not "workflow"
+//   - policies list approver (and identify) groups with their counts,
+//     rather than mapping groups to counts
+//   - credential types are the types of the creds they issue (see Cred):
+//     "ssh", "kube" and "iam", not "ssh_ca", "kubernetes" and
+//     "iam_assume_role"
+type ConfigV2 struct {
+	Version       string                `json:"version"`
+	Name          string                `json:"name"`
+	Idp           []IdpConfig           `json:"idp,omitempty"`
+	Roles         []RoleConfigV2        `json:"roles,omitempty"`
+	Workflow      WorkflowConfigV2      `json:"workflow"`
+	Credentials   []CredentialsConfigV2 `json:"credentials,omitempty"`
+	AccessControl *AccessControlConfig  `json:"access_control,omitempty"`
+	Audit         *AuditConfig          `json:"audit,omitempty"`
+	Policy        *PolicyConfig         `json:"policy,omitempty"`
+	Limits        *LimitsConfig         `json:"limits,omitempty"`
+}
+
+type RoleConfigV2 struct {
+	Name               string                        `json:"name"`
+	Policy             string                        `json:"policy"`
+	Credentials        []string                      `json:"credentials,omitempty"`
+	ValidForSeconds    int                           `json:"valid_for_seconds"`
+	CredentialDelivery *RoleCredentialDeliveryConfig `json:"credential_delivery,omitempty"`
+	ClientDefaults     *RoleClientDefaultsConfig     `json:"client_defaults,omitempty"`
+	CIIdentity         *RoleCIIdentityConfig         `json:"ci_identity,omitempty"`
+	IPOracle           *RoleIPOracleConfig           `json:"ip_oracle,omitempty"`
+	Schedule           *RoleScheduleConfigV2         `json:"schedule,omitempty"`
+	BreakGlass         *RoleBreakGlassConfigV2       `json:"break_glass,omitempty"`
+	Eligibility        *RoleEligibilityConfig        `json:"eligibility,omitempty"`
+	Limits             *RoleLimitsConfig             `json:"limits,omitempty"`
+}
+
+// RoleScheduleConfigV2 is RoleScheduleConfig, with approval groups as
+// for WorkflowPolicyConfigV2.
+type RoleScheduleConfigV2 struct {
+	Timezone       string                  `json:"timezone,omitempty"`
+	Windows        []TimeWindowConfig      `json:"windows,omitempty"`
+	Blackouts      []BlackoutConfig        `json:"blackouts,omitempty"`
+	OutsideWindows *RoleEscalationConfigV2 `json:"outside_windows,omitempty"`
+}
+
+type RoleEscalationConfigV2 struct {
+	Approvers []ApprovalGroupConfig `json:"approvers"`
+}
+
+// RoleBreakGlassConfigV2 is RoleBreakGlassConfig, with approval groups
+// as for WorkflowPolicyConfigV2.
+type RoleBreakGlassConfigV2 struct {
+	Approvers          []ApprovalGroupConfig `json:"approvers,omitempty"`
+	MaxValidForSeconds int                   `json:"max_valid_for_seconds"`
+	Notify             []string              `json:"notify,omitempty"`
+}
+
+type WorkflowConfigV2 struct {
+	BaseUrl  string                   `json:"base_url,omitempty"`
+	Policies []WorkflowPolicyConfigV2 `json:"policies,omitempty"`
+}
+
+type WorkflowPolicyConfigV2 struct {
+	Name                string                `json:"name"`
+	IdpName             string                `json:"idp_name,omitempty"`
+	RequesterCanApprove bool                  `json:"requester_can_approve,omitempty"`
+	Identify            []ApprovalGroupConfig `json:"identify,omitempty"`
+	Approvers           []ApprovalGroupConfig `json:"approvers,omitempty"`
+}
+
+// ApprovalGroupConfig is a group, and how many of its members must
+// approve (or identify).
+type ApprovalGroupConfig struct {
+	Group string `json:"group"`
+	Count int    `json:"count"`
+}
+
+type CredentialsConfigV2 struct {
+	Name   string      `json:"name"`
+	Type   string      `json:"type"`
+	Config interface{} `json:"config"`
+}
+
+// CredentialTypesV2 maps version 2 credential types to version 1 (and
+// Config) types.
+var CredentialTypesV2 = map[string]string{
+	"ssh":      "ssh_ca",
+	"kube":     "kubernetes",
+	"iam":      "iam_assume_role",
+	"iam_user": "iam_user",
+}
+
+// CredentialsConfigV2Types maps version 2 credential types to their
+// config structs.
+var CredentialsConfigV2Types = credentialsConfigV2Types()
+
+func credentialsConfigV2Types() map[string]func() interface{} {
+	types := make(map[string]func() interface{})
+	for v2, v1 := range CredentialTypesV2 {
+		types[v2] = CredentialsConfigTypes[v1]
+	}
+	return types
+}
+
+func (c *CredentialsConfigV2) UnmarshalJSON(data []byte) error {
+	var err error
+	c.Name, c.Type, c.Config, err = unmarshalTypedConfig(data, "credential", CredentialsConfigV2Types)
+	return err
+}
+
+// Config converts a version 2 config to Config.
+func (c *ConfigV2) Config() *Config {
+	config := &Config{
+		Name:    c.Name,
+		Version: c.Version,
+		Idp:     c.Idp,
+		Workflow: WorkflowConfig{
+			BaseUrl: c.Workflow.BaseUrl,
+		},
+	}
+	for _, r := range c.Roles {
+		role := RoleConfig{
+			Name:            r.Name,
+			Workflow:        r.Policy,
+			Credentials:     r.Credentials,
+			ValidForSeconds: r.ValidForSeconds,
+			CIIdentity:      r.CIIdentity,
+			IPOracle:        r.IPOracle,
+			Eligibility:     r.Eligibility,
+			Limits:          r.Limits,
+		}
+		if r.CredentialDelivery != nil {
+			role.CredentialDelivery = *r.CredentialDelivery
+		}
+		if r.ClientDefaults != nil {
+			role.ClientDefaults = *r.ClientDefaults
+		}
+		if sc := r.Schedule; sc != nil {
+			role.Schedule = &RoleScheduleConfig{
+				Timezone:  sc.Timezone,
+				Windows:   sc.Windows,
+				Blackouts: sc.Blackouts,
+			}
+			if sc.OutsideWindows != nil {
+				role.Schedule.OutsideWindows = &RoleEscalationConfig{
+					ApproverRoles: approvalGroupMap(sc.OutsideWindows.Approvers),
+				}
+			}
+		}
+		if bg := r.BreakGlass; bg != nil {
+			role.BreakGlass = &RoleBreakGlassConfig{
+				ApproverRoles:      approvalGroupMap(bg.Approvers),
+				MaxValidForSeconds: bg.MaxValidForSeconds,
+				Notify:             bg.Notify,
+			}
+		}
+		config.Roles = append(config.Roles, role)
+	}
+	for _, p := range c.Workflow.Policies {
+		config.Workflow.Policies = append(config.Workflow.Policies, WorkflowPolicyConfig{
+			Name:                p.Name,
+			IdpName:             p.IdpName,
+			RequesterCanApprove: p.RequesterCanApprove,
+			IdentifyRoles:       approvalGroupMap(p.Identify),
+			ApproverRoles:       approvalGroupMap(p.Approvers),
+		})
+	}
+	for _, cred := range c.Credentials {
+		config.Credentials = append(config.Credentials, CredentialsConfig{
+			Name:   cred.Name,
+			Type:   CredentialTypesV2[cred.Type],
+			Config: cred.Config,
+		})
+	}
+	if c.AccessControl != nil {
+		config.AccessControl = *c.AccessControl
+	}
+	if c.Audit != nil {
+		config.Audit = *c.Audit
+	}
+	if c.Policy != nil {
+		config.Policy = *c.Policy
+	}
+	if c.Limits != nil {
+		config.Limits = *c.Limits
+	}
+	return config
+}
+
+func approvalGroupMap(groups []ApprovalGroupConfig) map[string]int {
+	if groups == nil {
+		return nil
+	}
+	m := make(map[string]int)
+	for _, g := range groups {
+		m[g.Group] = g.Count
+	}
+	return m
+}
+
+// configDocVersion is the version of a decoded config document, which
+// is version 1 if it doesn't say.
+func configDocVersion(doc interface{}) string {
+	if m, ok := doc.(map[string]interface{}); ok {
+		if v, ok := m["version"].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ConfigVersion1
+}
+
+// MigrateConfig converts a version 1 config (or a fragment of one) to
+// version 2, returning it as JSON. It works on the config document, not
+// Config, so includes, vars and overlays (see ConfigRenderer) are kept,
+// as are unrendered references. Version 2 configs are returned as they
+// are.
+func MigrateConfig(data []byte) ([]byte, error) {
+	doc, err := decodeConfigDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("config is not a map")
+	}
+	switch version := configDocVersion(doc); version {
+	case ConfigVersion2:
+	case ConfigVersion1:
+		if err := migrateConfigV1(m); err != nil {
+			return nil, err
+		}
+		if overlays, ok := m[ConfigOverlaysKey].(map[string]interface{}); ok {
+			for _, name := range sortedDocKeys(overlays) {
+				overlay, ok := overlays[name].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if err := migrateConfigV1(overlay); err != nil {
+					return nil, errors.Wrapf(err, "overlay %s", name)
+				}
+				// The overlay's version is the config's
+				delete(overlay, "version")
+			}
+		}
+	default:
+		return nil, errors.Errorf("unsupported version: %s", version)
+	}
+	return json.Marshal(m)
+}
+
+// migrateConfigV1 converts a version 1 config document to version 2, in
+// place.
+func migrateConfigV1(doc map[string]interface{}) error {
+	doc["version"] = ConfigVersion2
+	for _, role := range docItems(doc["roles"]) {
+		if policy, ok := role["workflow"]; ok {
+			role["policy"] = policy
+			delete(role, "workflow")
+		}
+		schedule, _ := role["schedule"].(map[string]interface{})
+		if escalation, ok := schedule["outside_windows"].(map[string]interface{}); ok {
+			err := migrateApprovalGroups(escalation, fmt.Sprintf("roles[%v].schedule.outside_windows", role["name"]))
+			if err != nil {
+				return err
+			}
+		}
+		if awsProfileName, ok := role["client_defaults"].(string); ok {
+			role["client_defaults"] = map[string]interface{}{"aws_profile_name": awsProfileName}
+		}
+		if breakGlass, ok := role["break_glass"].(map[string]interface{}); ok {
+			err := migrateApprovalGroups(breakGlass, fmt.Sprintf("roles[%v].break_glass", role["name"]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if workflow, ok := doc["workflow"].(map[string]interface{}); ok {
+		for _, policy := range docItems(workflow["policies"]) {
+			err := migrateApprovalGroups(policy, fmt.Sprintf("workflow.policies[%v]", policy["name"]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	v1Types := make(map[string]string)
+	for v2, v1 := range CredentialTypesV2 {
+		v1Types[v1] = v2
+	}
+	for _, cred := range docItems(doc["credentials"]) {
+		t, ok := cred["type"].(string)
+		if !ok {
+			continue
+		}
+		v2, ok := v1Types[t]
+		if !ok {
+			return errors.Errorf("credentials[%v].type: unknown credential type: %s", cred["name"], t)
+		}
+		cred["type"] = v2
+	}
+	return nil
+}
+
+// migrateApprovalGroups converts maps of groups to counts to lists of
+// approval groups, in place.
+func migrateApprovalGroups(m map[string]interface{}, at string) error {
+	for _, r := range []struct{ v1, v2 string }{{"identify_roles", "identify"}, {"approver_roles", "approvers"}} {
+		groups, ok := m[r.v1]
+		if !ok {
+			continue
+		}
+		delete(m, r.v1)
+		if groups == nil {
+			// Removed by an overlay
+			m[r.v2] = nil
+			continue
+		}
+		counts, ok := groups.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%s.%s: expected a map of groups to counts", at, r.v1)
+		}
+		list := make([]interface{}, 0, len(counts))
+		for _, group := range sortedDocKeys(counts) {
+			list = append(list, map[string]interface{}{"group": group, "count": counts[group]})
+		}
+		m[r.v2] = list
+	}
+	return nil
+}
+
+// docItems returns the maps in a list in a config document.
+func docItems(v interface{}) []map[string]interface{} {
+	list, _ := v.([]interface{})
+	var items []map[string]interface{}
+	for _, i := range list {
+		if m, ok := i.(map[string]interface{}); ok {
+			items = append(items, m)
+		}
+	}
+	return items
+}
+
+// v2ProblemPaths renames Config fields in problem paths to their
+// version 2 names.
+var v2ProblemPaths = []struct{ v1, v2 string }{
+	{".workflow", ".policy"},
+	{".identify_roles", ".identify"},
+	{".approver_roles", ".approvers"},
+}
+
+func v2ProblemPath(path string) string {
+	for _, r := range v2ProblemPaths {
+		if i := indexConfigField(path, r.v1); i >= 0 {
+			path = path[:i] + r.v2 + path[i+len(r.v1):]
+		}
+	}
+	return path
+}
+
+// indexConfigField finds a field in a path, as a whole field name.
+func indexConfigField(path string, field string) int {
+	for i := 0; i+len(field) <= len(path); i++ {
+		if path[i:i+len(field)] != field {
+			continue
+		}
+		end := i + len(field)
+		if end == len(path) || path[end] == '.' || path[end] == '[' {
+			return i
+		}
+	}
+	return -1
+}
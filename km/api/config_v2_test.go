@@ -0,0 +1,241 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// migrateTestConfig loads a version 1 config file, both as it is and
+// migrated to version 2.
+func migrateTestConfig(t *testing.T, path string) (*Config, *Config) {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	v1, err := ParseConfig(data)
+	assert.NoError(t, err)
+	migrated, err := MigrateConfig(data)
+	assert.NoError(t, err)
+	v2, err := ParseConfig(migrated)
+	assert.NoError(t, err)
+	return v1, v2
+}
+
+func TestMigrateConfigRoundTrip(t *testing.T) {
+	for _, path := range []string{"./testdata/config.yaml", "./testdata/example_api_config.yaml"} {
+		t.Run(path, func(t *testing.T) {
+			v1, v2 := migrateTestConfig(t, path)
+			assert.Equal(t, ConfigVersion2, v2.Version)
+			// Apart from the version, both load the same
+			v2.Version = v1.Version
+			assert.Equal(t, v1, v2)
+
+			// And lint the same
+			v1.Normalise()
+			v2.Normalise()
+			assert.Equal(t, len(v1.Lint()), len(v2.Lint()))
+		})
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	migrated, err := MigrateConfig([]byte(`
+include: [common.yaml]
+vars:
+  ttl: 3600
+roles:
+- name: deployment
+  workflow: deploy_with_approval
+  valid_for_seconds: ${ttl}
+workflow:
+  policies:
+  - name: deploy_with_approval
+    approver_roles: {ops: 1, admins: 2}
+    identify_roles: {deployer: 1}
+credentials:
+- name: ssh
+  type: ssh_ca
+- name: aws
+  type: iam_assume_role
+overlays:
+  prod:
+    roles:
+    - name: deployment
+      workflow: auto
+    workflow:
+      policies:
+      - name: deploy_with_approval
+        approver_roles: null
+`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": "2",
+		"include": ["common.yaml"],
+		"vars": {"ttl": 3600},
+		"roles": [{"name": "deployment", "policy": "deploy_with_approval", "valid_for_seconds": "${ttl}"}],
+		"workflow": {"policies": [{
+			"name": "deploy_with_approval",
+			"approvers": [{"group": "admins", "count": 2}, {"group": "ops", "count": 1}],
+			"identify": [{"group": "deployer", "count": 1}]
+		}]},
+		"credentials": [{"name": "ssh", "type": "ssh"}, {"name": "aws", "type": "iam"}],
+		"overlays": {"prod": {
+			"roles": [{"name": "deployment", "policy": "auto"}],
+			"workflow": {"policies": [{"name": "deploy_with_approval", "approvers": null}]}
+		}}
+	}`, string(migrated))
+
+	// Version 2 configs are already migrated
+	again, err := MigrateConfig(migrated)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(migrated), string(again))
+
+	_, err = MigrateConfig([]byte(`{"version": "3"}`))
+	assert.EqualError(t, err, "unsupported version: 3")
+	_, err = MigrateConfig([]byte(`{"credentials": [{"name": "x", "type": "ldap"}]}`))
+	assert.EqualError(t, err, "credentials[x].type: unknown credential type: ldap")
+}
+
+func TestMigratedOverlaysRender(t *testing.T) {
+	v1 := `
+name: nonprod
+roles:
+- name: deployment
+  workflow: approval
+  valid_for_seconds: 3600
+workflow:
+  policies:
+  - name: approval
+    approver_roles: {ops: 1}
+  - name: auto
+overlays:
+  prod:
+    workflow:
+      policies:
+      - name: approval
+        approver_roles: {admins: 2}
+    roles:
+    - name: deployment
+      workflow: auto
+`
+	migrated, err := MigrateConfig([]byte(v1))
+	assert.NoError(t, err)
+	for _, data := range []string{v1, string(migrated)} {
+		r := testRenderer(map[string]string{"s3://config/issuer.yaml": data})
+		r.Overlay = "prod"
+		rendered, err := r.Render("s3://config/issuer.yaml")
+		assert.NoError(t, err)
+		config, err := ParseConfig(rendered)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "auto", config.FindRoleByName("deployment").Workflow)
+		// Approval groups are merged, as maps of groups were
+		assert.Equal(t, map[string]int{"ops": 1, "admins": 2}, config.Workflow.FindPolicyByName("approval").ApproverRoles)
+	}
+}
+
+func TestLintV2Paths(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+version: "2"
+name: nonprod
+roles:
+- name: deployment
+  policy: nope
+  valid_for_seconds: 3600
+workflow:
+  policies:
+  - name: auto
+    approvers: [{group: ops, count: 0}]
+`))
+	assert.NoError(t, err)
+	config.Normalise()
+	assert.Equal(t, []string{
+		"workflow.policies[auto].idp_name: no such idp: \"\"",
+		"workflow.policies[auto].approvers.ops: impossible approval count 0",
+		"roles[deployment].policy: no such workflow policy: nope",
+	}, problemErrors(config.Lint()))
+}
+
+func TestConfigV2JSON(t *testing.T) {
+	// The version 2 structs marshal to what they unmarshal from
+	data := `{
+		"version": "2",
+		"name": "nonprod",
+		"roles": [{"name": "deployment", "policy": "auto", "valid_for_seconds": 3600}],
+		"workflow": {"policies": [{"name": "auto", "approvers": [{"group": "ops", "count": 1}]}]},
+		"credentials": [{"name": "kube", "type": "kube", "config": {"ca_cert": "ca.crt", "ca_key": "ca.key"}}]
+	}`
+	var config ConfigV2
+	assert.NoError(t, json.Unmarshal([]byte(data), &config))
+	assert.IsType(t, &CredentialsConfigKube{}, config.Credentials[0].Config)
+	out, err := json.Marshal(&config)
+	assert.NoError(t, err)
+	assert.JSONEq(t, data, string(out))
+}
+
+func TestMigrateRoleSchedule(t *testing.T) {
+	v1 := `
+roles:
+- name: deployment
+  workflow: auto
+  schedule:
+    windows: [{days: [mon-fri], start: "09:00", end: "17:00"}]
+    outside_windows:
+      approver_roles: {ops: 1}
+`
+	migrated, err := MigrateConfig([]byte(v1))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": "2",
+		"roles": [{"name": "deployment", "policy": "auto", "schedule": {
+			"windows": [{"days": ["mon-fri"], "start": "09:00", "end": "17:00"}],
+			"outside_windows": {"approvers": [{"group": "ops", "count": 1}]}
+		}}]
+	}`, string(migrated))
+	config, err := ParseConfig(migrated)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"ops": 1}, config.FindRoleByName("deployment").Schedule.OutsideWindows.ApproverRoles)
+}
+
+func TestMigrateRoleBreakGlass(t *testing.T) {
+	migrated, err := MigrateConfig([]byte(`
+roles:
+- name: deployment
+  workflow: auto
+  break_glass:
+    approver_roles: {ops: 1}
+    max_valid_for_seconds: 900
+`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": "2",
+		"roles": [{"name": "deployment", "policy": "auto", "break_glass": {
+			"approvers": [{"group": "ops", "count": 1}],
+			"max_valid_for_seconds": 900
+		}}]
+	}`, string(migrated))
+}
+
+func TestMigrateRoleClientDefaults(t *testing.T) {
+	v1 := []byte(`
+roles:
+- name: deployment
+  workflow: auto
+  client_defaults: default
+`)
+	config, err := ParseConfig(v1)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleClientDefaultsConfig{AwsProfileName: "default"}, config.Roles[0].ClientDefaults)
+
+	migrated, err := MigrateConfig(v1)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": "2",
+		"roles": [{"name": "deployment", "policy": "auto", "client_defaults": {"aws_profile_name": "default"}}]
+	}`, string(migrated))
+	config, err = ParseConfig(migrated)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", config.Roles[0].ClientDefaults.AwsProfileName)
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"strings"
+)
+
+// Version is the keymaster build version, set at link time with
+// -ldflags "-X github.com/bsycorp/keymaster/km/api.Version=...".
+var Version = "dev"
+
+// ApiVersions are the api versions spoken by this build, most preferred
+// first. Issuers that predate discovery speak version "1". Version "2"
+// returns failed requests as an ErrorResponse.
+var ApiVersions = []string{"2", "1"}
+
+// Features an issuer may advertise in discovery.
+const (
+	FeatureKmsWrapping = "kms_wrapping"
+	FeatureCsr         = "csr"
+	FeatureDirectAuth  = "direct_auth"
+	FeatureCIIdentity  = "ci_identity"
+	FeatureBreakGlass  = "break_glass"
+)
+
+// Negotiate checks that the issuer that gave this discovery response can
+// serve a client speaking the given api versions, and supports the
+// request types the client needs. It returns the api version to use.
+func (r *DiscoveryResponse) Negotiate(clientVersions []string, requestTypes ...string) (string, error) {
+	serverVersions := r.ApiVersions
+	if len(serverVersions) == 0 {
+		// An issuer from before the discovery handshake
+		serverVersions = []string{"1"}
+	}
+	version := ""
+	for _, cv := range clientVersions {
+		if contains(serverVersions, cv) {
+			version = cv
+			break
+		}
+	}
+	if version == "" {
+		return "", NewError(ErrorCodeIncompatible, "km client (version %s, api versions %s) is incompatible with "+
+			"issuer (version %s, api versions %s): %s",
+			Version, strings.Join(clientVersions, ","),
+			serverVersionString(r.ServerVersion), strings.Join(serverVersions, ","),
+			upgradeAdvice(clientVersions, serverVersions))
+	}
+	// Issuers from before the discovery handshake don't list request types
+	if len(r.RequestTypes) > 0 {
+		for _, requestType := range requestTypes {
+			if !contains(r.RequestTypes, requestType) {
+				return "", NewError(ErrorCodeIncompatible, "issuer (version %s) does not support request type: %s",
+					serverVersionString(r.ServerVersion), requestType)
+			}
+		}
+	}
+	return version, nil
+}
+
+// HasFeature reports whether the issuer advertised a feature.
+func (r *DiscoveryResponse) HasFeature(feature string) bool {
+	return r.Features[feature]
+}
+
+// CheckApiVersions returns an error if none of a client's api versions
+// are spoken by this build. Clients from before the discovery handshake
+// don't send any versions, and speak version "1".
+func CheckApiVersions(clientVersions []string) error {
+	if len(clientVersions) == 0 {
+		clientVersions = []string{"1"}
+	}
+	for _, cv := range clientVersions {
+		if contains(ApiVersions, cv) {
+			return nil
+		}
+	}
+	return NewError(ErrorCodeIncompatible, "km client api versions %s are not supported by issuer "+
+		"(version %s, api versions %s): %s",
+		strings.Join(clientVersions, ","), Version, strings.Join(ApiVersions, ","),
+		upgradeAdvice(clientVersions, ApiVersions))
+}
+
+// HasErrorResponses reports whether failed requests are returned as an
+// ErrorResponse to clients speaking an api version.
+func HasErrorResponses(apiVersion string) bool {
+	return apiVersion != "" && !versionLess(apiVersion, "2")
+}
+
+func upgradeAdvice(clientVersions []string, serverVersions []string) string {
+	if versionLess(maxVersion(clientVersions), maxVersion(serverVersions)) {
+		return "please upgrade km"
+	}
+	return "the issuer needs to be upgraded, or use an older km"
+}
+
+func maxVersion(versions []string) string {
+	max := ""
+	for _, v := range versions {
+		if versionLess(max, v) {
+			max = v
+		}
+	}
+	return max
+}
+
+// versionLess orders api versions, which are integers, without parsing.
+func versionLess(a, b string) bool {
+	return len(a) < len(b) || (len(a) == len(b) && a < b)
+}
+
+func serverVersionString(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiscoveryResponse_Negotiate(t *testing.T) {
+	// Issuers from before the discovery handshake speak version 1
+	legacy := DiscoveryResponse{}
+	version, err := legacy.Negotiate([]string{"1"}, RequestTypeWorkflowAuth)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", version)
+
+	resp := DiscoveryResponse{
+		ServerVersion: "v2.0.0",
+		ApiVersions:   []string{"3", "2"},
+		RequestTypes:  []string{RequestTypeDiscovery, RequestTypeConfig},
+	}
+	version, err = resp.Negotiate([]string{"2", "1"}, RequestTypeConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", version)
+
+	// An old client talking to a new issuer
+	_, err = resp.Negotiate([]string{"1"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "please upgrade km")
+
+	// A new client talking to an old issuer
+	_, err = resp.Negotiate([]string{"10", "4"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "the issuer needs to be upgraded")
+
+	// Unsupported request type
+	_, err = resp.Negotiate([]string{"2"}, RequestTypeWorkflowAuth)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "workflow_auth")
+}
+
+func TestCheckApiVersions(t *testing.T) {
+	assert.NoError(t, CheckApiVersions(nil))
+	assert.NoError(t, CheckApiVersions(ApiVersions))
+	assert.NoError(t, CheckApiVersions([]string{"999", ApiVersions[0]}))
+	err := CheckApiVersions([]string{"999"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "the issuer needs to be upgraded")
+}
+
+func TestDiscoveryResponse_HasFeature(t *testing.T) {
+	resp := DiscoveryResponse{
+		Features: map[string]bool{
+			FeatureCIIdentity:  true,
+			FeatureKmsWrapping: false,
+		},
+	}
+	assert.True(t, resp.HasFeature(FeatureCIIdentity))
+	assert.False(t, resp.HasFeature(FeatureKmsWrapping))
+	assert.False(t, resp.HasFeature(FeatureCsr))
+}
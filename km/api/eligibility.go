@@ -0,0 +1,81 @@
+package api
+
+import (
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+)
+
+// RoleEligibilityConfig says who may request a role at all, before any
+// approvals. Requesters are eligible if they identify (with a SAML
+// assertion of their own, from the role's workflow policy idp) as a
+// member of one of the allow groups, and of none of the deny groups, or
+// if they present a CI identity token matching one of the CI identities.
+type RoleEligibilityConfig struct {
+	AllowGroups []string `json:"allow_groups,omitempty"`
+	// DenyGroups are exceptions to AllowGroups
+	DenyGroups   []string               `json:"deny_groups,omitempty"`
+	CIIdentities []RoleCIIdentityConfig `json:"ci_identities,omitempty"`
+}
+
+// Requester is what's known about who is making a request.
+type Requester struct {
+	// Identified is true if the requester identified themselves, in
+	// which case Groups are their groups
+	Identified bool
+	Groups     []string
+	// CIIdpName is the idp of the requester's CI identity token, if they
+	// presented one, and CIClaims looks up its claims
+	CIIdpName string
+	CIClaims  func(name string) []string
+}
+
+// NeedsIdentity reports whether requesters must identify, unless they
+// have a CI identity.
+func (e *RoleEligibilityConfig) NeedsIdentity() bool {
+	return len(e.AllowGroups) > 0
+}
+
+// VerifiesRequester reports whether anyone granted the role has proved
+// who they are, with a CI identity token or an assertion of their own,
+// as eligibility can't be met otherwise.
+func (r *RoleConfig) VerifiesRequester() bool {
+	return r.CIIdentity != nil || r.Eligibility != nil
+}
+
+// Check returns an Error if a requester isn't eligible for a role.
+func (e *RoleEligibilityConfig) Check(role string, r *Requester) error {
+	for _, m := range e.CIIdentities {
+		if r.CIIdpName != "" && r.CIIdpName == m.IdpName && r.CIClaims != nil &&
+			idtoken.MatchClaimsFunc(r.CIClaims, m.Claims) == nil {
+			return nil
+		}
+	}
+	if r.Identified {
+		for _, group := range e.DenyGroups {
+			if contains(r.Groups, group) {
+				return NewError(ErrorCodeNotEligible, "members of %s may not request role %s", group, role).
+					WithDetails(&ErrorDetails{Role: role})
+			}
+		}
+		for _, group := range e.AllowGroups {
+			if contains(r.Groups, group) {
+				return nil
+			}
+		}
+	}
+	var ways []string
+	if len(e.AllowGroups) > 0 {
+		ways = append(ways, "identify as a member of "+strings.Join(e.AllowGroups, ", "))
+	}
+	for _, m := range e.CIIdentities {
+		ways = append(ways, "present a matching CI identity token from idp "+m.IdpName)
+	}
+	if len(ways) == 0 {
+		return NewError(ErrorCodeNotEligible, "nobody is eligible for role %s", role).
+			WithDetails(&ErrorDetails{Role: role})
+	}
+	return NewError(ErrorCodeNotEligible, "requester is not eligible for role %s, they must %s",
+		role, strings.Join(ways, " or ")).
+		WithDetails(&ErrorDetails{Role: role, EligibleGroups: e.AllowGroups})
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleEligibilityConfig_Check(t *testing.T) {
+	e := &RoleEligibilityConfig{
+		AllowGroups: []string{"engineers", "ops"},
+		DenyGroups:  []string{"contractors"},
+		CIIdentities: []RoleCIIdentityConfig{
+			{IdpName: "gitlab", Claims: map[string][]string{"project_path": {"group/*"}}},
+		},
+	}
+	claims := func(project string) func(string) []string {
+		return func(name string) []string {
+			if name == "project_path" {
+				return []string{project}
+			}
+			return nil
+		}
+	}
+	tests := []struct {
+		name      string
+		requester *Requester
+		eligible  bool
+	}{
+		{"engineer", &Requester{Identified: true, Groups: []string{"staff", "engineers"}}, true},
+		{"ops", &Requester{Identified: true, Groups: []string{"ops"}}, true},
+		{"contractor", &Requester{Identified: true, Groups: []string{"engineers", "contractors"}}, false},
+		{"someone else", &Requester{Identified: true, Groups: []string{"staff"}}, false},
+		{"unidentified", &Requester{Groups: []string{"engineers"}}, false},
+		{"pipeline", &Requester{CIIdpName: "gitlab", CIClaims: claims("group/app")}, true},
+		{"other pipeline", &Requester{CIIdpName: "gitlab", CIClaims: claims("other/app")}, false},
+		{"other idp", &Requester{CIIdpName: "github", CIClaims: claims("group/app")}, false},
+		{"nobody", &Requester{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := e.Check("deployment", test.requester)
+			if test.eligible {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, ErrorCodeNotEligible, ErrorCode(err))
+			}
+		})
+	}
+
+	err := e.Check("deployment", &Requester{Identified: true, Groups: []string{"contractors", "engineers"}})
+	assert.EqualError(t, err, "members of contractors may not request role deployment")
+	err = e.Check("deployment", &Requester{})
+	assert.EqualError(t, err, "requester is not eligible for role deployment, they must identify as a member of "+
+		"engineers, ops or present a matching CI identity token from idp gitlab")
+	assert.Equal(t, []string{"engineers", "ops"}, errors.Cause(err).(*Error).Details.EligibleGroups)
+	assert.Equal(t, 403, ErrorStatus(ErrorCodeNotEligible))
+}
+
+func TestConfig_LintEligibility(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	role := &config.Roles[0]
+	assert.True(t, role.Eligibility.NeedsIdentity())
+
+	role.Eligibility = &RoleEligibilityConfig{
+		DenyGroups: []string{"contractors", " "},
+		CIIdentities: []RoleCIIdentityConfig{
+			{IdpName: "nonprod", Claims: map[string][]string{"project_path": {"[group"}}},
+		},
+	}
+	assert.Equal(t, []string{
+		"roles[deployment].eligibility.deny_groups: deny_groups are exceptions to allow_groups, which are missing",
+		"roles[deployment].eligibility: empty group name",
+		"roles[deployment].eligibility.ci_identities[0].idp_name: idp nonprod is saml, not a ci idp",
+		"roles[deployment].eligibility.ci_identities[0].claims.project_path: invalid pattern \"[group\": syntax error in pattern",
+	}, problemErrors(config.Lint()))
+
+	role.Eligibility = &RoleEligibilityConfig{
+		AllowGroups: []string{"engineers"},
+		DenyGroups:  []string{"engineers"},
+	}
+	config.Workflow.Policies[1].IdpName = "gitlab"
+	assert.Equal(t, []string{
+		"workflow.policies[deploy_with_approval].idp_name: idp gitlab is gitlab_jwt, approvals need a saml idp",
+		"roles[deployment].eligibility.deny_groups: engineers is also in allow_groups",
+		"roles[deployment].eligibility.allow_groups: workflow policy deploy_with_approval has no saml idp for requesters to identify with",
+	}, problemErrors(config.Lint()))
+
+	role.Eligibility = &RoleEligibilityConfig{}
+	assert.Contains(t, problemErrors(config.Lint()),
+		"roles[deployment].eligibility: no allow_groups or ci_identities, nobody is eligible")
+}
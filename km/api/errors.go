@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Error codes returned by the issuer
+const (
+	// The request could not be understood
+	ErrorCodeBadRequest = "bad_request"
+	// The client and issuer can't work together, one needs upgrading
+	ErrorCodeIncompatible = "incompatible"
+	// The request needs something the issuer doesn't do
+	ErrorCodeNotImplemented = "not_implemented"
+	// The requested role doesn't exist
+	ErrorCodeRoleNotFound = "role_not_found"
+	// The requester's identity (e.g. a CI identity token) was not accepted
+	ErrorCodeIdentityRejected = "identity_rejected"
+	// The requester's source address was not vouched for, or is not
+	// whitelisted
+	ErrorCodeSourceNotAllowed = "source_not_allowed"
+	// A SAML assertion was invalid, or didn't count as an approval
+	ErrorCodeInvalidAssertion = "invalid_assertion"
+	// The approvals submitted don't meet the role's workflow policy
+	ErrorCodeNotEnoughApprovals = "not_enough_approvals"
+	// The role can't be used now: it's outside the role's time windows,
+	// or in a blackout
+	ErrorCodeOutsideSchedule = "outside_schedule"
+	// Break-glass was requested for a role without a break-glass policy
+	ErrorCodeBreakGlassNotAllowed = "break_glass_not_allowed"
+	// The requester isn't eligible for the role
+	ErrorCodeNotEligible = "not_eligible"
+	// The issuer's policy denied the request
+	ErrorCodePolicyDenied = "policy_denied"
+	// The requester, or everyone, has been issued as many credentials
+	// for the role as its limits allow for now
+	ErrorCodeRateLimited = "rate_limited"
+	// The issuer's configuration is broken
+	ErrorCodeConfiguration = "configuration"
+	// Issuing the credentials failed, e.g. an AWS api call failed
+	ErrorCodeIssuance = "issuance"
+	// Anything else
+	ErrorCodeInternal = "internal"
+)
+
+// Error is a failed request, as returned by the issuer.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Retryable errors may succeed if the same request is tried again
+	Retryable bool `json:"retryable"`
+	// RetryAfterSeconds, if set, is how long to wait before retrying
+	RetryAfterSeconds int           `json:"retry_after_seconds,omitempty"`
+	Details           *ErrorDetails `json:"details,omitempty"`
+}
+
+// ErrorDetails says more about why a request failed, where that is
+// useful to the requester.
+type ErrorDetails struct {
+	Role string `json:"role,omitempty"`
+	// Approvals still needed, by approver group
+	MissingApprovals map[string]int `json:"missing_approvals,omitempty"`
+	// Groups that an assertion's user would need to be in to approve
+	ApproverGroups []string `json:"approver_groups,omitempty"`
+	// Groups that the requester would need to be in to be eligible
+	EligibleGroups []string `json:"eligible_groups,omitempty"`
+	// Why the issuer's policy denied the request
+	PolicyReasons []string `json:"policy_reasons,omitempty"`
+}
+
+// ErrorResponse is returned in place of a response for a failed request,
+// to clients speaking api version 2 or later.
+type ErrorResponse struct {
+	Error *Error `json:"error"`
+}
+
+func NewError(code string, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// WrapError returns an Error with the given code for an underlying error,
+// with the message prefixed as by errors.Wrap.
+func WrapError(err error, code string, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message + ": " + err.Error(),
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetails sets the error's details.
+func (e *Error) WithDetails(details *ErrorDetails) *Error {
+	e.Details = details
+	return e
+}
+
+// WithRetryable sets whether the error is retryable.
+func (e *Error) WithRetryable(retryable bool) *Error {
+	e.Retryable = retryable
+	return e
+}
+
+// WithRetryAfter makes the error retryable after a wait, rounded up to
+// the second.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	e.Retryable = true
+	e.RetryAfterSeconds = int((d + time.Second - 1) / time.Second)
+	return e
+}
+
+// AsError returns the Error behind err, which may have been wrapped with
+// errors.Wrap. Any other error is an internal error.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e
+	}
+	return &Error{
+		Code:    ErrorCodeInternal,
+		Message: err.Error(),
+	}
+}
+
+// ErrorCode returns the code of the Error behind err, or an empty string
+// if err is not (and does not wrap) an Error.
+func ErrorCode(err error) string {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// IsRetryable reports whether err is a retryable Error.
+func IsRetryable(err error) bool {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Retryable
+	}
+	return false
+}
+
+// RetryAfter returns how long to wait before retrying err, if it is an
+// Error that says.
+func RetryAfter(err error) time.Duration {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return time.Duration(e.RetryAfterSeconds) * time.Second
+	}
+	return 0
+}
+
+// ErrorStatus is the HTTP status code for an error code.
+func ErrorStatus(code string) int {
+	switch code {
+	case ErrorCodeBadRequest, ErrorCodeIncompatible:
+		return http.StatusBadRequest
+	case ErrorCodeIdentityRejected, ErrorCodeSourceNotAllowed, ErrorCodeInvalidAssertion, ErrorCodeNotEnoughApprovals,
+		ErrorCodeOutsideSchedule, ErrorCodeBreakGlassNotAllowed, ErrorCodeNotEligible,
+		ErrorCodePolicyDenied:
+		return http.StatusForbidden
+	case ErrorCodeRoleNotFound:
+		return http.StatusNotFound
+	case ErrorCodeNotImplemented:
+		return http.StatusNotImplemented
+	case ErrorCodeRateLimited:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// decodeErrorResponse returns the Error in a response payload, if it is
+// an ErrorResponse.
+func decodeErrorResponse(payload []byte) *Error {
+	var errResp ErrorResponse
+	if json.Unmarshal(payload, &errResp) != nil || errResp.Error == nil || errResp.Error.Code == "" {
+		return nil
+	}
+	return errResp.Error
+}
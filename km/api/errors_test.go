@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	err := errors.Wrap(NewError(ErrorCodeNotEnoughApprovals, "not enough approvals, want: %d, got: %d", 2, 1).
+		WithDetails(&ErrorDetails{MissingApprovals: map[string]int{"approvers": 1}}), "calling issuer")
+	assert.Equal(t, "calling issuer: not enough approvals, want: 2, got: 1", err.Error())
+	assert.Equal(t, ErrorCodeNotEnoughApprovals, ErrorCode(err))
+	assert.Equal(t, 1, AsError(err).Details.MissingApprovals["approvers"])
+	assert.False(t, IsRetryable(err))
+
+	err = WrapError(errors.New("throttled"), ErrorCodeIssuance, "during issuance").WithRetryable(true)
+	assert.Equal(t, "during issuance: throttled", err.Error())
+	assert.True(t, IsRetryable(err))
+
+	err = NewError(ErrorCodeRateLimited, "rate limited").WithRetryAfter(90*time.Second + time.Millisecond)
+	assert.True(t, IsRetryable(err))
+	assert.Equal(t, 91*time.Second, RetryAfter(errors.Wrap(err, "calling issuer")))
+	assert.Equal(t, http.StatusTooManyRequests, ErrorStatus(ErrorCodeRateLimited))
+
+	plain := errors.New("boom")
+	assert.Equal(t, "", ErrorCode(plain))
+	assert.Equal(t, ErrorCodeInternal, AsError(plain).Code)
+	assert.Nil(t, AsError(nil))
+	assert.Equal(t, time.Duration(0), RetryAfter(plain))
+}
+
+func TestHasErrorResponses(t *testing.T) {
+	assert.False(t, HasErrorResponses(""))
+	assert.False(t, HasErrorResponses("1"))
+	assert.True(t, HasErrorResponses("2"))
+	assert.True(t, HasErrorResponses("10"))
+}
+
+type fakeTransport struct {
+	response []byte
+}
+
+func (t *fakeTransport) RoundTrip(payload []byte) ([]byte, error) {
+	return t.response, nil
+}
+
+func TestClientDecodesErrorResponse(t *testing.T) {
+	client := &Client{Transport: &fakeTransport{
+		response: []byte(`{"error":{"code":"role_not_found","message":"requested role not found: x","details":{"role":"x"}}}`),
+	}}
+	_, err := client.WorkflowAuth(&WorkflowAuthRequest{Role: "x"})
+	assert.Error(t, err)
+	assert.Equal(t, ErrorCodeRoleNotFound, ErrorCode(err))
+	assert.Equal(t, "x", AsError(err).Details.Role)
+
+	// Ordinary responses are not errors
+	client.Transport = &fakeTransport{response: []byte(`{"version":"1.0","config":{"name":"x"}}`)}
+	resp, err := client.GetConfig(&ConfigRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "x", resp.Config.Name)
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Keys of a config document that are used by rendering, and so are not
+// part of the rendered config.
+const (
+	ConfigIncludeKey  = "include"
+	ConfigVarsKey     = "vars"
+	ConfigOverlaysKey = "overlays"
+)
+
+// maxIncludeDepth bounds nested includes, as a backstop to the cycle check.
+const maxIncludeDepth = 16
+
+// ConfigRenderer renders a config document, which may be split across
+// includes and templated with variables, into the effective config:
+//
+//   include:             # fragments, deep merged under this document
+//     - common/idp.yaml  # relative to this document (file:// or s3://)
+//     - s3://bucket/shared/roles.yaml
+//   vars:
+//     account: "062921715532"
+//   name: fooproject_${env:KM_ENV}
+//   overlays:            # merged on top, if selected by name
+//     prod:
+//       vars:
+//         account: "140374123517"
+//
+// Maps are merged key by key. Lists of named items (roles, credentials,
+// idps and workflow policies) are merged by name, and approval groups by
+// group. Other lists are replaced, and a null value removes a key.
+// Strings may refer to vars with ${name}, or to the environment with
+// ${env:NAME}; $${ is a literal ${. A string that is only a reference to
+// a var takes the var's type.
+type ConfigRenderer struct {
+	// Load loads includes, util.Load unless set
+	Load func(string) ([]byte, error)
+	// LookupEnv looks up ${env:NAME} references, os.LookupEnv unless set
+	LookupEnv func(string) (string, bool)
+	// Overlay names the overlay to apply, if any
+	Overlay string
+
+	// Sources are the references rendered from, the config first, then
+	// the includes in the order they were loaded.
+	Sources []string
+}
+
+// RenderConfig renders the config at a reference (see util.Load), with
+// an overlay if it is given.
+func RenderConfig(ref string, overlay string) ([]byte, error) {
+	r := &ConfigRenderer{Overlay: overlay}
+	return r.Render(ref)
+}
+
+func (r *ConfigRenderer) load(ref string) ([]byte, error) {
+	if r.Load == nil {
+		return util.Load(ref)
+	}
+	return r.Load(ref)
+}
+
+func (r *ConfigRenderer) lookupEnv(name string) (string, bool) {
+	if r.LookupEnv == nil {
+		return os.LookupEnv(name)
+	}
+	return r.LookupEnv(name)
+}
+
+// Render loads and renders the config at a reference, returning it as
+// JSON.
+func (r *ConfigRenderer) Render(ref string) ([]byte, error) {
+	data, err := r.load(ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.RenderData(data, ref)
+}
+
+// RenderData renders a config, loaded from ref (which relative includes
+// are resolved against), returning it as JSON.
+func (r *ConfigRenderer) RenderData(data []byte, ref string) ([]byte, error) {
+	r.Sources = []string{ref}
+	doc, err := decodeConfigDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	doc, err = r.expandIncludes(doc, ref, []string{ref})
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := doc.(map[string]interface{}); ok {
+		overlays, _ := m[ConfigOverlaysKey].(map[string]interface{})
+		delete(m, ConfigOverlaysKey)
+		if r.Overlay != "" {
+			overlay, ok := overlays[r.Overlay]
+			if !ok {
+				return nil, errors.Errorf("config has no overlay: %s", r.Overlay)
+			}
+			doc = mergeConfig(doc, overlay)
+		}
+	} else if r.Overlay != "" {
+		return nil, errors.Errorf("config has no overlay: %s", r.Overlay)
+	}
+	doc = dropNulls(doc)
+	doc, err = r.interpolate(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func decodeConfigDocument(data []byte) (interface{}, error) {
+	// JSON is YAML, so this does for both
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing config")
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "parsing config")
+	}
+	return doc, nil
+}
+
+// expandIncludes merges a document's includes under it. stack holds the
+// references being included, to catch cycles.
+func (r *ConfigRenderer) expandIncludes(doc interface{}, ref string, stack []string) (interface{}, error) {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return doc, nil
+	}
+	includes, ok := m[ConfigIncludeKey]
+	if !ok {
+		return doc, nil
+	}
+	delete(m, ConfigIncludeKey)
+	var refs []string
+	switch v := includes.(type) {
+	case string:
+		refs = []string{v}
+	case []interface{}:
+		for _, i := range v {
+			s, ok := i.(string)
+			if !ok {
+				return nil, errors.Errorf("%s: include must be a list of references", ref)
+			}
+			refs = append(refs, s)
+		}
+	default:
+		return nil, errors.Errorf("%s: include must be a list of references", ref)
+	}
+	if len(stack) > maxIncludeDepth {
+		return nil, errors.Errorf("%s: includes nested too deeply", ref)
+	}
+	var merged interface{}
+	for _, include := range refs {
+		includeRef, err := resolveInclude(ref, include)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stack {
+			if s == includeRef {
+				return nil, errors.Errorf("%s: include cycle: %s", ref, strings.Join(append(stack, includeRef), " -> "))
+			}
+		}
+		data, err := r.load(includeRef)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: loading include %s", ref, include)
+		}
+		r.Sources = append(r.Sources, includeRef)
+		fragment, err := decodeConfigDocument(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: include %s", ref, include)
+		}
+		fragment, err = r.expandIncludes(fragment, includeRef, append(stack, includeRef))
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfig(merged, fragment)
+	}
+	return mergeConfig(merged, m), nil
+}
+
+// resolveInclude resolves an include against the reference of the
+// document including it. References with a scheme are used as they are,
+// and anything else is a path relative to a file:// or s3:// document.
+func resolveInclude(ref string, include string) (string, error) {
+	if strings.Contains(include, "://") {
+		return include, nil
+	}
+	for _, scheme := range []string{"file://", "s3://"} {
+		if strings.HasPrefix(ref, scheme) {
+			if path.IsAbs(include) {
+				if scheme == "s3://" {
+					return "", errors.Errorf("%s: s3 include must be relative: %s", ref, include)
+				}
+				return scheme + include, nil
+			}
+			return scheme + path.Join(path.Dir(ref[len(scheme):]), include), nil
+		}
+	}
+	return "", errors.Errorf("relative include %s needs a file:// or s3:// config", include)
+}
+
+// mergeConfig deep merges over onto base, as described for
+// ConfigRenderer. base is modified.
+func mergeConfig(base interface{}, over interface{}) interface{} {
+	switch o := over.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			// Nulls are kept, for an overlay to apply later
+			return o
+		}
+		for k, v := range o {
+			if v == nil {
+				delete(b, k)
+				continue
+			}
+			b[k] = mergeConfig(b[k], v)
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		key := itemKey(b)
+		if !ok || key == "" || itemKey(o) != key {
+			return o
+		}
+		for _, item := range o {
+			name := item.(map[string]interface{})[key]
+			found := false
+			for i := range b {
+				if b[i].(map[string]interface{})[key] == name {
+					b[i] = mergeConfig(b[i], item)
+					found = true
+					break
+				}
+			}
+			if !found {
+				b = append(b, item)
+			}
+		}
+		return b
+	}
+	return over
+}
+
+// dropNulls removes keys with null values, that no base had to remove.
+func dropNulls(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, i := range value {
+			if i == nil {
+				delete(value, k)
+			} else {
+				value[k] = dropNulls(i)
+			}
+		}
+	case []interface{}:
+		for n := range value {
+			value[n] = dropNulls(value[n])
+		}
+	}
+	return v
+}
+
+// itemKeys are the keys list items are merged by.
+var itemKeys = []string{"name", "group"}
+
+// itemKey returns the key that every item in a list of maps has a
+// string value for, if any.
+func itemKey(list []interface{}) string {
+	for _, key := range itemKeys {
+		keyed := len(list) > 0
+		for _, item := range list {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			if _, ok := m[key].(string); !ok {
+				keyed = false
+				break
+			}
+		}
+		if keyed {
+			return key
+		}
+	}
+	return ""
+}
+
+var configVarRef = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// interpolate replaces var and environment references throughout a
+// document, and removes its vars.
+func (r *ConfigRenderer) interpolate(doc interface{}) (interface{}, error) {
+	vars := make(map[string]interface{})
+	if m, ok := doc.(map[string]interface{}); ok {
+		if v, ok := m[ConfigVarsKey]; ok {
+			delete(m, ConfigVarsKey)
+			vm, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("vars: must be a map")
+			}
+			// Vars may refer to the environment, but not other vars
+			for _, name := range sortedDocKeys(vm) {
+				value, err := r.interpolateValue(vm[name], nil, ConfigVarsKey+"."+name)
+				if err != nil {
+					return nil, err
+				}
+				switch value.(type) {
+				case string, json.Number, bool:
+				default:
+					return nil, errors.Errorf("%s.%s: vars must be strings, numbers or booleans", ConfigVarsKey, name)
+				}
+				vars[name] = value
+			}
+		}
+	}
+	return r.interpolateValue(doc, vars, "")
+}
+
+func (r *ConfigRenderer) interpolateValue(v interface{}, vars map[string]interface{}, at string) (interface{}, error) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedDocKeys(value) {
+			i, err := r.interpolateValue(value[k], vars, joinSchemaPath(at, k))
+			if err != nil {
+				return nil, err
+			}
+			value[k] = i
+		}
+	case []interface{}:
+		for n := range value {
+			i, err := r.interpolateValue(value[n], vars, fmt.Sprintf("%s[%d]", at, n))
+			if err != nil {
+				return nil, err
+			}
+			value[n] = i
+		}
+	case string:
+		return r.interpolateString(value, vars, at)
+	}
+	return v, nil
+}
+
+func (r *ConfigRenderer) interpolateString(s string, vars map[string]interface{}, at string) (interface{}, error) {
+	// A lone var reference keeps the var's type, e.g. for a number
+	if m := configVarRef.FindStringSubmatch(s); m != nil && m[0] == s && !strings.HasPrefix(s, "$$") {
+		return r.lookupVar(m[1], vars, at)
+	}
+	var err error
+	out := configVarRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		value, lookupErr := r.lookupVar(ref[2:len(ref)-1], vars, at)
+		if lookupErr != nil {
+			if err == nil {
+				err = lookupErr
+			}
+			return ""
+		}
+		return fmt.Sprint(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *ConfigRenderer) lookupVar(name string, vars map[string]interface{}, at string) (interface{}, error) {
+	if strings.HasPrefix(name, "env:") {
+		value, ok := r.lookupEnv(name[4:])
+		if !ok {
+			return nil, errors.Errorf("%s: environment variable %s is not set", at, name[4:])
+		}
+		return value, nil
+	}
+	value, ok := vars[name]
+	if !ok {
+		return nil, errors.Errorf("%s: unknown var: %s", at, name)
+	}
+	return value, nil
+}
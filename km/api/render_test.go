@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRenderer(files map[string]string) *ConfigRenderer {
+	return &ConfigRenderer{
+		Load: func(ref string) ([]byte, error) {
+			data, ok := files[ref]
+			if !ok {
+				return nil, errors.Errorf("no such file: %s", ref)
+			}
+			return []byte(data), nil
+		},
+		LookupEnv: func(name string) (string, bool) {
+			if name == "KM_ENV" {
+				return "nonprod", true
+			}
+			return "", false
+		},
+	}
+}
+
+func renderToMap(t *testing.T, r *ConfigRenderer, ref string) map[string]interface{} {
+	data, err := r.Render(ref)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &doc))
+	return doc
+}
+
+var testRenderFiles = map[string]string{
+	"s3://config/issuer.yaml": `
+include:
+  - common/base.yaml
+  - s3://shared/roles.yaml
+vars:
+  account: "062921715532"
+  ttl: 3600
+name: fooproject_${env:KM_ENV}
+roles:
+  - name: deployment
+    valid_for_seconds: ${ttl}
+credentials:
+  - name: aws-admin
+    type: iam_assume_role
+    config:
+      target_role: arn:aws:iam::${account}:role/admin
+overlays:
+  prod:
+    vars:
+      account: "140374123517"
+    roles:
+      - name: developer
+        workflow: null
+      - name: breakglass
+        workflow: approval
+    audit: null
+`,
+	"s3://config/common/base.yaml": `
+version: "1.0"
+audit:
+  sink: stdout://
+workflow:
+  base_url: https://workflow.example.com/
+  policies: [{name: auto}]
+`,
+	"s3://shared/roles.yaml": `
+roles:
+  - name: deployment
+    workflow: auto
+    credentials: [aws-admin]
+    valid_for_seconds: 900
+  - name: developer
+    workflow: auto
+`,
+}
+
+func TestRenderConfig(t *testing.T) {
+	r := testRenderer(testRenderFiles)
+	doc := renderToMap(t, r, "s3://config/issuer.yaml")
+	assert.Equal(t, "fooproject_nonprod", doc["name"])
+	assert.Equal(t, "1.0", doc["version"])
+	// Named items are merged, and a lone var keeps its type
+	roles := doc["roles"].([]interface{})
+	assert.Len(t, roles, 2)
+	assert.Equal(t, map[string]interface{}{
+		"name":              "deployment",
+		"workflow":          "auto",
+		"credentials":       []interface{}{"aws-admin"},
+		"valid_for_seconds": float64(3600),
+	}, roles[0])
+	creds := doc["credentials"].([]interface{})
+	assert.Equal(t, "arn:aws:iam::062921715532:role/admin",
+		creds[0].(map[string]interface{})["config"].(map[string]interface{})["target_role"])
+	for _, key := range []string{ConfigIncludeKey, ConfigVarsKey, ConfigOverlaysKey} {
+		assert.NotContains(t, doc, key)
+	}
+	assert.Equal(t, []string{"s3://config/issuer.yaml", "s3://config/common/base.yaml", "s3://shared/roles.yaml"}, r.Sources)
+
+	// The rendered config parses
+	data, err := r.Render("s3://config/issuer.yaml")
+	assert.NoError(t, err)
+	config, err := ParseConfig(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "fooproject_nonprod", config.Name)
+	assert.Equal(t, 3600, config.FindRoleByName("deployment").ValidForSeconds)
+}
+
+func TestRenderConfigOverlay(t *testing.T) {
+	r := testRenderer(testRenderFiles)
+	r.Overlay = "prod"
+	doc := renderToMap(t, r, "s3://config/issuer.yaml")
+	creds := doc["credentials"].([]interface{})
+	assert.Equal(t, "arn:aws:iam::140374123517:role/admin",
+		creds[0].(map[string]interface{})["config"].(map[string]interface{})["target_role"])
+	assert.NotContains(t, doc, "audit")
+	roles := doc["roles"].([]interface{})
+	assert.Len(t, roles, 3)
+	assert.Equal(t, map[string]interface{}{"name": "developer"}, roles[1])
+	assert.Equal(t, map[string]interface{}{"name": "breakglass", "workflow": "approval"}, roles[2])
+
+	r.Overlay = "nope"
+	_, err := r.Render("s3://config/issuer.yaml")
+	assert.EqualError(t, err, "config has no overlay: nope")
+}
+
+func TestRenderConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		files  map[string]string
+		err    string
+	}{
+		{
+			name:   "unknown var",
+			config: "name: ${nope}",
+			err:    "name: unknown var: nope",
+		},
+		{
+			name:   "unset env",
+			config: "roles: [{name: a, workflow: '${env:NOPE}'}]",
+			err:    "roles[0].workflow: environment variable NOPE is not set",
+		},
+		{
+			name:   "vars refer to env only",
+			config: "vars: {a: x, b: '${a}'}\nname: ${b}",
+			err:    "vars.b: unknown var: a",
+		},
+		{
+			name:   "escaped",
+			config: "name: $${literal}",
+		},
+		{
+			name:   "missing include",
+			config: "include: [s3://nope/a.yaml]",
+			err:    "s3://config/test.yaml: loading include s3://nope/a.yaml: no such file: s3://nope/a.yaml",
+		},
+		{
+			name:   "cycle",
+			config: "include: [a.yaml]",
+			files: map[string]string{
+				"s3://config/a.yaml": "include: [b.yaml]",
+				"s3://config/b.yaml": "include: [a.yaml]",
+			},
+			err: "s3://config/b.yaml: include cycle: s3://config/test.yaml -> s3://config/a.yaml -> s3://config/b.yaml -> s3://config/a.yaml",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]string{"s3://config/test.yaml": test.config}
+			for k, v := range test.files {
+				files[k] = v
+			}
+			data, err := testRenderer(files).Render("s3://config/test.yaml")
+			if test.err == "" {
+				assert.NoError(t, err)
+				assert.JSONEq(t, `{"name": "${literal}"}`, string(data))
+				return
+			}
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestResolveInclude(t *testing.T) {
+	tests := []struct {
+		ref, include, expected string
+	}{
+		{"s3://bucket/env/issuer.yaml", "../common/idp.yaml", "s3://bucket/common/idp.yaml"},
+		{"file://config/issuer.yaml", "roles.yaml", "file://config/roles.yaml"},
+		{"file://issuer.yaml", "roles.yaml", "file://roles.yaml"},
+		{"file://config/issuer.yaml", "/etc/km/roles.yaml", "file:///etc/km/roles.yaml"},
+		{"data://abc", "s3://bucket/roles.yaml", "s3://bucket/roles.yaml"},
+	}
+	for _, test := range tests {
+		actual, err := resolveInclude(test.ref, test.include)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, actual)
+	}
+	_, err := resolveInclude("data://abc", "roles.yaml")
+	assert.Error(t, err)
+}
@@ -5,14 +5,37 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Request types
+const (
+	RequestTypeDiscovery      = "discovery"
+	RequestTypeConfig         = "config"
+	RequestTypeDirectSamlAuth = "direct_saml_auth"
+	RequestTypeDirectOidcAuth = "direct_oidc_auth"
+	RequestTypeWorkflowStart  = "workflow_start"
+	RequestTypeWorkflowAuth   = "workflow_auth"
+)
+
 type Request struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
+	Type string `json:"type"`
+	// Api version negotiated during discovery, empty for discovery itself
+	// and for clients from before the discovery handshake.
+	ApiVersion string      `json:"api_version,omitempty"`
+	Payload    interface{} `json:"payload"`
 }
 
-type DiscoveryRequest struct {}
+type DiscoveryRequest struct {
+	ClientVersion string   `json:"client_version"`
+	ApiVersions   []string `json:"api_versions"`
+}
 
-type DiscoveryResponse struct {}
+type DiscoveryResponse struct {
+	ServerVersion   string          `json:"server_version"`
+	ApiVersions     []string        `json:"api_versions"`
+	RequestTypes    []string        `json:"request_types"`
+	CredentialTypes []string        `json:"credential_types"`
+	IdpTypes        []string        `json:"idp_types"`
+	Features        map[string]bool `json:"features"`
+}
 
 type ConfigRequest struct {
 }
@@ -51,6 +74,33 @@ type WorkflowAuthRequest struct {
 	IssuingNonce string `json:"issuing_nonce"`
 	IdpNonce string `json:"idp_nonce"`
 	Assertions []string `json:"assertions"`
+	// CI job token (gitlab CI_JOB_JWT or github actions OIDC token),
+	// for roles requiring a CI identity
+	IdentityToken string `json:"identity_token,omitempty"`
+	// IP oracle token vouching for the requester's source address, for
+	// issuers enforcing source address whitelists
+	IpToken string `json:"ip_token,omitempty"`
+	// Set to request the role's break-glass policy in place of its
+	// workflow policy
+	BreakGlass *BreakGlassRequest `json:"break_glass,omitempty"`
+	// Where the request came from, e.g. a CI job, for the issuer's
+	// policy (if any). It's as the requester says.
+	Source *RequestSource `json:"source,omitempty"`
+}
+
+// RequestSource describes where a request came from, as for workflow.
+type RequestSource struct {
+	Description string `json:"description,omitempty"`
+	DetailsURI  string `json:"details_uri,omitempty"`
+}
+
+// MinJustificationLength is the shortest justification a break-glass
+// request may give.
+const MinJustificationLength = 10
+
+// BreakGlassRequest asks for emergency access, saying why.
+type BreakGlassRequest struct {
+	Justification string `json:"justification"`
 }
 
 type WorkflowAuthResponse struct {
@@ -59,27 +109,29 @@ type WorkflowAuthResponse struct {
 
 func (c *Request) UnmarshalJSON(data []byte) error {
 	var t struct {
-		Type    string          `json:"type"`
-		Payload json.RawMessage `json:"payload"`
+		Type       string          `json:"type"`
+		ApiVersion string          `json:"api_version"`
+		Payload    json.RawMessage `json:"payload"`
 	}
 	err := json.Unmarshal(data, &t)
 	if err != nil {
 		return err
 	}
 	c.Type = t.Type
+	c.ApiVersion = t.ApiVersion
 	var payload interface{}
 	switch c.Type {
-	case "discovery":
+	case RequestTypeDiscovery:
 		payload = &DiscoveryRequest{}
-	case "config":
+	case RequestTypeConfig:
 		payload = &ConfigRequest{}
-	case "direct_saml_auth":
+	case RequestTypeDirectSamlAuth:
 		payload = &DirectSamlAuthRequest{}
-	case "direct_oidc_auth":
+	case RequestTypeDirectOidcAuth:
 		payload = &DirectOidcAuthRequest{}
-	case "workflow_start":
+	case RequestTypeWorkflowStart:
 		payload = &WorkflowStartRequest{}
-	case "workflow_auth":
+	case RequestTypeWorkflowAuth:
 		payload = &WorkflowAuthRequest{}
 	default:
 		return errors.New("unknown operation type: " + c.Type)
@@ -10,10 +10,14 @@ func TestRequest_UnmarshalJSON(t *testing.T) {
 	testCases := map[string]Request{
 		"discovery": {
 			Type: "discovery",
-			Payload: &DiscoveryRequest{},
+			Payload: &DiscoveryRequest{
+				ClientVersion: "v1.0.0",
+				ApiVersions:   []string{"1"},
+			},
 		},
 		"config": {
 			Type: "config",
+			ApiVersion: "1",
 			Payload: &ConfigRequest{},
 		},
 		"direct_saml_auth": {
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RoleScheduleConfig restricts when a role may be used. Times are in the
+// schedule's timezone.
+type RoleScheduleConfig struct {
+	// Timezone is an IANA timezone name, e.g. Australia/Sydney, and
+	// defaults to UTC
+	Timezone string `json:"timezone,omitempty"`
+	// Windows are when the role may be used. Without any, it may be used
+	// at any time outside of blackouts.
+	Windows []TimeWindowConfig `json:"windows,omitempty"`
+	// Blackouts are periods (e.g. change freezes) when the role can't be
+	// used, even with escalation.
+	Blackouts []BlackoutConfig `json:"blackouts,omitempty"`
+	// OutsideWindows, if set, lets the role be used outside its windows
+	// with extra approvals. Otherwise it can't be.
+	OutsideWindows *RoleEscalationConfig `json:"outside_windows,omitempty"`
+}
+
+// TimeWindowConfig is a range of hours on some days of the week, e.g.
+// days [mon-fri] from 09:00 to 17:30. A window that ends before it starts
+// runs overnight, into the next day.
+type TimeWindowConfig struct {
+	// Days are mon, tue, ... sun, or ranges of them such as mon-fri
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// BlackoutConfig is a period a role can't be used in. Start and end are
+// RFC 3339 times, or dates or times (2006-01-02, 2006-01-02T15:04) in the
+// schedule's timezone. An end date is inclusive, a time is not.
+type BlackoutConfig struct {
+	Name  string `json:"name,omitempty"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// RoleEscalationConfig are approvals needed in addition to those of the
+// role's workflow policy.
+type RoleEscalationConfig struct {
+	ApproverRoles map[string]int `json:"approver_roles"`
+}
+
+// ScheduleDecision is what a role's schedule says about a time.
+type ScheduleDecision struct {
+	// InWindow is true if the time is in one of the role's windows, or
+	// the role has none
+	InWindow bool
+	// Blackout is the blackout the time is in, if any
+	Blackout *BlackoutConfig
+	// BlackoutEnd is when that blackout ends
+	BlackoutEnd time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Location loads the schedule's timezone.
+func (s *RoleScheduleConfig) Location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timezone %s", s.Timezone)
+	}
+	return loc, nil
+}
+
+// Evaluate checks a time against the schedule. Errors are only returned
+// for a broken schedule.
+func (s *RoleScheduleConfig) Evaluate(t time.Time) (*ScheduleDecision, error) {
+	loc, err := s.Location()
+	if err != nil {
+		return nil, err
+	}
+	t = t.In(loc)
+	decision := &ScheduleDecision{InWindow: len(s.Windows) == 0}
+	for i := range s.Blackouts {
+		start, end, err := s.Blackouts[i].period(loc)
+		if err != nil {
+			return nil, err
+		}
+		if !t.Before(start) && t.Before(end) {
+			decision.Blackout = &s.Blackouts[i]
+			decision.BlackoutEnd = end
+			break
+		}
+	}
+	for _, w := range s.Windows {
+		in, err := w.contains(t)
+		if err != nil {
+			return nil, err
+		}
+		if in {
+			decision.InWindow = true
+			break
+		}
+	}
+	return decision, nil
+}
+
+// ApproverRolesAt returns the approvals a request for a role needs at a
+// time: those of its workflow policy, and those of its schedule's
+// escalation if the time is outside its windows, in which case escalated
+// is true. An Error is returned if the role can't be used at that time.
+func (r *RoleConfig) ApproverRolesAt(policy *WorkflowPolicyConfig, t time.Time) (approvers map[string]int, escalated bool, err error) {
+	if r.Schedule == nil {
+		return policy.ApproverRoles, false, nil
+	}
+	decision, err := r.Schedule.Evaluate(t)
+	if err != nil {
+		return nil, false, WrapError(err, ErrorCodeConfiguration, "role schedule")
+	}
+	if decision.Blackout != nil {
+		name := decision.Blackout.Name
+		if name == "" {
+			name = "blackout"
+		}
+		return nil, false, NewError(ErrorCodeOutsideSchedule, "role %s can't be used during %s, until %s",
+			r.Name, name, decision.BlackoutEnd.Format(time.RFC3339)).
+			WithDetails(&ErrorDetails{Role: r.Name})
+	}
+	if decision.InWindow {
+		return policy.ApproverRoles, false, nil
+	}
+	if r.Schedule.OutsideWindows == nil {
+		return nil, false, NewError(ErrorCodeOutsideSchedule, "role %s can't be used outside its time windows", r.Name).
+			WithDetails(&ErrorDetails{Role: r.Name})
+	}
+	approvers = make(map[string]int)
+	for group, n := range policy.ApproverRoles {
+		approvers[group] = n
+	}
+	for group, n := range r.Schedule.OutsideWindows.ApproverRoles {
+		approvers[group] += n
+	}
+	return approvers, true, nil
+}
+
+func (w *TimeWindowConfig) contains(t time.Time) (bool, error) {
+	days, err := parseWeekdays(w.Days)
+	if err != nil {
+		return false, err
+	}
+	start, err := parseTimeOfDay(w.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseTimeOfDay(w.End)
+	if err != nil {
+		return false, err
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return days[t.Weekday()] && minute >= start && minute < end, nil
+	}
+	// Overnight, from start on one of the days until end the next day
+	yesterday := (t.Weekday() + 6) % 7
+	return (days[t.Weekday()] && minute >= start) || (days[yesterday] && minute < end), nil
+}
+
+// parseWeekdays parses days and ranges of days, e.g. [mon-fri, sun].
+func parseWeekdays(specs []string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, spec := range specs {
+		parts := strings.SplitN(strings.ToLower(spec), "-", 2)
+		first, ok := weekdays[parts[0]]
+		if !ok {
+			return nil, errors.Errorf("invalid day: %s", spec)
+		}
+		last := first
+		if len(parts) == 2 {
+			last, ok = weekdays[parts[1]]
+			if !ok {
+				return nil, errors.Errorf("invalid day: %s", spec)
+			}
+		}
+		// Ranges may wrap around the week, e.g. fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseTimeOfDay parses HH:MM (up to 24:00) into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, errors.Errorf("invalid time of day: %q, want HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("invalid time of day: %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// period returns the start and (exclusive) end of a blackout.
+func (b *BlackoutConfig) period(loc *time.Location) (time.Time, time.Time, error) {
+	start, _, err := parseScheduleTime(b.Start, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, isDate, err := parseScheduleTime(b.End, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if isDate {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, errors.Errorf("blackout %s ends before it starts", b.Name)
+	}
+	return start, end, nil
+}
+
+// parseScheduleTime parses an RFC 3339 time, or a local date or time,
+// reporting whether it was just a date.
+func parseScheduleTime(s string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, loc); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, errors.Errorf("invalid time: %q, want 2006-01-02, 2006-01-02T15:04 or RFC 3339", s)
+}
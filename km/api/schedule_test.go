@@ -0,0 +1,148 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleScheduleEvaluate(t *testing.T) {
+	schedule := &RoleScheduleConfig{
+		Timezone: "Australia/Sydney",
+		Windows: []TimeWindowConfig{
+			{Days: []string{"mon-fri"}, Start: "09:00", End: "17:30"},
+			// Overnight, wrapping around the week
+			{Days: []string{"sat-sun"}, Start: "22:00", End: "02:00"},
+		},
+		Blackouts: []BlackoutConfig{
+			{Name: "xmas", Start: "2026-12-24", End: "2026-12-26"},
+			{Start: "2026-11-02T12:00", End: "2026-11-02T13:00"},
+		},
+	}
+	sydney, err := schedule.Location()
+	assert.NoError(t, err)
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, sydney)
+		assert.NoError(t, err)
+		return tm
+	}
+	tests := []struct {
+		time     time.Time
+		inWindow bool
+		blackout string
+	}{
+		// Monday
+		{at("2026-11-02 09:00"), true, ""},
+		{at("2026-11-02 08:59"), false, ""},
+		{at("2026-11-02 17:30"), false, ""},
+		// In UTC this is 23:00 on Sunday
+		{time.Date(2026, 11, 1, 23, 0, 0, 0, time.UTC), true, ""},
+		{at("2026-11-02 12:30"), true, "blackout"},
+		{at("2026-11-02 13:00"), true, ""},
+		// Saturday night, into Sunday, and Sunday night into Monday
+		{at("2026-11-07 23:00"), true, ""},
+		{at("2026-11-08 01:59"), true, ""},
+		{at("2026-11-08 02:00"), false, ""},
+		{at("2026-11-09 01:00"), true, ""},
+		{at("2026-11-10 01:00"), false, ""},
+		// The end date is inclusive
+		{at("2026-12-23 23:59"), false, ""},
+		{at("2026-12-24 00:00"), false, "xmas"},
+		{at("2026-12-26 23:59"), true, "xmas"},
+		{at("2026-12-28 10:00"), true, ""},
+	}
+	for _, test := range tests {
+		decision, err := schedule.Evaluate(test.time)
+		assert.NoError(t, err)
+		assert.Equal(t, test.inWindow, decision.InWindow, "in window at %s", test.time)
+		if test.blackout == "" {
+			assert.Nil(t, decision.Blackout, "blackout at %s", test.time)
+			continue
+		}
+		if assert.NotNil(t, decision.Blackout, "blackout at %s", test.time) {
+			name := decision.Blackout.Name
+			if name == "" {
+				name = "blackout"
+			}
+			assert.Equal(t, test.blackout, name)
+		}
+	}
+
+	// Without windows a role can be used at any time
+	decision, err := (&RoleScheduleConfig{}).Evaluate(at("2026-11-07 03:00"))
+	assert.NoError(t, err)
+	assert.True(t, decision.InWindow)
+
+	_, err = (&RoleScheduleConfig{Timezone: "Nowhere/Special"}).Evaluate(time.Now())
+	assert.Error(t, err)
+}
+
+func TestRoleApproverRolesAt(t *testing.T) {
+	policy := &WorkflowPolicyConfig{Name: "approval", ApproverRoles: map[string]int{"ops": 1}}
+	role := &RoleConfig{
+		Name:     "deployment",
+		Workflow: "approval",
+		Schedule: &RoleScheduleConfig{
+			Windows:   []TimeWindowConfig{{Days: []string{"mon-fri"}, Start: "09:00", End: "17:00"}},
+			Blackouts: []BlackoutConfig{{Name: "freeze", Start: "2026-12-21", End: "2027-01-04"}},
+		},
+	}
+	monday := time.Date(2026, 11, 2, 10, 0, 0, 0, time.UTC)
+	saturday := time.Date(2026, 11, 7, 10, 0, 0, 0, time.UTC)
+
+	approvers, escalated, err := role.ApproverRolesAt(policy, monday)
+	assert.NoError(t, err)
+	assert.False(t, escalated)
+	assert.Equal(t, map[string]int{"ops": 1}, approvers)
+
+	_, _, err = role.ApproverRolesAt(policy, saturday)
+	assert.EqualError(t, err, "role deployment can't be used outside its time windows")
+	assert.Equal(t, ErrorCodeOutsideSchedule, ErrorCode(err))
+
+	role.Schedule.OutsideWindows = &RoleEscalationConfig{ApproverRoles: map[string]int{"ops": 1, "admins": 1}}
+	approvers, escalated, err = role.ApproverRolesAt(policy, saturday)
+	assert.NoError(t, err)
+	assert.True(t, escalated)
+	assert.Equal(t, map[string]int{"ops": 2, "admins": 1}, approvers)
+	// The policy itself isn't changed
+	assert.Equal(t, map[string]int{"ops": 1}, policy.ApproverRoles)
+
+	// Escalation doesn't get around a blackout
+	_, _, err = role.ApproverRolesAt(policy, time.Date(2026, 12, 25, 10, 0, 0, 0, time.UTC))
+	assert.EqualError(t, err, "role deployment can't be used during freeze, until 2027-01-05T00:00:00Z")
+	assert.Equal(t, ErrorCodeOutsideSchedule, ErrorCode(err))
+
+	// Roles without a schedule can always be used
+	role.Schedule = nil
+	approvers, escalated, err = role.ApproverRolesAt(policy, saturday)
+	assert.NoError(t, err)
+	assert.False(t, escalated)
+	assert.Equal(t, policy.ApproverRoles, approvers)
+}
+
+func TestLintSchedule(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	config.Roles[0].Schedule = &RoleScheduleConfig{
+		Timezone: "Nowhere/Special",
+		Windows: []TimeWindowConfig{
+			{Days: []string{"mon-fry"}, Start: "9:00", End: "17:00"},
+			{Start: "12:00", End: "12:00"},
+		},
+		Blackouts: []BlackoutConfig{
+			{Name: "freeze", Start: "2026-12-21", End: "2026-12-01"},
+			{Start: "tomorrow", End: "2026-12-01"},
+		},
+		OutsideWindows: &RoleEscalationConfig{ApproverRoles: map[string]int{"ops": 0}},
+	}
+	assert.Equal(t, []string{
+		"roles[deployment].schedule.timezone: invalid timezone Nowhere/Special: unknown time zone Nowhere/Special",
+		"roles[deployment].schedule.windows[0].days: invalid day: mon-fry",
+		"roles[deployment].schedule.windows[0].start: invalid time of day: \"9:00\", want HH:MM",
+		"roles[deployment].schedule.windows[1].days: no days",
+		"roles[deployment].schedule.windows[1]: window starts when it ends",
+		"roles[deployment].schedule.blackouts[freeze]: blackout freeze ends before it starts",
+		"roles[deployment].schedule.blackouts[1]: invalid time: \"tomorrow\", want 2006-01-02, 2006-01-02T15:04 or RFC 3339",
+		"roles[deployment].schedule.outside_windows.approver_roles.ops: impossible approval count 0",
+	}, problemErrors(config.Lint()))
+}
@@ -0,0 +1,369 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaDialect is the JSON Schema draft the config schema follows.
+const SchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema the config schema is written in.
+type Schema struct {
+	Dialect     string             `json:"$schema,omitempty"`
+	Ref         string             `json:"$ref,omitempty"`
+	Defs        map[string]*Schema `json:"$defs,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Const       interface{}        `json:"const,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	// AdditionalProperties is false for structs, and the value schema
+	// for maps
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	Items                *Schema     `json:"items,omitempty"`
+	AllOf                []*Schema   `json:"allOf,omitempty"`
+	AnyOf                []*Schema   `json:"anyOf,omitempty"`
+	If                   *Schema     `json:"if,omitempty"`
+	Then                 *Schema     `json:"then,omitempty"`
+}
+
+// schemaUnions are the structs whose config depends on their type.
+var schemaUnions = map[reflect.Type]map[string]func() interface{}{
+	reflect.TypeOf(IdpConfig{}):           IdpConfigTypes,
+	reflect.TypeOf(CredentialsConfig{}):   CredentialsConfigTypes,
+	reflect.TypeOf(CredentialsConfigV2{}): CredentialsConfigV2Types,
+}
+
+// schemaRequired are the properties that must be given, by struct.
+var schemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(IdpConfig{}):            {"name", "type"},
+	reflect.TypeOf(CredentialsConfig{}):    {"name", "type"},
+	reflect.TypeOf(RoleConfig{}):           {"name"},
+	reflect.TypeOf(WorkflowPolicyConfig{}): {"name"},
+	// Version 2 configs must say so
+	reflect.TypeOf(ConfigV2{}):               {"version"},
+	reflect.TypeOf(CredentialsConfigV2{}):    {"name", "type"},
+	reflect.TypeOf(RoleConfigV2{}):           {"name"},
+	reflect.TypeOf(WorkflowPolicyConfigV2{}): {"name"},
+	reflect.TypeOf(ApprovalGroupConfig{}):    {"group", "count"},
+}
+
+// schemaV1Forms are other forms structs may take in version 1 configs,
+// from before they were structs.
+var schemaV1Forms = map[reflect.Type]*Schema{
+	reflect.TypeOf(RoleClientDefaultsConfig{}): {Type: "string"},
+}
+
+// schemaRoots are the config structs of each config version.
+var schemaRoots = map[string]reflect.Type{
+	ConfigVersion1: reflect.TypeOf(Config{}),
+	ConfigVersion2: reflect.TypeOf(ConfigV2{}),
+}
+
+// ConfigSchema generates the JSON Schema of the current version of the
+// issuer config.
+func ConfigSchema() *Schema {
+	return ConfigSchemaFor(CurrentConfigVersion)
+}
+
+// ConfigSchemaFor generates the JSON Schema of a version of the issuer
+// config from its config structs, or returns nil for an unsupported
+// version. Idp and credential configs are unions discriminated by their
+// type. Unknown properties are not allowed.
+func ConfigSchemaFor(version string) *Schema {
+	t, ok := schemaRoots[version]
+	if !ok {
+		return nil
+	}
+	g := &schemaGenerator{version: version, defs: make(map[string]*Schema)}
+	root := g.define(t)
+	root.Dialect = SchemaDialect
+	root.Title = "Keymaster issuer configuration, version " + version
+	if version == ConfigVersion1 {
+		root.Properties["version"].Enum = []string{ConfigVersion1}
+	} else {
+		root.Properties["version"].Const = version
+	}
+	root.Defs = g.defs
+	return root
+}
+
+type schemaGenerator struct {
+	version string
+	defs    map[string]*Schema
+}
+
+// define returns the schema of a struct, with every struct it refers to
+// added to the definitions.
+func (g *schemaGenerator) define(t reflect.Type) *Schema {
+	s := &Schema{
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		Required:             schemaRequired[t],
+		AdditionalProperties: false,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schemaOf(f.Type)
+	}
+	if types, ok := schemaUnions[t]; ok {
+		var names []string
+		for name := range types {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		s.Properties["type"] = &Schema{Type: "string", Enum: names}
+		s.Properties["config"] = &Schema{Type: "object"}
+		for _, name := range names {
+			config := reflect.TypeOf(types[name]()).Elem()
+			s.AllOf = append(s.AllOf, &Schema{
+				If: &Schema{
+					Properties: map[string]*Schema{"type": {Const: name}},
+					Required:   []string{"type"},
+				},
+				Then: &Schema{
+					Properties: map[string]*Schema{"config": g.ref(config)},
+				},
+			})
+		}
+	}
+	return s
+}
+
+func (g *schemaGenerator) ref(t reflect.Type) *Schema {
+	if _, ok := g.defs[t.Name()]; !ok {
+		// Reserve the name first, in case of recursion
+		g.defs[t.Name()] = nil
+		g.defs[t.Name()] = g.define(t)
+	}
+	return &Schema{Ref: "#/$defs/" + t.Name()}
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schemaOf(t.Elem())
+	case reflect.Struct:
+		if form, ok := schemaV1Forms[t]; ok && g.version == ConfigVersion1 {
+			return &Schema{AnyOf: []*Schema{g.ref(t), form}}
+		}
+		return g.ref(t)
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	}
+	// Anything else (an interface) is unconstrained
+	return &Schema{}
+}
+
+// Validate checks a decoded JSON document (as decoded with UseNumber)
+// against the schema, returning a problem for each violation.
+func (s *Schema) Validate(doc interface{}) []ConfigProblem {
+	v := &schemaValidator{root: s}
+	v.validate(s, doc, "")
+	return v.problems
+}
+
+type schemaValidator struct {
+	root     *Schema
+	problems []ConfigProblem
+}
+
+func (v *schemaValidator) errorf(path string, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *schemaValidator) resolve(s *Schema) *Schema {
+	for s.Ref != "" {
+		s = v.root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+	return s
+}
+
+// matches reports whether doc is valid against s, without reporting
+// any problems.
+func (v *schemaValidator) matches(s *Schema, doc interface{}) bool {
+	sub := &schemaValidator{root: v.root}
+	sub.validate(s, doc, "")
+	return len(sub.problems) == 0
+}
+
+func (v *schemaValidator) validate(s *Schema, doc interface{}, path string) {
+	s = v.resolve(s)
+	if s.Type != "" && !hasSchemaType(doc, s.Type) {
+		v.errorf(path, "expected %s, not %s", s.Type, schemaTypeOf(doc))
+		return
+	}
+	if s.Const != nil && !reflect.DeepEqual(s.Const, doc) {
+		v.errorf(path, "must be %v", s.Const)
+	}
+	if s.Enum != nil {
+		str, _ := doc.(string)
+		found := false
+		for _, e := range s.Enum {
+			found = found || e == str
+		}
+		if !found {
+			v.errorf(path, "%v is not one of %s", doc, strings.Join(s.Enum, ", "))
+		}
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := d[name]; !ok {
+				v.errorf(joinSchemaPath(path, name), "required")
+			}
+		}
+		for _, name := range sortedDocKeys(d) {
+			p := joinSchemaPath(path, name)
+			if prop, ok := s.Properties[name]; ok {
+				v.validate(prop, d[name], p)
+				continue
+			}
+			switch ap := s.AdditionalProperties.(type) {
+			case bool:
+				if !ap {
+					v.errorf(p, "unknown field")
+				}
+			case *Schema:
+				v.validate(ap, d[name], p)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range d {
+				v.validate(s.Items, item, fmt.Sprintf("%s[%s]", path, itemName(item, i)))
+			}
+		}
+	}
+	for _, sub := range s.AllOf {
+		v.validate(sub, doc, path)
+	}
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			matched = matched || v.matches(sub, doc)
+		}
+		if !matched {
+			// Say what's wrong with it in the first, usual, form
+			v.validate(s.AnyOf[0], doc, path)
+		}
+	}
+	if s.If != nil && s.Then != nil && v.matches(s.If, doc) {
+		v.validate(s.Then, doc, path)
+	}
+}
+
+func hasSchemaType(doc interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := doc.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := doc.([]interface{})
+		return ok
+	case "string":
+		_, ok := doc.(string)
+		return ok
+	case "boolean":
+		_, ok := doc.(bool)
+		return ok
+	case "integer":
+		n, ok := doc.(json.Number)
+		if ok {
+			_, err := n.Int64()
+			return err == nil
+		}
+		return false
+	case "number":
+		_, ok := doc.(json.Number)
+		return ok
+	}
+	return true
+}
+
+func schemaTypeOf(doc interface{}) string {
+	switch doc.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", doc)
+}
+
+// itemName names a list item by its name, if it has one, as lint does.
+func itemName(item interface{}, i int) string {
+	if m, ok := item.(map[string]interface{}); ok {
+		if name, ok := m["name"].(string); ok && name != "" {
+			return name
+		}
+	}
+	return fmt.Sprint(i)
+}
+
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func sortedDocKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MarshalSchema renders the schema of a config version as indented
+// JSON.
+func MarshalSchema(version string) ([]byte, error) {
+	schema := ConfigSchemaFor(version)
+	if schema == nil {
+		return nil, errors.Errorf("unsupported version: %s", version)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(schema); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
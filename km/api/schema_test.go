@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchemaFor(ConfigVersion1)
+	assert.Equal(t, SchemaDialect, schema.Dialect)
+	assert.Equal(t, false, schema.AdditionalProperties)
+	assert.Equal(t, "#/$defs/RoleConfig", schema.Properties["roles"].Items.Ref)
+
+	// Every idp and credential type has its config in the union
+	idp := schema.Defs["IdpConfig"]
+	assert.Equal(t, []string{"github_oidc", "gitlab_jwt", "oidc", "saml"}, idp.Properties["type"].Enum)
+	assert.Len(t, idp.AllOf, len(IdpConfigTypes))
+	assert.Equal(t, "saml", idp.AllOf[3].If.Properties["type"].Const)
+	assert.Equal(t, "#/$defs/IdpConfigSaml", idp.AllOf[3].Then.Properties["config"].Ref)
+	assert.Len(t, schema.Defs["CredentialsConfig"].AllOf, len(CredentialsConfigTypes))
+	for name := range CredentialsConfigTypes {
+		assert.Contains(t, schema.Defs["CredentialsConfig"].Properties["type"].Enum, name)
+	}
+
+	// Maps are described by their values
+	policy := schema.Defs["WorkflowPolicyConfig"]
+	assert.Equal(t, &Schema{Type: "integer"}, policy.Properties["approver_roles"].AdditionalProperties)
+
+	data, err := MarshalSchema(ConfigVersion1)
+	assert.NoError(t, err)
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, SchemaDialect, doc["$schema"])
+	assert.Equal(t, false, doc["additionalProperties"])
+
+	_, err = MarshalSchema("3")
+	assert.EqualError(t, err, "unsupported version: 3")
+}
+
+func TestConfigSchemaV2(t *testing.T) {
+	schema := ConfigSchema()
+	assert.Equal(t, ConfigVersion2, schema.Properties["version"].Const)
+	assert.Equal(t, []string{"version"}, schema.Required)
+	assert.Equal(t, "#/$defs/RoleConfigV2", schema.Properties["roles"].Items.Ref)
+	assert.Contains(t, schema.Defs["RoleConfigV2"].Properties, "policy")
+	assert.NotContains(t, schema.Defs["RoleConfigV2"].Properties, "workflow")
+	assert.Equal(t, []string{"iam", "iam_user", "kube", "ssh"},
+		schema.Defs["CredentialsConfigV2"].Properties["type"].Enum)
+	approvers := schema.Defs["WorkflowPolicyConfigV2"].Properties["approvers"]
+	assert.Equal(t, "#/$defs/ApprovalGroupConfig", approvers.Items.Ref)
+}
+
+func TestParseConfigSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		problems []string
+	}{
+		{
+			name: "valid",
+			config: `
+name: nonprod
+roles:
+- name: deployment
+  workflow: auto
+  valid_for_seconds: 3600
+workflow:
+  policies:
+  - name: auto
+`,
+		},
+		{
+			name: "typo",
+			config: `
+roles:
+- name: deployment
+  valid_for_second: 3600
+`,
+			problems: []string{"roles[deployment].valid_for_second: unknown field"},
+		},
+		{
+			name: "unknown top level field",
+			config: `
+name: nonprod
+rolse: []
+`,
+			problems: []string{"rolse: unknown field"},
+		},
+		{
+			name: "idp config",
+			config: `
+idp:
+- name: corp
+  type: saml
+  config:
+    certficate: foo
+`,
+			problems: []string{"idp[corp].config.certficate: unknown field"},
+		},
+		{
+			name: "credential config",
+			config: `
+credentials:
+- name: aws
+  type: iam_assume_role
+  config:
+    ca_key: foo
+`,
+			problems: []string{"credentials[aws].config.ca_key: unknown field"},
+		},
+		{
+			name: "unknown type",
+			config: `
+idp:
+- name: corp
+  type: ldap
+`,
+			problems: []string{"idp[corp].type: ldap is not one of github_oidc, gitlab_jwt, oidc, saml"},
+		},
+		{
+			name: "wrong types",
+			config: `
+roles:
+- name: deployment
+  valid_for_seconds: 1.5
+  credentials: aws
+`,
+			problems: []string{
+				"roles[deployment].credentials: expected array, not string",
+				"roles[deployment].valid_for_seconds: expected integer, not number",
+			},
+		},
+		{
+			name: "missing name",
+			config: `
+roles:
+- workflow: auto
+`,
+			problems: []string{"roles[0].name: required"},
+		},
+		{
+			name:     "unsupported version",
+			config:   `version: "3"`,
+			problems: []string{"version: unsupported version: 3 (supported: 1.0, 2)"},
+		},
+		{
+			name: "version 1 fields in version 2",
+			config: `
+version: "2"
+roles:
+- name: deployment
+  workflow: auto
+credentials:
+- name: ssh
+  type: ssh_ca
+`,
+			problems: []string{
+				"credentials[ssh].type: ssh_ca is not one of iam, iam_user, kube, ssh",
+				"roles[deployment].workflow: unknown field",
+			},
+		},
+		{
+			name: "version 2 fields in version 1",
+			config: `
+version: "1.0"
+roles:
+- name: deployment
+  policy: auto
+`,
+			problems: []string{"roles[deployment].policy: unknown field"},
+		},
+		{
+			name: "version 1 client defaults",
+			config: `
+roles:
+- name: deployment
+  client_defaults: default
+- name: admin
+  client_defaults: {aws_profile_name: admin, profile_nmae: admin}
+`,
+			problems: []string{"roles[admin].client_defaults.profile_nmae: unknown field"},
+		},
+		{
+			name: "version 1 client defaults in version 2",
+			config: `
+version: "2"
+roles:
+- name: deployment
+  client_defaults: default
+`,
+			problems: []string{"roles[deployment].client_defaults: expected object, not string"},
+		},
+		{
+			name:     "json",
+			config:   `{"name": "nonprod", "roles": [{"name": "deployment", "valid_for_secnods": 900}]}`,
+			problems: []string{"roles[deployment].valid_for_secnods: unknown field"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseConfig([]byte(test.config))
+			if test.problems == nil {
+				assert.NoError(t, err)
+				assert.NotNil(t, config)
+				return
+			}
+			assert.Nil(t, config)
+			errs, ok := err.(ConfigErrors)
+			if assert.True(t, ok, "%v", err) {
+				var problems []string
+				for _, p := range errs {
+					problems = append(problems, p.Path+": "+p.Message)
+				}
+				assert.Equal(t, test.problems, problems)
+			}
+		})
+	}
+}
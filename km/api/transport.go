@@ -0,0 +1,237 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Transport carries a marshalled api.Request envelope to an issuer and
+// returns the marshalled response.
+type Transport interface {
+	RoundTrip(payload []byte) ([]byte, error)
+}
+
+// NewTransport returns a transport for an issuer target: an https:// (or
+// http://) URL for an issuer served over HTTP, otherwise a lambda
+// function name or ARN.
+func NewTransport(target string) (Transport, error) {
+	if IsHttpTarget(target) {
+		return NewHttpTransport(target)
+	}
+	return NewLambdaTransport(target), nil
+}
+
+// IsHttpTarget reports whether an issuer target is a URL.
+func IsHttpTarget(target string) bool {
+	return strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://")
+}
+
+type LambdaTransport struct {
+	//    * Function name - my-function (name-only), my-function:v1 (with alias).
+	//    * Function ARN - arn:aws:lambda:us-west-2:123456789012:function:my-function.
+	//    * Partial ARN - 123456789012:function:my-function.
+	FunctionName string
+	// RetryInterval and MaxAttempts are as per HttpTransport
+	RetryInterval time.Duration
+	MaxAttempts   int
+	lambdaClient  lambdaiface.LambdaAPI
+}
+
+func NewLambdaTransport(functionName string) *LambdaTransport {
+	t := new(LambdaTransport)
+	_, disableSSL := os.LookupEnv("KM_DISABLE_SSL")
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			EndpointResolver: endpoints.ResolverFunc(util.EndpointResolver),
+			DisableSSL:       &disableSSL,
+		},
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	t.FunctionName = functionName
+	t.lambdaClient = lambda.New(sess) // TODO: region? Or can that come from env?
+	return t
+}
+
+func (t *LambdaTransport) RoundTrip(payload []byte) ([]byte, error) {
+	interval, maxAttempts := retrySettings(t.RetryInterval, t.MaxAttempts)
+	// Loop spins until a non-retryable error occurs, or the attempts run out
+	for attempt := 1; ; attempt++ {
+		result, err := t.lambdaClient.Invoke(&lambda.InvokeInput{
+			FunctionName: aws.String(t.FunctionName),
+			Payload:      payload,
+		})
+		if err != nil {
+			if isRetryableLambdaException(err) && attempt < maxAttempts {
+				log.Printf("rpc: retryable error: %v, waiting for: %v", err, interval)
+				time.Sleep(interval)
+				interval *= 2
+				continue // Retry
+			}
+			return nil, errors.Wrap(err, "rpc invoke")
+		}
+		if err = isLambdaError(result); err != nil {
+			return nil, errors.Wrap(err, "rpc error")
+		}
+		return result.Payload, nil
+	}
+}
+
+func isLambdaError(resp *lambda.InvokeOutput) error {
+	if resp.FunctionError != nil {
+		return errors.Errorf("function error: %s: response payload: %s",
+			*resp.FunctionError, string(resp.Payload))
+	} else if *resp.StatusCode != 200 {
+		return errors.Errorf("bad status code: %d, response payload: %s",
+			*resp.StatusCode, string(resp.Payload))
+	}
+	return nil
+}
+
+func isRetryableLambdaException(e error) bool {
+	switch e.(type) {
+	default:
+		return false
+	case *lambda.ResourceNotReadyException:
+		return true
+	case *lambda.TooManyRequestsException:
+		return true
+	case *lambda.EC2ThrottledException:
+		return true
+	}
+}
+
+// HttpTransport posts request envelopes to an issuer served over HTTP,
+// by keymaster-server or behind API Gateway.
+type HttpTransport struct {
+	URL        string
+	HttpClient *http.Client
+	// RetryInterval is the first wait before retrying a retryable status,
+	// RpcRetryInterval if zero
+	RetryInterval time.Duration
+	// MaxAttempts is how many times a request is tried, RpcMaxAttempts if
+	// zero
+	MaxAttempts int
+}
+
+// NewHttpTransport returns a transport for an issuer URL. TLS can be
+// configured from the environment:
+//   KM_TLS_CA_CERT     CA bundle to verify the issuer with, instead of the system roots
+//   KM_TLS_CLIENT_CERT client certificate, for issuers requiring mTLS
+//   KM_TLS_CLIENT_KEY  client certificate key
+// Each is loaded with util.Load, so may be a file, s3 object or literal.
+func NewHttpTransport(url string) (*HttpTransport, error) {
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &HttpTransport{
+		URL: url,
+		HttpClient: &http.Client{
+			Timeout: 60 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}, nil
+}
+
+func tlsConfigFromEnv() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if caCert := os.Getenv("KM_TLS_CA_CERT"); caCert != "" {
+		data, err := util.Load(caCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading KM_TLS_CA_CERT")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in KM_TLS_CA_CERT")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	clientCert, clientKey := os.Getenv("KM_TLS_CLIENT_CERT"), os.Getenv("KM_TLS_CLIENT_KEY")
+	if clientCert != "" || clientKey != "" {
+		certData, err := util.Load(clientCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading KM_TLS_CLIENT_CERT")
+		}
+		keyData, err := util.Load(clientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading KM_TLS_CLIENT_KEY")
+		}
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (t *HttpTransport) RoundTrip(payload []byte) ([]byte, error) {
+	interval, maxAttempts := retrySettings(t.RetryInterval, t.MaxAttempts)
+	// Loop spins until a non-retryable error occurs, or the attempts run out
+	for attempt := 1; ; attempt++ {
+		resp, err := t.HttpClient.Post(t.URL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return nil, errors.Wrap(err, "rpc post")
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "rpc read")
+		}
+		if resp.StatusCode != http.StatusOK {
+			if apiErr := decodeErrorResponse(body); apiErr != nil {
+				return nil, apiErr
+			}
+		}
+		if isRetryableStatus(resp.StatusCode) && attempt < maxAttempts {
+			log.Printf("rpc: retryable status: %d, waiting for: %v", resp.StatusCode, interval)
+			time.Sleep(interval)
+			interval *= 2
+			continue // Retry
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Wrap(errors.Errorf("bad status code: %d, response payload: %s",
+				resp.StatusCode, string(body)), "rpc error")
+		}
+		return body, nil
+	}
+}
+
+// retrySettings defaults a transport's first retry interval and maximum
+// attempts.
+func retrySettings(interval time.Duration, maxAttempts int) (time.Duration, int) {
+	if interval == 0 {
+		interval = RpcRetryInterval
+	}
+	if maxAttempts == 0 {
+		maxAttempts = RpcMaxAttempts
+	}
+	return interval, maxAttempts
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
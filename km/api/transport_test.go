@@ -0,0 +1,124 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	transport, err := NewTransport("https://keymaster.example.com/api")
+	assert.NoError(t, err)
+	assert.IsType(t, &HttpTransport{}, transport)
+
+	transport, err = NewTransport("arn:aws:lambda:ap-southeast-2:123456789012:function:km")
+	assert.NoError(t, err)
+	assert.IsType(t, &LambdaTransport{}, transport)
+}
+
+func TestHttpTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errorMessage":"broken"}`))
+			return
+		}
+		if r.URL.Path == "/limited" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"code":"rate_limited","message":"rate limited","retryable":true,"retry_after_seconds":60}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"server_version":"test","api_versions":["1"]}`))
+	}))
+	defer srv.Close()
+
+	client := &Client{
+		Target:    srv.URL,
+		Transport: &HttpTransport{URL: srv.URL, HttpClient: srv.Client()},
+	}
+	resp, err := client.Negotiate()
+	assert.NoError(t, err)
+	assert.Equal(t, "test", resp.ServerVersion)
+
+	client.Transport = &HttpTransport{URL: srv.URL + "/broken", HttpClient: srv.Client()}
+	_, err = client.Discovery(&DiscoveryRequest{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad status code: 500")
+	assert.Contains(t, err.Error(), "broken")
+
+	// A 429 with an error is the issuer's, not a proxy's throttling, so
+	// it's returned rather than retried
+	client.Transport = &HttpTransport{URL: srv.URL + "/limited", HttpClient: srv.Client()}
+	_, err = client.Discovery(&DiscoveryRequest{})
+	assert.Equal(t, ErrorCodeRateLimited, ErrorCode(err))
+	assert.Equal(t, time.Minute, RetryAfter(err))
+}
+
+func TestHttpTransportRetries(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.URL.Path == "/recovers" && attempts == 3 {
+			_, _ = w.Write([]byte(`{"server_version":"test","api_versions":["1"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`unavailable`))
+	}))
+	defer srv.Close()
+
+	transport := &HttpTransport{URL: srv.URL + "/recovers", HttpClient: srv.Client(), RetryInterval: time.Millisecond}
+	_, err := transport.RoundTrip([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// A proxy that never recovers gives up with its last response
+	attempts = 0
+	transport = &HttpTransport{URL: srv.URL, HttpClient: srv.Client(), RetryInterval: time.Millisecond, MaxAttempts: 4}
+	_, err = transport.RoundTrip([]byte(`{}`))
+	assert.EqualError(t, err, "rpc error: bad status code: 503, response payload: unavailable")
+	assert.Equal(t, 4, attempts)
+}
+
+// throttledLambda fails invocations with throttling until it has been
+// invoked failures times.
+type throttledLambda struct {
+	lambdaiface.LambdaAPI
+	failures int
+	invokes  int
+}
+
+func (f *throttledLambda) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	f.invokes++
+	if f.invokes <= f.failures {
+		return nil, &lambda.TooManyRequestsException{Message_: aws.String("slow down")}
+	}
+	return &lambda.InvokeOutput{StatusCode: aws.Int64(200), Payload: []byte(`{}`)}, nil
+}
+
+func TestLambdaTransportRetries(t *testing.T) {
+	fake := &throttledLambda{failures: 2}
+	transport := &LambdaTransport{FunctionName: "km", RetryInterval: time.Millisecond, lambdaClient: fake}
+	payload, err := transport.RoundTrip([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{}`), payload)
+	assert.Equal(t, 3, fake.invokes)
+
+	// Throttled for good, it gives up with the last error
+	fake = &throttledLambda{failures: 10}
+	transport = &LambdaTransport{FunctionName: "km", RetryInterval: time.Millisecond, MaxAttempts: 4, lambdaClient: fake}
+	_, err = transport.RoundTrip([]byte(`{}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "rpc invoke")
+	assert.Equal(t, 4, fake.invokes)
+}
@@ -0,0 +1,696 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bounds on role valid_for_seconds for iam_assume_role credentials, as
+// per the STS AssumeRole limits.
+const (
+	MinValidForSeconds = 900
+	MaxValidForSeconds = 43200
+	// SSH certificates are capped by the issuer (creds.MaxValidForSeconds)
+	MaxSSHValidForSeconds = 7 * 24 * 3600
+	// Break-glass credentials are short lived
+	MaxBreakGlassValidForSeconds = 3600
+)
+
+// validForBounds are the valid_for_seconds each credential type can be
+// issued for. Types without bounds need only a positive period.
+var validForBounds = map[string]struct{ min, max int }{
+	"iam_assume_role": {MinValidForSeconds, MaxValidForSeconds},
+	"ssh_ca":          {1, MaxSSHValidForSeconds},
+}
+
+var (
+	iamRoleArnRe  = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/[\w+=,.@/-]+$`)
+	iamRoleNameRe = regexp.MustCompile(`^[\w+=,.@-]{1,64}$`)
+	kmsKeyArnRe   = regexp.MustCompile(`^arn:aws[a-z-]*:kms:[a-z0-9-]+:\d{12}:(key/[0-9a-f-]+|alias/[\w/-]+)$`)
+	kmsKeyIdRe    = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	kmsAliasRe    = regexp.MustCompile(`^alias/[\w/-]+$`)
+)
+
+// ConfigProblem is something wrong with a config.
+type ConfigProblem struct {
+	// Path locates the problem, e.g. "roles[deployment].workflow"
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	// Warnings are reported by lint, but don't stop a config loading
+	Warning bool `json:"warning,omitempty"`
+}
+
+func (p ConfigProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Path == "" {
+		return fmt.Sprintf("%s: %s", level, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", level, p.Path, p.Message)
+}
+
+// ConfigErrors is returned by Validate, with every error found.
+type ConfigErrors []ConfigProblem
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, p := range e {
+		msgs[i] = p.Path + ": " + p.Message
+		if p.Path == "" {
+			msgs[i] = p.Message
+		}
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+type linter struct {
+	problems []ConfigProblem
+}
+
+func (l *linter) errorf(path string, format string, args ...interface{}) {
+	l.problems = append(l.problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(path string, format string, args ...interface{}) {
+	l.problems = append(l.problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// names records the names in a list, reporting empty and duplicate ones.
+func (l *linter) names(kind string, names []string) map[string]bool {
+	seen := make(map[string]bool)
+	for i, name := range names {
+		if name == "" {
+			l.errorf(fmt.Sprintf("%s[%d]", kind, i), "missing name")
+			continue
+		}
+		if seen[name] {
+			l.errorf(fmt.Sprintf("%s[%s]", kind, name), "duplicate name")
+		}
+		seen[name] = true
+	}
+	return seen
+}
+
+// Lint checks a config is consistent: that names are unique, references
+// resolve, and ARNs, CIDRs, urls and durations are well formed. It
+// doesn't load anything; see CheckCAKeys for that.
+func (c *Config) Lint() []ConfigProblem {
+	l := &linter{}
+	supported := false
+	for _, v := range SupportedConfigVersions {
+		supported = supported || c.Version == v
+	}
+	if !supported {
+		l.errorf("version", "unsupported version: %s", c.Version)
+	}
+	if c.Name == "" {
+		l.errorf("name", "missing name")
+	}
+
+	var idpNames, credNames, policyNames, roleNames []string
+	for _, idp := range c.Idp {
+		idpNames = append(idpNames, idp.Name)
+	}
+	for _, cred := range c.Credentials {
+		credNames = append(credNames, cred.Name)
+	}
+	for _, policy := range c.Workflow.Policies {
+		policyNames = append(policyNames, policy.Name)
+	}
+	for _, role := range c.Roles {
+		roleNames = append(roleNames, role.Name)
+	}
+	l.names("idp", idpNames)
+	l.names("credentials", credNames)
+	l.names("workflow.policies", policyNames)
+	l.names("roles", roleNames)
+
+	c.lintIdps(l)
+	c.lintCredentials(l)
+	c.lintWorkflow(l)
+	c.lintRoles(l)
+	c.lintAccessControl(l)
+	c.lintAudit(l)
+	c.lintPolicy(l)
+	c.lintLimits(l)
+	if c.Version == ConfigVersion2 {
+		// Problems are where they are in the config file
+		for i := range l.problems {
+			l.problems[i].Path = v2ProblemPath(l.problems[i].Path)
+		}
+	}
+	return l.problems
+}
+
+// Validate returns the errors Lint finds as ConfigErrors, ignoring
+// warnings.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	for _, p := range c.Lint() {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) lintIdps(l *linter) {
+	for _, idp := range c.Idp {
+		p := fmt.Sprintf("idp[%s]", idp.Name)
+		switch i := idp.Config.(type) {
+		case *IdpConfigSaml:
+			if i.Certificate == "" {
+				l.errorf(p+".config.certificate", "missing certificate")
+			}
+			if i.RedirectURI != "" {
+				lintUrl(l, p+".config.redirect_uri", i.RedirectURI)
+			}
+		case *IdpConfigOidc:
+			l.warnf(p, "oidc idps are not implemented")
+		case *IdpConfigGitlabJwt:
+			if i.Issuer != "" {
+				lintUrl(l, p+".config.issuer", i.Issuer)
+			}
+			if i.JwksUrl != "" {
+				lintUrl(l, p+".config.jwks_url", i.JwksUrl)
+			}
+		case *IdpConfigGithubOidc:
+			// Any workflow can ask GitHub for a token, so the audience is
+			// all that says it was meant for this issuer
+			if i.Audience == "" {
+				l.errorf(p+".config.audience", "missing audience")
+			}
+			if i.Issuer != "" {
+				lintUrl(l, p+".config.issuer", i.Issuer)
+			}
+			if i.JwksUrl != "" {
+				lintUrl(l, p+".config.jwks_url", i.JwksUrl)
+			}
+		}
+	}
+}
+
+func (c *Config) lintCredentials(l *linter) {
+	for _, cred := range c.Credentials {
+		p := fmt.Sprintf("credentials[%s].config", cred.Name)
+		switch cc := cred.Config.(type) {
+		case *CredentialsConfigSSH:
+			lintCAKey(l, p+".ca_key", cc.CAKey)
+			if len(cc.Principals) == 0 {
+				l.errorf(p+".principals", "missing principals")
+			}
+		case *CredentialsConfigKube:
+			if cc.CACert == "" {
+				l.errorf(p+".ca_cert", "missing ca cert")
+			}
+			lintCAKey(l, p+".ca_key", cc.CAKey)
+		case *CredentialsConfigIAMAssumeRole:
+			switch {
+			case cc.TargetRole == "":
+				l.errorf(p+".target_role", "missing target role")
+			case strings.HasPrefix(cc.TargetRole, "arn:"):
+				if !iamRoleArnRe.MatchString(cc.TargetRole) {
+					l.errorf(p+".target_role", "invalid iam role arn: %s", cc.TargetRole)
+				}
+			case !iamRoleNameRe.MatchString(cc.TargetRole):
+				l.errorf(p+".target_role", "invalid iam role name: %s", cc.TargetRole)
+			}
+		case *CredentialsConfigIAMUser:
+			l.warnf(p, "iam_user credentials are not implemented")
+		}
+	}
+}
+
+func (c *Config) lintWorkflow(l *linter) {
+	if c.Workflow.BaseUrl != "" {
+		lintUrl(l, "workflow.base_url", c.Workflow.BaseUrl)
+	}
+	for _, policy := range c.Workflow.Policies {
+		p := fmt.Sprintf("workflow.policies[%s]", policy.Name)
+		needsIdp := len(policy.IdentifyRoles) > 0 || len(policy.ApproverRoles) > 0
+		if policy.IdpName != "" || needsIdp {
+			idp := c.FindIdpByName(policy.IdpName)
+			if idp == nil {
+				l.errorf(p+".idp_name", "no such idp: %q", policy.IdpName)
+			} else if idp.Type != "saml" {
+				l.errorf(p+".idp_name", "idp %s is %s, approvals need a saml idp", idp.Name, idp.Type)
+			}
+		}
+		for _, group := range sortedKeys(policy.IdentifyRoles) {
+			if n := policy.IdentifyRoles[group]; n != 1 {
+				l.errorf(p+".identify_roles."+group, "must be 1, not %d", n)
+			}
+		}
+		for _, group := range sortedKeys(policy.ApproverRoles) {
+			if n := policy.ApproverRoles[group]; n < 1 {
+				l.errorf(p+".approver_roles."+group, "impossible approval count %d", n)
+			}
+		}
+		if len(policy.IdentifyRoles) > 0 {
+			l.warnf(p+".identify_roles", "identify roles are not implemented")
+		}
+		if len(policy.ApproverRoles) > 1 {
+			l.warnf(p+".approver_roles", "multiple approver groups are not implemented")
+		}
+	}
+}
+
+func (c *Config) lintRoles(l *linter) {
+	for _, role := range c.Roles {
+		p := fmt.Sprintf("roles[%s]", role.Name)
+		if role.Workflow == "" {
+			l.errorf(p+".workflow", "missing workflow policy")
+		} else if c.Workflow.FindPolicyByName(role.Workflow) == nil {
+			l.errorf(p+".workflow", "no such workflow policy: %s", role.Workflow)
+		}
+		if len(role.Credentials) == 0 {
+			l.warnf(p+".credentials", "no credentials")
+		}
+		for _, credName := range role.Credentials {
+			if c.FindCredentialByName(credName) == nil {
+				l.errorf(p+".credentials", "no such credential: %s", credName)
+			}
+		}
+		c.lintValidFor(l, p+".valid_for_seconds", &role)
+		if key := role.CredentialDelivery.KmsWrapWith; key != "" && !isKMSKey(key) {
+			l.errorf(p+".credential_delivery.kms_wrap_with", "invalid kms key arn, alias or id: %s", key)
+		}
+		if role.CIIdentity != nil {
+			c.lintCIIdentity(l, p+".ci_identity", role.CIIdentity)
+		}
+		if role.Schedule != nil {
+			lintSchedule(l, p+".schedule", role.Schedule)
+		}
+		if role.BreakGlass != nil {
+			c.lintBreakGlass(l, p+".break_glass", &role)
+		}
+		if role.Eligibility != nil {
+			c.lintEligibility(l, p+".eligibility", &role)
+		}
+		if role.Limits != nil {
+			lintRoleLimits(l, p+".limits", &role)
+		}
+	}
+}
+
+// lintValidFor checks a role's valid_for_seconds against the bounds of
+// each of its credential types.
+func (c *Config) lintValidFor(l *linter, p string, role *RoleConfig) {
+	if role.ValidForSeconds <= 0 {
+		l.errorf(p, "%d is not positive", role.ValidForSeconds)
+		return
+	}
+	for _, credName := range role.Credentials {
+		cred := c.FindCredentialByName(credName)
+		if cred == nil {
+			continue
+		}
+		bounds, ok := validForBounds[cred.Type]
+		if !ok {
+			continue
+		}
+		if role.ValidForSeconds < bounds.min || role.ValidForSeconds > bounds.max {
+			l.errorf(p, "%d is not between %d and %d, as %s credential %s needs",
+				role.ValidForSeconds, bounds.min, bounds.max, cred.Type, credName)
+		}
+	}
+}
+
+func (c *Config) lintCIIdentity(l *linter, p string, ci *RoleCIIdentityConfig) {
+	idp := c.FindIdpByName(ci.IdpName)
+	if idp == nil {
+		l.errorf(p+".idp_name", "no such idp: %q", ci.IdpName)
+	} else if scoping, ok := ciScopingClaims[idp.Type]; !ok {
+		l.errorf(p+".idp_name", "idp %s is %s, not a ci idp", idp.Name, idp.Type)
+	} else if len(ci.Claims) == 0 {
+		l.errorf(p+".claims", "no claims, any job can match")
+	} else if !scopesCIClaims(ci.Claims, scoping) {
+		l.errorf(p+".claims", "none of %s, so jobs from any repository can match", strings.Join(scoping, ", "))
+	}
+	for _, claim := range sortedListKeys(ci.Claims) {
+		if len(ci.Claims[claim]) == 0 {
+			l.errorf(p+".claims."+claim, "no patterns, nothing can match")
+		}
+		for _, pattern := range ci.Claims[claim] {
+			if _, err := path.Match(pattern, ""); err != nil {
+				l.errorf(p+".claims."+claim, "invalid pattern %q: %s", pattern, err)
+			}
+		}
+	}
+}
+
+// ciScopingClaims are the claims of each ci idp's tokens that say which
+// repositories (or projects) a job may come from. The default issuers
+// are public, so a CI identity must match at least one.
+var ciScopingClaims = map[string][]string{
+	"gitlab_jwt":  {"project_path", "project_id", "namespace_path", "namespace_id"},
+	"github_oidc": {"repository", "repository_id", "repository_owner", "repository_owner_id"},
+}
+
+// scopesCIClaims reports whether claims match some scoping claim with
+// patterns that don't match anything.
+func scopesCIClaims(claims map[string][]string, scoping []string) bool {
+	for _, claim := range scoping {
+		patterns := claims[claim]
+		if len(patterns) > 0 && !contains(patterns, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) lintEligibility(l *linter, p string, role *RoleConfig) {
+	e := role.Eligibility
+	if len(e.AllowGroups) == 0 && len(e.CIIdentities) == 0 {
+		l.errorf(p, "no allow_groups or ci_identities, nobody is eligible")
+	}
+	if len(e.DenyGroups) > 0 && len(e.AllowGroups) == 0 {
+		l.errorf(p+".deny_groups", "deny_groups are exceptions to allow_groups, which are missing")
+	}
+	for _, group := range e.DenyGroups {
+		if contains(e.AllowGroups, group) {
+			l.errorf(p+".deny_groups", "%s is also in allow_groups", group)
+		}
+	}
+	for _, group := range append(append([]string{}, e.AllowGroups...), e.DenyGroups...) {
+		if strings.TrimSpace(group) == "" {
+			l.errorf(p, "empty group name")
+		}
+	}
+	if policy := c.Workflow.FindPolicyByName(role.Workflow); policy != nil && len(e.AllowGroups) > 0 {
+		if idp := c.FindIdpByName(policy.IdpName); idp == nil || idp.Type != "saml" {
+			l.errorf(p+".allow_groups", "workflow policy %s has no saml idp for requesters to identify with", policy.Name)
+		}
+	}
+	for i := range e.CIIdentities {
+		c.lintCIIdentity(l, fmt.Sprintf("%s.ci_identities[%d]", p, i), &e.CIIdentities[i])
+	}
+	if role.CIIdentity != nil && len(e.AllowGroups) > 0 {
+		l.warnf(p+".allow_groups", "the role has a ci_identity, so requesters never identify with a group")
+	}
+}
+
+func (c *Config) lintBreakGlass(l *linter, p string, role *RoleConfig) {
+	b := role.BreakGlass
+	if b.MaxValidForSeconds < MinValidForSeconds || b.MaxValidForSeconds > MaxBreakGlassValidForSeconds {
+		l.errorf(p+".max_valid_for_seconds", "%d is not between %d and %d",
+			b.MaxValidForSeconds, MinValidForSeconds, MaxBreakGlassValidForSeconds)
+	}
+	for _, group := range sortedKeys(b.ApproverRoles) {
+		if n := b.ApproverRoles[group]; n < 1 {
+			l.errorf(p+".approver_roles."+group, "impossible approval count %d", n)
+		}
+	}
+	if policy := c.Workflow.FindPolicyByName(role.Workflow); policy != nil && len(b.ApproverRoles) > 0 {
+		if policy.IdpName == "" {
+			l.errorf(p+".approver_roles", "workflow policy %s has no idp to approve with", policy.Name)
+		}
+	}
+	for i, target := range b.Notify {
+		np := fmt.Sprintf("%s.notify[%d]", p, i)
+		switch {
+		case strings.HasPrefix(target, "sns://"):
+			if !strings.HasPrefix(target[6:], "arn:") {
+				l.errorf(np, "invalid sns topic arn: %s", target[6:])
+			}
+		case strings.HasPrefix(target, "https://"):
+			lintUrl(l, np, target)
+		default:
+			l.errorf(np, "unsupported notify target: %s", target)
+		}
+	}
+	if len(b.Notify) == 0 {
+		l.warnf(p+".notify", "break-glass requests are only audited")
+	}
+	if c.Audit.Reviews == "" {
+		l.errorf(p, "break-glass roles need an audit reviews store")
+	}
+}
+
+func lintSchedule(l *linter, p string, s *RoleScheduleConfig) {
+	loc, err := s.Location()
+	if err != nil {
+		l.errorf(p+".timezone", "%s", err)
+		loc = time.UTC
+	}
+	for i, w := range s.Windows {
+		wp := fmt.Sprintf("%s.windows[%d]", p, i)
+		if len(w.Days) == 0 {
+			l.errorf(wp+".days", "no days")
+		} else if _, err := parseWeekdays(w.Days); err != nil {
+			l.errorf(wp+".days", "%s", err)
+		}
+		start, err := parseTimeOfDay(w.Start)
+		if err != nil {
+			l.errorf(wp+".start", "%s", err)
+		}
+		end, err := parseTimeOfDay(w.End)
+		if err != nil {
+			l.errorf(wp+".end", "%s", err)
+		} else if start == end {
+			l.errorf(wp, "window starts when it ends")
+		}
+	}
+	for i, b := range s.Blackouts {
+		bp := fmt.Sprintf("%s.blackouts[%s]", p, b.Name)
+		if b.Name == "" {
+			bp = fmt.Sprintf("%s.blackouts[%d]", p, i)
+		}
+		if _, _, err := b.period(loc); err != nil {
+			l.errorf(bp, "%s", err)
+		}
+	}
+	if e := s.OutsideWindows; e != nil {
+		if len(s.Windows) == 0 {
+			l.warnf(p+".outside_windows", "no windows, so never needed")
+		}
+		if len(e.ApproverRoles) == 0 {
+			l.errorf(p+".outside_windows.approver_roles", "no approver groups, use windows without outside_windows to deny")
+		}
+		for _, group := range sortedKeys(e.ApproverRoles) {
+			if n := e.ApproverRoles[group]; n < 1 {
+				l.errorf(p+".outside_windows.approver_roles."+group, "impossible approval count %d", n)
+			}
+		}
+	}
+}
+
+func (c *Config) lintAccessControl(l *linter) {
+	ipOracle := c.AccessControl.IPOracle
+	p := "access_control.ip_oracle"
+	switch ipOracle.Signer {
+	case "", "kms", "local":
+	default:
+		l.errorf(p+".signer", "unsupported ip oracle signer: %s", ipOracle.Signer)
+	}
+	if ipOracle.Signer == "local" && ipOracle.Key == "" && ipOracle.JwksUrl == "" {
+		l.errorf(p+".key", "a local signer needs a public key or jwks url")
+	}
+	if ipOracle.SignUrl != "" {
+		lintUrl(l, p+".sign_url", ipOracle.SignUrl)
+	}
+	if ipOracle.JwksUrl != "" {
+		lintUrl(l, p+".jwks_url", ipOracle.JwksUrl)
+	}
+	for _, name := range sortedListKeys(ipOracle.Ranges) {
+		if err := validateCidrs(ipOracle.Ranges[name], nil); err != nil {
+			l.errorf(p+".ranges."+name, "%s", err)
+		}
+	}
+	if err := validateCidrs(ipOracle.WhiteListCidrs, ipOracle.Ranges); err != nil {
+		l.errorf(p+".whitelist_cidrs", "%s", err)
+	}
+	if err := validateCidrs(ipOracle.DenyListCidrs, ipOracle.Ranges); err != nil {
+		l.errorf(p+".denylist_cidrs", "%s", err)
+	}
+	for _, role := range c.Roles {
+		if role.IPOracle == nil {
+			continue
+		}
+		rp := fmt.Sprintf("roles[%s].ip_oracle", role.Name)
+		if err := validateCidrs(role.IPOracle.WhiteListCidrs, ipOracle.Ranges); err != nil {
+			l.errorf(rp+".whitelist_cidrs", "%s", err)
+		}
+		if err := validateCidrs(role.IPOracle.DenyListCidrs, ipOracle.Ranges); err != nil {
+			l.errorf(rp+".denylist_cidrs", "%s", err)
+		}
+	}
+}
+
+func (c *Config) lintAudit(l *linter) {
+	sink := c.Audit.Sink
+	switch {
+	case sink == "" || sink == "stdout":
+	case strings.HasPrefix(sink, "file://"), strings.HasPrefix(sink, "firehose://"):
+	case strings.HasPrefix(sink, "s3://"):
+		lintUrl(l, "audit.sink", sink)
+	default:
+		l.errorf("audit.sink", "unsupported audit sink: %s", sink)
+	}
+	if c.Audit.HmacKey == "" {
+		l.warnf("audit.hmac_key", "no hmac key, so anyone who can write to the sink can rewrite the audit chain")
+	}
+	reviews := c.Audit.Reviews
+	switch {
+	case reviews == "", strings.HasPrefix(reviews, "file://"):
+	case strings.HasPrefix(reviews, "s3://"):
+		lintUrl(l, "audit.reviews", reviews)
+	default:
+		l.errorf("audit.reviews", "unsupported reviews store: %s", reviews)
+	}
+}
+
+func (c *Config) lintPolicy(l *linter) {
+	switch c.Policy.Approvals {
+	case "", PolicyApprovalsBuiltin:
+	case PolicyApprovalsPolicy:
+		if !c.Policy.Enabled() {
+			l.errorf("policy.approvals", "approvals are left to a policy, but there are no rules")
+		}
+	default:
+		l.errorf("policy.approvals", "unsupported approvals mode: %s", c.Policy.Approvals)
+	}
+}
+
+func lintRoleLimits(l *linter, p string, role *RoleConfig) {
+	limits := role.Limits
+	if limits.PerRequester == nil && limits.PerRole == nil {
+		l.warnf(p, "no per_requester or per_role limits")
+	}
+	// The username in a request is only a claim, so requesters are
+	// counted by an identity they prove, which needs a ci_identity or
+	// eligibility rules to ask them for one
+	if limits.PerRequester != nil && !role.VerifiesRequester() {
+		l.errorf(p+".per_requester", "requesters of role %s aren't identified, it needs a ci_identity or eligibility", role.Name)
+	}
+	lintLimit(l, p+".per_requester", limits.PerRequester)
+	lintLimit(l, p+".per_role", limits.PerRole)
+}
+
+func lintLimit(l *linter, p string, limit *LimitConfig) {
+	if limit == nil {
+		return
+	}
+	if limit.IssuancesPerHour < 0 {
+		l.errorf(p+".issuances_per_hour", "%d is negative", limit.IssuancesPerHour)
+	}
+	if limit.MaxActive < 0 {
+		l.errorf(p+".max_active", "%d is negative", limit.MaxActive)
+	}
+	if limit.IssuancesPerHour == 0 && limit.MaxActive == 0 {
+		l.warnf(p, "no issuances_per_hour or max_active, so no limit")
+	}
+}
+
+func (c *Config) lintLimits(l *linter) {
+	store := c.Limits.Store
+	switch {
+	case store == "" || store == "memory":
+		// Each issuer instance (e.g. each lambda) would count for itself,
+		// multiplying the limits by however many there are
+		for _, role := range c.Roles {
+			if role.Limits != nil {
+				l.errorf(fmt.Sprintf("roles[%s].limits", role.Name),
+					"limits would be counted per issuer instance, set limits.store to share them")
+			}
+		}
+	case strings.HasPrefix(store, "dynamodb://"):
+		if store == "dynamodb://" {
+			l.errorf("limits.store", "missing dynamodb table name")
+		}
+	default:
+		l.errorf("limits.store", "unsupported limits store: %s", store)
+	}
+}
+
+// CheckPolicy checks the policy rules, if any, with check, e.g. that
+// they can be loaded and compiled.
+func (c *Config) CheckPolicy(check func(rules string) error) []ConfigProblem {
+	l := &linter{}
+	if c.Policy.Enabled() {
+		if err := check(c.Policy.Rules); err != nil {
+			l.errorf("policy.rules", "%s", err)
+		}
+	}
+	return l.problems
+}
+
+// CheckCAKeys checks the CA key of each ssh and kubernetes credential
+// with check, e.g. that it can be loaded and parsed, or that a KMS key
+// exists.
+func (c *Config) CheckCAKeys(check func(caKey string) error) []ConfigProblem {
+	l := &linter{}
+	checked := make(map[string]error)
+	for _, cred := range c.Credentials {
+		var caKey string
+		switch cc := cred.Config.(type) {
+		case *CredentialsConfigSSH:
+			caKey = cc.CAKey
+		case *CredentialsConfigKube:
+			caKey = cc.CAKey
+		}
+		if caKey == "" {
+			continue
+		}
+		err, ok := checked[caKey]
+		if !ok {
+			err = check(caKey)
+			checked[caKey] = err
+		}
+		if err != nil {
+			l.errorf(fmt.Sprintf("credentials[%s].config.ca_key", cred.Name), "%s", err)
+		}
+	}
+	return l.problems
+}
+
+// lintCAKey checks a CA key is given, and if it's a KMS key
+// (kms://<key>) that the key is an ARN, alias or id.
+func lintCAKey(l *linter, p string, caKey string) {
+	if caKey == "" {
+		l.errorf(p, "missing ca key")
+	} else if strings.HasPrefix(caKey, "kms://") && !isKMSKey(caKey[6:]) {
+		l.errorf(p, "invalid kms key arn, alias or id: %s", caKey[6:])
+	}
+}
+
+func isKMSKey(key string) bool {
+	return kmsKeyArnRe.MatchString(key) || kmsAliasRe.MatchString(key) || kmsKeyIdRe.MatchString(key)
+}
+
+func lintUrl(l *linter, p string, s string) {
+	u, err := url.Parse(s)
+	if err != nil {
+		l.errorf(p, "invalid url: %s", err)
+	} else if u.Scheme == "" || u.Host == "" {
+		l.errorf(p, "invalid url: %s", s)
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedListKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
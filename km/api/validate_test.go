@@ -0,0 +1,313 @@
+package api
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestConfig(t *testing.T, path string) *Config {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	config, err := ParseConfig(data)
+	assert.NoError(t, err)
+	config.Normalise()
+	return config
+}
+
+func problemErrors(problems []ConfigProblem) []string {
+	var errs []string
+	for _, p := range problems {
+		if !p.Warning {
+			errs = append(errs, p.Path+": "+p.Message)
+		}
+	}
+	return errs
+}
+
+func TestConfig_LintSampleConfigs(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	assert.Empty(t, problemErrors(config.Lint()))
+	assert.NoError(t, config.Validate())
+
+	// The api example references a credential that doesn't exist
+	config = loadTestConfig(t, "./testdata/example_api_config.yaml")
+	assert.Equal(t, []string{
+		"roles[cloudengineer].credentials: no such credential: kube",
+		"roles[developer].credentials: no such credential: kube",
+		"roles[deployment].credentials: no such credential: kube",
+	}, problemErrors(config.Lint()))
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Len(t, err.(ConfigErrors), 3)
+}
+
+func TestConfig_Lint(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		path   string
+	}{
+		{"version", func(c *Config) { c.Version = "2.0" }, "version"},
+		{"duplicate role", func(c *Config) { c.Roles = append(c.Roles, c.Roles[0]) }, "roles[deployment]"},
+		{"duplicate credential", func(c *Config) {
+			c.Credentials = append(c.Credentials, c.Credentials[0])
+		}, "credentials[ssh-jumpbox]"},
+		{"duplicate policy", func(c *Config) {
+			c.Workflow.Policies = append(c.Workflow.Policies, c.Workflow.Policies[0])
+		}, "workflow.policies[deploy_with_identify]"},
+		{"duplicate idp", func(c *Config) { c.Idp = append(c.Idp, c.Idp[0]) }, "idp[nonprod]"},
+		{"unknown workflow", func(c *Config) { c.Roles[0].Workflow = "nope" }, "roles[deployment].workflow"},
+		{"no workflow", func(c *Config) { c.Roles[0].Workflow = "" }, "roles[deployment].workflow"},
+		{"too short", func(c *Config) { c.Roles[0].ValidForSeconds = 60 }, "roles[deployment].valid_for_seconds"},
+		{"too long", func(c *Config) { c.Roles[0].ValidForSeconds = 86400 }, "roles[deployment].valid_for_seconds"},
+		{"ssh too long", func(c *Config) {
+			c.Roles[0].Credentials = []string{"ssh-jumpbox"}
+			c.Roles[0].ValidForSeconds = 8 * 86400
+		}, "roles[deployment].valid_for_seconds"},
+		{"kube not positive", func(c *Config) {
+			c.Roles[0].Credentials = []string{"kube-admin"}
+			c.Roles[0].ValidForSeconds = 0
+		}, "roles[deployment].valid_for_seconds"},
+		{"kms key", func(c *Config) {
+			c.Roles[0].CredentialDelivery.KmsWrapWith = "arn:aws:kms:ap-southeast-2:bogus"
+		}, "roles[deployment].credential_delivery.kms_wrap_with"},
+		{"ci idp", func(c *Config) { c.Roles[1].CIIdentity.IdpName = "nonprod" }, "roles[gitlab-deployment].ci_identity.idp_name"},
+		{"ci pattern", func(c *Config) {
+			c.Roles[1].CIIdentity.Claims["project_path"] = []string{"foo/["}
+		}, "roles[gitlab-deployment].ci_identity.claims.project_path"},
+		{"ci claims", func(c *Config) { c.Roles[1].CIIdentity.Claims = nil }, "roles[gitlab-deployment].ci_identity.claims"},
+		{"ci unscoped", func(c *Config) {
+			c.Roles[2].CIIdentity.Claims = map[string][]string{"environment": {"nonprod"}}
+		}, "roles[github-deployment].ci_identity.claims"},
+		{"ci any project", func(c *Config) {
+			c.Roles[1].CIIdentity.Claims["project_path"] = []string{"*"}
+		}, "roles[gitlab-deployment].ci_identity.claims"},
+		{"eligibility ci claims", func(c *Config) {
+			c.Roles[0].Eligibility.CIIdentities[0].Claims = map[string][]string{}
+		}, "roles[deployment].eligibility.ci_identities[0].claims"},
+		{"github audience", func(c *Config) { c.Idp[2].Config.(*IdpConfigGithubOidc).Audience = "" }, "idp[github].config.audience"},
+		{"target role arn", func(c *Config) {
+			c.Credentials[5].Config = &CredentialsConfigIAMAssumeRole{TargetRole: "arn:aws:iam::1234:role/admin"}
+		}, "credentials[aws-admin].config.target_role"},
+		{"target role name", func(c *Config) {
+			c.Credentials[5].Config = &CredentialsConfigIAMAssumeRole{TargetRole: "not a role"}
+		}, "credentials[aws-admin].config.target_role"},
+		{"ssh principals", func(c *Config) {
+			c.Credentials[0].Config = &CredentialsConfigSSH{CAKey: "file://ca.key"}
+		}, "credentials[ssh-jumpbox].config.principals"},
+		{"kube ca key", func(c *Config) { c.Credentials[2].Config = &CredentialsConfigKube{} }, "credentials[kube-user].config.ca_key"},
+		{"approval count", func(c *Config) {
+			c.Workflow.Policies[1].ApproverRoles["gg_digitalid_business_approver"] = 0
+		}, "workflow.policies[deploy_with_approval].approver_roles.gg_digitalid_business_approver"},
+		{"identify count", func(c *Config) {
+			c.Workflow.Policies[0].IdentifyRoles["adfs_role_deployer"] = 2
+		}, "workflow.policies[deploy_with_identify].identify_roles.adfs_role_deployer"},
+		{"policy idp", func(c *Config) { c.Workflow.Policies[0].IdpName = "gitlab" }, "workflow.policies[deploy_with_identify].idp_name"},
+		{"base url", func(c *Config) { c.Workflow.BaseUrl = "workflow.example.com" }, "workflow.base_url"},
+		{"audit sink", func(c *Config) { c.Audit.Sink = "syslog://localhost" }, "audit.sink"},
+		{"whitelist", func(c *Config) {
+			c.AccessControl.IPOracle.WhiteListCidrs = []string{"10.0.0.0/33"}
+		}, "access_control.ip_oracle.whitelist_cidrs"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := loadTestConfig(t, "./testdata/config.yaml")
+			test.modify(config)
+			var paths []string
+			for _, p := range config.Lint() {
+				if !p.Warning {
+					paths = append(paths, p.Path)
+				}
+			}
+			assert.Contains(t, paths, test.path)
+			assert.Error(t, config.Validate())
+		})
+	}
+}
+
+func TestConfig_LintWarnings(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	config.Roles[0].Credentials = nil
+	config.Audit.HmacKey = ""
+	var warnings []string
+	for _, p := range config.Lint() {
+		if p.Warning {
+			warnings = append(warnings, p.String())
+		}
+	}
+	assert.Contains(t, warnings, "warning: roles[deployment].credentials: no credentials")
+	assert.Contains(t, warnings,
+		"warning: audit.hmac_key: no hmac key, so anyone who can write to the sink can rewrite the audit chain")
+	assert.Contains(t, warnings,
+		"warning: workflow.policies[deploy_with_approval].approver_roles: multiple approver groups are not implemented")
+	// Warnings don't stop a config loading
+	assert.NoError(t, config.Validate())
+}
+
+func TestConfig_LintValidFor(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	// The STS bounds don't apply to ssh certificates
+	config.Roles[0].Credentials = []string{"ssh-jumpbox", "kube-admin"}
+	config.Roles[0].ValidForSeconds = 86400
+	assert.NoError(t, config.Validate())
+	config.Roles[0].ValidForSeconds = 300
+	assert.NoError(t, config.Validate())
+
+	config.Roles[0].Credentials = append(config.Roles[0].Credentials, "aws-admin")
+	assert.Equal(t, []string{
+		"roles[deployment].valid_for_seconds: 300 is not between 900 and 43200, as iam_assume_role credential aws-admin needs",
+	}, problemErrors(config.Lint()))
+}
+
+func TestConfig_CheckCAKeys(t *testing.T) {
+	checks := make(map[string]int)
+	check := func(caKey string) error {
+		checks[caKey]++
+		if caKey == "ssm:///keymaster/nonprod/sshca.key" || caKey == "kms://alias/keymaster-nonprod-ssh-ca" {
+			return nil
+		}
+		return errors.New("parsing ca key: no key found")
+	}
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	problems := config.CheckCAKeys(check)
+	assert.Len(t, problems, 2)
+	assert.Equal(t, "credentials[kube-user].config.ca_key", problems[0].Path)
+	assert.Equal(t, "parsing ca key: no key found", problems[0].Message)
+	assert.Equal(t, "credentials[kube-admin].config.ca_key", problems[1].Path)
+	// Each key is only checked once
+	assert.Equal(t, map[string]int{
+		"ssm:///keymaster/nonprod/sshca.key":            1,
+		"kms://alias/keymaster-nonprod-ssh-ca":          1,
+		"secretsmanager://keymaster/nonprod/kubeca#key": 1,
+	}, checks)
+}
+
+func TestConfig_LintKMSCAKey(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	config.Credentials[0].Config = &CredentialsConfigSSH{CAKey: "kms://alias/keymaster-ssh-ca", Principals: []string{"core"}}
+	config.Credentials[2].Config = &CredentialsConfigKube{
+		CACert: "s3://my-bucket/kubeca.crt",
+		CAKey:  "kms://arn:aws:kms:ap-southeast-2:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+	}
+	assert.NoError(t, config.Validate())
+	config.Credentials[0].Config = &CredentialsConfigSSH{CAKey: "kms://keymaster-ssh-ca", Principals: []string{"core"}}
+	assert.Equal(t, []string{
+		"credentials[ssh-jumpbox].config.ca_key: invalid kms key arn, alias or id: keymaster-ssh-ca",
+	}, problemErrors(config.Lint()))
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`{"name": "nonprod", "version": "1.0"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "nonprod", config.Name)
+	config, err = ParseConfig([]byte("name: nonprod\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "nonprod", config.Name)
+	_, err = ParseConfig([]byte("{nope"))
+	assert.Error(t, err)
+}
+
+func TestConfig_LintBreakGlass(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	role := &config.Roles[0]
+	assert.Equal(t, 900, role.BreakGlass.ValidForSeconds(role))
+
+	role.BreakGlass = &RoleBreakGlassConfig{
+		ApproverRoles:      map[string]int{"ops": 0},
+		MaxValidForSeconds: 7200,
+		Notify:             []string{"sns://keymaster-break-glass", "http://hooks.example.com/x", "https://"},
+	}
+	config.Audit.Reviews = ""
+	assert.Equal(t, []string{
+		"roles[deployment].break_glass.max_valid_for_seconds: 7200 is not between 900 and 3600",
+		"roles[deployment].break_glass.approver_roles.ops: impossible approval count 0",
+		"roles[deployment].break_glass.notify[0]: invalid sns topic arn: keymaster-break-glass",
+		"roles[deployment].break_glass.notify[1]: unsupported notify target: http://hooks.example.com/x",
+		"roles[deployment].break_glass.notify[2]: invalid url: https://",
+		"roles[deployment].break_glass: break-glass roles need an audit reviews store",
+	}, problemErrors(config.Lint()))
+
+	// Without notify targets, break-glass requests are only audited
+	role.BreakGlass = &RoleBreakGlassConfig{MaxValidForSeconds: 900}
+	config.Audit.Reviews = "file:///var/lib/keymaster/reviews"
+	var warnings []string
+	for _, p := range config.Lint() {
+		if p.Warning {
+			warnings = append(warnings, p.String())
+		}
+	}
+	assert.Contains(t, warnings, "warning: roles[deployment].break_glass.notify: break-glass requests are only audited")
+	assert.NoError(t, config.Validate())
+
+	config.Audit.Reviews = "dynamodb://reviews"
+	assert.Equal(t, []string{"audit.reviews: unsupported reviews store: dynamodb://reviews"}, problemErrors(config.Lint()))
+}
+
+func TestConfig_LintPolicy(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	config.Policy = PolicyConfig{Approvals: "nobody"}
+	assert.Equal(t, []string{"policy.approvals: unsupported approvals mode: nobody"}, problemErrors(config.Lint()))
+	config.Policy = PolicyConfig{Approvals: PolicyApprovalsPolicy}
+	assert.Equal(t, []string{"policy.approvals: approvals are left to a policy, but there are no rules"},
+		problemErrors(config.Lint()))
+
+	checked := 0
+	check := func(rules string) error {
+		checked++
+		return errors.New("rules[x].deny: must be a bool expression")
+	}
+	assert.Empty(t, config.CheckPolicy(check))
+	config.Policy.Rules = "s3://config-bucket/policy.yaml"
+	assert.Empty(t, problemErrors(config.Lint()))
+	assert.Equal(t, []string{"policy.rules: rules[x].deny: must be a bool expression"},
+		problemErrors(config.CheckPolicy(check)))
+	assert.Equal(t, 1, checked)
+}
+
+func TestConfig_LintLimits(t *testing.T) {
+	config := loadTestConfig(t, "./testdata/config.yaml")
+	config.Roles[0].Limits = &RoleLimitsConfig{
+		PerRequester: &LimitConfig{IssuancesPerHour: -1},
+		PerRole:      &LimitConfig{},
+	}
+	config.Limits.Store = "redis://limits"
+	assert.Equal(t, []string{
+		"roles[" + config.Roles[0].Name + "].limits.per_requester.issuances_per_hour: -1 is negative",
+		"limits.store: unsupported limits store: redis://limits",
+	}, problemErrors(config.Lint()))
+
+	// Limits counted in memory aren't shared
+	config.Roles[0].Limits.PerRequester.IssuancesPerHour = 2
+	for _, store := range []string{"", "memory"} {
+		config.Limits.Store = store
+		assert.Equal(t, []string{
+			"roles[" + config.Roles[0].Name + "].limits: limits would be counted per issuer instance, set limits.store to share them",
+		}, problemErrors(config.Lint()))
+	}
+
+	// and limits of zero aren't limits
+	config.Limits.Store = "dynamodb://km-limits"
+	problems := config.Lint()
+	assert.Empty(t, problemErrors(problems))
+	var warnings []string
+	for _, p := range problems {
+		if p.Warning && strings.Contains(p.Path, ".limits") {
+			warnings = append(warnings, p.Path+": "+p.Message)
+		}
+	}
+	assert.Equal(t, []string{
+		"roles[" + config.Roles[0].Name + "].limits.per_role: no issuances_per_hour or max_active, so no limit",
+	}, warnings)
+
+	// Requesters who aren't asked to prove who they are can't be counted
+	config.Roles[0].Eligibility = nil
+	assert.Equal(t, []string{
+		"roles[deployment].limits.per_requester: requesters of role deployment aren't identified, it needs a ci_identity or eligibility",
+	}, problemErrors(config.Lint()))
+	config.Roles[0].Limits.PerRequester = nil
+	assert.Empty(t, problemErrors(config.Lint()))
+}
@@ -0,0 +1,185 @@
+// Package audit records every issuance decision as a structured event.
+//
+// Events are written to a Sink (stdout, a file, S3 or Firehose) by a
+// Logger, which links them into a hash chain: each event carries the hash
+// of the event before it, and its own hash, keyed with an HMAC key if one
+// is configured. Verify detects events that have been edited, removed or
+// reordered. Each Logger (in practice each issuer process) writes its own
+// chain, identified by a random chain id.
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Event types
+const (
+	EventIssued = "issued"
+	EventDenied = "denied"
+)
+
+// Event is an issuance decision.
+type Event struct {
+	// Chain and Sequence place the event in its hash chain
+	Chain    string    `json:"chain"`
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+
+	Environment     string       `json:"environment"`
+	Role            string       `json:"role"`
+	Requester       Requester    `json:"requester"`
+	Approvers       []Approver   `json:"approvers,omitempty"`
+	Credentials     []Credential `json:"credentials,omitempty"`
+	ValidForSeconds int          `json:"valid_for_seconds,omitempty"`
+	// Why extra approvals were needed, if they were
+	Escalation string `json:"escalation,omitempty"`
+	// Set for break-glass requests
+	BreakGlass *BreakGlass `json:"break_glass,omitempty"`
+
+	// Why a request was denied
+	ErrorCode string `json:"error_code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+type Requester struct {
+	Username string `json:"username"`
+	// Subject of a verified CI identity token
+	CIIdentity string `json:"ci_identity,omitempty"`
+	// Source address vouched for by the ip oracle
+	SourceIp string `json:"source_ip,omitempty"`
+	// Groups the requester identified with, for roles with eligibility
+	// rules
+	Groups []string `json:"groups,omitempty"`
+}
+
+// BreakGlass is why emergency access was requested, and the review it
+// opened if it was granted.
+type BreakGlass struct {
+	Justification string `json:"justification"`
+	ReviewId      string `json:"review_id,omitempty"`
+}
+
+// Approver is the user behind an approving SAML assertion.
+type Approver struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+}
+
+// Credential identifies an issued credential, without its secrets.
+type Credential struct {
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	Expiry          int64  `json:"expiry"`
+	RoleArn         string `json:"role_arn,omitempty"`
+	RoleSessionName string `json:"role_session_name,omitempty"`
+	Username        string `json:"username,omitempty"`
+	SerialNumber    uint64 `json:"serial_number,omitempty"`
+	KeyId           string `json:"key_id,omitempty"`
+}
+
+// Credentials describes issued credentials for an audit event.
+func Credentials(creds []api.Cred) []Credential {
+	result := make([]Credential, 0, len(creds))
+	for _, c := range creds {
+		cred := Credential{
+			Name:   c.Name,
+			Type:   c.Type,
+			Expiry: c.Expiry,
+		}
+		switch v := c.Value.(type) {
+		case *api.IAMCred:
+			cred.RoleArn = v.RoleArn
+			cred.RoleSessionName = v.RoleSessionName
+		case *api.SSHCred:
+			cred.Username = v.Username
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey(v.Certificate); err == nil {
+				if cert, ok := pub.(*ssh.Certificate); ok {
+					cred.SerialNumber = cert.Serial
+					cred.KeyId = cert.KeyId
+				}
+			}
+		case *api.KubeCred:
+			cred.Username = v.Username
+		}
+		result = append(result, cred)
+	}
+	return result
+}
+
+// Hash returns the hash of an event, over everything but the hash
+// itself: an HMAC-SHA256 if there is a key, otherwise a SHA-256.
+func Hash(e *Event, key []byte) (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", errors.Wrap(err, "marshalling audit event")
+	}
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Logger writes events to a sink as a hash chain.
+type Logger struct {
+	Sink  Sink
+	Key   []byte
+	Clock clockwork.Clock
+
+	mu       sync.Mutex
+	chain    string
+	sequence uint64
+	prevHash string
+}
+
+func NewLogger(sink Sink, key []byte) *Logger {
+	return &Logger{
+		Sink:  sink,
+		Key:   key,
+		Clock: clockwork.NewRealClock(),
+		chain: uuid.New().String(),
+	}
+}
+
+// Log adds an event to the chain and writes it to the sink. If the
+// write fails the event is not part of the chain.
+func (l *Logger) Log(e *Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Chain = l.chain
+	e.Sequence = l.sequence + 1
+	e.Time = l.Clock.Now().UTC()
+	e.PrevHash = l.prevHash
+	hash, err := Hash(e, l.Key)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	err = l.Sink.Write(e)
+	if err != nil {
+		return errors.Wrap(err, "writing audit event")
+	}
+	l.sequence = e.Sequence
+	l.prevHash = e.Hash
+	return nil
+}
@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLog(t *testing.T, key []byte, n int) []*Event {
+	var buf bytes.Buffer
+	l := NewLogger(&WriterSink{W: &buf}, key)
+	l.Clock = clockwork.NewFakeClock()
+	for i := 0; i < n; i++ {
+		assert.NoError(t, l.Log(&Event{
+			Type:      EventIssued,
+			Role:      "deployment",
+			Requester: Requester{Username: "smithb12"},
+			Credentials: Credentials([]api.Cred{
+				{
+					Name: "nonprod-deployment",
+					Type: "iam",
+					Value: &api.IAMCred{
+						RoleArn:         "arn:aws:iam::123456789012:role/deployment",
+						RoleSessionName: "smithb12-1234",
+						SecretAccessKey: "secret",
+					},
+				},
+			}),
+		}))
+	}
+	events, err := ReadEvents(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, n)
+	return events
+}
+
+func TestLoggerChain(t *testing.T) {
+	key := []byte("audit-key")
+	events := testLog(t, key, 3)
+	assert.Equal(t, uint64(1), events[0].Sequence)
+	assert.Equal(t, "", events[0].PrevHash)
+	assert.Equal(t, events[0].Hash, events[1].PrevHash)
+	assert.Equal(t, events[0].Chain, events[2].Chain)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/deployment", events[0].Credentials[0].RoleArn)
+	assert.Empty(t, Verify(events, key))
+
+	// Order doesn't matter
+	assert.Empty(t, Verify([]*Event{events[2], events[0], events[1]}, key))
+
+	// The wrong key fails every hash
+	assert.Len(t, Verify(events, []byte("wrong")), 3)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	key := []byte("audit-key")
+
+	events := testLog(t, key, 3)
+	events[1].Requester.Username = "someone-else"
+	problems := Verify(events, key)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, uint64(2), problems[0].Sequence)
+	assert.Contains(t, problems[0].Message, "modified")
+
+	events = testLog(t, key, 3)
+	problems = Verify([]*Event{events[0], events[2]}, key)
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Message, "events 2 to 2 are missing")
+
+	events = testLog(t, key, 3)
+	problems = Verify(events[1:], key)
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Message, "events 1 to 1 are missing")
+
+	// Rehashing an edited event without the key doesn't help
+	events = testLog(t, key, 3)
+	events[1].Requester.Username = "someone-else"
+	events[1].Hash, _ = Hash(events[1], nil)
+	problems = Verify(events, key)
+	assert.Len(t, problems, 2)
+
+	// Nor does splicing in an event from another chain
+	other := testLog(t, key, 3)
+	other[1].Chain = events[1].Chain
+	problems = Verify([]*Event{events[0], other[1], events[2]}, key)
+	assert.NotEmpty(t, problems)
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km-audit-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	for i := 0; i < 2; i++ {
+		sink, err := NewSink("file://" + path)
+		assert.NoError(t, err)
+		l := NewLogger(sink, nil)
+		assert.NoError(t, l.Log(&Event{Type: EventDenied, Reason: "not enough approvals"}))
+		assert.NoError(t, sink.(*FileSink).Close())
+	}
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	events, err := ReadEvents(f)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.NotEqual(t, events[0].Chain, events[1].Chain)
+	assert.Empty(t, Verify(events, nil))
+}
+
+type fakeS3 struct {
+	s3iface.S3API
+	puts []*s3.PutObjectInput
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, input)
+	return &s3.PutObjectOutput{}, nil
+}
+
+type fakeFirehose struct {
+	firehoseiface.FirehoseAPI
+	records [][]byte
+}
+
+func (f *fakeFirehose) PutRecord(input *firehose.PutRecordInput) (*firehose.PutRecordOutput, error) {
+	f.records = append(f.records, input.Record.Data)
+	return &firehose.PutRecordOutput{}, nil
+}
+
+func TestAwsSinks(t *testing.T) {
+	s3Client := &fakeS3{}
+	l := NewLogger(&S3Sink{S3: s3Client, Bucket: "audit", Prefix: "keymaster"}, nil)
+	assert.NoError(t, l.Log(&Event{Type: EventIssued}))
+	assert.Len(t, s3Client.puts, 1)
+	assert.Equal(t, "audit", *s3Client.puts[0].Bucket)
+	assert.Regexp(t, `^keymaster/\d{4}/\d{2}/\d{2}/[0-9a-f-]+/0{19}1\.json$`, *s3Client.puts[0].Key)
+
+	firehoseClient := &fakeFirehose{}
+	l = NewLogger(&FirehoseSink{Firehose: firehoseClient, StreamName: "audit"}, nil)
+	assert.NoError(t, l.Log(&Event{Type: EventIssued}))
+	assert.Len(t, firehoseClient.records, 1)
+	events, err := ReadEvents(bytes.NewReader(firehoseClient.records[0]))
+	assert.NoError(t, err)
+	assert.Empty(t, Verify(events, nil))
+}
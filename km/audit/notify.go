@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/pkg/errors"
+)
+
+// Notifier tells people about an event, e.g. a break-glass request.
+type Notifier interface {
+	Notify(e *Event) error
+}
+
+// NewNotifier returns a notifier for a target:
+//   sns://topic-arn      a message on an SNS topic
+//   https://...          a JSON POST, with a "text" summary as for Slack
+func NewNotifier(target string) (Notifier, error) {
+	switch {
+	case strings.HasPrefix(target, "sns://"):
+		sess := session.Must(session.NewSession())
+		return &SNSNotifier{
+			SNS:      sns.New(sess),
+			TopicArn: target[6:],
+		}, nil
+	case strings.HasPrefix(target, "https://"):
+		return &WebhookNotifier{
+			Url:    target,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported notify target: %s", target)
+}
+
+// Summary describes an event in a line.
+func Summary(e *Event) string {
+	who := e.Requester.Username
+	if who == "" {
+		who = "(unknown)"
+	}
+	summary := fmt.Sprintf("%s requested role %s in %s: %s", who, e.Role, e.Environment, e.Type)
+	if e.Reason != "" {
+		summary += " (" + e.Reason + ")"
+	}
+	if e.BreakGlass != nil {
+		summary = fmt.Sprintf("BREAK GLASS: %s, because: %s", summary, e.BreakGlass.Justification)
+		if e.BreakGlass.ReviewId != "" {
+			summary += fmt.Sprintf(". Review %s must be signed off.", e.BreakGlass.ReviewId)
+		}
+	}
+	return summary
+}
+
+// SNSNotifier publishes events to an SNS topic.
+type SNSNotifier struct {
+	SNS      snsiface.SNSAPI
+	TopicArn string
+}
+
+func (n *SNSNotifier) Notify(e *Event) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("keymaster %s: %s in %s", e.Type, e.Role, e.Environment)
+	if e.BreakGlass != nil {
+		subject = "BREAK GLASS " + subject
+	}
+	// SNS subjects are at most 100 characters
+	if len(subject) > 100 {
+		subject = subject[:100]
+	}
+	_, err = n.SNS.Publish(&sns.PublishInput{
+		TopicArn: aws.String(n.TopicArn),
+		Subject:  aws.String(subject),
+		Message:  aws.String(Summary(e) + "\n\n" + string(data)),
+	})
+	return errors.Wrap(err, "publishing notification")
+}
+
+// WebhookNotifier posts events to a webhook.
+type WebhookNotifier struct {
+	Url    string
+	Client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(e *Event) error {
+	data, err := json.Marshal(struct {
+		Text  string `json:"text"`
+		Event *Event `json:"event"`
+	}{Summary(e), e})
+	if err != nil {
+		return err
+	}
+	resp, err := n.Client.Post(n.Url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "posting notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("posting notification: %s", resp.Status)
+	}
+	return nil
+}
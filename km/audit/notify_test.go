@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	f.published = append(f.published, input)
+	return &sns.PublishOutput{}, nil
+}
+
+func testBreakGlassEvent() *Event {
+	return &Event{
+		Type:        EventIssued,
+		Environment: "nonprod",
+		Role:        "deployment",
+		Requester:   Requester{Username: "smithb12"},
+		BreakGlass:  &BreakGlass{Justification: "workflow is down", ReviewId: "r1"},
+	}
+}
+
+func TestSummary(t *testing.T) {
+	e := testBreakGlassEvent()
+	assert.Equal(t, "BREAK GLASS: smithb12 requested role deployment in nonprod: issued, because: "+
+		"workflow is down. Review r1 must be signed off.", Summary(e))
+	e = &Event{Type: EventDenied, Role: "deployment", Environment: "nonprod", Reason: "not enough approvals"}
+	assert.Equal(t, "(unknown) requested role deployment in nonprod: denied (not enough approvals)", Summary(e))
+}
+
+func TestSNSNotifier(t *testing.T) {
+	client := &fakeSNS{}
+	n := &SNSNotifier{SNS: client, TopicArn: "arn:aws:sns:ap-southeast-2:123456789012:break-glass"}
+	assert.NoError(t, n.Notify(testBreakGlassEvent()))
+	assert.Len(t, client.published, 1)
+	assert.Equal(t, "arn:aws:sns:ap-southeast-2:123456789012:break-glass", *client.published[0].TopicArn)
+	assert.Equal(t, "BREAK GLASS keymaster issued: deployment in nonprod", *client.published[0].Subject)
+	assert.Contains(t, *client.published[0].Message, `"review_id": "r1"`)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var posted struct {
+		Text  string `json:"text"`
+		Event *Event `json:"event"`
+	}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	n := &WebhookNotifier{Url: server.URL, Client: server.Client()}
+	e := testBreakGlassEvent()
+	assert.NoError(t, n.Notify(e))
+	assert.Equal(t, Summary(e), posted.Text)
+	assert.Equal(t, e, posted.Event)
+
+	status = http.StatusForbidden
+	assert.EqualError(t, n.Notify(e), "posting notification: 403 Forbidden")
+
+	_, err := NewNotifier("http://hooks.example.com/x")
+	assert.EqualError(t, err, "unsupported notify target: http://hooks.example.com/x")
+}
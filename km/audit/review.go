@@ -0,0 +1,294 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// Review statuses
+const (
+	ReviewPending   = "pending"
+	ReviewSignedOff = "signed_off"
+)
+
+// Review is the after-the-fact review of a break-glass request. One is
+// opened for each break-glass request that is issued, and stays pending
+// until someone other than the requester signs it off.
+type Review struct {
+	Id            string       `json:"id"`
+	Status        string       `json:"status"`
+	Opened        time.Time    `json:"opened"`
+	Environment   string       `json:"environment"`
+	Role          string       `json:"role"`
+	Requester     Requester    `json:"requester"`
+	Approvers     []Approver   `json:"approvers,omitempty"`
+	Justification string       `json:"justification"`
+	Credentials   []Credential `json:"credentials,omitempty"`
+	// The audit event recording the request
+	EventChain    string `json:"event_chain"`
+	EventSequence uint64 `json:"event_sequence"`
+	EventHash     string `json:"event_hash"`
+
+	SignOff *SignOff `json:"sign_off,omitempty"`
+}
+
+// SignOff is who closed a review, and what they found.
+type SignOff struct {
+	Reviewer string    `json:"reviewer"`
+	Time     time.Time `json:"time"`
+	Notes    string    `json:"notes,omitempty"`
+}
+
+// NewReview opens a review of a logged break-glass event.
+func NewReview(e *Event) (*Review, error) {
+	if e.BreakGlass == nil || e.BreakGlass.ReviewId == "" {
+		return nil, errors.New("not a break-glass event")
+	}
+	return &Review{
+		Id:            e.BreakGlass.ReviewId,
+		Status:        ReviewPending,
+		Opened:        e.Time,
+		Environment:   e.Environment,
+		Role:          e.Role,
+		Requester:     e.Requester,
+		Approvers:     e.Approvers,
+		Justification: e.BreakGlass.Justification,
+		Credentials:   e.Credentials,
+		EventChain:    e.Chain,
+		EventSequence: e.Sequence,
+		EventHash:     e.Hash,
+	}, nil
+}
+
+// SignOffBy closes a review. The requester can't sign off their own
+// request, and notes are required.
+func (r *Review) SignOffBy(reviewer string, notes string, at time.Time) error {
+	if r.Status != ReviewPending {
+		return errors.Errorf("review %s is already %s", r.Id, r.Status)
+	}
+	if reviewer == "" {
+		return errors.New("a reviewer is required")
+	}
+	if strings.EqualFold(reviewer, r.Requester.Username) {
+		return errors.Errorf("%s can't review their own break-glass request", reviewer)
+	}
+	if strings.TrimSpace(notes) == "" {
+		return errors.New("review notes are required")
+	}
+	r.Status = ReviewSignedOff
+	r.SignOff = &SignOff{Reviewer: reviewer, Time: at.UTC(), Notes: notes}
+	return nil
+}
+
+// ReviewStore keeps reviews.
+type ReviewStore interface {
+	Put(r *Review) error
+	// Get returns an error if there's no such review
+	Get(id string) (*Review, error)
+	// List returns every review, oldest first
+	List() ([]*Review, error)
+}
+
+// NewReviewStore returns a store for a target:
+//   file:///path         a JSON file per review in a directory
+//   s3://bucket/prefix   a JSON object per review
+func NewReviewStore(target string) (ReviewStore, error) {
+	switch {
+	case strings.HasPrefix(target, "file://"):
+		return &FileReviewStore{Dir: target[7:]}, nil
+	case strings.HasPrefix(target, "s3://"):
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing reviews store")
+		}
+		sess := session.Must(session.NewSession())
+		return &S3ReviewStore{
+			S3:     s3.New(sess),
+			Bucket: u.Host,
+			Prefix: strings.Trim(u.Path, "/"),
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported reviews store: %s", target)
+}
+
+var reviewIdPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+func checkReviewId(id string) error {
+	if !reviewIdPattern.MatchString(id) {
+		return errors.Errorf("invalid review id: %q", id)
+	}
+	return nil
+}
+
+func sortReviews(reviews []*Review) {
+	sort.SliceStable(reviews, func(i, j int) bool {
+		return reviews[i].Opened.Before(reviews[j].Opened)
+	})
+}
+
+// FileReviewStore keeps reviews as JSON files in a directory.
+type FileReviewStore struct {
+	Dir string
+}
+
+func (s *FileReviewStore) path(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+func (s *FileReviewStore) Put(r *Review) error {
+	if err := checkReviewId(r.Id); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return errors.Wrap(err, "creating reviews directory")
+	}
+	// Write and rename, so a review is never half written
+	tmp := s.path(r.Id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "writing review")
+	}
+	return errors.Wrap(os.Rename(tmp, s.path(r.Id)), "writing review")
+}
+
+func (s *FileReviewStore) Get(id string) (*Review, error) {
+	if err := checkReviewId(id); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("no such review: %s", id)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading review")
+	}
+	return unmarshalReview(data, id)
+}
+
+func (s *FileReviewStore) List() ([]*Review, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	reviews := make([]*Review, 0, len(paths))
+	for _, path := range paths {
+		r, err := s.Get(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, r)
+	}
+	sortReviews(reviews)
+	return reviews, nil
+}
+
+// S3ReviewStore keeps reviews as JSON objects in a bucket.
+type S3ReviewStore struct {
+	S3     s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+func (s *S3ReviewStore) Key(id string) string {
+	key := id + ".json"
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + key
+	}
+	return key
+}
+
+func (s *S3ReviewStore) Put(r *Review) error {
+	if err := checkReviewId(r.Id); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.Key(r.Id)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return errors.Wrap(err, "writing review")
+}
+
+func (s *S3ReviewStore) Get(id string) (*Review, error) {
+	if err := checkReviewId(id); err != nil {
+		return nil, err
+	}
+	out, err := s.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Key(id)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, errors.Errorf("no such review: %s", id)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading review")
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading review")
+	}
+	return unmarshalReview(data, id)
+}
+
+func (s *S3ReviewStore) List() ([]*Review, error) {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+	var ids []string
+	err := s.S3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(o.Key), prefix)
+			if strings.HasSuffix(name, ".json") && !strings.Contains(name, "/") {
+				ids = append(ids, strings.TrimSuffix(name, ".json"))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing reviews")
+	}
+	reviews := make([]*Review, 0, len(ids))
+	for _, id := range ids {
+		r, err := s.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, r)
+	}
+	sortReviews(reviews)
+	return reviews, nil
+}
+
+func unmarshalReview(data []byte, id string) (*Review, error) {
+	r := new(Review)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrapf(err, "reading review %s", id)
+	}
+	return r, nil
+}
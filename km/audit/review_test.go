@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+// breakGlassEvent logs a break-glass event, opened at a time.
+func breakGlassEvent(t *testing.T, id string, at time.Time) *Event {
+	l := NewLogger(&WriterSink{W: ioutil.Discard}, nil)
+	l.Clock = clockwork.NewFakeClockAt(at)
+	e := &Event{
+		Type:        EventIssued,
+		Environment: "nonprod",
+		Role:        "deployment",
+		Requester:   Requester{Username: "smithb12"},
+		BreakGlass:  &BreakGlass{Justification: "workflow is down, INC-123", ReviewId: id},
+	}
+	assert.NoError(t, l.Log(e))
+	return e
+}
+
+// fakeReviewS3 keeps objects in memory.
+type fakeReviewS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (f *fakeReviewS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[*input.Key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeReviewS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeReviewS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	page := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	fn(page, true)
+	return nil
+}
+
+func TestReviewStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km-reviews-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileStore, err := NewReviewStore("file://" + dir)
+	assert.NoError(t, err)
+	s3Client := &fakeReviewS3{objects: make(map[string][]byte)}
+
+	stores := map[string]ReviewStore{
+		"file": fileStore,
+		"s3":   &S3ReviewStore{S3: s3Client, Bucket: "audit", Prefix: "keymaster/reviews"},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			later, err := NewReview(breakGlassEvent(t, "b-review", time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)))
+			assert.NoError(t, err)
+			earlier, err := NewReview(breakGlassEvent(t, "a-review", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)))
+			assert.NoError(t, err)
+			assert.NoError(t, store.Put(later))
+			assert.NoError(t, store.Put(earlier))
+
+			review, err := store.Get("b-review")
+			assert.NoError(t, err)
+			assert.Equal(t, later, review)
+			assert.Equal(t, ReviewPending, review.Status)
+			assert.Equal(t, "workflow is down, INC-123", review.Justification)
+			assert.Equal(t, uint64(1), review.EventSequence)
+
+			reviews, err := store.List()
+			assert.NoError(t, err)
+			if assert.Len(t, reviews, 2) {
+				// Oldest first
+				assert.Equal(t, "a-review", reviews[0].Id)
+				assert.Equal(t, "b-review", reviews[1].Id)
+			}
+
+			_, err = store.Get("nope")
+			assert.EqualError(t, err, "no such review: nope")
+			_, err = store.Get("../../etc/passwd")
+			assert.Error(t, err)
+		})
+	}
+	assert.Contains(t, s3Client.objects, "keymaster/reviews/a-review.json")
+
+	_, err = NewReviewStore("dynamodb://reviews")
+	assert.EqualError(t, err, "unsupported reviews store: dynamodb://reviews")
+}
+
+func TestReviewSignOff(t *testing.T) {
+	now := time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC)
+	review, err := NewReview(breakGlassEvent(t, "r1", now.Add(-time.Hour)))
+	assert.NoError(t, err)
+
+	assert.EqualError(t, review.SignOffBy("SmithB12", "all good", now), "SmithB12 can't review their own break-glass request")
+	assert.EqualError(t, review.SignOffBy("jonesa", " ", now), "review notes are required")
+	assert.EqualError(t, review.SignOffBy("", "all good", now), "a reviewer is required")
+	assert.Equal(t, ReviewPending, review.Status)
+
+	assert.NoError(t, review.SignOffBy("jonesa", "restarted the stuck deploy", now))
+	assert.Equal(t, ReviewSignedOff, review.Status)
+	assert.Equal(t, &SignOff{Reviewer: "jonesa", Time: now, Notes: "restarted the stuck deploy"}, review.SignOff)
+	assert.EqualError(t, review.SignOffBy("jonesa", "again", now), "review r1 is already signed_off")
+
+	_, err = NewReview(&Event{Type: EventIssued})
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// Sink is somewhere audit events are written to.
+type Sink interface {
+	Write(e *Event) error
+}
+
+// NewSink returns a sink for a target:
+//   stdout (or empty)    JSON lines on stdout, e.g. for CloudWatch logs
+//   file:///path         JSON lines appended to a file
+//   s3://bucket/prefix   an object per event
+//   firehose://stream    a record per event, on a Kinesis Firehose stream
+func NewSink(target string) (Sink, error) {
+	switch {
+	case target == "" || target == "stdout":
+		return &WriterSink{W: os.Stdout}, nil
+	case strings.HasPrefix(target, "file://"):
+		return NewFileSink(target[7:])
+	case strings.HasPrefix(target, "s3://"):
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing audit sink")
+		}
+		sess := session.Must(session.NewSession())
+		return &S3Sink{
+			S3:     s3.New(sess),
+			Bucket: u.Host,
+			Prefix: strings.Trim(u.Path, "/"),
+		}, nil
+	case strings.HasPrefix(target, "firehose://"):
+		sess := session.Must(session.NewSession())
+		return &FirehoseSink{
+			Firehose:   firehose.New(sess),
+			StreamName: target[11:],
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported audit sink: %s", target)
+}
+
+func marshalLine(e *Event) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// WriterSink writes events as JSON lines.
+type WriterSink struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+func (s *WriterSink) Write(e *Event) error {
+	line, err := marshalLine(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(line)
+	return err
+}
+
+// FileSink appends events to a file as JSON lines.
+type FileSink struct {
+	WriterSink
+	f *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening audit file")
+	}
+	return &FileSink{WriterSink: WriterSink{W: f}, f: f}, nil
+}
+
+func (s *FileSink) Write(e *Event) error {
+	err := s.WriterSink.Write(e)
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// S3Sink writes each event to its own object, keyed by date, chain and
+// sequence so that a chain lists in order.
+type S3Sink struct {
+	S3     s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+func (s *S3Sink) Key(e *Event) string {
+	key := fmt.Sprintf("%s/%s/%020d.json", e.Time.Format("2006/01/02"), e.Chain, e.Sequence)
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + key
+	}
+	return key
+}
+
+func (s *S3Sink) Write(e *Event) error {
+	data, err := marshalLine(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.S3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(s.Key(e)),
+		Body:        aws.ReadSeekCloser(strings.NewReader(string(data))),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// FirehoseSink writes each event as a record on a Kinesis Firehose
+// delivery stream.
+type FirehoseSink struct {
+	Firehose   firehoseiface.FirehoseAPI
+	StreamName string
+}
+
+func (s *FirehoseSink) Write(e *Event) error {
+	data, err := marshalLine(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.Firehose.PutRecord(&firehose.PutRecordInput{
+		DeliveryStreamName: aws.String(s.StreamName),
+		Record:             &firehose.Record{Data: data},
+	})
+	return err
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Problem is something wrong with an audit chain.
+type Problem struct {
+	Chain    string
+	Sequence uint64
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("chain %s sequence %d: %s", p.Chain, p.Sequence, p.Message)
+}
+
+// ReadEvents reads events written as JSON lines, in any order.
+func ReadEvents(r io.Reader) ([]*Event, error) {
+	var events []*Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := new(Event)
+		err := json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading audit event on line %d", line)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Verify checks events form unbroken hash chains, and returns what is
+// wrong with them. Edited events fail their hash, removed events leave a
+// gap in the sequence or break the link to the previous hash. Events
+// removed from the end of a chain can't be detected from the chain
+// alone.
+func Verify(events []*Event, key []byte) []Problem {
+	chains := make(map[string][]*Event)
+	var chainIds []string
+	for _, e := range events {
+		if _, ok := chains[e.Chain]; !ok {
+			chainIds = append(chainIds, e.Chain)
+		}
+		chains[e.Chain] = append(chains[e.Chain], e)
+	}
+	sort.Strings(chainIds)
+
+	var problems []Problem
+	for _, id := range chainIds {
+		chain := chains[id]
+		sort.SliceStable(chain, func(i, j int) bool {
+			return chain[i].Sequence < chain[j].Sequence
+		})
+		var prev *Event
+		for _, e := range chain {
+			report := func(format string, args ...interface{}) {
+				problems = append(problems, Problem{
+					Chain:    id,
+					Sequence: e.Sequence,
+					Message:  fmt.Sprintf(format, args...),
+				})
+			}
+			hash, err := Hash(e, key)
+			if err != nil {
+				report("%v", err)
+			} else if hash != e.Hash {
+				report("hash does not match, event has been modified")
+			}
+			switch {
+			case prev == nil && e.Sequence != 1:
+				report("chain starts at sequence %d, events 1 to %d are missing", e.Sequence, e.Sequence-1)
+			case prev == nil && e.PrevHash != "":
+				report("first event in chain has a previous hash")
+			case prev != nil && e.Sequence == prev.Sequence:
+				report("duplicate sequence number")
+			case prev != nil && e.Sequence != prev.Sequence+1:
+				report("events %d to %d are missing", prev.Sequence+1, e.Sequence-1)
+			case prev != nil && e.PrevHash != prev.Hash:
+				report("previous hash does not match, chain is broken")
+			}
+			prev = e
+		}
+	}
+	return problems
+}
@@ -1 +1,158 @@
 package client
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Config is the km client configuration file (~/.keymaster.yaml),
+// holding named profiles of client defaults.
+type Config struct {
+	CurrentProfile string              `json:"current_profile,omitempty"`
+	Profiles       map[string]*Profile `json:"profiles,omitempty"`
+}
+
+// Profile holds the client defaults for an issuer and role.
+type Profile struct {
+	Issuer             string `json:"issuer,omitempty"`
+	Role               string `json:"role,omitempty"`
+	Username           string `json:"username,omitempty"`
+	Name               string `json:"name,omitempty"`
+	Email              string `json:"email,omitempty"`
+	AwsCredentialsFile string `json:"aws_credentials_file,omitempty"`
+	AwsProfileName     string `json:"aws_profile_name,omitempty"`
+}
+
+// ProfileKeys are the settings which may be stored in a profile.
+var ProfileKeys = []string{
+	"issuer",
+	"role",
+	"username",
+	"name",
+	"email",
+	"aws_credentials_file",
+	"aws_profile_name",
+}
+
+// LoadConfig reads the client config file. A missing file is not an
+// error, an empty config is returned instead.
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, errors.Wrap(err, "failed to read km config file")
+	}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse km config file: %s", path)
+	}
+	return config, nil
+}
+
+// Save writes the client config file.
+func (c *Config) Save(path string) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal km config")
+	}
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write km config file")
+	}
+	return nil
+}
+
+// Profile returns the named profile, or the current profile if name is
+// empty. It returns nil if there is no such profile.
+func (c *Config) Profile(name string) *Profile {
+	if name == "" {
+		name = c.CurrentProfile
+	}
+	return c.Profiles[name]
+}
+
+// EnsureProfile returns the named profile, creating it if it does not
+// exist yet.
+func (c *Config) EnsureProfile(name string) *Profile {
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*Profile)
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		p = &Profile{}
+		c.Profiles[name] = p
+	}
+	return p
+}
+
+// Use makes the named profile current.
+func (c *Config) Use(name string) error {
+	if _, ok := c.Profiles[name]; !ok {
+		return errors.Errorf("no such profile: %s", name)
+	}
+	c.CurrentProfile = name
+	return nil
+}
+
+// ProfileNames returns the names of all profiles, sorted.
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *Profile) fields() map[string]*string {
+	return map[string]*string{
+		"issuer":               &p.Issuer,
+		"role":                 &p.Role,
+		"username":             &p.Username,
+		"name":                 &p.Name,
+		"email":                &p.Email,
+		"aws_credentials_file": &p.AwsCredentialsFile,
+		"aws_profile_name":     &p.AwsProfileName,
+	}
+}
+
+// Get returns a profile setting by key.
+func (p *Profile) Get(key string) (string, error) {
+	field, ok := p.fields()[key]
+	if !ok {
+		return "", errors.Errorf("unknown profile key: %s", key)
+	}
+	return *field, nil
+}
+
+// Set changes a profile setting by key.
+func (p *Profile) Set(key string, value string) error {
+	field, ok := p.fields()[key]
+	if !ok {
+		return errors.Errorf("unknown profile key: %s", key)
+	}
+	*field = value
+	return nil
+}
+
+// Seed fills in a profile from an issuer's client defaults for a role.
+// Settings already in the profile are kept.
+func (p *Profile) Seed(issuer string, role *api.RoleConfig) {
+	if p.Issuer == "" {
+		p.Issuer = issuer
+	}
+	if p.Role == "" {
+		p.Role = role.Name
+	}
+	if p.AwsProfileName == "" {
+		p.AwsProfileName = role.ClientDefaults.AwsProfileName
+	}
+}
@@ -1 +1,72 @@
 package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLoadAndSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km-config-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".keymaster.yaml")
+
+	// Missing file gives an empty config
+	config, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Nil(t, config.Profile(""))
+
+	p := config.EnsureProfile("nonprod")
+	assert.NoError(t, p.Set("issuer", "arn:aws:lambda:ap-southeast-2:123456789012:function:km"))
+	assert.NoError(t, p.Set("aws_profile_name", "default"))
+	assert.Error(t, p.Set("nope", "x"))
+	assert.NoError(t, config.Use("nonprod"))
+	assert.Error(t, config.Use("prod"))
+	assert.NoError(t, config.Save(path))
+
+	config2, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, config, config2)
+	assert.Equal(t, []string{"nonprod"}, config2.ProfileNames())
+	issuer, err := config2.Profile("").Get("issuer")
+	assert.NoError(t, err)
+	assert.Equal(t, "arn:aws:lambda:ap-southeast-2:123456789012:function:km", issuer)
+	_, err = config2.Profile("nonprod").Get("nope")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("profiles: [broken"), 0600))
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestProfileKeys(t *testing.T) {
+	var p Profile
+	for _, key := range ProfileKeys {
+		assert.NoError(t, p.Set(key, key+"-value"))
+		value, err := p.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, key+"-value", value)
+	}
+	assert.Len(t, p.fields(), len(ProfileKeys))
+}
+
+func TestProfileSeed(t *testing.T) {
+	role := &api.RoleConfig{
+		Name: "deployment",
+		ClientDefaults: api.RoleClientDefaultsConfig{
+			AwsProfileName: "deploy",
+		},
+	}
+	p := Profile{Role: "developer"}
+	p.Seed("km-issuer", role)
+	assert.Equal(t, Profile{
+		Issuer:         "km-issuer",
+		Role:           "developer",
+		AwsProfileName: "deploy",
+	}, p)
+}
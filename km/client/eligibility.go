@@ -0,0 +1,51 @@
+package client
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// TokenRequester describes the holder of a CI identity token, by the
+// issuer's CI idp with the token's issuer. The token is not verified,
+// only the issuer can do that, so this is only good for working out
+// which roles are worth asking for.
+func TokenRequester(config *api.ConfigPublic, token string) (*api.Requester, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return nil, errors.Wrap(err, "parsing ci identity token")
+	}
+	iss, _ := claims["iss"].(string)
+	for _, idp := range config.Idp {
+		var issuer string
+		switch c := idp.Config.(type) {
+		case *api.IdpConfigGitlabJwt:
+			issuer = c.IssuerOrDefault()
+		case *api.IdpConfigGithubOidc:
+			issuer = c.IssuerOrDefault()
+		default:
+			continue
+		}
+		if issuer == iss {
+			return &api.Requester{
+				CIIdpName: idp.Name,
+				CIClaims:  idtoken.Claims(claims).Strings,
+			}, nil
+		}
+	}
+	return nil, errors.Errorf("issuer has no ci idp for tokens from %s", iss)
+}
+
+// EligibleRoles filters role summaries to those a requester is eligible
+// for. Roles without eligibility rules are open to anyone.
+func EligibleRoles(config *api.ConfigPublic, roles []RoleSummary, requester *api.Requester) []RoleSummary {
+	eligible := make([]RoleSummary, 0, len(roles))
+	for _, r := range roles {
+		role := config.FindRoleByName(r.Name)
+		if role == nil || role.Eligibility == nil || role.Eligibility.Check(role.Name, requester) == nil {
+			eligible = append(eligible, r)
+		}
+	}
+	return eligible
+}
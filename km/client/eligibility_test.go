@@ -0,0 +1,84 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/bsycorp/keymaster/km/api"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func eligibilityTestConfig() *api.ConfigPublic {
+	config := testPublicConfig()
+	config.Idp = []api.IdpConfig{
+		{Name: "nonprod", Type: "saml", Config: &api.IdpConfigSaml{}},
+		{Name: "gitlab", Type: "gitlab_jwt", Config: &api.IdpConfigGitlabJwt{Issuer: "gitlab.example.com"}},
+	}
+	config.Roles[0].Eligibility = &api.RoleEligibilityConfig{
+		AllowGroups: []string{"engineers"},
+		DenyGroups:  []string{"contractors"},
+		CIIdentities: []api.RoleCIIdentityConfig{
+			{IdpName: "gitlab", Claims: map[string][]string{"project_path": {"fooproject/deploy"}}},
+		},
+	}
+	return config
+}
+
+func TestTokenRequester(t *testing.T) {
+	config := eligibilityTestConfig()
+	// Signed with anything, it isn't verified
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":          "gitlab.example.com",
+		"project_path": "fooproject/deploy",
+	}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	requester, err := TokenRequester(config, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "gitlab", requester.CIIdpName)
+	assert.Equal(t, []string{"fooproject/deploy"}, requester.CIClaims("project_path"))
+
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "https://token.actions.githubusercontent.com",
+	}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = TokenRequester(config, token)
+	assert.EqualError(t, err, "issuer has no ci idp for tokens from https://token.actions.githubusercontent.com")
+
+	// An idp without an issuer takes tokens from gitlab.com, as the
+	// issuer does
+	config.Idp[1].Config = &api.IdpConfigGitlabJwt{}
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "https://gitlab.com",
+	}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	requester, err = TokenRequester(config, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "gitlab", requester.CIIdpName)
+
+	_, err = TokenRequester(config, "nope")
+	assert.Error(t, err)
+}
+
+func TestEligibleRoles(t *testing.T) {
+	config := eligibilityTestConfig()
+	roles := SummariseRoles(config)
+	names := func(roles []RoleSummary) []string {
+		var names []string
+		for _, r := range roles {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"deployment", "gitlab-deployment"},
+		names(EligibleRoles(config, roles, &api.Requester{Identified: true, Groups: []string{"engineers"}})))
+	assert.Equal(t, []string{"gitlab-deployment"},
+		names(EligibleRoles(config, roles, &api.Requester{Identified: true, Groups: []string{"engineers", "contractors"}})))
+	assert.Equal(t, []string{"deployment", "gitlab-deployment"},
+		names(EligibleRoles(config, roles, &api.Requester{
+			CIIdpName: "gitlab",
+			CIClaims:  func(string) []string { return []string{"fooproject/deploy"} },
+		})))
+	assert.Equal(t, []string{"gitlab-deployment"}, names(EligibleRoles(config, roles, &api.Requester{})))
+}
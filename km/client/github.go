@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// FetchGithubIDToken requests an OIDC token for the running GitHub Actions
+// job, using the request URL and bearer token that GitHub provides in
+// ACTIONS_ID_TOKEN_REQUEST_URL and ACTIONS_ID_TOKEN_REQUEST_TOKEN. If
+// audience is empty GitHub's default audience is used.
+func FetchGithubIDToken(httpClient *http.Client, requestURL string, requestToken string, audience string) (string, error) {
+	if requestURL == "" || requestToken == "" {
+		return "", errors.New("github actions id token request url or token not set, " +
+			"does the workflow have the 'id-token: write' permission?")
+	}
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing github id token request url")
+	}
+	if audience != "" {
+		q := u.Query()
+		q.Set("audience", audience)
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "bearer "+requestToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "error requesting github id token")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading github id token response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("error requesting github id token: StatusCode: %d: Body: %s",
+			resp.StatusCode, string(body))
+	}
+	var tokenResp struct {
+		Value string `json:"value"`
+	}
+	err = json.Unmarshal(body, &tokenResp)
+	if err != nil {
+		return "", errors.Wrap(err, "error parsing github id token response")
+	}
+	if tokenResp.Value == "" {
+		return "", errors.New("github id token response has no token")
+	}
+	return tokenResp.Value, nil
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchGithubIDToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer request-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "1", r.URL.Query().Get("api-version"))
+		if r.URL.Query().Get("audience") == "keymaster" {
+			_, _ = w.Write([]byte(`{"count": 1, "value": "the-token"}`))
+		} else {
+			_, _ = w.Write([]byte(`{"count": 0}`))
+		}
+	}))
+	defer ts.Close()
+
+	token, err := FetchGithubIDToken(ts.Client(), ts.URL+"/token?api-version=1", "request-token", "keymaster")
+	assert.NoError(t, err)
+	assert.Equal(t, "the-token", token)
+
+	_, err = FetchGithubIDToken(ts.Client(), ts.URL+"/token?api-version=1", "request-token", "")
+	assert.Error(t, err)
+
+	_, err = FetchGithubIDToken(ts.Client(), ts.URL+"/token?api-version=1", "wrong-token", "keymaster")
+	assert.Error(t, err)
+
+	_, err = FetchGithubIDToken(ts.Client(), "", "", "keymaster")
+	assert.Error(t, err)
+}
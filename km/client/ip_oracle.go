@@ -0,0 +1,47 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/pkg/errors"
+)
+
+// FetchIPToken requests an ip oracle token vouching for this client's
+// source address from the sign endpoint published by an issuer. The
+// token carries the issuing nonce of the workflow it's for, so it can't
+// be replayed with another request.
+func FetchIPToken(httpClient *http.Client, config *api.IPOraclePublicConfig, nonce string) (string, error) {
+	if config.SignUrl == "" {
+		return "", errors.New("issuer requires an ip oracle token, but publishes no sign url")
+	}
+	reqBody, err := json.Marshal(map[string]string{
+		"Audience": config.Audience,
+		"Nonce":    nonce,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Post(config.SignUrl, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", errors.Wrap(err, "error requesting ip oracle token")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading ip oracle token response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("error requesting ip oracle token: StatusCode: %d: Body: %s",
+			resp.StatusCode, string(body))
+	}
+	token := strings.TrimSpace(string(body))
+	if token == "" {
+		return "", errors.New("ip oracle token response has no token")
+	}
+	return token, nil
+}
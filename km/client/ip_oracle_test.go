@@ -0,0 +1,50 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchIPToken(t *testing.T) {
+	var body map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body["Nonce"] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("header.claims.signature"))
+	}))
+	defer srv.Close()
+
+	token, err := FetchIPToken(srv.Client(), &api.IPOraclePublicConfig{
+		SignUrl: srv.URL,
+		KeyId:   "alias/ip-oracle",
+	}, "nonce-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "header.claims.signature", token)
+	// The oracle's key is its own business
+	assert.Equal(t, map[string]string{"Audience": "", "Nonce": "nonce-1"}, body)
+
+	token, err = FetchIPToken(srv.Client(), &api.IPOraclePublicConfig{
+		SignUrl:  srv.URL,
+		Audience: "nonprod",
+	}, "nonce-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "header.claims.signature", token)
+	assert.Equal(t, "nonprod", body["Audience"])
+
+	_, err = FetchIPToken(srv.Client(), &api.IPOraclePublicConfig{SignUrl: srv.URL}, "")
+	assert.Error(t, err)
+	_, err = FetchIPToken(srv.Client(), &api.IPOraclePublicConfig{}, "nonce-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/api"
+)
+
+// RoleSummary describes what a role issues and what a request for it
+// needs, as published by an issuer.
+type RoleSummary struct {
+	Name                string                        `json:"name"`
+	Environment         string                        `json:"environment"`
+	Credentials         []api.CredentialsPublicConfig `json:"credentials"`
+	ValidForSeconds     int                           `json:"valid_for_seconds"`
+	WorkflowPolicy      string                        `json:"workflow_policy"`
+	Idp                 string                        `json:"idp"`
+	RequesterCanApprove bool                          `json:"requester_can_approve"`
+	IdentifyGroups      map[string]int                `json:"identify_groups,omitempty"`
+	ApproverGroups      map[string]int                `json:"approver_groups,omitempty"`
+	CIIdentity          *api.RoleCIIdentityConfig     `json:"ci_identity,omitempty"`
+	Schedule            *api.RoleScheduleConfig       `json:"schedule,omitempty"`
+	BreakGlass          *api.RoleBreakGlassConfig     `json:"break_glass,omitempty"`
+	Eligibility         *api.RoleEligibilityConfig    `json:"eligibility,omitempty"`
+	Limits              *api.RoleLimitsConfig         `json:"limits,omitempty"`
+}
+
+// SummariseRoles summarises every role in an issuer's public config.
+func SummariseRoles(config *api.ConfigPublic) []RoleSummary {
+	summaries := make([]RoleSummary, 0, len(config.Roles))
+	for i := range config.Roles {
+		summaries = append(summaries, SummariseRole(config, &config.Roles[i]))
+	}
+	return summaries
+}
+
+// SummariseRole summarises a role in an issuer's public config.
+func SummariseRole(config *api.ConfigPublic, role *api.RoleConfig) RoleSummary {
+	summary := RoleSummary{
+		Name:            role.Name,
+		Environment:     config.Name,
+		Credentials:     make([]api.CredentialsPublicConfig, 0, len(role.Credentials)),
+		ValidForSeconds: role.ValidForSeconds,
+		WorkflowPolicy:  role.Workflow,
+		CIIdentity:      role.CIIdentity,
+		Schedule:        role.Schedule,
+		BreakGlass:      role.BreakGlass,
+		Eligibility:     role.Eligibility,
+		Limits:          role.Limits,
+	}
+	for _, credName := range role.Credentials {
+		cred := api.CredentialsPublicConfig{Name: credName, Type: "unknown"}
+		if c := config.FindCredentialByName(credName); c != nil {
+			cred.Type = c.Type
+		}
+		summary.Credentials = append(summary.Credentials, cred)
+	}
+	if policy := config.Workflow.FindPolicyByName(role.Workflow); policy != nil {
+		summary.Idp = policy.IdpName
+		summary.RequesterCanApprove = policy.RequesterCanApprove
+		summary.IdentifyGroups = policy.IdentifyRoles
+		summary.ApproverGroups = policy.ApproverRoles
+	}
+	return summary
+}
+
+// WriteJSON writes role summaries (or anything else) as indented JSON.
+func WriteJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// WriteRolesTable writes role summaries as a table, one role per line.
+func WriteRolesTable(w io.Writer, roles []RoleSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tCREDENTIALS\tVALID FOR\tWORKFLOW\tAPPROVERS\tIDP")
+	for _, r := range roles {
+		creds := make([]string, 0, len(r.Credentials))
+		for _, c := range r.Credentials {
+			creds = append(creds, fmt.Sprintf("%s (%s)", c.Name, c.Type))
+		}
+		idp := r.Idp
+		if r.CIIdentity != nil {
+			idp = strings.TrimPrefix(idp+","+r.CIIdentity.IdpName, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Name,
+			strings.Join(creds, ", "),
+			time.Duration(r.ValidForSeconds)*time.Second,
+			r.WorkflowPolicy,
+			formatGroupCounts(r.ApproverGroups),
+			idp)
+	}
+	return tw.Flush()
+}
+
+// DescribeRole writes a plain English description of what a request for
+// the role will need.
+func DescribeRole(w io.Writer, r *RoleSummary) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-18s %s\n", "Role:", r.Name)
+	fmt.Fprintf(&b, "%-18s %s\n", "Environment:", r.Environment)
+	fmt.Fprintf(&b, "%-18s %s\n", "Valid for:", time.Duration(r.ValidForSeconds)*time.Second)
+	fmt.Fprintf(&b, "Credentials:\n")
+	if len(r.Credentials) == 0 {
+		fmt.Fprintf(&b, "  (none)\n")
+	}
+	for _, c := range r.Credentials {
+		fmt.Fprintf(&b, "  - %s (%s)\n", c.Name, c.Type)
+	}
+	fmt.Fprintf(&b, "%-18s %s\n", "Workflow policy:", r.WorkflowPolicy)
+	if r.Idp != "" {
+		fmt.Fprintf(&b, "%-18s %s\n", "Identity provider:", r.Idp)
+	}
+
+	if r.Eligibility != nil {
+		describeEligibility(&b, r.Eligibility)
+	}
+
+	fmt.Fprintf(&b, "\nTo be issued this role, a request needs:\n")
+	needs := 0
+	if r.CIIdentity != nil {
+		needs++
+		fmt.Fprintf(&b, "  - a CI identity token from idp %s", r.CIIdentity.IdpName)
+		describeClaims(&b, r.CIIdentity.Claims)
+	}
+	for _, group := range sortedGroups(r.IdentifyGroups) {
+		needs++
+		fmt.Fprintf(&b, "  - the requester to identify as a member of %s\n", group)
+	}
+	for _, group := range sortedGroups(r.ApproverGroups) {
+		needs++
+		fmt.Fprintf(&b, "  - %s from members of %s\n", plural(r.ApproverGroups[group], "approval"), group)
+	}
+	if needs == 0 {
+		fmt.Fprintf(&b, "  - nothing, it is issued without approval\n")
+	} else if len(r.ApproverGroups) > 0 {
+		if r.RequesterCanApprove {
+			fmt.Fprintf(&b, "The requester may approve their own request.\n")
+		} else {
+			fmt.Fprintf(&b, "The requester may not approve their own request.\n")
+		}
+	}
+	if r.Schedule != nil {
+		describeSchedule(&b, r.Schedule)
+	}
+	if bg := r.BreakGlass; bg != nil {
+		approvals := "no approvals"
+		if len(bg.ApproverRoles) > 0 {
+			approvals = formatGroupCounts(bg.ApproverRoles)
+		}
+		validFor := r.ValidForSeconds
+		if bg.MaxValidForSeconds > 0 && bg.MaxValidForSeconds < validFor {
+			validFor = bg.MaxValidForSeconds
+		}
+		fmt.Fprintf(&b, "\nIn an emergency it can be requested with --break-glass and a justification,\n")
+		fmt.Fprintf(&b, "needing %s, for %s. Such requests are announced and must be reviewed.\n",
+			approvals, time.Duration(validFor)*time.Second)
+	}
+	if r.Limits != nil {
+		describeLimits(&b, r.Limits)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func describeLimits(b *strings.Builder, l *api.RoleLimitsConfig) {
+	fmt.Fprintf(b, "\nIt is rate limited:\n")
+	if l.PerRequester != nil {
+		fmt.Fprintf(b, "  - each requester may be issued %s\n", formatLimit(l.PerRequester))
+	}
+	if l.PerRole != nil {
+		fmt.Fprintf(b, "  - everyone together may be issued %s\n", formatLimit(l.PerRole))
+	}
+}
+
+func formatLimit(l *api.LimitConfig) string {
+	var limits []string
+	if l.IssuancesPerHour > 0 {
+		limits = append(limits, plural(l.IssuancesPerHour, "credential")+" an hour")
+	}
+	if l.MaxActive > 0 {
+		limits = append(limits, fmt.Sprintf("at most %d unexpired at once", l.MaxActive))
+	}
+	if len(limits) == 0 {
+		return "any number of credentials"
+	}
+	return strings.Join(limits, ", and ")
+}
+
+func describeEligibility(b *strings.Builder, e *api.RoleEligibilityConfig) {
+	fmt.Fprintf(b, "\nOnly these requesters may ask for the role:\n")
+	if len(e.AllowGroups) > 0 {
+		fmt.Fprintf(b, "  - members of %s, who identify themselves", strings.Join(e.AllowGroups, ", "))
+		if len(e.DenyGroups) > 0 {
+			fmt.Fprintf(b, ", unless they are members of %s", strings.Join(e.DenyGroups, ", "))
+		}
+		fmt.Fprintf(b, "\n")
+	}
+	for _, ci := range e.CIIdentities {
+		fmt.Fprintf(b, "  - holders of a CI identity token from idp %s", ci.IdpName)
+		describeClaims(b, ci.Claims)
+	}
+}
+
+func describeClaims(b *strings.Builder, claims map[string][]string) {
+	if len(claims) == 0 {
+		fmt.Fprintf(b, "\n")
+		return
+	}
+	fmt.Fprintf(b, ", with claims:\n")
+	for _, name := range sortedKeys(claims) {
+		fmt.Fprintf(b, "      %s matching one of: %s\n", name, strings.Join(claims[name], ", "))
+	}
+}
+
+func describeSchedule(b *strings.Builder, s *api.RoleScheduleConfig) {
+	timezone := s.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	fmt.Fprintf(b, "\nThe role can only be used")
+	if len(s.Windows) == 0 {
+		fmt.Fprintf(b, " outside of blackouts (%s):\n", timezone)
+	} else {
+		fmt.Fprintf(b, " in these windows (%s):\n", timezone)
+	}
+	for _, w := range s.Windows {
+		fmt.Fprintf(b, "  - %s %s-%s\n", strings.Join(w.Days, ","), w.Start, w.End)
+	}
+	for _, blackout := range s.Blackouts {
+		name := blackout.Name
+		if name == "" {
+			name = "blackout"
+		}
+		fmt.Fprintf(b, "  - not during %s, %s to %s\n", name, blackout.Start, blackout.End)
+	}
+	if s.OutsideWindows != nil && len(s.Windows) > 0 {
+		fmt.Fprintf(b, "Outside its windows it needs %s as well.\n", formatGroupCounts(s.OutsideWindows.ApproverRoles))
+	}
+}
+
+func formatGroupCounts(groups map[string]int) string {
+	if len(groups) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(groups))
+	for _, group := range sortedGroups(groups) {
+		parts = append(parts, fmt.Sprintf("%dx %s", groups[group], group))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func sortedGroups(groups map[string]int) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(m map[string][]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPublicConfig() *api.ConfigPublic {
+	return &api.ConfigPublic{
+		Name: "fooproject_nonprod",
+		Roles: []api.RoleConfig{
+			{
+				Name:            "deployment",
+				Credentials:     []string{"kube-admin", "aws-admin"},
+				Workflow:        "deploy_with_approval",
+				ValidForSeconds: 3600,
+			},
+			{
+				Name:            "gitlab-deployment",
+				Credentials:     []string{"aws-admin", "deleted"},
+				Workflow:        "auto",
+				ValidForSeconds: 900,
+				CIIdentity: &api.RoleCIIdentityConfig{
+					IdpName: "gitlab",
+					Claims: map[string][]string{
+						"ref_protected": {"true"},
+						"project_path":  {"fooproject/*"},
+					},
+				},
+			},
+		},
+		Workflow: api.WorkflowConfig{
+			Policies: []api.WorkflowPolicyConfig{
+				{
+					Name:    "deploy_with_approval",
+					IdpName: "nonprod",
+					ApproverRoles: map[string]int{
+						"technical_approver": 1,
+						"business_approver":  2,
+					},
+				},
+				{
+					Name: "auto",
+				},
+			},
+		},
+		Credentials: []api.CredentialsPublicConfig{
+			{Name: "kube-admin", Type: "kubernetes"},
+			{Name: "aws-admin", Type: "iam_assume_role"},
+		},
+	}
+}
+
+func TestSummariseRoles(t *testing.T) {
+	roles := SummariseRoles(testPublicConfig())
+	assert.Len(t, roles, 2)
+	assert.Equal(t, RoleSummary{
+		Name:        "deployment",
+		Environment: "fooproject_nonprod",
+		Credentials: []api.CredentialsPublicConfig{
+			{Name: "kube-admin", Type: "kubernetes"},
+			{Name: "aws-admin", Type: "iam_assume_role"},
+		},
+		ValidForSeconds: 3600,
+		WorkflowPolicy:  "deploy_with_approval",
+		Idp:             "nonprod",
+		ApproverGroups: map[string]int{
+			"technical_approver": 1,
+			"business_approver":  2,
+		},
+	}, roles[0])
+	assert.Equal(t, "unknown", roles[1].Credentials[1].Type)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteJSON(&buf, roles))
+	var decoded []RoleSummary
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, roles, decoded)
+}
+
+func TestWriteRolesTable(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteRolesTable(&buf, SummariseRoles(testPublicConfig())))
+	expected := `ROLE               CREDENTIALS                                           VALID FOR  WORKFLOW              APPROVERS                                    IDP
+deployment         kube-admin (kubernetes), aws-admin (iam_assume_role)  1h0m0s     deploy_with_approval  2x business_approver, 1x technical_approver  nonprod
+gitlab-deployment  aws-admin (iam_assume_role), deleted (unknown)        15m0s      auto                  -                                            gitlab
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestDescribeRole(t *testing.T) {
+	config := testPublicConfig()
+
+	var buf bytes.Buffer
+	summary := SummariseRole(config, config.FindRoleByName("deployment"))
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	expected := `Role:              deployment
+Environment:       fooproject_nonprod
+Valid for:         1h0m0s
+Credentials:
+  - kube-admin (kubernetes)
+  - aws-admin (iam_assume_role)
+Workflow policy:   deploy_with_approval
+Identity provider: nonprod
+
+To be issued this role, a request needs:
+  - 2 approvals from members of business_approver
+  - 1 approval from members of technical_approver
+The requester may not approve their own request.
+`
+	assert.Equal(t, expected, buf.String())
+
+	buf.Reset()
+	summary = SummariseRole(config, config.FindRoleByName("gitlab-deployment"))
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	assert.Contains(t, buf.String(), `  - a CI identity token from idp gitlab, with claims:
+      project_path matching one of: fooproject/*
+      ref_protected matching one of: true
+`)
+
+	buf.Reset()
+	summary = SummariseRole(config, &api.RoleConfig{
+		Name: "office-hours",
+		Schedule: &api.RoleScheduleConfig{
+			Timezone:       "Australia/Sydney",
+			Windows:        []api.TimeWindowConfig{{Days: []string{"mon-fri"}, Start: "09:00", End: "17:00"}},
+			Blackouts:      []api.BlackoutConfig{{Name: "change freeze", Start: "2026-12-21", End: "2027-01-04"}},
+			OutsideWindows: &api.RoleEscalationConfig{ApproverRoles: map[string]int{"ops": 1}},
+		},
+	})
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	assert.Contains(t, buf.String(), `
+The role can only be used in these windows (Australia/Sydney):
+  - mon-fri 09:00-17:00
+  - not during change freeze, 2026-12-21 to 2027-01-04
+Outside its windows it needs 1x ops as well.
+`)
+
+	buf.Reset()
+	summary = SummariseRole(config, &api.RoleConfig{
+		Name:            "breakable",
+		ValidForSeconds: 3600,
+		BreakGlass:      &api.RoleBreakGlassConfig{MaxValidForSeconds: 900},
+	})
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	assert.Contains(t, buf.String(), `
+In an emergency it can be requested with --break-glass and a justification,
+needing no approvals, for 15m0s. Such requests are announced and must be reviewed.
+`)
+
+	buf.Reset()
+	summary = SummariseRole(config, &api.RoleConfig{
+		Name: "engineers-only",
+		Eligibility: &api.RoleEligibilityConfig{
+			AllowGroups: []string{"engineers"},
+			DenyGroups:  []string{"contractors"},
+			CIIdentities: []api.RoleCIIdentityConfig{
+				{IdpName: "gitlab", Claims: map[string][]string{"project_path": {"fooproject/deploy"}}},
+			},
+		},
+	})
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	assert.Contains(t, buf.String(), `
+Only these requesters may ask for the role:
+  - members of engineers, who identify themselves, unless they are members of contractors
+  - holders of a CI identity token from idp gitlab, with claims:
+      project_path matching one of: fooproject/deploy
+`)
+
+	buf.Reset()
+	summary = SummariseRole(config, &api.RoleConfig{
+		Name: "limited",
+		Limits: &api.RoleLimitsConfig{
+			PerRequester: &api.LimitConfig{IssuancesPerHour: 1, MaxActive: 1},
+			PerRole:      &api.LimitConfig{IssuancesPerHour: 20},
+		},
+	})
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	assert.Contains(t, buf.String(), `
+It is rate limited:
+  - each requester may be issued 1 credential an hour, and at most 1 unexpired at once
+  - everyone together may be issued 20 credentials an hour
+`)
+
+	buf.Reset()
+	summary = SummariseRole(config, &api.RoleConfig{Name: "free-for-all"})
+	assert.NoError(t, DescribeRole(&buf, &summary))
+	assert.Contains(t, buf.String(), "nothing, it is issued without approval")
+}
@@ -0,0 +1,113 @@
+package creds
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+)
+
+// IdpUserPrincipal in a principals list is replaced with the username.
+const IdpUserPrincipal = "$idpuser"
+
+// DefaultSSHExtensions are the extensions user certificates carry.
+var DefaultSSHExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// SSHCAIssuer issues SSH user certificates, signed with a CA key that is
+// loaded (or for a KMS key, found) each time, rather than kept in config.
+type SSHCAIssuer struct {
+	Name       string
+	CAKey      string
+	Principals []string
+	Keys       *CAKeyLoader
+	Clock      clockwork.Clock
+}
+
+func (i *SSHCAIssuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
+	ca, err := i.Keys.SSHSigner(i.CAKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ssh ca key for %s", i.Name)
+	}
+	principals := make([]string, len(i.Principals))
+	for n, p := range i.Principals {
+		principals[n] = strings.Replace(p, IdpUserPrincipal, u.Username, -1)
+	}
+	user := &UserInfo{
+		Identity:        u.Username,
+		Principals:      principals,
+		ValidForSeconds: u.ValidFor,
+	}
+	issuer := &SSHIssuer{Random: rand.Reader, Clock: i.Clock}
+	publicKey, privateKey, err := issuer.GenerateKeyPair(user)
+	if err != nil {
+		return nil, err
+	}
+	sshCreds, err := issuer.CreateSignedCertificate(ca, publicKey, privateKey, user, DefaultSSHExtensions, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []api.Cred{
+		{
+			Name:   i.Name,
+			Type:   "ssh",
+			Expiry: i.Clock.Now().Add(time.Duration(u.ValidFor) * time.Second).Unix(),
+			Value: &api.SSHCred{
+				Username:    u.Username,
+				Certificate: sshCreds.Certificate,
+				PrivateKey:  sshCreds.PrivateKey,
+			},
+		},
+	}, nil
+}
+
+// KubeCAIssuer issues kubernetes client certificates, signed with a CA
+// key that is loaded each time, as per SSHCAIssuer.
+type KubeCAIssuer struct {
+	Name   string
+	CACert string
+	CAKey  string
+	Keys   *CAKeyLoader
+	Clock  clockwork.Clock
+}
+
+func (i *KubeCAIssuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
+	certPem, err := i.Keys.Load(i.CACert)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading kube ca cert for %s", i.Name)
+	}
+	signer, err := i.Keys.Signer(i.CAKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kube ca key for %s", i.Name)
+	}
+	issuer, err := NewKubeIssuerWithSigner(certPem, signer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing kube ca for %s", i.Name)
+	}
+	issuer.Clock = i.Clock
+	keyPair, err := issuer.GenerateUserKeyPair(u.Username, nil, u.ValidFor)
+	if err != nil {
+		return nil, err
+	}
+	encoded := keyPair.Encode()
+	return []api.Cred{
+		{
+			Name:   i.Name,
+			Type:   "kube",
+			Expiry: i.Clock.Now().Add(time.Duration(u.ValidFor) * time.Second).Unix(),
+			Value: &api.KubeCred{
+				Username:   u.Username,
+				PrivateKey: string(encoded.PrivateKeyPEM),
+				PublicKey:  string(encoded.PublicKeyPEM),
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,99 @@
+package creds
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHCAIssuer(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC))
+	var loaded []string
+	issuer := &SSHCAIssuer{
+		Name:       "ssh-all",
+		CAKey:      "file://testdata/test_ca_user_key",
+		Principals: []string{IdpUserPrincipal, "core"},
+		Keys: &CAKeyLoader{Load: func(s string) ([]byte, error) {
+			loaded = append(loaded, s)
+			return util.Load(s)
+		}},
+		Clock: clock,
+	}
+	creds, err := issuer.IssueFor(&api.AuthInfo{Environment: "nonprod", Role: "deployment", Username: "fred", ValidFor: 3600})
+	assert.NoError(t, err)
+	assert.Len(t, creds, 1)
+	assert.Equal(t, "ssh-all", creds[0].Name)
+	assert.Equal(t, "ssh", creds[0].Type)
+	assert.Equal(t, clock.Now().Add(time.Hour).Unix(), creds[0].Expiry)
+	// The CA key is loaded when issuing
+	assert.Equal(t, []string{"file://testdata/test_ca_user_key"}, loaded)
+
+	sshCred := creds[0].Value.(*api.SSHCred)
+	assert.Equal(t, "fred", sshCred.Username)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(sshCred.Certificate)
+	assert.NoError(t, err)
+	cert := pub.(*ssh.Certificate)
+	assert.Equal(t, []string{"fred", "core"}, cert.ValidPrincipals)
+	assert.Equal(t, "fred", cert.KeyId)
+	assert.Equal(t, uint64(clock.Now().Add(time.Hour).Unix()), cert.ValidBefore)
+	_, ok := cert.Extensions["permit-pty"]
+	assert.True(t, ok)
+	// RSA CAs sign with SHA-256, not SHA-1
+	assert.Equal(t, ssh.SigAlgoRSASHA2256, cert.Signature.Format)
+
+	issuer.CAKey = "file://testdata/nope"
+	_, err = issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+	assert.Error(t, err)
+	issuer.CAKey = "not a key"
+	_, err = issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+	assert.Error(t, err)
+}
+
+func TestKubeCAIssuer(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	issuer := &KubeCAIssuer{
+		Name:   "kube-admin",
+		CACert: "file://" + CaTestCertFile,
+		CAKey:  "file://" + CaTestCertKey,
+		Keys:   &CAKeyLoader{Load: util.Load},
+		Clock:  clock,
+	}
+	creds, err := issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+	assert.NoError(t, err)
+	assert.Len(t, creds, 1)
+	assert.Equal(t, "kube", creds[0].Type)
+	kubeCred := creds[0].Value.(*api.KubeCred)
+	assert.Equal(t, "fred", kubeCred.Username)
+	block, _ := pem.Decode([]byte(kubeCred.PublicKey))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, "fred", cert.Subject.CommonName)
+	assert.Equal(t, clock.Now().Add(time.Hour).Unix(), cert.NotAfter.Unix())
+
+	issuer.CAKey = "file://testdata/test_ca_user_key"
+	_, err = issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+	assert.Error(t, err)
+}
+
+func TestNewFromConfig(t *testing.T) {
+	config := &api.Config{
+		Credentials: []api.CredentialsConfig{
+			{Name: "ssh", Type: "ssh_ca", Config: &api.CredentialsConfigSSH{CAKey: "ssm:///ca", Principals: []string{"core"}}},
+			{Name: "kube", Type: "kubernetes", Config: &api.CredentialsConfigKube{CACert: "ca.crt", CAKey: "ssm:///kube"}},
+		},
+	}
+	issuer, err := NewFromConfig(&api.RoleConfig{Name: "deployment", Credentials: []string{"ssh", "kube"}}, config)
+	assert.NoError(t, err)
+	assert.Len(t, issuer.issuers, 2)
+	assert.Equal(t, "ssm:///ca", issuer.issuers[0].(*SSHCAIssuer).CAKey)
+
+	_, err = NewFromConfig(&api.RoleConfig{Name: "deployment", Credentials: []string{"nope"}}, config)
+	assert.EqualError(t, err, "role deployment references unknown credential: nope")
+}
@@ -7,10 +7,14 @@ import (
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/bsycorp/keymaster/km/api"
 	"github.com/bsycorp/keymaster/km/util"
+	"github.com/jonboulle/clockwork"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// SupportedTypes are the credential config types that can be issued.
+var SupportedTypes = []string{"iam_assume_role", "ssh_ca", "kubernetes"}
+
 type issuer interface {
 	IssueFor(u *api.AuthInfo) ([]api.Cred, error)
 }
@@ -26,10 +30,29 @@ func NewFromConfig(role *api.RoleConfig, config *api.Config) (*Issuer, error) {
 	var issuer Issuer
 	for _, credName := range role.Credentials {
 		credConfig := config.FindCredentialByName(credName)
+		if credConfig == nil {
+			return nil, errors.Errorf("role %s references unknown credential: %s", role.Name, credName)
+		}
 		switch c := credConfig.Config.(type) {
 		case *api.CredentialsConfigIAMAssumeRole:
 			i := NewSTSIssuer(sts.New(sess), c.TargetRole)
 			issuer.issuers = append(issuer.issuers, i)
+		case *api.CredentialsConfigSSH:
+			issuer.issuers = append(issuer.issuers, &SSHCAIssuer{
+				Name:       credName,
+				CAKey:      c.CAKey,
+				Principals: c.Principals,
+				Keys:       DefaultCAKeyLoader(),
+				Clock:      clockwork.NewRealClock(),
+			})
+		case *api.CredentialsConfigKube:
+			issuer.issuers = append(issuer.issuers, &KubeCAIssuer{
+				Name:   credName,
+				CACert: c.CACert,
+				CAKey:  c.CAKey,
+				Keys:   DefaultCAKeyLoader(),
+				Clock:  clockwork.NewRealClock(),
+			})
 		default:
 			log.Printf("TODO: unimplemented cred config type for: %s", credName)
 		}
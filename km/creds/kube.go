@@ -1,6 +1,7 @@
 package creds
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -24,7 +25,10 @@ const (
 )
 
 type KubeIssuer struct {
-	CAKeypair     *tls.Certificate
+	CAKeypair *tls.Certificate
+	// CASigner signs certificates, the CA keypair's private key or e.g.
+	// a KMSSigner
+	CASigner      crypto.Signer
 	CACert        *x509.Certificate
 	CACertEncoded string
 	Clock         clockwork.Clock
@@ -51,11 +55,45 @@ func NewKubeIssuer(certPem, keyPem []byte) (*KubeIssuer, error) {
 		return nil, err
 	}
 	issuer.CAKeypair = &caKeypair
+	issuer.CASigner = caKeypair.PrivateKey.(crypto.Signer)
 	issuer.CACert = caCert
 	issuer.Clock = clockwork.NewRealClock()
 	return &issuer, nil
 }
 
+// NewKubeIssuerWithSigner returns an issuer for a CA certificate whose
+// key is held by signer, e.g. in KMS.
+func NewKubeIssuerWithSigner(certPem []byte, signer crypto.Signer) (*KubeIssuer, error) {
+	block, _ := pem.Decode(certPem)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in ca cert")
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !publicKeysEqual(caCert.PublicKey, signer.Public()) {
+		return nil, errors.New("ca cert does not match the ca key")
+	}
+	return &KubeIssuer{
+		CASigner: signer,
+		CACert:   caCert,
+		Clock:    clockwork.NewRealClock(),
+	}, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	aDer, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDer, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDer, bDer)
+}
+
 func RandomSerial() (*big.Int, error) {
 	// CA serial values are supposed to be *guaranteed* unique. But 63 bits
 	// of randomness should be good enough given reasonable birthday bounds.
@@ -137,7 +175,7 @@ func (issuer *KubeIssuer) GenerateUserKeyPair(cn string, orgs []string, validFor
 
 	// Sign the certificate
 	log.Println("signing user certificate")
-	signedCert, err := x509.CreateCertificate(rand.Reader, cert, issuer.CACert, pub, issuer.CAKeypair.PrivateKey)
+	signedCert, err := x509.CreateCertificate(rand.Reader, cert, issuer.CACert, pub, issuer.CASigner)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,183 @@
+package creds
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// KMSKeyPrefix marks a CA key that is an asymmetric KMS key, e.g.
+// kms://alias/keymaster-ssh-ca, rather than a reference to a PEM key.
+const KMSKeyPrefix = "kms://"
+
+// KMSSigner is a crypto.Signer backed by an asymmetric KMS key (RSA or
+// ECDSA), so the private key never leaves KMS.
+type KMSSigner struct {
+	KMS   kmsiface.KMSAPI
+	KeyId string
+
+	publicKey crypto.PublicKey
+}
+
+// NewKMSSigner returns a signer for a KMS key, fetching its public key.
+func NewKMSSigner(client kmsiface.KMSAPI, keyId string) (*KMSSigner, error) {
+	out, err := client.GetPublicKey(&kms.GetPublicKeyInput{
+		KeyId: aws.String(keyId),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting kms public key for %s", keyId)
+	}
+	if aws.StringValue(out.KeyUsage) != kms.KeyUsageTypeSignVerify {
+		return nil, errors.Errorf("kms key %s is not a signing key", keyId)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing kms public key for %s", keyId)
+	}
+	return &KMSSigner{KMS: client, KeyId: keyId, publicKey: pub}, nil
+}
+
+func (s *KMSSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs a digest with KMS. As for rsa.PrivateKey, RSA signatures
+// are PKCS #1 v1.5 unless opts is *rsa.PSSOptions. ECDSA signatures are
+// ASN.1 encoded, as for ecdsa.PrivateKey.
+func (s *KMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := kmsSigningAlgorithm(s.publicKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.KMS.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.KeyId),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error signing with kms key %s", s.KeyId)
+	}
+	return out.Signature, nil
+}
+
+// kmsSigningAlgorithm returns the KMS signing algorithm for a key type,
+// hash and padding.
+func kmsSigningAlgorithm(pub crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	var bits string
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		bits = "256"
+	case crypto.SHA384:
+		bits = "384"
+	case crypto.SHA512:
+		bits = "512"
+	default:
+		return "", errors.Errorf("unsupported hash for kms signing: %v", opts.HashFunc())
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return "RSASSA_PSS_SHA_" + bits, nil
+		}
+		return "RSASSA_PKCS1_V1_5_SHA_" + bits, nil
+	case *ecdsa.PublicKey:
+		return "ECDSA_SHA_" + bits, nil
+	}
+	return "", errors.Errorf("unsupported kms key type: %T", pub)
+}
+
+// CAKeyLoader loads CA signers from config references: kms:// keys sign
+// with KMS, and anything else is loaded (see util.Load) as a PEM private
+// key, for a local software signer.
+type CAKeyLoader struct {
+	Load func(string) ([]byte, error)
+	KMS  kmsiface.KMSAPI
+}
+
+var (
+	defaultCAKeyLoaderOnce sync.Once
+	defaultCAKeyLoader     *CAKeyLoader
+)
+
+// DefaultCAKeyLoader returns a CAKeyLoader using util.Load, and a KMS
+// client for the region of the environment or shared config.
+func DefaultCAKeyLoader() *CAKeyLoader {
+	defaultCAKeyLoaderOnce.Do(func() {
+		sess := session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		}))
+		defaultCAKeyLoader = &CAKeyLoader{Load: util.Load, KMS: kms.New(sess)}
+	})
+	return defaultCAKeyLoader
+}
+
+// Signer returns the signer for a CA key reference.
+func (l *CAKeyLoader) Signer(ref string) (crypto.Signer, error) {
+	if strings.HasPrefix(ref, KMSKeyPrefix) {
+		return NewKMSSigner(l.KMS, ref[len(KMSKeyPrefix):])
+	}
+	data, err := l.Load(ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading ca key")
+	}
+	key, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ca key")
+	}
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		key = *k
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported ca key type: %T", key)
+	}
+	return signer, nil
+}
+
+// Check checks a CA key reference can be loaded and signed with.
+func (l *CAKeyLoader) Check(ref string) error {
+	_, err := l.Signer(ref)
+	return err
+}
+
+// SSHSigner returns an ssh.Signer for a CA key reference. RSA keys sign
+// with rsa-sha2-256 rather than SHA-1, which KMS can't sign with (and
+// OpenSSH no longer accepts).
+func (l *CAKeyLoader) SSHSigner(ref string) (ssh.Signer, error) {
+	signer, err := l.Signer(ref)
+	if err != nil {
+		return nil, err
+	}
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "unsupported ssh ca key")
+	}
+	if _, ok := signer.Public().(*rsa.PublicKey); ok {
+		if algorithmSigner, ok := sshSigner.(ssh.AlgorithmSigner); ok {
+			return rsaSHA256Signer{algorithmSigner}, nil
+		}
+	}
+	return sshSigner, nil
+}
+
+type rsaSHA256Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (s rsaSHA256Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2256)
+}
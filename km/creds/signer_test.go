@@ -0,0 +1,214 @@
+package creds
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeKMS signs with local keys, as KMS would with the same keys.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	keys  map[string]crypto.Signer
+	signs []string
+}
+
+func (f *fakeKMS) GetPublicKey(in *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	key, ok := f.keys[aws.StringValue(in.KeyId)]
+	if !ok {
+		return nil, errors.New("NotFoundException")
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{
+		KeyId:     in.KeyId,
+		KeyUsage:  aws.String(kms.KeyUsageTypeSignVerify),
+		PublicKey: der,
+	}, nil
+}
+
+func (f *fakeKMS) Sign(in *kms.SignInput) (*kms.SignOutput, error) {
+	key := f.keys[aws.StringValue(in.KeyId)]
+	if aws.StringValue(in.MessageType) != kms.MessageTypeDigest {
+		return nil, errors.New("ValidationException")
+	}
+	algorithm := aws.StringValue(in.SigningAlgorithm)
+	f.signs = append(f.signs, algorithm)
+	var opts crypto.SignerOpts
+	switch {
+	case strings.HasSuffix(algorithm, "_256"):
+		opts = crypto.SHA256
+	case strings.HasSuffix(algorithm, "_384"):
+		opts = crypto.SHA384
+	case strings.HasSuffix(algorithm, "_512"):
+		opts = crypto.SHA512
+	}
+	if len(in.Message) != opts.HashFunc().Size() {
+		return nil, errors.New("ValidationException: digest length")
+	}
+	if strings.HasPrefix(algorithm, "RSASSA_PSS") {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: opts.HashFunc()}
+	}
+	sig, err := key.Sign(rand.Reader, in.Message, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: in.KeyId, Signature: sig, SigningAlgorithm: in.SigningAlgorithm}, nil
+}
+
+func testKMS(t *testing.T) *fakeKMS {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return &fakeKMS{keys: map[string]crypto.Signer{
+		"alias/rsa-ca": rsaKey,
+		"alias/ec-ca":  ecKey,
+	}}
+}
+
+func TestKMSSigner(t *testing.T) {
+	client := testKMS(t)
+	digest := make([]byte, 32)
+
+	signer, err := NewKMSSigner(client, "alias/rsa-ca")
+	assert.NoError(t, err)
+	pub := signer.Public().(*rsa.PublicKey)
+	sig, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	assert.NoError(t, err)
+	assert.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig))
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	sig, err = signer.Sign(rand.Reader, digest, pss)
+	assert.NoError(t, err)
+	assert.NoError(t, rsa.VerifyPSS(pub, crypto.SHA256, digest, sig, pss))
+	// KMS can't sign SHA-1 digests
+	_, err = signer.Sign(rand.Reader, digest[:20], crypto.SHA1)
+	assert.Error(t, err)
+
+	signer, err = NewKMSSigner(client, "alias/ec-ca")
+	assert.NoError(t, err)
+	sig, err = signer.Sign(rand.Reader, digest, crypto.SHA256)
+	assert.NoError(t, err)
+	var ecSig struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(sig, &ecSig)
+	assert.NoError(t, err)
+	assert.True(t, ecdsa.Verify(signer.Public().(*ecdsa.PublicKey), digest, ecSig.R, ecSig.S))
+
+	assert.Equal(t, []string{"RSASSA_PKCS1_V1_5_SHA_256", "RSASSA_PSS_SHA_256", "ECDSA_SHA_256"}, client.signs)
+
+	_, err = NewKMSSigner(client, "alias/nope")
+	assert.Error(t, err)
+}
+
+func TestSSHCAIssuerWithKMS(t *testing.T) {
+	client := testKMS(t)
+	for _, keyId := range []string{"alias/rsa-ca", "alias/ec-ca"} {
+		issuer := &SSHCAIssuer{
+			Name:       "ssh",
+			CAKey:      "kms://" + keyId,
+			Principals: []string{IdpUserPrincipal},
+			Keys:       &CAKeyLoader{KMS: client},
+			Clock:      clockwork.NewRealClock(),
+		}
+		creds, err := issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+		if !assert.NoError(t, err, keyId) {
+			continue
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(creds[0].Value.(*api.SSHCred).Certificate)
+		assert.NoError(t, err)
+		cert := pub.(*ssh.Certificate)
+
+		// The certificate checks out against the KMS public key
+		caPub, err := ssh.NewPublicKey(client.keys[keyId].Public())
+		assert.NoError(t, err)
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) == string(caPub.Marshal())
+			},
+		}
+		assert.NoError(t, checker.CheckCert("fred", cert), keyId)
+	}
+}
+
+func TestKubeCAIssuerWithKMS(t *testing.T) {
+	client := testKMS(t)
+	for _, keyId := range []string{"alias/rsa-ca", "alias/ec-ca"} {
+		caKey := client.keys[keyId]
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "kube-ca"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+		assert.NoError(t, err)
+		caCertPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		caCert, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+
+		issuer := &KubeCAIssuer{
+			Name:   "kube",
+			CACert: "file://kube-ca.crt",
+			CAKey:  "kms://" + keyId,
+			Keys: &CAKeyLoader{
+				KMS: client,
+				Load: func(s string) ([]byte, error) {
+					return caCertPem, nil
+				},
+			},
+			Clock: clockwork.NewRealClock(),
+		}
+		creds, err := issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+		if !assert.NoError(t, err, keyId) {
+			continue
+		}
+		block, _ := pem.Decode([]byte(creds[0].Value.(*api.KubeCred).PublicKey))
+		cert, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		assert.NoError(t, cert.CheckSignatureFrom(caCert), keyId)
+
+		// The cert has to match the key
+		issuer.CAKey = "kms://alias/rsa-ca"
+		if keyId == "alias/rsa-ca" {
+			issuer.CAKey = "kms://alias/ec-ca"
+		}
+		_, err = issuer.IssueFor(&api.AuthInfo{Username: "fred", ValidFor: 3600})
+		assert.Error(t, err)
+	}
+}
+
+func TestCAKeyLoaderCheck(t *testing.T) {
+	keys := &CAKeyLoader{
+		KMS: testKMS(t),
+		Load: func(s string) ([]byte, error) {
+			return []byte(s), nil
+		},
+	}
+	assert.NoError(t, keys.Check("kms://alias/ec-ca"))
+	assert.Error(t, keys.Check("kms://alias/nope"))
+	assert.Error(t, keys.Check("not a key"))
+}
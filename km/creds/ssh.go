@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"github.com/bsycorp/keymaster/km/api"
 	"github.com/jonboulle/clockwork"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
@@ -14,7 +15,7 @@ import (
 
 const (
 	KeyBits            = 2048
-	MaxValidForSeconds = 7 * 24 * 3600
+	MaxValidForSeconds = api.MaxSSHValidForSeconds
 )
 
 type UserInfo struct {
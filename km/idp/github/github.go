@@ -0,0 +1,40 @@
+package github
+
+import (
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/pkg/errors"
+)
+
+// DefaultIssuer is the issuer of GitHub Actions OIDC tokens.
+const DefaultIssuer = "https://token.actions.githubusercontent.com"
+
+// JwksURL returns the location of the JWKS for a GitHub OIDC issuer.
+func JwksURL(issuer string) string {
+	return strings.TrimRight(issuer, "/") + "/.well-known/jwks"
+}
+
+// TokenProcessor verifies GitHub Actions OIDC tokens.
+type TokenProcessor struct {
+	Verifier *idtoken.Verifier
+}
+
+func (p *TokenProcessor) Process(token string) (*idtoken.Identity, error) {
+	if token == "" {
+		return nil, errors.New("no github actions oidc token provided")
+	}
+	claims, err := p.Verifier.Verify(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "github actions oidc token verification failed")
+	}
+	username := claims.String("actor")
+	if username == "" {
+		return nil, errors.New("github actions oidc token has no actor claim")
+	}
+	return &idtoken.Identity{
+		Subject:  claims.String("sub"),
+		Username: username,
+		Claims:   claims,
+	}, nil
+}
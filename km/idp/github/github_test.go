@@ -0,0 +1,68 @@
+package github
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJwksURL(t *testing.T) {
+	assert.Equal(t, "https://token.actions.githubusercontent.com/.well-known/jwks", JwksURL(DefaultIssuer))
+}
+
+func TestTokenProcessor(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tp := &TokenProcessor{
+		Verifier: &idtoken.Verifier{
+			Issuer:   DefaultIssuer,
+			Audience: "keymaster",
+			Keys:     idtoken.NewKeySet(idtoken.Key{KeyId: "k1", Public: &key.PublicKey}),
+		},
+	}
+
+	claims := jwt.MapClaims{
+		"iss":              DefaultIssuer,
+		"aud":              "keymaster",
+		"sub":              "repo:bsycorp/keymaster:environment:prod",
+		"exp":              time.Now().Add(time.Minute).Unix(),
+		"actor":            "smithb12",
+		"repository":       "bsycorp/keymaster",
+		"ref":              "refs/heads/master",
+		"environment":      "prod",
+		"job_workflow_ref": "bsycorp/keymaster/.github/workflows/deploy.yml@refs/heads/master",
+	}
+	sign := func() string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return signed
+	}
+
+	identity, err := tp.Process(sign())
+	assert.NoError(t, err)
+	assert.Equal(t, "smithb12", identity.Username)
+	assert.Equal(t, "repo:bsycorp/keymaster:environment:prod", identity.Subject)
+	assert.NoError(t, idtoken.MatchClaims(identity.Claims, map[string][]string{
+		"repository":       {"bsycorp/*"},
+		"environment":      {"prod"},
+		"job_workflow_ref": {"bsycorp/keymaster/.github/workflows/deploy.yml@refs/heads/master"},
+	}))
+
+	// Tokens for another audience are rejected
+	claims["aud"] = "sts.amazonaws.com"
+	_, err = tp.Process(sign())
+	assert.Error(t, err)
+
+	claims["aud"] = "keymaster"
+	delete(claims, "actor")
+	_, err = tp.Process(sign())
+	assert.Error(t, err)
+}
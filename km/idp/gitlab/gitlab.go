@@ -0,0 +1,41 @@
+package gitlab
+
+import (
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/pkg/errors"
+)
+
+// DefaultIssuer is the issuer of job tokens from gitlab.com.
+const DefaultIssuer = "https://gitlab.com"
+
+// JwksURL returns the location of the JWKS for a GitLab instance.
+func JwksURL(issuer string) string {
+	return strings.TrimRight(issuer, "/") + "/-/jwks"
+}
+
+// TokenProcessor verifies GitLab CI job JWTs (CI_JOB_JWT or ID tokens).
+type TokenProcessor struct {
+	Verifier *idtoken.Verifier
+}
+
+func (p *TokenProcessor) Process(token string) (*idtoken.Identity, error) {
+	if token == "" {
+		return nil, errors.New("no gitlab job token provided")
+	}
+	claims, err := p.Verifier.Verify(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitlab job token verification failed")
+	}
+	username := claims.String("user_login")
+	if username == "" {
+		return nil, errors.New("gitlab job token has no user_login claim")
+	}
+	return &idtoken.Identity{
+		Subject:  claims.String("sub"),
+		Username: username,
+		Email:    claims.String("user_email"),
+		Claims:   claims,
+	}, nil
+}
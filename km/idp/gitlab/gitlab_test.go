@@ -0,0 +1,60 @@
+package gitlab
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJwksURL(t *testing.T) {
+	assert.Equal(t, "https://gitlab.com/-/jwks", JwksURL(DefaultIssuer))
+	assert.Equal(t, "https://gitlab.example.com/-/jwks", JwksURL("https://gitlab.example.com/"))
+}
+
+func TestTokenProcessor(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tp := &TokenProcessor{
+		Verifier: &idtoken.Verifier{
+			Issuer: "gitlab.example.com",
+			Keys:   idtoken.NewKeySet(idtoken.Key{KeyId: "k1", Public: &key.PublicKey}),
+		},
+	}
+
+	claims := jwt.MapClaims{
+		"iss":          "gitlab.example.com",
+		"sub":          "job_1234",
+		"exp":          time.Now().Add(time.Minute).Unix(),
+		"user_login":   "smithb12",
+		"user_email":   "bob.smith@awesome.com",
+		"project_path": "group/project",
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	identity, err := tp.Process(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "smithb12", identity.Username)
+	assert.Equal(t, "bob.smith@awesome.com", identity.Email)
+	assert.Equal(t, "job_1234", identity.Subject)
+	assert.Equal(t, "group/project", identity.Claims.String("project_path"))
+
+	// A token without a user is not useful
+	delete(claims, "user_login")
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err = token.SignedString(key)
+	assert.NoError(t, err)
+	_, err = tp.Process(signed)
+	assert.Error(t, err)
+
+	_, err = tp.Process("")
+	assert.Error(t, err)
+}
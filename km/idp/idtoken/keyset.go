@@ -0,0 +1,277 @@
+package idtoken
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultKeySetRefresh is how long a remote key set is cached before it
+// is fetched again.
+const DefaultKeySetRefresh = 15 * time.Minute
+
+// KeySource provides the public keys used to verify token signatures.
+type KeySource interface {
+	KeySet() (*KeySet, error)
+}
+
+// KeySet is a set of public keys parsed from a JSON Web Key Set.
+type KeySet struct {
+	keys []Key
+}
+
+// Key is a single public key from a JSON Web Key Set.
+type Key struct {
+	KeyId     string
+	Algorithm string
+	Public    crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// ParseKeySet parses a JSON Web Key Set document. Keys which are not
+// signing keys, or are of an unsupported type, are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var jwks jsonWebKeySet
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, errors.Wrap(err, "error parsing jwks")
+	}
+	ks := &KeySet{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var pub crypto.PublicKey
+		var err error
+		switch jwk.Kty {
+		case "RSA":
+			pub, err = parseRSAKey(&jwk)
+		case "EC":
+			pub, err = parseECKey(&jwk)
+		case "OKP":
+			pub, err = parseOKPKey(&jwk)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing jwk: %s", jwk.Kid)
+		}
+		ks.keys = append(ks.keys, Key{KeyId: jwk.Kid, Algorithm: jwk.Alg, Public: pub})
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("jwks contains no usable signing keys")
+	}
+	return ks, nil
+}
+
+// NewKeySet creates a key set from already parsed keys.
+func NewKeySet(keys ...Key) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// KeySet allows a static KeySet to be used as a KeySource.
+func (ks *KeySet) KeySet() (*KeySet, error) {
+	return ks, nil
+}
+
+// Keys returns the keys in the set.
+func (ks *KeySet) Keys() []Key {
+	return ks.keys
+}
+
+// Lookup finds the key for the given key id. An empty key id is only
+// accepted when the set holds exactly one key.
+func (ks *KeySet) Lookup(kid string) (*Key, error) {
+	if kid == "" {
+		if len(ks.keys) == 1 {
+			return &ks.keys[0], nil
+		}
+		return nil, errors.New("token has no key id and jwks has multiple keys")
+	}
+	for i := range ks.keys {
+		if ks.keys[i].KeyId == kid {
+			return &ks.keys[i], nil
+		}
+	}
+	return nil, errors.Errorf("key id not found in jwks: %s", kid)
+}
+
+// MarshalJSON encodes the key set as a JSON Web Key Set document.
+func (ks *KeySet) MarshalJSON() ([]byte, error) {
+	var jwks jsonWebKeySet
+	jwks.Keys = make([]jsonWebKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		jwk := jsonWebKey{Kid: k.KeyId, Alg: k.Algorithm, Use: "sig"}
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encodeBigInt(pub.N)
+			jwk.E = encodeBigInt(big.NewInt(int64(pub.E)))
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = pub.Curve.Params().Name
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(pub.X.Bytes(), size))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(pub.Y.Bytes(), size))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			return nil, errors.Errorf("unsupported public key type in jwks: %T", k.Public)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return json.Marshal(jwks)
+}
+
+func parseRSAKey(jwk *jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(jwk.N)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad modulus")
+	}
+	e, err := decodeBigInt(jwk.E)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad exponent")
+	}
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent too large")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseECKey(jwk *jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch jwk.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.Errorf("unsupported curve: %s", jwk.Crv)
+	}
+	x, err := decodeBigInt(jwk.X)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad x coordinate")
+	}
+	y, err := decodeBigInt(jwk.Y)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad y coordinate")
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func parseOKPKey(jwk *jsonWebKey) (ed25519.PublicKey, error) {
+	if jwk.Crv != "Ed25519" {
+		return nil, errors.Errorf("unsupported curve: %s", jwk.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad public key")
+	}
+	if len(x) != ed25519.PublicKeySize {
+		return nil, errors.New("bad public key size")
+	}
+	return ed25519.PublicKey(x), nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// RemoteKeySet fetches a JSON Web Key Set over HTTPS and caches it.
+type RemoteKeySet struct {
+	URL        string
+	HttpClient *http.Client
+	Refresh    time.Duration
+
+	mu        sync.Mutex
+	cached    *KeySet
+	fetchedAt time.Time
+}
+
+// NewRemoteKeySet creates a key source for the JWKS at the given URL.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		URL:        url,
+		HttpClient: http.DefaultClient,
+		Refresh:    DefaultKeySetRefresh,
+	}
+}
+
+func (r *RemoteKeySet) KeySet() (*KeySet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cached != nil && time.Since(r.fetchedAt) < r.Refresh {
+		return r.cached, nil
+	}
+	resp, err := r.HttpClient.Get(r.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching jwks")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading jwks response body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("error fetching jwks: StatusCode: %d", resp.StatusCode)
+	}
+	ks, err := ParseKeySet(body)
+	if err != nil {
+		return nil, err
+	}
+	r.cached = ks
+	r.fetchedAt = time.Now()
+	return ks, nil
+}
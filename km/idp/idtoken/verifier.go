@@ -0,0 +1,204 @@
+package idtoken
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+)
+
+// DefaultLeeway is the clock skew allowed when checking token times.
+const DefaultLeeway = 60 * time.Second
+
+// SupportedAlgorithms are the signing algorithms accepted by Verifier.
+var SupportedAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// Claims are the verified claims from an identity token.
+type Claims map[string]interface{}
+
+// Identity is the verified identity of a token bearer.
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	Claims   Claims
+}
+
+// Verifier checks the signature, issuer, audience and validity period of
+// JWT identity tokens such as GitLab CI job tokens.
+type Verifier struct {
+	Issuer string
+	// Audience is optional; if set the token must be issued for it.
+	Audience string
+	Keys     KeySource
+	Clock    clockwork.Clock
+	Leeway   time.Duration
+}
+
+// Verify validates the token and returns its claims.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	if v.Keys == nil {
+		return nil, errors.New("verifier has no keys configured")
+	}
+	keySet, err := v.Keys.KeySet()
+	if err != nil {
+		return nil, err
+	}
+	parser := &jwt.Parser{
+		ValidMethods:         SupportedAlgorithms,
+		SkipClaimsValidation: true,
+	}
+	mapClaims := jwt.MapClaims{}
+	_, err = parser.ParseWithClaims(token, mapClaims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := keySet.Lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm != "" && key.Algorithm != t.Method.Alg() {
+			return nil, errors.Errorf("token alg %s does not match key alg %s", t.Method.Alg(), key.Algorithm)
+		}
+		return key.Public, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid token")
+	}
+	claims := Claims(mapClaims)
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) validate(claims Claims) error {
+	clock := v.Clock
+	if clock == nil {
+		clock = clockwork.NewRealClock()
+	}
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = DefaultLeeway
+	}
+	now := clock.Now()
+
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return errors.Errorf("token issuer mismatch, want: %s, got: %s", v.Issuer, claims.String("iss"))
+	}
+	if v.Audience != "" && !claims.HasAudience(v.Audience) {
+		return errors.Errorf("token not issued for audience: %s", v.Audience)
+	}
+	exp, ok := claims.Time("exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(leeway)) {
+		return errors.Errorf("token is expired by %v", now.Sub(exp))
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	if iat, ok := claims.Time("iat"); ok && now.Add(leeway).Before(iat) {
+		return errors.New("token used before issued")
+	}
+	return nil
+}
+
+// String returns the named claim as a string. Booleans and numbers are
+// formatted, other types are returned as an empty string.
+func (c Claims) String(name string) string {
+	switch val := c[name].(type) {
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case json.Number:
+		return val.String()
+	}
+	return ""
+}
+
+// Strings returns the named claim as a list of strings. A single string
+// claim is returned as a list of one.
+func (c Claims) Strings(name string) []string {
+	switch val := c[name].(type) {
+	case []interface{}:
+		result := make([]string, 0, len(val))
+		for _, item := range val {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	case []string:
+		return val
+	case nil:
+		return nil
+	}
+	return []string{c.String(name)}
+}
+
+// Time returns the named numeric date claim.
+func (c Claims) Time(name string) (time.Time, bool) {
+	switch val := c[name].(type) {
+	case float64:
+		return time.Unix(int64(val), 0), true
+	case json.Number:
+		i, err := val.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(i, 0), true
+	}
+	return time.Time{}, false
+}
+
+// HasAudience reports whether the aud claim contains the audience.
+func (c Claims) HasAudience(audience string) bool {
+	for _, aud := range c.Strings("aud") {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchClaims checks that, for every claim named in matchers, the claim
+// matches at least one of its glob patterns (as per path.Match).
+func MatchClaims(claims Claims, matchers map[string][]string) error {
+	return MatchClaimsFunc(claims.Strings, matchers)
+}
+
+// MatchClaimsFunc is MatchClaims, for claims looked up by a function
+// (e.g. Claims.Strings).
+func MatchClaimsFunc(claims func(name string) []string, matchers map[string][]string) error {
+	names := make([]string, 0, len(matchers))
+	for name := range matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		patterns := matchers[name]
+		values := claims(name)
+		if !matchAny(values, patterns) {
+			return errors.Errorf("claim %s = %q does not match any of: %q", name, values, patterns)
+		}
+	}
+	return nil
+}
+
+func matchAny(values []string, patterns []string) bool {
+	for _, value := range values {
+		for _, pattern := range patterns {
+			if ok, err := path.Match(pattern, value); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package idtoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTime = time.Date(2020, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":           "https://gitlab.example.com",
+		"aud":           "keymaster",
+		"sub":           "project_path:group/project:ref_type:branch:ref:master",
+		"iat":           testTime.Unix(),
+		"nbf":           testTime.Unix(),
+		"exp":           testTime.Add(5 * time.Minute).Unix(),
+		"project_path":  "group/project",
+		"ref":           "master",
+		"ref_protected": "true",
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func testVerifier(keys KeySource) *Verifier {
+	return &Verifier{
+		Issuer:   "https://gitlab.example.com",
+		Audience: "keymaster",
+		Keys:     keys,
+		Clock:    clockwork.NewFakeClockAt(testTime.Add(time.Minute)),
+	}
+}
+
+func TestKeySetRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	ks := NewKeySet(
+		Key{KeyId: "rsa1", Algorithm: "RS256", Public: &rsaKey.PublicKey},
+		Key{KeyId: "ec1", Algorithm: "ES256", Public: &ecKey.PublicKey},
+		Key{KeyId: "ed1", Algorithm: "EdDSA", Public: edPub},
+	)
+	data, err := json.Marshal(ks)
+	assert.NoError(t, err)
+
+	ks2, err := ParseKeySet(data)
+	assert.NoError(t, err)
+	assert.Equal(t, ks, ks2)
+
+	_, err = ks2.Lookup("nope")
+	assert.Error(t, err)
+	_, err = ks2.Lookup("")
+	assert.Error(t, err)
+}
+
+func TestParseKeySetErrors(t *testing.T) {
+	_, err := ParseKeySet([]byte("not json"))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": []}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": [{"kty": "RSA", "kid": "x", "n": "", "e": "AQAB"}]}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": [{"kty": "EC", "kid": "x", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": [{"kty": "OKP", "kid": "x", "crv": "Ed25519", "x": "AQ"}]}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": [{"kty": "OKP", "kid": "x", "crv": "X25519", "x": "AQ"}]}`))
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	ks := NewKeySet(
+		Key{KeyId: "rsa1", Algorithm: "RS256", Public: &rsaKey.PublicKey},
+		Key{KeyId: "ec1", Public: &ecKey.PublicKey},
+		Key{KeyId: "ed1", Public: edPub},
+	)
+	v := testVerifier(ks)
+
+	claims, err := v.Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, testClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "group/project", claims.String("project_path"))
+
+	claims, err = v.Verify(sign(t, jwt.SigningMethodES256, "ec1", ecKey, testClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "true", claims.String("ref_protected"))
+
+	claims, err = v.Verify(sign(t, EdDSA, "ed1", edKey, testClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "master", claims.String("ref"))
+
+	// EdDSA against a key of another type
+	_, err = v.Verify(sign(t, EdDSA, "rsa1", edKey, testClaims()))
+	assert.Error(t, err)
+
+	// Signed by a key not in the set
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa1", otherKey, testClaims()))
+	assert.Error(t, err)
+
+	// Unknown key id
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa2", rsaKey, testClaims()))
+	assert.Error(t, err)
+
+	// Algorithm doesn't match the key's declared algorithm
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS384, "rsa1", rsaKey, testClaims()))
+	assert.Error(t, err)
+
+	// Unsigned tokens are never accepted
+	_, err = v.Verify(sign(t, jwt.SigningMethodNone, "rsa1", jwt.UnsafeAllowNoneSignatureType, testClaims()))
+	assert.Error(t, err)
+
+	// Wrong issuer
+	c := testClaims()
+	c["iss"] = "https://gitlab.com"
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, c))
+	assert.Error(t, err)
+
+	// Wrong audience, and audience lists
+	c = testClaims()
+	c["aud"] = "someone-else"
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, c))
+	assert.Error(t, err)
+	c["aud"] = []string{"someone-else", "keymaster"}
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, c))
+	assert.NoError(t, err)
+
+	// No expiry
+	c = testClaims()
+	delete(c, "exp")
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, c))
+	assert.Error(t, err)
+
+	// Garbage
+	_, err = v.Verify("not.a.token")
+	assert.Error(t, err)
+}
+
+func TestVerifyTimes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	v := testVerifier(NewKeySet(Key{KeyId: "rsa1", Public: &rsaKey.PublicKey}))
+	token := sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, testClaims())
+
+	// Within leeway of expiry
+	v.Clock = clockwork.NewFakeClockAt(testTime.Add(5*time.Minute + 30*time.Second))
+	_, err = v.Verify(token)
+	assert.NoError(t, err)
+
+	// Expired
+	v.Clock = clockwork.NewFakeClockAt(testTime.Add(10 * time.Minute))
+	_, err = v.Verify(token)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+
+	// Not valid yet
+	v.Clock = clockwork.NewFakeClockAt(testTime.Add(-10 * time.Minute))
+	_, err = v.Verify(token)
+	assert.Error(t, err)
+}
+
+func TestMatchClaims(t *testing.T) {
+	claims := Claims{
+		"project_path":  "group/project",
+		"ref":           "refs/heads/release-1",
+		"ref_protected": true,
+		"groups":        []interface{}{"dev", "ops"},
+	}
+	assert.NoError(t, MatchClaims(claims, nil))
+	assert.NoError(t, MatchClaims(claims, map[string][]string{
+		"project_path":  {"group/*"},
+		"ref":           {"refs/heads/master", "refs/heads/release-*"},
+		"ref_protected": {"true"},
+		"groups":        {"ops"},
+	}))
+	assert.Error(t, MatchClaims(claims, map[string][]string{
+		"project_path": {"other/*"},
+	}))
+	assert.Error(t, MatchClaims(claims, map[string][]string{
+		"environment": {"*"},
+	}))
+	// Globs don't cross path separators
+	assert.Error(t, MatchClaims(claims, map[string][]string{
+		"project_path": {"*"},
+	}))
+}
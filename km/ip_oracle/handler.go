@@ -0,0 +1,266 @@
+package ip_oracle
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits on the client supplied claims
+const (
+	MaxAudienceLength = 256
+	MaxNonceLength    = 256
+)
+
+// SignRequest is the body of a sign request. Older clients also send a
+// KMSKeyId, which is ignored: the key is fixed by the oracle's own
+// configuration.
+type SignRequest struct {
+	// Audience is the keymaster environment the token is for
+	Audience string
+	// Nonce is an optional value to embed in the token
+	Nonce string
+}
+
+// SignHandler is the ip oracle sign endpoint, behind API Gateway. It
+// issues tokens for the client's address on POST, and publishes the
+// signing key as a JWKS on GET .../jwks.
+type SignHandler struct {
+	Issuer *TokenIssuer
+	// TrustedProxies are the proxies (e.g. a load balancer or CDN in
+	// front of API Gateway) whose X-Forwarded-For is believed. Without
+	// any the API Gateway source address is used.
+	TrustedProxies []*net.IPNet
+	// Limiter limits requests per client address, if set
+	Limiter *RateLimiter
+}
+
+func (h *SignHandler) HandleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case req.HTTPMethod == http.MethodGet && strings.HasSuffix(req.Path, "/jwks"):
+		return h.handleJWKS()
+	case req.HTTPMethod == http.MethodPost || req.HTTPMethod == "":
+		return h.handleSign(req)
+	}
+	return errorResponse(http.StatusMethodNotAllowed, "method not allowed"), nil
+}
+
+func (h *SignHandler) handleSign(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	clientIp, err := h.ClientIp(req)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	if h.Limiter != nil {
+		if ok, wait := h.Limiter.Allow(clientIp); !ok {
+			resp := errorResponse(http.StatusTooManyRequests, "rate limit exceeded")
+			resp.Headers["Retry-After"] = fmt.Sprint(int(math.Ceil(wait.Seconds())))
+			return resp, nil
+		}
+	}
+	var signReq SignRequest
+	if strings.TrimSpace(req.Body) != "" {
+		if err := json.Unmarshal([]byte(req.Body), &signReq); err != nil {
+			return errorResponse(http.StatusBadRequest, "malformed request body"), nil
+		}
+	}
+	if err := checkClaimValue("audience", signReq.Audience, MaxAudienceLength); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	if err := checkClaimValue("nonce", signReq.Nonce, MaxNonceLength); err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+	signedString, err := h.Issuer.Issue(clientIp, signReq.Audience, signReq.Nonce)
+	if err != nil {
+		log.Errorf("error signing ip oracle token: %v", err)
+		return errorResponse(http.StatusInternalServerError, "error signing token"), nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Cache-Control": "no-store"},
+		Body:       signedString,
+	}, nil
+}
+
+func (h *SignHandler) handleJWKS() (events.APIGatewayProxyResponse, error) {
+	signer, ok := h.Issuer.Method.(Signer)
+	if !ok {
+		return errorResponse(http.StatusNotFound, "no jwks for this signer"), nil
+	}
+	jwks, err := JWKS(signer)
+	if err != nil {
+		log.Errorf("error building ip oracle jwks: %v", err)
+		return errorResponse(http.StatusInternalServerError, "error building jwks"), nil
+	}
+	body, err := json.Marshal(jwks)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "max-age=300",
+		},
+		Body: string(body),
+	}, nil
+}
+
+// VerifyRequest is the body of a verify request. Older clients also
+// send a KMSKeyId, which is ignored.
+type VerifyRequest struct {
+	SignedString string
+}
+
+// ErrorBody is the body of an error response. For refused tokens it
+// names the address and rule which decided it.
+type ErrorBody struct {
+	Error   string `json:"error"`
+	Address string `json:"address,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// VerifyHandler is the ip oracle verify endpoint, behind API Gateway. It
+// verifies a token and checks its addresses against a policy, responding
+// with the source address if they are allowed.
+type VerifyHandler struct {
+	Verifier *Verifier
+	Policy   *Policy
+}
+
+func (h *VerifyHandler) HandleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if req.HTTPMethod != http.MethodPost && req.HTTPMethod != "" {
+		return errorResponse(http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+	var verifyReq VerifyRequest
+	if err := json.Unmarshal([]byte(req.Body), &verifyReq); err != nil {
+		return errorResponse(http.StatusBadRequest, "malformed request body"), nil
+	}
+	claims, err := h.Verifier.Verify(verifyReq.SignedString)
+	if err != nil {
+		return jsonErrorResponse(http.StatusForbidden, ErrorBody{Error: "invalid token: " + err.Error()}), nil
+	}
+	decision := h.Policy.Check(claims)
+	if !decision.Allowed {
+		return jsonErrorResponse(http.StatusForbidden, ErrorBody{
+			Error:   decision.Reason,
+			Address: decision.Address,
+			Rule:    decision.Rule,
+		}), nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       claims.SourceIp,
+	}, nil
+}
+
+// ClientIp returns the address a request came from. API Gateway's source
+// address is used unless it is a trusted proxy, in which case the
+// X-Forwarded-For chain is walked from the right, past trusted proxies,
+// to the first address which isn't one.
+func (h *SignHandler) ClientIp(req events.APIGatewayProxyRequest) (string, error) {
+	sourceIp := net.ParseIP(req.RequestContext.Identity.SourceIP)
+	if sourceIp == nil {
+		return "", errors.Errorf("no valid source address: %q", req.RequestContext.Identity.SourceIP)
+	}
+	if !h.trusted(sourceIp) {
+		return sourceIp.String(), nil
+	}
+	forwarded := forwardedFor(req)
+	clientIp := sourceIp
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			return "", errors.Errorf("malformed X-Forwarded-For address: %q", forwarded[i])
+		}
+		clientIp = ip
+		if !h.trusted(ip) {
+			break
+		}
+	}
+	return clientIp.String(), nil
+}
+
+func (h *SignHandler) trusted(ip net.IP) bool {
+	for _, proxy := range h.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the X-Forwarded-For addresses of a request, from
+// every X-Forwarded-For header, in order.
+func forwardedFor(req events.APIGatewayProxyRequest) []string {
+	var values []string
+	for name, headers := range req.MultiValueHeaders {
+		if strings.EqualFold(name, "X-Forwarded-For") {
+			values = append(values, headers...)
+		}
+	}
+	if len(values) == 0 {
+		for name, header := range req.Headers {
+			if strings.EqualFold(name, "X-Forwarded-For") {
+				values = append(values, header)
+			}
+		}
+	}
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// ParseTrustedProxies parses a comma separated list of CIDRs.
+func ParseTrustedProxies(cidrs string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid trusted proxy cidr")
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+func checkClaimValue(name string, value string, maxLength int) error {
+	if len(value) > maxLength {
+		return errors.Errorf("%s is longer than %d characters", name, maxLength)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return errors.Errorf("%s contains unprintable characters", name)
+		}
+	}
+	return nil
+}
+
+func errorResponse(status int, message string) events.APIGatewayProxyResponse {
+	return jsonErrorResponse(status, ErrorBody{Error: message})
+}
+
+func jsonErrorResponse(status int, resp ErrorBody) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(resp)
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,272 @@
+package ip_oracle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signEvent(sourceIp string, body string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodPost,
+		Path:       "/sign",
+		Body:       body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Identity: events.APIGatewayRequestIdentity{SourceIP: sourceIp},
+		},
+	}
+}
+
+func testSignHandler(t *testing.T) (*SignHandler, *idtoken.KeySet) {
+	issuer, keys := testIssuer(t)
+	issuer.Clock = nil
+	return &SignHandler{Issuer: issuer}, keys
+}
+
+func TestSignHandler(t *testing.T) {
+	h, keys := testSignHandler(t)
+
+	// The key is the oracle's, whatever the request asks for
+	resp, err := h.HandleRequest(signEvent("203.0.113.7",
+		`{"KMSKeyId": "arn:aws:kms:ap-southeast-2:123456789012:key/other", "Audience": "nonprod", "Nonce": "abc123"}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, resp.Body)
+
+	claims, err := (&Verifier{Keys: keys, Audience: "nonprod", Nonce: "abc123"}).Verify(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", claims.SourceIp)
+	assert.Equal(t, "https://ip-oracle.example.com", claims.Issuer)
+
+	// No body at all is fine
+	resp, err = h.HandleRequest(signEvent("203.0.113.7", ""))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, body := range []string{
+		`not json`,
+		`{"Audience": "` + strings.Repeat("a", MaxAudienceLength+1) + `"}`,
+		`{"Nonce": "bad\nnonce"}`,
+	} {
+		resp, err = h.HandleRequest(signEvent("203.0.113.7", body))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	resp, err = h.HandleRequest(signEvent("", ""))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req := signEvent("203.0.113.7", "")
+	req.HTTPMethod = http.MethodDelete
+	resp, err = h.HandleRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestSignHandlerJWKS(t *testing.T) {
+	h, _ := testSignHandler(t)
+	req := signEvent("203.0.113.7", "")
+	req.HTTPMethod = http.MethodGet
+	req.Path = "/prod/jwks"
+	resp, err := h.HandleRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	keys, err := idtoken.ParseKeySet([]byte(resp.Body))
+	require.NoError(t, err)
+
+	token, err := h.HandleRequest(signEvent("203.0.113.7", ""))
+	require.NoError(t, err)
+	sourceIp, err := VerifyIPJWTWithKeys(token.Body, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", sourceIp)
+}
+
+func TestSignHandlerClientIp(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 2001:db8::/32")
+	require.NoError(t, err)
+	h := &SignHandler{TrustedProxies: proxies}
+
+	tests := []struct {
+		name      string
+		sourceIp  string
+		headers   map[string]string
+		multi     map[string][]string
+		want      string
+		wantError bool
+	}{
+		{
+			name:     "direct",
+			sourceIp: "203.0.113.7",
+			want:     "203.0.113.7",
+		},
+		{
+			name:     "forwarded by an untrusted source is ignored",
+			sourceIp: "203.0.113.7",
+			headers:  map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:     "203.0.113.7",
+		},
+		{
+			name:     "through a trusted proxy",
+			sourceIp: "10.1.1.1",
+			headers:  map[string]string{"x-forwarded-for": "198.51.100.1"},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "spoofed addresses left of the client are ignored",
+			sourceIp: "10.1.1.1",
+			headers:  map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1, 10.2.2.2"},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "multiple headers",
+			sourceIp: "2001:db8::1",
+			multi:    map[string][]string{"X-Forwarded-For": {"192.0.2.1", "198.51.100.1, 10.2.2.2"}},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "only proxies",
+			sourceIp: "10.1.1.1",
+			headers:  map[string]string{"X-Forwarded-For": "10.3.3.3, 10.2.2.2"},
+			want:     "10.3.3.3",
+		},
+		{
+			name:     "trusted proxy without a header",
+			sourceIp: "10.1.1.1",
+			want:     "10.1.1.1",
+		},
+		{
+			name:      "malformed",
+			sourceIp:  "10.1.1.1",
+			headers:   map[string]string{"X-Forwarded-For": "198.51.100.1, bogus"},
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := signEvent(tt.sourceIp, "")
+			req.Headers = tt.headers
+			req.MultiValueHeaders = tt.multi
+			clientIp, err := h.ClientIp(req)
+			if tt.wantError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, clientIp)
+		})
+	}
+
+	_, err = ParseTrustedProxies("10.0.0.1")
+	assert.Error(t, err)
+}
+
+func TestSignHandlerRateLimit(t *testing.T) {
+	h, _ := testSignHandler(t)
+	clock := clockwork.NewFakeClockAt(testTime)
+	h.Limiter = NewRateLimiter(2)
+	h.Limiter.Clock = clock
+
+	sign := func(sourceIp string) events.APIGatewayProxyResponse {
+		resp, err := h.HandleRequest(signEvent(sourceIp, ""))
+		require.NoError(t, err)
+		return resp
+	}
+	assert.Equal(t, http.StatusOK, sign("203.0.113.7").StatusCode)
+	assert.Equal(t, http.StatusOK, sign("203.0.113.7").StatusCode)
+	resp := sign("203.0.113.7")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "30", resp.Headers["Retry-After"])
+	var body map[string]string
+	require.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Equal(t, "rate limit exceeded", body["error"])
+
+	// Other clients have their own limit
+	assert.Equal(t, http.StatusOK, sign("198.51.100.1").StatusCode)
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, http.StatusOK, sign("203.0.113.7").StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, sign("203.0.113.7").StatusCode)
+}
+
+func TestRateLimiterPrunes(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(testTime)
+	l := NewRateLimiter(60)
+	l.Clock = clock
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		ok, _ := l.Allow(fmt.Sprint(i))
+		assert.True(t, ok)
+	}
+	clock.Advance(time.Minute)
+	ok, _ := l.Allow("new")
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestVerifyHandler(t *testing.T) {
+	issuer, keys := testIssuer(t)
+	issuer.Clock = nil
+	policy, err := NewPolicy([]string{"ci-egress"}, []string{"203.0.113.66"},
+		map[string][]string{"ci-egress": {"203.0.113.0/24", "2001:db8:c1::/48"}})
+	require.NoError(t, err)
+	h := &VerifyHandler{Verifier: &Verifier{Keys: keys}, Policy: policy}
+
+	verify := func(token string) (events.APIGatewayProxyResponse, ErrorBody) {
+		body, err := json.Marshal(VerifyRequest{SignedString: token})
+		require.NoError(t, err)
+		resp, err := h.HandleRequest(signEvent("192.0.2.1", string(body)))
+		require.NoError(t, err)
+		var errBody ErrorBody
+		if resp.StatusCode != http.StatusOK {
+			require.NoError(t, json.Unmarshal([]byte(resp.Body), &errBody))
+		}
+		return resp, errBody
+	}
+	token := func(addrs ...string) string {
+		token, err := issuer.IssueAddresses(addrs, "", "")
+		require.NoError(t, err)
+		return token
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		status  int
+		body    string
+		address string
+		rule    string
+	}{
+		{"allowed", token("203.0.113.7"), http.StatusOK, "203.0.113.7", "", ""},
+		{"allowed ipv6", token("2001:db8:c1::7"), http.StatusOK, "2001:db8:c1::7", "", ""},
+		{"dual stack", token("203.0.113.7", "2001:db8:c1::7"), http.StatusOK, "203.0.113.7", "", ""},
+		{"denied", token("203.0.113.66"), http.StatusForbidden, "", "203.0.113.66", "203.0.113.66"},
+		{"outside", token("198.51.100.1"), http.StatusForbidden, "", "198.51.100.1", ""},
+		{"second address outside", token("203.0.113.7", "2001:db8::7"), http.StatusForbidden, "", "2001:db8::7", ""},
+		{"invalid token", "not.a.token", http.StatusForbidden, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, errBody := verify(tt.token)
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, tt.body, resp.Body)
+				return
+			}
+			assert.NotEmpty(t, errBody.Error)
+			assert.Equal(t, tt.address, errBody.Address)
+			assert.Equal(t, tt.rule, errBody.Rule)
+		})
+	}
+
+	resp, err := h.HandleRequest(signEvent("192.0.2.1", "not json"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -1,134 +1,126 @@
+// Package ip_oracle issues and verifies short lived JWTs vouching for the
+// source address of a request. Tokens are signed either by a KMS key or
+// by a local RSA, ECDSA or Ed25519 key, and can be verified with KMS or
+// offline against the oracle's published JSON Web Key Set.
 package ip_oracle
 
 import (
-  "os"
-  "time"
-  "strings"
-  "encoding/json"
+	"time"
 
-  "github.com/aws/aws-sdk-go/service/kms"
-  "github.com/aws/aws-sdk-go/aws/session"
-  "github.com/aws/aws-sdk-go/aws"
-  jwt "github.com/dgrijalva/jwt-go"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
 )
 
-const AWS_DEFAULT_REGION = "ap-southeast-2"
-
-type SigningMethodKMS struct {
-  KeyId string
-  GrantToken string
-  SigningAlgorithm string
-}
+// TokenLifetime is how long an ip oracle token is valid for.
+const TokenLifetime = 10 * time.Minute
 
 type IPOracleClaims struct {
-    SourceIp string `json:"source_ip,omitempty"`
-    jwt.StandardClaims
+	SourceIp string `json:"source_ip,omitempty"`
+	// SourceIps are further addresses of the client, e.g. both the IPv4
+	// and IPv6 addresses of a dual stack client
+	SourceIps []string `json:"source_ips,omitempty"`
+	// Nonce is chosen by the client, to tie the token to its request
+	Nonce string `json:"nonce,omitempty"`
+	jwt.StandardClaims
 }
 
-func NewSigningMethodKMS(keyId string) *SigningMethodKMS {
-  return &SigningMethodKMS{
-      KeyId: keyId,
-      GrantToken: "CreateGrant",
-      SigningAlgorithm: "RSASSA_PKCS1_V1_5_SHA_256",
-  }
+// Addresses returns every address the token vouches for.
+func (c *IPOracleClaims) Addresses() []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{c.SourceIp}, c.SourceIps...) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
-func (sm *SigningMethodKMS) Sign(signingString string, key interface{}) (string, error) {
-  region := os.Getenv("AWS_REGION")
-  if region == "" {
-    region = AWS_DEFAULT_REGION
-  }
-  sess := session.Must(session.NewSession(&aws.Config{
-    Region: aws.String(region),
-  }))
-  svc := kms.New(sess)
-
-  keyId := sm.KeyId
-  grantToken := sm.GrantToken
-  signingAlgorithm := sm.SigningAlgorithm
-  signInput := kms.SignInput{
-    GrantTokens: []*string{&grantToken},
-    KeyId: &keyId,
-    Message: []byte(signingString),
-    SigningAlgorithm: &signingAlgorithm,
-  }
-
-  signOutput, err := svc.Sign(&signInput)
-  if err != nil {
-    return "", err
-  }
-
-  sig := signOutput.Signature
-  return jwt.EncodeSegment(sig), nil
+// Signer is a signing method which knows its own public key, so that
+// tokens it signs can be verified without it.
+type Signer interface {
+	jwt.SigningMethod
+	// Kid is the key id tokens are signed with
+	Kid() string
+	PublicKey() (interface{}, error)
 }
 
-func (sm *SigningMethodKMS) Alg() string {
-  return "RS256"
+// TokenIssuer issues ip oracle tokens.
+type TokenIssuer struct {
+	Method jwt.SigningMethod
+	// Issuer is the iss claim, if set
+	Issuer   string
+	Lifetime time.Duration
+	Clock    clockwork.Clock
 }
 
-func (sm *SigningMethodKMS) Verify(signingString string, signature string, key interface{}) error {
-  region := os.Getenv("AWS_REGION")
-  if region == "" {
-    region = AWS_DEFAULT_REGION
-  }
-  sess := session.Must(session.NewSession(&aws.Config{
-    Region: aws.String(region),
-  }))
-  svc := kms.New(sess)
-
-  grantToken := sm.GrantToken
-  keyId := sm.KeyId
-  signingAlgorithm := sm.SigningAlgorithm
-  sig, err := jwt.DecodeSegment(signature)
-  verifyInput := kms.VerifyInput{
-    GrantTokens: []*string{&grantToken},
-    KeyId: &keyId,
-    Message: []byte(signingString),
-    Signature: sig,
-    SigningAlgorithm: &signingAlgorithm,
-  }
-
-  _, err = svc.Verify(&verifyInput)
-  return err
+// Issue returns a token vouching for sourceIp, for an audience (the
+// keymaster environment it will be presented to) and with a nonce if
+// given. If the signing method is a Signer the token header names its
+// key.
+func (i *TokenIssuer) Issue(sourceIp string, audience string, nonce string) (string, error) {
+	return i.IssueAddresses([]string{sourceIp}, audience, nonce)
 }
 
-func MakeIPJWT(sourceIp string, sm jwt.SigningMethod) (string, error) {
-  issuedAt := time.Now().UTC()
-  expiresAt := issuedAt.Add(time.Minute * 10)
-  
-  claims := IPOracleClaims{
-    sourceIp,
-    jwt.StandardClaims{
-      IssuedAt: issuedAt.UnixNano() / int64(time.Second),
-      ExpiresAt: expiresAt.UnixNano() / int64(time.Second),
-    },
-  }
-  token := jwt.NewWithClaims(sm, claims)
-  signedString, err := token.SignedString(sm)
-  return signedString, err
+// IssueAddresses returns a token vouching for several addresses of one
+// client.
+func (i *TokenIssuer) IssueAddresses(sourceIps []string, audience string, nonce string) (string, error) {
+	if len(sourceIps) == 0 {
+		return "", errors.New("no source address to vouch for")
+	}
+	clock := i.Clock
+	if clock == nil {
+		clock = clockwork.NewRealClock()
+	}
+	lifetime := i.Lifetime
+	if lifetime == 0 {
+		lifetime = TokenLifetime
+	}
+	issuedAt := clock.Now().UTC()
+	claims := IPOracleClaims{
+		SourceIp:  sourceIps[0],
+		SourceIps: sourceIps[1:],
+		Nonce:     nonce,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    i.Issuer,
+			Audience:  audience,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(lifetime).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(i.Method, claims)
+	if signer, ok := i.Method.(Signer); ok && signer.Kid() != "" {
+		token.Header["kid"] = signer.Kid()
+	}
+	return token.SignedString(i.Method)
 }
 
-func ParseSignature(signedString string) (string, string) {
-  signedString_parts := strings.Split(signedString, ".")
-  return strings.Join(signedString_parts[0:2], "."), signedString_parts[2]
+// MakeIPJWT returns a token vouching for sourceIp, with no issuer or
+// audience.
+func MakeIPJWT(sourceIp string, sm jwt.SigningMethod) (string, error) {
+	return (&TokenIssuer{Method: sm}).Issue(sourceIp, "", "")
 }
 
+// VerifyIPJWT verifies a token with a signing method, such as
+// SigningMethodKMS, and returns the source address it vouches for.
 func VerifyIPJWT(signedString string, sm jwt.SigningMethod) (string, error) {
-  signingString, signature := ParseSignature(signedString)
-  err := sm.Verify(signingString, signature, nil)
-  if err != nil {
-    return "", err
-  }
-  return VerifyIPOracleClaims(signingString)
+	claims, err := (&Verifier{Method: sm}).Verify(signedString)
+	if err != nil {
+		return "", err
+	}
+	return claims.SourceIp, nil
 }
 
-func VerifyIPOracleClaims(signingString string) (string, error) {
-  signingString_parts := strings.Split(signingString, ".")
-  claims, err := jwt.DecodeSegment(signingString_parts[1])
-  if err != nil {
-    return "", err
-  }
-  var ipOracleClaims IPOracleClaims
-  json.Unmarshal(claims, &ipOracleClaims)
-  return ipOracleClaims.SourceIp, ipOracleClaims.Valid()
+// VerifyIPJWTWithKeys verifies a token against a set of public keys,
+// such as the oracle's JWKS, and returns the source address it vouches
+// for. No call is made to KMS.
+func VerifyIPJWTWithKeys(signedString string, keys idtoken.KeySource) (string, error) {
+	claims, err := (&Verifier{Keys: keys}).Verify(signedString)
+	if err != nil {
+		return "", err
+	}
+	return claims.SourceIp, nil
 }
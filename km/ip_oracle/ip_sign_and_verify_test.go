@@ -1,75 +1,271 @@
 package ip_oracle
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
 	"testing"
 	"time"
-	"flag"
 
-	"github.com/stretchr/testify/assert"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-var KmsTestKeyId = flag.String("KmsTestKeyId", "720ed5bb-33b2-4493-a4d6-68751f08d60a", "The ID of the test KMS key")
+// fakeKMS signs and verifies with local keys, as KMS would.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	keys map[string]crypto.Signer
+}
 
-func TestSuccessfulCreateIPJWT(t *testing.T) {
-	return
+func (f *fakeKMS) key(keyId *string) (crypto.Signer, error) {
+	key, ok := f.keys[aws.StringValue(keyId)]
+	if !ok {
+		return nil, &kms.NotFoundException{Message_: aws.String("Invalid keyId " + aws.StringValue(keyId))}
+	}
+	return key, nil
+}
 
-	sm := NewSigningMethodKMS(*KmsTestKeyId)
-	_, err := MakeIPJWT("192.168.5.6", sm)
-	assert.NoError(t, err)
+func (f *fakeKMS) Sign(in *kms.SignInput) (*kms.SignOutput, error) {
+	key, err := f.key(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(in.Message)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: in.KeyId, Signature: sig, SigningAlgorithm: in.SigningAlgorithm}, nil
 }
 
-func TestUnsuccessfulCreateIPJWTWithInvalidKMSKey(t *testing.T) {
-	sm := NewSigningMethodKMS("1234-abcd-5678-efgh")
-	_, err := MakeIPJWT("1.1.1.1", sm)
-	assert.Error(t, err, "NotFoundException: Invalid keyId 1234-abcd-5678-efgh")
+func (f *fakeKMS) Verify(in *kms.VerifyInput) (*kms.VerifyOutput, error) {
+	key, err := f.key(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(in.Message)
+	valid := false
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], in.Signature) == nil
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		if _, err := asn1.Unmarshal(in.Signature, &sig); err == nil {
+			valid = ecdsa.Verify(pub, digest[:], sig.R, sig.S)
+		}
+	}
+	if !valid {
+		return nil, &kms.KMSInvalidSignatureException{Message_: aws.String("invalid signature")}
+	}
+	return &kms.VerifyOutput{KeyId: in.KeyId, SignatureValid: aws.Bool(true)}, nil
 }
 
-func TestSuccessfulIPJWTVerifyViaKMS(t *testing.T) {
-	t.Parallel()
+func (f *fakeKMS) GetPublicKey(in *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error) {
+	key, err := f.key(in.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{KeyId: in.KeyId, PublicKey: der}, nil
+}
 
-	return // TODO: FIXME
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
 
-	sm := NewSigningMethodKMS(*KmsTestKeyId)
-	signedString, _ := MakeIPJWT("192.168.5.6", sm)
-	sourceIp, err := VerifyIPJWT(signedString, sm)
+func testECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	return key
+}
 
-	assert.NoError(t, err, "Verify IP via KMS should be successful!")
-	assert.Equal(t, sourceIp, "192.168.5.6", "Verified IP should be same as the client source IP")
+func testEd25519Key(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return key
 }
 
-func TestUnsuccessfulIPJWTVerifyWithInvalidKMSKey(t *testing.T) {
-	t.Parallel()
+func TestLocalSigners(t *testing.T) {
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		alg  string
+	}{
+		{"rsa", testRSAKey(t), "RS256"},
+		{"p256", testECKey(t, elliptic.P256()), "ES256"},
+		{"p384", testECKey(t, elliptic.P384()), "ES384"},
+		{"p521", testECKey(t, elliptic.P521()), "ES512"},
+		{"ed25519", testEd25519Key(t), "EdDSA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewLocalSigner(tt.key)
+			require.NoError(t, err)
+			assert.Equal(t, tt.alg, signer.Alg())
+
+			signedString, err := MakeIPJWT("192.168.5.6", signer)
+			require.NoError(t, err)
 
-	return // TODO: FIXME
+			sourceIp, err := VerifyIPJWT(signedString, signer)
+			assert.NoError(t, err)
+			assert.Equal(t, "192.168.5.6", sourceIp)
 
-	sm := NewSigningMethodKMS(*KmsTestKeyId)
-	signedString, _ := MakeIPJWT("192.168.5.6", sm)
+			keys, err := PublicKeySet(tt.key.Public())
+			require.NoError(t, err)
+			sourceIp, err = VerifyIPJWTWithKeys(signedString, keys)
+			assert.NoError(t, err)
+			assert.Equal(t, "192.168.5.6", sourceIp)
 
-	sm = NewSigningMethodKMS("1234-abcd-5678-efgh")
-	_, err := VerifyIPJWT(signedString, sm)
-	assert.Error(t, err, "NotFoundException: Invalid keyId 1234-abcd-5678-efgh")
+			other, err := PublicKeySet(testEd25519Key(t).Public())
+			require.NoError(t, err)
+			_, err = VerifyIPJWTWithKeys(signedString, other)
+			assert.Error(t, err)
+		})
+	}
 }
 
-func TestUnsuccessfulIPJWTVerifyAfterExpiry(t *testing.T) {
-	t.Parallel()
+func TestLoadLocalSigner(t *testing.T) {
+	key := testECKey(t, elliptic.P256())
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	pubDer, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+
+	signer, err := LoadLocalSigner(string(privatePem))
+	require.NoError(t, err)
+	signedString, err := MakeIPJWT("10.0.0.1", signer)
+	require.NoError(t, err)
+
+	for _, ref := range []string{string(publicPem), string(privatePem)} {
+		keys, err := LoadPublicKeySet(ref)
+		require.NoError(t, err)
+		sourceIp, err := VerifyIPJWTWithKeys(signedString, keys)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.0.0.1", sourceIp)
+	}
+
+	_, err = LoadLocalSigner("not a key")
+	assert.Error(t, err)
+}
+
+func TestKMSSigner(t *testing.T) {
+	fake := &fakeKMS{keys: map[string]crypto.Signer{
+		"rsa-key": testRSAKey(t),
+		"ec-key":  testECKey(t, elliptic.P256()),
+	}}
+	tests := []struct {
+		keyId            string
+		signingAlgorithm string
+		alg              string
+	}{
+		{"rsa-key", kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, "RS256"},
+		{"ec-key", kms.SigningAlgorithmSpecEcdsaSha256, "ES256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyId, func(t *testing.T) {
+			sm := &SigningMethodKMS{KMS: fake, KeyId: tt.keyId, SigningAlgorithm: tt.signingAlgorithm}
+			assert.Equal(t, tt.alg, sm.Alg())
+
+			signedString, err := MakeIPJWT("192.168.5.6", sm)
+			require.NoError(t, err)
 
-	return // TODO: FIXME
+			sourceIp, err := VerifyIPJWT(signedString, sm)
+			assert.NoError(t, err)
+			assert.Equal(t, "192.168.5.6", sourceIp)
 
-	sm := NewSigningMethodKMS(*KmsTestKeyId)
+			// Verifiable offline from the published key set too
+			keys, err := JWKS(sm)
+			require.NoError(t, err)
+			data, err := json.Marshal(keys)
+			require.NoError(t, err)
+			parsed, err := idtoken.ParseKeySet(data)
+			require.NoError(t, err)
+			sourceIp, err = VerifyIPJWTWithKeys(signedString, parsed)
+			assert.NoError(t, err)
+			assert.Equal(t, "192.168.5.6", sourceIp)
+		})
+	}
+}
+
+func TestKMSSignerInvalidKey(t *testing.T) {
+	fake := &fakeKMS{keys: map[string]crypto.Signer{"rsa-key": testRSAKey(t)}}
+	sm := &SigningMethodKMS{KMS: fake, KeyId: "rsa-key", SigningAlgorithm: kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256}
+	signedString, err := MakeIPJWT("192.168.5.6", sm)
+	require.NoError(t, err)
+
+	bad := &SigningMethodKMS{KMS: fake, KeyId: "1234-abcd-5678-efgh", SigningAlgorithm: kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256}
+	_, err = MakeIPJWT("1.1.1.1", bad)
+	assert.Error(t, err)
+	_, err = VerifyIPJWT(signedString, bad)
+	assert.Error(t, err)
+}
+
+func TestJWKSRoundTrip(t *testing.T) {
+	rsaSigner, err := NewLocalSigner(testRSAKey(t))
+	require.NoError(t, err)
+	edSigner, err := NewLocalSigner(testEd25519Key(t))
+	require.NoError(t, err)
+
+	keys, err := JWKS(rsaSigner, edSigner)
+	require.NoError(t, err)
+	data, err := json.Marshal(keys)
+	require.NoError(t, err)
+	parsed, err := idtoken.ParseKeySet(data)
+	require.NoError(t, err)
+	require.Len(t, parsed.Keys(), 2)
+
+	for _, signer := range []Signer{rsaSigner, edSigner} {
+		signedString, err := MakeIPJWT("172.16.1.1", signer)
+		require.NoError(t, err)
+		sourceIp, err := VerifyIPJWTWithKeys(signedString, parsed)
+		assert.NoError(t, err)
+		assert.Equal(t, "172.16.1.1", sourceIp)
+	}
+}
+
+func TestUnsuccessfulIPJWTVerifyAfterExpiry(t *testing.T) {
+	signer, err := NewLocalSigner(testEd25519Key(t))
+	require.NoError(t, err)
 	issuedAt := time.Date(2019, time.November, 10, 23, 0, 0, 0, time.UTC)
 	expiresAt := issuedAt.Add(time.Minute * 10)
 
 	claims := IPOracleClaims{
-		"1.2.3.4",
-		jwt.StandardClaims{
-		  IssuedAt: issuedAt.UnixNano() / int64(time.Second),
-		  ExpiresAt: expiresAt.UnixNano() / int64(time.Second),
+		SourceIp: "1.2.3.4",
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: expiresAt.Unix(),
 		},
 	}
-	token := jwt.NewWithClaims(sm, claims)
-	signedString, _ := token.SignedString(sm)
+	token := jwt.NewWithClaims(signer, claims)
+	token.Header["kid"] = signer.Kid()
+	signedString, err := token.SignedString(signer)
+	require.NoError(t, err)
 
-	_, err := VerifyIPJWT(signedString, sm)
+	_, err = VerifyIPJWT(signedString, signer)
 	assert.Contains(t, err.Error(), "token is expired by")
-}
\ No newline at end of file
+
+	keys, err := JWKS(signer)
+	require.NoError(t, err)
+	_, err = VerifyIPJWTWithKeys(signedString, keys)
+	assert.Contains(t, err.Error(), "token is expired by")
+}
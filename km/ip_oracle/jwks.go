@@ -0,0 +1,57 @@
+package ip_oracle
+
+import (
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+)
+
+// JWKS returns the key set verifiers can check tokens from the signers
+// against, to be published by the oracle.
+func JWKS(signers ...Signer) (*idtoken.KeySet, error) {
+	keys := make([]idtoken.Key, 0, len(signers))
+	for _, signer := range signers {
+		pub, err := signer.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, idtoken.Key{
+			KeyId:     signer.Kid(),
+			Algorithm: signer.Alg(),
+			Public:    pub,
+		})
+	}
+	return idtoken.NewKeySet(keys...), nil
+}
+
+// PublicKeySet returns a key set of a single public key, identified by
+// its thumbprint as tokens from a LocalSigner are.
+func PublicKeySet(pub interface{}) (*idtoken.KeySet, error) {
+	method, err := signingMethodFor(pub)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := Thumbprint(pub)
+	if err != nil {
+		return nil, err
+	}
+	return idtoken.NewKeySet(idtoken.Key{
+		KeyId:     kid,
+		Algorithm: method.Alg(),
+		Public:    pub,
+	}), nil
+}
+
+// LoadPublicKeySet loads a PEM public (or private) key with util.Load
+// and returns a key set of it.
+func LoadPublicKeySet(publicKey string) (*idtoken.KeySet, error) {
+	data, err := util.Load(publicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading ip oracle public key")
+	}
+	pub, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return PublicKeySet(pub)
+}
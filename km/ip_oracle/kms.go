@@ -0,0 +1,175 @@
+package ip_oracle
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"math/big"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// kmsAlgorithms maps KMS signing algorithms to JWT algorithms.
+var kmsAlgorithms = map[string]string{
+	kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256: "RS256",
+	kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384: "RS384",
+	kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512: "RS512",
+	kms.SigningAlgorithmSpecRsassaPssSha256:      "PS256",
+	kms.SigningAlgorithmSpecRsassaPssSha384:      "PS384",
+	kms.SigningAlgorithmSpecRsassaPssSha512:      "PS512",
+	kms.SigningAlgorithmSpecEcdsaSha256:          "ES256",
+	kms.SigningAlgorithmSpecEcdsaSha384:          "ES384",
+	kms.SigningAlgorithmSpecEcdsaSha512:          "ES512",
+}
+
+// ecdsaKeySizes are the JWT signature component sizes for each ECDSA
+// algorithm.
+var ecdsaKeySizes = map[string]int{
+	kms.SigningAlgorithmSpecEcdsaSha256: 32,
+	kms.SigningAlgorithmSpecEcdsaSha384: 48,
+	kms.SigningAlgorithmSpecEcdsaSha512: 66,
+}
+
+var (
+	defaultKMSOnce   sync.Once
+	defaultKMSClient kmsiface.KMSAPI
+)
+
+// DefaultKMSClient returns a KMS client shared by every signing method,
+// for the region of the environment or shared config.
+func DefaultKMSClient() kmsiface.KMSAPI {
+	defaultKMSOnce.Do(func() {
+		sess := session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		}))
+		defaultKMSClient = kms.New(sess)
+	})
+	return defaultKMSClient
+}
+
+// SigningMethodKMS signs and verifies tokens with an asymmetric KMS key.
+type SigningMethodKMS struct {
+	KMS              kmsiface.KMSAPI
+	KeyId            string
+	SigningAlgorithm string
+
+	mu        sync.Mutex
+	publicKey interface{}
+}
+
+// NewSigningMethodKMS returns a signing method for a KMS RSA key, using
+// RSASSA_PKCS1_V1_5_SHA_256 (RS256).
+func NewSigningMethodKMS(keyId string) *SigningMethodKMS {
+	return &SigningMethodKMS{
+		KMS:              DefaultKMSClient(),
+		KeyId:            keyId,
+		SigningAlgorithm: kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+	}
+}
+
+func (sm *SigningMethodKMS) Alg() string {
+	return kmsAlgorithms[sm.SigningAlgorithm]
+}
+
+func (sm *SigningMethodKMS) Sign(signingString string, key interface{}) (string, error) {
+	if sm.Alg() == "" {
+		return "", errors.Errorf("unsupported kms signing algorithm: %s", sm.SigningAlgorithm)
+	}
+	signOutput, err := sm.KMS.Sign(&kms.SignInput{
+		KeyId:            aws.String(sm.KeyId),
+		Message:          []byte(signingString),
+		SigningAlgorithm: aws.String(sm.SigningAlgorithm),
+	})
+	if err != nil {
+		return "", err
+	}
+	sig := signOutput.Signature
+	if size, ok := ecdsaKeySizes[sm.SigningAlgorithm]; ok {
+		// KMS signatures are DER, JWT signatures are r || s
+		sig, err = derToRawSignature(sig, size)
+		if err != nil {
+			return "", err
+		}
+	}
+	return jwt.EncodeSegment(sig), nil
+}
+
+func (sm *SigningMethodKMS) Verify(signingString string, signature string, key interface{}) error {
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if size, ok := ecdsaKeySizes[sm.SigningAlgorithm]; ok {
+		sig, err = rawToDerSignature(sig, size)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = sm.KMS.Verify(&kms.VerifyInput{
+		KeyId:            aws.String(sm.KeyId),
+		Message:          []byte(signingString),
+		Signature:        sig,
+		SigningAlgorithm: aws.String(sm.SigningAlgorithm),
+	})
+	return err
+}
+
+func (sm *SigningMethodKMS) Kid() string {
+	return sm.KeyId
+}
+
+// PublicKey fetches the public half of the KMS key, once.
+func (sm *SigningMethodKMS) PublicKey() (interface{}, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.publicKey != nil {
+		return sm.publicKey, nil
+	}
+	out, err := sm.KMS.GetPublicKey(&kms.GetPublicKeyInput{
+		KeyId: aws.String(sm.KeyId),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting kms public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing kms public key")
+	}
+	sm.publicKey = pub
+	return pub, nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func derToRawSignature(der []byte, size int) ([]byte, error) {
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("malformed ecdsa signature")
+	}
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	if len(r) > size || len(s) > size {
+		return nil, errors.New("malformed ecdsa signature")
+	}
+	raw := make([]byte, 2*size)
+	copy(raw[size-len(r):size], r)
+	copy(raw[2*size-len(s):], s)
+	return raw, nil
+}
+
+func rawToDerSignature(raw []byte, size int) ([]byte, error) {
+	if len(raw) != 2*size {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(raw[:size]),
+		S: new(big.Int).SetBytes(raw[size:]),
+	})
+}
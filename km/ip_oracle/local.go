@@ -0,0 +1,151 @@
+package ip_oracle
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/bsycorp/keymaster/km/util"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// LocalSigner signs tokens with a private key held by the oracle itself:
+// RSA keys sign RS256, ECDSA keys ES256, ES384 or ES512 by curve, and
+// Ed25519 keys EdDSA.
+type LocalSigner struct {
+	method  jwt.SigningMethod
+	private crypto.Signer
+	kid     string
+}
+
+// NewLocalSigner returns a signer for a private key.
+func NewLocalSigner(private crypto.Signer) (*LocalSigner, error) {
+	method, err := signingMethodFor(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := Thumbprint(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &LocalSigner{method: method, private: private, kid: kid}, nil
+}
+
+// LoadLocalSigner loads a PEM private key (PKCS#1, PKCS#8 or SEC 1) with
+// util.Load and returns a signer for it.
+func LoadLocalSigner(privateKey string) (*LocalSigner, error) {
+	data, err := util.Load(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading ip oracle private key")
+	}
+	private, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalSigner(private)
+}
+
+func (s *LocalSigner) Alg() string {
+	return s.method.Alg()
+}
+
+func (s *LocalSigner) Sign(signingString string, key interface{}) (string, error) {
+	return s.method.Sign(signingString, s.private)
+}
+
+func (s *LocalSigner) Verify(signingString string, signature string, key interface{}) error {
+	return s.method.Verify(signingString, signature, s.private.Public())
+}
+
+func (s *LocalSigner) Kid() string {
+	return s.kid
+}
+
+func (s *LocalSigner) PublicKey() (interface{}, error) {
+	return s.private.Public(), nil
+}
+
+// ParsePrivateKey parses the first PEM private key in data.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing private key")
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key type: %T", key)
+		}
+		return signer, nil
+	}
+	return nil, errors.Errorf("unsupported PEM block: %s", block.Type)
+}
+
+// ParsePublicKey parses the first PEM public key in data. A private key
+// is accepted too, and its public half returned.
+func ParsePublicKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM public key found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		return pub, errors.Wrap(err, "error parsing public key")
+	case "RSA PUBLIC KEY":
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		return pub, errors.Wrap(err, "error parsing public key")
+	}
+	private, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return private.Public(), nil
+}
+
+// Thumbprint is the key id of a public key: the unpadded base64url
+// SHA-256 of its PKIX encoding.
+func Thumbprint(pub interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding public key")
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func signingMethodFor(pub interface{}) (jwt.SigningMethod, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			return jwt.SigningMethodES256, nil
+		case 384:
+			return jwt.SigningMethodES384, nil
+		case 521:
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, errors.Errorf("unsupported ecdsa curve: %s", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return idtoken.EdDSA, nil
+	}
+	return nil, errors.Errorf("unsupported key type: %T", pub)
+}
@@ -0,0 +1,142 @@
+package ip_oracle
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Rule is a named set of address ranges.
+type Rule struct {
+	Name  string
+	Cidrs []*net.IPNet
+}
+
+func (r *Rule) Contains(ip net.IP) bool {
+	for _, cidr := range r.Cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy decides which source addresses are allowed. An address matching
+// any deny rule is denied; otherwise it must match an allow rule, unless
+// there are none.
+type Policy struct {
+	Allow []Rule
+	Deny  []Rule
+}
+
+// Decision is the outcome of checking addresses against a policy.
+type Decision struct {
+	Allowed bool
+	// Address is the address that decided the outcome: the first denied,
+	// or the first allowed
+	Address string
+	// Rule is the name of the rule that matched Address, if any
+	Rule   string
+	Reason string
+}
+
+// NewPolicy builds a policy from allow and deny entries, each a CIDR, a
+// single address, or the name of one of the named ranges.
+func NewPolicy(allow []string, deny []string, ranges map[string][]string) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if p.Allow, err = parseRules(allow, ranges); err != nil {
+		return nil, err
+	}
+	if p.Deny, err = parseRules(deny, ranges); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseRules(entries []string, ranges map[string][]string) ([]Rule, error) {
+	rules := make([]Rule, 0, len(entries))
+	for _, entry := range entries {
+		if cidrs, ok := ranges[entry]; ok {
+			rule := Rule{Name: entry}
+			for _, cidr := range cidrs {
+				ipNet, err := ParseCidr(cidr)
+				if err != nil {
+					return nil, errors.Wrapf(err, "range %s", entry)
+				}
+				rule.Cidrs = append(rule.Cidrs, ipNet)
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		ipNet, err := ParseCidr(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, Rule{Name: entry, Cidrs: []*net.IPNet{ipNet}})
+	}
+	return rules, nil
+}
+
+// ParseCidr parses a CIDR, or a single IPv4 or IPv6 address as a /32 or
+// /128.
+func ParseCidr(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid address or range: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.Errorf("invalid address or range: %s", s)
+	}
+	return ipNet, nil
+}
+
+// Check decides whether the addresses a token vouches for are allowed.
+// Every address must be.
+func (p *Policy) Check(claims *IPOracleClaims) Decision {
+	addrs := claims.Addresses()
+	if len(addrs) == 0 {
+		return Decision{Reason: "token vouches for no address"}
+	}
+	var allowed Decision
+	for i, addr := range addrs {
+		decision := p.CheckAddress(addr)
+		if !decision.Allowed {
+			return decision
+		}
+		if i == 0 {
+			allowed = decision
+		}
+	}
+	return allowed
+}
+
+// CheckAddress decides whether a single address is allowed.
+func (p *Policy) CheckAddress(addr string) Decision {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return Decision{Address: addr, Reason: "not an address"}
+	}
+	for _, rule := range p.Deny {
+		if rule.Contains(ip) {
+			return Decision{Address: addr, Rule: rule.Name, Reason: "denied by " + rule.Name}
+		}
+	}
+	if len(p.Allow) == 0 {
+		return Decision{Allowed: true, Address: addr, Reason: "no allow rules"}
+	}
+	for _, rule := range p.Allow {
+		if rule.Contains(ip) {
+			return Decision{Allowed: true, Address: addr, Rule: rule.Name, Reason: "allowed by " + rule.Name}
+		}
+	}
+	return Decision{Address: addr, Reason: "not in any allowed range"}
+}
@@ -0,0 +1,110 @@
+package ip_oracle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyCheckAddress(t *testing.T) {
+	ranges := map[string][]string{
+		"ci-egress": {"203.0.113.0/24", "2001:db8:c1::/48"},
+		"office":    {"198.51.100.10", "2001:db8:0ff::/48"},
+	}
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		addr    string
+		allowed bool
+		rule    string
+	}{
+		{"no rules", nil, nil, "192.0.2.1", true, ""},
+		{"ipv4 cidr", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true, "10.0.0.0/8"},
+		{"ipv4 outside", []string{"10.0.0.0/8"}, nil, "11.1.2.3", false, ""},
+		{"ipv6 cidr", []string{"2001:db8::/32"}, nil, "2001:db8::1", true, "2001:db8::/32"},
+		{"ipv6 outside", []string{"2001:db8::/32"}, nil, "2001:db9::1", false, ""},
+		{"single address", []string{"192.0.2.7"}, nil, "192.0.2.7", true, "192.0.2.7"},
+		{"single address neighbour", []string{"192.0.2.7"}, nil, "192.0.2.8", false, ""},
+		{"single ipv6 address", []string{"2001:db8::7"}, nil, "2001:db8::7", true, "2001:db8::7"},
+		{"ipv4 mapped ipv6", []string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true, "10.0.0.0/8"},
+		{"ipv4 against ipv6 range", []string{"2001:db8::/32"}, nil, "10.1.2.3", false, ""},
+		{"named range", []string{"ci-egress"}, nil, "203.0.113.9", true, "ci-egress"},
+		{"named range ipv6", []string{"ci-egress", "office"}, nil, "2001:db8:ff::1", true, "office"},
+		{"named range outside", []string{"ci-egress"}, nil, "198.51.100.10", false, ""},
+		{"first matching rule", []string{"10.0.0.0/8", "10.1.0.0/16"}, nil, "10.1.2.3", true, "10.0.0.0/8"},
+		{"denied", []string{"10.0.0.0/8"}, []string{"10.66.0.0/16"}, "10.66.1.1", false, "10.66.0.0/16"},
+		{"deny without allow", nil, []string{"office"}, "198.51.100.10", false, "office"},
+		{"deny list misses", nil, []string{"office"}, "198.51.100.11", true, ""},
+		{"not an address", []string{"10.0.0.0/8"}, nil, "bogus", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPolicy(tt.allow, tt.deny, ranges)
+			require.NoError(t, err)
+			decision := p.CheckAddress(tt.addr)
+			assert.Equal(t, tt.allowed, decision.Allowed, decision.Reason)
+			assert.Equal(t, tt.rule, decision.Rule)
+			assert.Equal(t, tt.addr, decision.Address)
+		})
+	}
+}
+
+func TestPolicyCheckClaims(t *testing.T) {
+	p, err := NewPolicy([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.66.0.0/16"}, nil)
+	require.NoError(t, err)
+	tests := []struct {
+		name    string
+		claims  IPOracleClaims
+		allowed bool
+		address string
+		rule    string
+	}{
+		{"single", IPOracleClaims{SourceIp: "10.1.2.3"}, true, "10.1.2.3", "10.0.0.0/8"},
+		{"dual stack", IPOracleClaims{SourceIp: "10.1.2.3", SourceIps: []string{"2001:db8::1"}}, true, "10.1.2.3", "10.0.0.0/8"},
+		{"one outside", IPOracleClaims{SourceIp: "10.1.2.3", SourceIps: []string{"2001:db9::1"}}, false, "2001:db9::1", ""},
+		{"one denied", IPOracleClaims{SourceIp: "2001:db8::1", SourceIps: []string{"10.66.0.1"}}, false, "10.66.0.1", "10.66.0.0/16"},
+		{"none", IPOracleClaims{}, false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := p.Check(&tt.claims)
+			assert.Equal(t, tt.allowed, decision.Allowed, decision.Reason)
+			assert.Equal(t, tt.address, decision.Address)
+			assert.Equal(t, tt.rule, decision.Rule)
+		})
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	ranges := map[string][]string{"bad": {"10.0.0.0/33"}}
+	for _, tt := range []struct {
+		allow []string
+		deny  []string
+	}{
+		{[]string{"10.0.0.0/33"}, nil},
+		{nil, []string{"not-a-range"}},
+		{[]string{"bad"}, nil},
+	} {
+		_, err := NewPolicy(tt.allow, tt.deny, ranges)
+		assert.Error(t, err)
+	}
+}
+
+func TestIssueAddresses(t *testing.T) {
+	issuer, keys := testIssuer(t)
+	issuer.Clock = nil
+	token, err := issuer.IssueAddresses([]string{"10.1.2.3", "2001:db8::1", "10.1.2.3"}, "", "")
+	require.NoError(t, err)
+	claims, err := (&Verifier{Keys: keys}).Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.1.2.3", "2001:db8::1"}, claims.Addresses())
+
+	_, err = issuer.IssueAddresses(nil, "", "")
+	assert.Error(t, err)
+	token, err = issuer.IssueAddresses([]string{"10.1.2.3", "bogus"}, "", "")
+	require.NoError(t, err)
+	_, err = (&Verifier{Keys: keys}).Verify(token)
+	assert.Error(t, err)
+}
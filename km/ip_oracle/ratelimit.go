@@ -0,0 +1,78 @@
+package ip_oracle
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+// maxRateLimitBuckets bounds the addresses a RateLimiter tracks; beyond
+// it buckets which have refilled are dropped.
+const maxRateLimitBuckets = 10000
+
+// RateLimiter is a token bucket per key (client address). Its state is
+// held in memory, so each lambda instance limits on its own.
+type RateLimiter struct {
+	// Rate is the tokens added per second, Burst the bucket size
+	Rate  float64
+	Burst int
+	Clock clockwork.Clock
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows perMinute requests per key each minute, in bursts
+// of up to perMinute.
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return &RateLimiter{
+		Rate:  float64(perMinute) / 60,
+		Burst: perMinute,
+		Clock: clockwork.NewRealClock(),
+	}
+}
+
+// Allow takes a token for key, and reports whether there was one. If not
+// it returns how long until there will be.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Clock.Now()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops buckets which would have refilled by now, as they are no
+// different to new ones.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
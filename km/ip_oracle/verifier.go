@@ -0,0 +1,156 @@
+package ip_oracle
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+)
+
+// MaxTokenLength bounds the tokens Verifier will parse. Real tokens are
+// well under 1KB.
+const MaxTokenLength = 8192
+
+// ErrMalformedToken is returned for anything that isn't a JWT.
+var ErrMalformedToken = errors.New("malformed ip oracle token")
+
+// Verifier checks ip oracle tokens: the signature, with Method (e.g.
+// SigningMethodKMS) or against Keys (e.g. the oracle's JWKS), that the
+// header alg is the one expected, the issuer and audience if set, and
+// the validity period with some leeway for clock skew.
+type Verifier struct {
+	Method jwt.SigningMethod
+	Keys   idtoken.KeySource
+	// Issuer, Audience and Nonce are optional; if set tokens must carry
+	// them
+	Issuer   string
+	Audience string
+	Nonce    string
+	Clock    clockwork.Clock
+	Leeway   time.Duration
+}
+
+// Verify validates a token and returns its claims.
+func (v *Verifier) Verify(signedString string) (*IPOracleClaims, error) {
+	if len(signedString) > MaxTokenLength || strings.Count(signedString, ".") != 2 {
+		return nil, ErrMalformedToken
+	}
+	parts := strings.Split(signedString, ".")
+	claims := &IPOracleClaims{}
+	token, _, err := new(jwt.Parser).ParseUnverified(signedString, claims)
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformedToken, err.Error())
+	}
+	signingString := parts[0] + "." + parts[1]
+	if err := v.verifySignature(token, signingString, parts[2]); err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) verifySignature(token *jwt.Token, signingString string, signature string) error {
+	alg := token.Method.Alg()
+	if v.Method != nil {
+		if alg != v.Method.Alg() {
+			return errors.Errorf("unexpected token alg %s, want %s", alg, v.Method.Alg())
+		}
+		return errors.Wrap(v.Method.Verify(signingString, signature, nil), "invalid token signature")
+	}
+	if v.Keys == nil {
+		return errors.New("verifier has no keys configured")
+	}
+	keySet, err := v.Keys.KeySet()
+	if err != nil {
+		return err
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, err := keySet.Lookup(kid)
+	if err != nil {
+		return err
+	}
+	if key.Algorithm != "" && key.Algorithm != alg {
+		return errors.Errorf("token alg %s does not match key alg %s", alg, key.Algorithm)
+	}
+	if !algAllowedForKey(alg, key.Public) {
+		return errors.Errorf("token alg %s can't be used with a %T key", alg, key.Public)
+	}
+	return errors.Wrap(token.Method.Verify(signingString, signature, key.Public), "invalid token signature")
+}
+
+// algAllowedForKey reports whether alg is a signing algorithm for the
+// type of key, so that a key is never used with another algorithm.
+func algAllowedForKey(alg string, pub interface{}) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			return alg == "ES256"
+		case 384:
+			return alg == "ES384"
+		case 521:
+			return alg == "ES512"
+		}
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+func (v *Verifier) validate(claims *IPOracleClaims) error {
+	clock := v.Clock
+	if clock == nil {
+		clock = clockwork.NewRealClock()
+	}
+	leeway := v.Leeway
+	if leeway == 0 {
+		leeway = idtoken.DefaultLeeway
+	}
+	now := clock.Now()
+
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return errors.Errorf("token issuer mismatch, want: %s, got: %s", v.Issuer, claims.Issuer)
+	}
+	if v.Audience != "" && claims.Audience != v.Audience {
+		return errors.Errorf("token not issued for audience: %s", v.Audience)
+	}
+	if v.Nonce != "" && claims.Nonce != v.Nonce {
+		return errors.New("token nonce mismatch")
+	}
+	if claims.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	exp := time.Unix(claims.ExpiresAt, 0)
+	if now.After(exp.Add(leeway)) {
+		return errors.Errorf("token is expired by %v", now.Sub(exp))
+	}
+	if claims.NotBefore != 0 && now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if claims.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(claims.IssuedAt, 0)) {
+		return errors.New("token used before issued")
+	}
+	if net.ParseIP(claims.SourceIp) == nil {
+		return errors.Errorf("token has no valid source_ip claim: %q", claims.SourceIp)
+	}
+	for _, addr := range claims.SourceIps {
+		if net.ParseIP(addr) == nil {
+			return errors.Errorf("token has an invalid source_ips address: %q", addr)
+		}
+	}
+	return nil
+}
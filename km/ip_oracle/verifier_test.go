@@ -0,0 +1,241 @@
+package ip_oracle
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2020, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+func testIssuer(t *testing.T) (*TokenIssuer, *idtoken.KeySet) {
+	signer, err := NewLocalSigner(testEd25519Key(t))
+	require.NoError(t, err)
+	keys, err := JWKS(signer)
+	require.NoError(t, err)
+	return &TokenIssuer{
+		Method: signer,
+		Issuer: "https://ip-oracle.example.com",
+		Clock:  clockwork.NewFakeClockAt(testTime),
+	}, keys
+}
+
+func TestVerifier(t *testing.T) {
+	issuer, keys := testIssuer(t)
+	v := &Verifier{
+		Keys:     keys,
+		Issuer:   "https://ip-oracle.example.com",
+		Audience: "nonprod",
+		Clock:    clockwork.NewFakeClockAt(testTime.Add(time.Minute)),
+	}
+
+	token, err := issuer.Issue("10.1.2.3", "nonprod", "")
+	require.NoError(t, err)
+	claims, err := v.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.2.3", claims.SourceIp)
+	assert.Equal(t, "nonprod", claims.Audience)
+	assert.Equal(t, "https://ip-oracle.example.com", claims.Issuer)
+
+	// Issued for another environment
+	token, err = issuer.Issue("10.1.2.3", "prod", "")
+	require.NoError(t, err)
+	_, err = v.Verify(token)
+	assert.Contains(t, err.Error(), "not issued for audience")
+
+	// By another issuer
+	other := *issuer
+	other.Issuer = "https://elsewhere.example.com"
+	token, err = other.Issue("10.1.2.3", "nonprod", "")
+	require.NoError(t, err)
+	_, err = v.Verify(token)
+	assert.Contains(t, err.Error(), "issuer mismatch")
+
+	// Nonce
+	token, err = issuer.Issue("10.1.2.3", "nonprod", "n-123")
+	require.NoError(t, err)
+	withNonce := *v
+	withNonce.Nonce = "n-123"
+	claims, err = withNonce.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, "n-123", claims.Nonce)
+	withNonce.Nonce = "n-456"
+	_, err = withNonce.Verify(token)
+	assert.Contains(t, err.Error(), "nonce mismatch")
+
+	// Not an address
+	token, err = issuer.Issue("", "nonprod", "")
+	require.NoError(t, err)
+	_, err = v.Verify(token)
+	assert.Contains(t, err.Error(), "source_ip")
+}
+
+func TestVerifierTimes(t *testing.T) {
+	issuer, keys := testIssuer(t)
+	token, err := issuer.Issue("10.1.2.3", "", "")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		valid bool
+	}{
+		{"fresh", testTime, true},
+		{"clock behind, within leeway", testTime.Add(-30 * time.Second), true},
+		{"clock behind", testTime.Add(-2 * time.Minute), false},
+		{"expired, within leeway", testTime.Add(TokenLifetime + 30*time.Second), true},
+		{"expired", testTime.Add(TokenLifetime + 2*time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Verifier{Keys: keys, Clock: clockwork.NewFakeClockAt(tt.now)}
+			_, err := v.Verify(token)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	noExpiry := jwt.NewWithClaims(issuer.Method, IPOracleClaims{SourceIp: "10.1.2.3"})
+	noExpiry.Header["kid"] = issuer.Method.(Signer).Kid()
+	token, err = noExpiry.SignedString(issuer.Method)
+	require.NoError(t, err)
+	_, err = (&Verifier{Keys: keys}).Verify(token)
+	assert.Contains(t, err.Error(), "no expiry")
+}
+
+func TestVerifierAlgorithms(t *testing.T) {
+	rsaKey := testRSAKey(t)
+	rsaSigner, err := NewLocalSigner(rsaKey)
+	require.NoError(t, err)
+	rsaKeys, err := JWKS(rsaSigner)
+	require.NoError(t, err)
+	claims := IPOracleClaims{SourceIp: "10.1.2.3", StandardClaims: jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}}
+	sign := func(method jwt.SigningMethod, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = rsaSigner.Kid()
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	_, err = (&Verifier{Keys: rsaKeys}).Verify(sign(jwt.SigningMethodRS256, rsaKey))
+	assert.NoError(t, err)
+	_, err = (&Verifier{Method: rsaSigner}).Verify(sign(jwt.SigningMethodRS256, rsaKey))
+	assert.NoError(t, err)
+
+	// Another algorithm with the same key
+	_, err = (&Verifier{Keys: rsaKeys}).Verify(sign(jwt.SigningMethodRS384, rsaKey))
+	assert.Error(t, err)
+	_, err = (&Verifier{Method: rsaSigner}).Verify(sign(jwt.SigningMethodRS384, rsaKey))
+	assert.Contains(t, err.Error(), "unexpected token alg")
+
+	// Unsigned
+	unsigned := sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType)
+	_, err = (&Verifier{Keys: rsaKeys}).Verify(unsigned)
+	assert.Error(t, err)
+	_, err = (&Verifier{Method: rsaSigner}).Verify(unsigned)
+	assert.Error(t, err)
+
+	// HMAC keyed with the public key
+	hmacKeys := idtoken.NewKeySet(idtoken.Key{KeyId: rsaSigner.Kid(), Public: &rsaKey.PublicKey})
+	_, err = (&Verifier{Keys: hmacKeys}).Verify(sign(jwt.SigningMethodHS256, []byte("secret")))
+	assert.Error(t, err)
+
+	// A key without a declared alg still only accepts its own
+	ecKey := testECKey(t, elliptic.P256())
+	ecKeys := idtoken.NewKeySet(idtoken.Key{KeyId: rsaSigner.Kid(), Public: &ecKey.PublicKey})
+	token := jwt.NewWithClaims(jwt.SigningMethodES384, claims)
+	token.Header["kid"] = rsaSigner.Kid()
+	signed, err := token.SignedString(testECKey(t, elliptic.P384()))
+	require.NoError(t, err)
+	_, err = (&Verifier{Keys: ecKeys}).Verify(signed)
+	assert.Contains(t, err.Error(), "can't be used with")
+}
+
+func TestVerifierMalformed(t *testing.T) {
+	_, keys := testIssuer(t)
+	v := &Verifier{Keys: keys}
+	for _, token := range []string{
+		"",
+		".",
+		"..",
+		"...",
+		"not-a-token",
+		"not.a.token",
+		"eyJhbGciOiJFZERTQSJ9",
+		"eyJhbGciOiJFZERTQSJ9.e30",
+		"eyJhbGciOiJFZERTQSJ9.bm90IGpzb24.c2ln",
+		"eyJhbGciOjV9.e30.c2ln",
+		"e30.e30.c2ln",
+		strings.Repeat("a", MaxTokenLength) + ".b.c",
+	} {
+		_, err := v.Verify(token)
+		assert.Error(t, err, "token %q", token)
+	}
+}
+
+// TestVerifierFuzz mutates valid tokens, checking the verifier never
+// panics and never accepts a token that was changed.
+func TestVerifierFuzz(t *testing.T) {
+	issuer, keys := testIssuer(t)
+	v := &Verifier{Keys: keys, Clock: clockwork.NewFakeClockAt(testTime)}
+	kmsToken, err := MakeIPJWT("10.1.2.3", &SigningMethodKMS{
+		KMS:              &fakeKMS{keys: map[string]crypto.Signer{"k": testRSAKey(t)}},
+		KeyId:            "k",
+		SigningAlgorithm: "RSASSA_PKCS1_V1_5_SHA_256",
+	})
+	require.NoError(t, err)
+	valid, err := issuer.Issue("10.1.2.3", "nonprod", "")
+	require.NoError(t, err)
+	corpus := []string{valid, kmsToken}
+
+	alphabet := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.=+/{}\":, \x00\xff")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		data := []byte(corpus[r.Intn(len(corpus))])
+		for n := r.Intn(4) + 1; n > 0; n-- {
+			switch r.Intn(4) {
+			case 0: // replace a byte
+				data[r.Intn(len(data))] = alphabet[r.Intn(len(alphabet))]
+			case 1: // insert a byte
+				pos := r.Intn(len(data) + 1)
+				data = append(data[:pos], append([]byte{alphabet[r.Intn(len(alphabet))]}, data[pos:]...)...)
+			case 2: // truncate
+				data = data[:r.Intn(len(data)+1)]
+			case 3: // splice segments of two tokens
+				other := strings.Split(corpus[r.Intn(len(corpus))], ".")
+				parts := strings.Split(string(data), ".")
+				if len(parts) > 0 {
+					k := r.Intn(len(parts))
+					parts[k] = other[r.Intn(len(other))]
+				}
+				data = []byte(strings.Join(parts, "."))
+			}
+			if len(data) == 0 {
+				break
+			}
+		}
+		token := string(data)
+		assert.NotPanics(t, func() {
+			claims, err := v.Verify(token)
+			if err == nil && token != valid {
+				// Only changes base64 decoding ignores can be accepted
+				assert.Equal(t, "10.1.2.3", claims.SourceIp, "accepted mutated token %q", token)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package limits
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+)
+
+// DynamoDB attributes. The table's partition key is "key", a string, and
+// "expires_at" can be its TTL attribute, so keys no longer in use are
+// cleaned up.
+const (
+	attrKey       = "key"
+	attrVersion   = "version"
+	attrIssuances = "issuances"
+	attrExpiresAt = "expires_at"
+)
+
+// maxDynamoDBAttempts is how many times an update is tried before giving
+// up, when other issuers keep updating the same key first.
+const maxDynamoDBAttempts = 5
+
+// DynamoDBStore keeps usage in a DynamoDB table, so issuers can share
+// it. Updates are optimistic: each item has a version, and an update
+// only succeeds if the version hasn't changed since it was read.
+type DynamoDBStore struct {
+	DynamoDB dynamodbiface.DynamoDBAPI
+	Table    string
+}
+
+func NewDynamoDBStore(table string) (*DynamoDBStore, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating dynamodb session")
+	}
+	return &DynamoDBStore{
+		DynamoDB: dynamodb.New(sess),
+		Table:    table,
+	}, nil
+}
+
+func (s *DynamoDBStore) Update(key string, fn func(u *Usage) error) error {
+	for attempt := 0; attempt < maxDynamoDBAttempts; attempt++ {
+		u, version, err := s.get(key)
+		if err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+		err = s.put(key, u, version)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			// Someone else updated it first, start again
+			continue
+		}
+		return err
+	}
+	return errors.Errorf("updating %s: too many concurrent updates", key)
+}
+
+// get returns a key's usage and version, zero if there's no item.
+func (s *DynamoDBStore) get(key string) (*Usage, int64, error) {
+	out, err := s.DynamoDB.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            map[string]*dynamodb.AttributeValue{attrKey: {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "getting %s", key)
+	}
+	u := &Usage{}
+	if out.Item == nil {
+		return u, 0, nil
+	}
+	var version int64
+	if v := out.Item[attrVersion]; v != nil && v.N != nil {
+		version, err = strconv.ParseInt(*v.N, 10, 64)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "parsing %s version", key)
+		}
+	}
+	if v := out.Item[attrIssuances]; v != nil && v.S != nil {
+		if err := json.Unmarshal([]byte(*v.S), &u.Issuances); err != nil {
+			return nil, 0, errors.Wrapf(err, "parsing %s issuances", key)
+		}
+	}
+	return u, version, nil
+}
+
+// put saves a key's usage, if its version is still the one read.
+func (s *DynamoDBStore) put(key string, u *Usage, version int64) error {
+	issuances, err := json.Marshal(u.Issuances)
+	if err != nil {
+		return err
+	}
+	// Unused keys expire now
+	until := u.Until()
+	if until.IsZero() {
+		until = time.Now()
+	}
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(s.Table),
+		Item: map[string]*dynamodb.AttributeValue{
+			attrKey:       {S: aws.String(key)},
+			attrVersion:   {N: aws.String(strconv.FormatInt(version+1, 10))},
+			attrIssuances: {S: aws.String(string(issuances))},
+			attrExpiresAt: {N: aws.String(strconv.FormatInt(until.Unix(), 10))},
+		},
+		ExpressionAttributeNames: map[string]*string{"#v": aws.String(attrVersion)},
+	}
+	if version == 0 {
+		in.ConditionExpression = aws.String("attribute_not_exists(#v)")
+	} else {
+		in.ConditionExpression = aws.String("#v = :v")
+		in.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":v": {N: aws.String(strconv.FormatInt(version, 10))},
+		}
+	}
+	_, err = s.DynamoDB.PutItem(in)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return err
+		}
+		return errors.Wrapf(err, "putting %s", key)
+	}
+	return nil
+}
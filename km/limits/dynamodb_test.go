@@ -0,0 +1,101 @@
+package limits
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDynamoDB keeps items by key, checking the version conditions the
+// store puts with. Before each put succeeds, race is called, to stand in
+// for another issuer's update.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+	puts  int
+	race  func(f *fakeDynamoDB)
+}
+
+func (f *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[*input.Key[attrKey].S]}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if f.race != nil {
+		race := f.race
+		f.race = nil
+		race(f)
+	}
+	key := *input.Item[attrKey].S
+	existing := f.items[key]
+	switch *input.ConditionExpression {
+	case "attribute_not_exists(#v)":
+		if existing != nil {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "exists", nil)
+		}
+	case "#v = :v":
+		if existing == nil || *existing[attrVersion].N != *input.ExpressionAttributeValues[":v"].N {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "changed", nil)
+		}
+	}
+	f.items[key] = input.Item
+	f.puts++
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	fake := &fakeDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	store := &DynamoDBStore{DynamoDB: fake, Table: "limits"}
+	clock := clockwork.NewFakeClock()
+	l := NewLimiter(store)
+	limits := []Limit{{Key: "dev/deployment", IssuancesPerHour: 2}}
+	expires := clock.Now().Add(15 * time.Minute)
+
+	assert.NoError(t, l.Take(limits, "1", clock.Now(), expires))
+	item := fake.items["dev/deployment"]
+	assert.Equal(t, "1", *item[attrVersion].N)
+	assert.Contains(t, *item[attrIssuances].S, `"id":"1"`)
+	assert.Equal(t, clock.Now().Add(Window).Unix(), mustUnix(t, item[attrExpiresAt]))
+
+	// Another issuer takes the last issuance between our get and put, so
+	// we try again and find the limit reached
+	fake.race = func(f *fakeDynamoDB) {
+		assert.NoError(t, NewLimiter(&DynamoDBStore{DynamoDB: f, Table: "limits"}).
+			Take(limits, "2", clock.Now(), expires))
+	}
+	err := l.Take(limits, "3", clock.Now(), expires)
+	assert.IsType(t, &ExceededError{}, err)
+	assert.Equal(t, 2, fake.puts)
+	assert.Equal(t, "2", *fake.items["dev/deployment"][attrVersion].N)
+
+	assert.NoError(t, l.Release(limits, "2", clock.Now()))
+	assert.NoError(t, l.Take(limits, "3", clock.Now(), expires))
+}
+
+func TestDynamoDBStore_Contention(t *testing.T) {
+	fake := &fakeDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	store := &DynamoDBStore{DynamoDB: &alwaysConflicting{fake}, Table: "limits"}
+	err := store.Update("dev/deployment", func(u *Usage) error { return nil })
+	assert.EqualError(t, err, "updating dev/deployment: too many concurrent updates")
+}
+
+type alwaysConflicting struct {
+	*fakeDynamoDB
+}
+
+func (f *alwaysConflicting) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "changed", nil)
+}
+
+func mustUnix(t *testing.T, v *dynamodb.AttributeValue) int64 {
+	n, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+	assert.NoError(t, err)
+	return n
+}
@@ -0,0 +1,202 @@
+// Package limits caps how often credentials are issued, and how many are
+// active at once. Issuances are counted per key (e.g. a role, or a
+// requester of a role) in a Store, which issuers can share.
+package limits
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Window is the period issuances per hour are counted over.
+const Window = time.Hour
+
+// Usage is what has been issued against a key that still counts: in the
+// last hour, or not yet expired.
+type Usage struct {
+	Issuances []Issuance `json:"issuances"`
+}
+
+// Issuance is one set of credentials issued.
+type Issuance struct {
+	Id      string    `json:"id"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+}
+
+// Store keeps usage by key. Update must be atomic: it applies fn to a
+// key's usage and saves the result, unless fn fails, and two updates of
+// a key must not both start from the same usage.
+type Store interface {
+	Update(key string, fn func(u *Usage) error) error
+}
+
+// NewStore returns the store for a target, e.g. memory (the default)
+// or dynamodb://table.
+func NewStore(target string) (Store, error) {
+	switch {
+	case target == "" || target == "memory":
+		return NewMemoryStore(), nil
+	case strings.HasPrefix(target, "dynamodb://"):
+		store, err := NewDynamoDBStore(target[11:])
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.Errorf("unsupported limits store: %s", target)
+}
+
+// Limit is how many issuances a key may have. A zero count is no limit.
+type Limit struct {
+	Key              string
+	IssuancesPerHour int
+	MaxActive        int
+}
+
+// ExceededError is returned for an issuance that would exceed a limit.
+type ExceededError struct {
+	Key string
+	// What was exceeded, e.g. "3 issuances per hour"
+	Limit string
+	// When the issuance would be within the limit, if nothing else is
+	// issued in the meantime
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("limit of %s for %s reached, retry after %s", e.Limit, e.Key, e.RetryAfter)
+}
+
+// Limiter counts issuances against limits.
+type Limiter struct {
+	Store Store
+}
+
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{Store: store}
+}
+
+// Take records an issuance now, with the given id and expiry, against
+// each of the limits, unless that would exceed any of them, in which
+// case it returns an *ExceededError and records nothing.
+func (l *Limiter) Take(limits []Limit, id string, now time.Time, expires time.Time) error {
+	for i, limit := range limits {
+		limit := limit
+		err := l.Store.Update(limit.Key, func(u *Usage) error {
+			u.prune(now)
+			if err := limit.check(u, now); err != nil {
+				return err
+			}
+			u.Issuances = append(u.Issuances, Issuance{Id: id, Issued: now, Expires: expires})
+			return nil
+		})
+		if err != nil {
+			// Give back what was taken against the limits before
+			if releaseErr := l.Release(limits[:i], id, now); releaseErr != nil {
+				return errors.Wrapf(releaseErr, "after %s", err)
+			}
+			if _, ok := err.(*ExceededError); ok {
+				return err
+			}
+			return errors.Wrapf(err, "updating limit %s", limit.Key)
+		}
+	}
+	return nil
+}
+
+// Release forgets an issuance, e.g. because the credentials weren't
+// issued after all.
+func (l *Limiter) Release(limits []Limit, id string, now time.Time) error {
+	for _, limit := range limits {
+		err := l.Store.Update(limit.Key, func(u *Usage) error {
+			u.prune(now)
+			kept := u.Issuances[:0]
+			for _, issuance := range u.Issuances {
+				if issuance.Id != id {
+					kept = append(kept, issuance)
+				}
+			}
+			u.Issuances = kept
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "releasing limit %s", limit.Key)
+		}
+	}
+	return nil
+}
+
+// check returns an *ExceededError if one more issuance would exceed the
+// limit.
+func (limit *Limit) check(u *Usage, now time.Time) error {
+	if limit.IssuancesPerHour > 0 {
+		var issued []time.Time
+		for _, issuance := range u.Issuances {
+			if issuance.Issued.After(now.Add(-Window)) {
+				issued = append(issued, issuance.Issued)
+			}
+		}
+		if len(issued) >= limit.IssuancesPerHour {
+			// Wait for enough issuances to leave the window
+			sortTimes(issued)
+			return &ExceededError{
+				Key:        limit.Key,
+				Limit:      fmt.Sprintf("%d issuances per hour", limit.IssuancesPerHour),
+				RetryAfter: issued[len(issued)-limit.IssuancesPerHour].Add(Window).Sub(now),
+			}
+		}
+	}
+	if limit.MaxActive > 0 {
+		var expires []time.Time
+		for _, issuance := range u.Issuances {
+			if issuance.Expires.After(now) {
+				expires = append(expires, issuance.Expires)
+			}
+		}
+		if len(expires) >= limit.MaxActive {
+			// Wait for enough credentials to expire
+			sortTimes(expires)
+			return &ExceededError{
+				Key:        limit.Key,
+				Limit:      fmt.Sprintf("%d active credentials", limit.MaxActive),
+				RetryAfter: expires[len(expires)-limit.MaxActive].Sub(now),
+			}
+		}
+	}
+	return nil
+}
+
+// prune drops issuances that no longer count against any limit.
+func (u *Usage) prune(now time.Time) {
+	kept := u.Issuances[:0]
+	for _, issuance := range u.Issuances {
+		if issuance.Issued.After(now.Add(-Window)) || issuance.Expires.After(now) {
+			kept = append(kept, issuance)
+		}
+	}
+	u.Issuances = kept
+}
+
+// Until is when the usage stops counting against any limit, so can be
+// forgotten.
+func (u *Usage) Until() time.Time {
+	var until time.Time
+	for _, issuance := range u.Issuances {
+		if t := issuance.Issued.Add(Window); t.After(until) {
+			until = t
+		}
+		if issuance.Expires.After(until) {
+			until = issuance.Expires
+		}
+	}
+	return until
+}
+
+func sortTimes(t []time.Time) {
+	sort.Slice(t, func(i, j int) bool { return t[i].Before(t[j]) })
+}
@@ -0,0 +1,94 @@
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_IssuancesPerHour(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	l := NewLimiter(NewMemoryStore())
+	limits := []Limit{{Key: "dev/deployment", IssuancesPerHour: 2}}
+
+	assert.NoError(t, l.Take(limits, "1", clock.Now(), clock.Now().Add(time.Minute)))
+	clock.Advance(10 * time.Minute)
+	assert.NoError(t, l.Take(limits, "2", clock.Now(), clock.Now().Add(time.Minute)))
+	clock.Advance(10 * time.Minute)
+	err := l.Take(limits, "3", clock.Now(), clock.Now().Add(time.Minute))
+	assert.Equal(t, &ExceededError{
+		Key:        "dev/deployment",
+		Limit:      "2 issuances per hour",
+		RetryAfter: 40 * time.Minute,
+	}, err)
+	assert.EqualError(t, err, "limit of 2 issuances per hour for dev/deployment reached, retry after 40m0s")
+
+	// Once the first issuance is an hour old, there's room for another
+	clock.Advance(40 * time.Minute)
+	assert.NoError(t, l.Take(limits, "3", clock.Now(), clock.Now().Add(time.Minute)))
+}
+
+func TestLimiter_MaxActive(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	l := NewLimiter(NewMemoryStore())
+	limits := []Limit{{Key: "dev/deployment", MaxActive: 1}}
+
+	assert.NoError(t, l.Take(limits, "1", clock.Now(), clock.Now().Add(15*time.Minute)))
+	err := l.Take(limits, "2", clock.Now(), clock.Now().Add(15*time.Minute))
+	if assert.IsType(t, &ExceededError{}, err) {
+		assert.Equal(t, "1 active credentials", err.(*ExceededError).Limit)
+		assert.Equal(t, 15*time.Minute, err.(*ExceededError).RetryAfter)
+	}
+
+	// Released issuances don't count
+	assert.NoError(t, l.Release(limits, "1", clock.Now()))
+	assert.NoError(t, l.Take(limits, "2", clock.Now(), clock.Now().Add(15*time.Minute)))
+
+	clock.Advance(15 * time.Minute)
+	assert.NoError(t, l.Take(limits, "3", clock.Now(), clock.Now().Add(15*time.Minute)))
+}
+
+func TestLimiter_TakeAll(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	store := NewMemoryStore()
+	l := NewLimiter(store)
+	role := Limit{Key: "dev/deployment", IssuancesPerHour: 10}
+	expires := clock.Now().Add(time.Hour)
+
+	assert.NoError(t, l.Take([]Limit{role, {Key: "dev/deployment/user:a", MaxActive: 1}}, "1", clock.Now(), expires))
+	err := l.Take([]Limit{role, {Key: "dev/deployment/user:a", MaxActive: 1}}, "2", clock.Now(), expires)
+	assert.IsType(t, &ExceededError{}, err)
+	// The role limit taken before the requester's was exceeded is given
+	// back
+	assert.Len(t, store.usage["dev/deployment"].Issuances, 1)
+	assert.NoError(t, l.Take([]Limit{role, {Key: "dev/deployment/user:b", MaxActive: 1}}, "3", clock.Now(), expires))
+	assert.Len(t, store.usage["dev/deployment"].Issuances, 2)
+}
+
+func TestUsage_Prune(t *testing.T) {
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	u := &Usage{Issuances: []Issuance{
+		{Id: "old", Issued: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)},
+		{Id: "active", Issued: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)},
+		{Id: "recent", Issued: now.Add(-time.Minute), Expires: now.Add(-time.Second)},
+	}}
+	u.prune(now)
+	assert.Len(t, u.Issuances, 2)
+	assert.Equal(t, now.Add(time.Hour), u.Until())
+	assert.True(t, (&Usage{}).Until().IsZero())
+}
+
+func TestNewStore(t *testing.T) {
+	store, err := NewStore("")
+	assert.NoError(t, err)
+	assert.IsType(t, &MemoryStore{}, store)
+	store, err = NewStore("dynamodb://km-limits")
+	assert.NoError(t, err)
+	if assert.IsType(t, &DynamoDBStore{}, store) {
+		assert.Equal(t, "km-limits", store.(*DynamoDBStore).Table)
+	}
+	_, err = NewStore("redis://limits")
+	assert.EqualError(t, err, "unsupported limits store: redis://limits")
+}
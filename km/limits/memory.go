@@ -0,0 +1,30 @@
+package limits
+
+import "sync"
+
+// MemoryStore keeps usage in memory, so counts only what this process
+// issues. It's for tests, and issuers that run as a single instance.
+type MemoryStore struct {
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{usage: make(map[string]Usage)}
+}
+
+func (s *MemoryStore) Update(key string, fn func(u *Usage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// fn gets a copy, so nothing changes if it fails
+	u := Usage{Issuances: append([]Issuance{}, s.usage[key].Issuances...)}
+	if err := fn(&u); err != nil {
+		return err
+	}
+	if len(u.Issuances) == 0 {
+		delete(s.usage, key)
+	} else {
+		s.usage[key] = u
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// Input is what a policy decides about: a request for a role, who made
+// it and who approved it. Rules see it as these variables:
+//
+//   environment          the issuer's environment name
+//   role                 the requested role
+//   requester            {username, groups, ci_identity, ci_claims, source_ip}
+//   approvers            [{username, groups}]
+//   approvals            approvers per group, e.g. approvals["security"]
+//   required_approvals   approvals per group the role's workflow policy needs
+//   missing_approvals    required approvals not given, per group
+//   source               {description, details_uri} as given by the client
+//   break_glass          whether this is a break-glass request
+//   justification        the break-glass justification
+//   now                  the time of the request, a timestamp
+//
+// Only the requester's ci_identity, ci_claims and source_ip, and the
+// approvers, are verified. The rest is as the requester says.
+type Input struct {
+	Environment       string         `json:"environment"`
+	Role              string         `json:"role"`
+	Requester         Requester      `json:"requester"`
+	Approvers         []Approver     `json:"approvers,omitempty"`
+	RequiredApprovals map[string]int `json:"required_approvals,omitempty"`
+	Source            Source         `json:"source"`
+	BreakGlass        bool           `json:"break_glass,omitempty"`
+	Justification     string         `json:"justification,omitempty"`
+	Time              time.Time      `json:"time"`
+}
+
+type Requester struct {
+	Username   string              `json:"username"`
+	Groups     []string            `json:"groups,omitempty"`
+	CIIdentity string              `json:"ci_identity,omitempty"`
+	CIClaims   map[string][]string `json:"ci_claims,omitempty"`
+	SourceIp   string              `json:"source_ip,omitempty"`
+}
+
+type Approver struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+type Source struct {
+	Description string `json:"description,omitempty"`
+	DetailsURI  string `json:"details_uri,omitempty"`
+}
+
+// vars returns the input as CEL variables. Every variable is set, and
+// every key of a map variable, so rules don't have to check for them.
+func (in *Input) vars() map[string]interface{} {
+	approvals := make(map[string]int64)
+	approvers := make([]interface{}, 0, len(in.Approvers))
+	for _, a := range in.Approvers {
+		for _, group := range a.Groups {
+			approvals[group]++
+		}
+		approvers = append(approvers, map[string]interface{}{
+			"username": a.Username,
+			"groups":   stringList(a.Groups),
+		})
+	}
+	required := make(map[string]int64)
+	missing := make(map[string]int64)
+	for group, n := range in.RequiredApprovals {
+		required[group] = int64(n)
+		if approvals[group] < int64(n) {
+			missing[group] = int64(n) - approvals[group]
+		}
+	}
+	claims := make(map[string]interface{})
+	for name, values := range in.Requester.CIClaims {
+		claims[name] = stringList(values)
+	}
+	now, _ := ptypes.TimestampProto(in.Time)
+	return map[string]interface{}{
+		"environment": in.Environment,
+		"role":        in.Role,
+		"requester": map[string]interface{}{
+			"username":    in.Requester.Username,
+			"groups":      stringList(in.Requester.Groups),
+			"ci_identity": in.Requester.CIIdentity,
+			"ci_claims":   claims,
+			"source_ip":   in.Requester.SourceIp,
+		},
+		"approvers":          approvers,
+		"approvals":          approvals,
+		"required_approvals": required,
+		"missing_approvals":  missing,
+		"source": map[string]string{
+			"description": in.Source.Description,
+			"details_uri": in.Source.DetailsURI,
+		},
+		"break_glass":   in.BreakGlass,
+		"justification": in.Justification,
+		"now":           now,
+	}
+}
+
+func stringList(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
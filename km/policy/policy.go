@@ -0,0 +1,180 @@
+// Package policy decides issuance with policy-as-code: rules written in
+// CEL (https://github.com/google/cel-spec) over the request, who
+// approved it and when, any of which can deny it.
+//
+// A policy is a YAML (or JSON) document:
+//
+//   rules:
+//     - name: prod-security
+//       deny: >
+//         environment.startsWith("prod") && !("security" in approvals)
+//         && !source.details_uri.contains("/hotfix/")
+//       reason: prod needs security approval, unless it's a hotfix
+//   tests:
+//     - name: hotfix without security approval
+//       input: {environment: prod, source: {details_uri: ".../hotfix/123"}}
+//       allow: true
+//
+// Requests are allowed unless a rule denies them. See Input for the
+// variables rules can use.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/ghodss/yaml"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/pkg/errors"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Document is a policy as written.
+type Document struct {
+	Rules []Rule `json:"rules"`
+	Tests []Test `json:"tests,omitempty"`
+}
+
+// Rule denies a request if its CEL expression is true.
+type Rule struct {
+	Name string `json:"name"`
+	Deny string `json:"deny"`
+	// Reason is given to the requester when the rule denies them
+	Reason string `json:"reason,omitempty"`
+}
+
+// Decision is what a policy decided about a request.
+type Decision struct {
+	Allow bool `json:"allow"`
+	// The rules that denied the request, and their reasons
+	DeniedBy []string `json:"denied_by,omitempty"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
+// Policy is a compiled policy, ready to evaluate.
+type Policy struct {
+	Rules []Rule
+	Tests []Test
+
+	programs []cel.Program
+}
+
+// variables are what rules can refer to, see Input.vars.
+var variables = []*exprpb.Decl{
+	decls.NewIdent("environment", decls.String, nil),
+	decls.NewIdent("role", decls.String, nil),
+	decls.NewIdent("requester", decls.NewMapType(decls.String, decls.Dyn), nil),
+	decls.NewIdent("approvers", decls.NewListType(decls.NewMapType(decls.String, decls.Dyn)), nil),
+	decls.NewIdent("approvals", decls.NewMapType(decls.String, decls.Int), nil),
+	decls.NewIdent("required_approvals", decls.NewMapType(decls.String, decls.Int), nil),
+	decls.NewIdent("missing_approvals", decls.NewMapType(decls.String, decls.Int), nil),
+	decls.NewIdent("source", decls.NewMapType(decls.String, decls.String), nil),
+	decls.NewIdent("break_glass", decls.Bool, nil),
+	decls.NewIdent("justification", decls.String, nil),
+	decls.NewIdent("now", decls.Timestamp, nil),
+}
+
+// Parse parses and compiles a policy document.
+func Parse(data []byte) (*Policy, error) {
+	var doc Document
+	if err := unmarshalStrict(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing policy")
+	}
+	return Compile(&doc)
+}
+
+// Load loads and compiles a policy, which may be given by reference
+// (see util.Load).
+func Load(rules string) (*Policy, error) {
+	data, err := util.Load(rules)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading policy")
+	}
+	return Parse(data)
+}
+
+// Compile compiles a policy document's rules.
+func Compile(doc *Document) (*Policy, error) {
+	env, err := cel.NewEnv(cel.Declarations(variables...))
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{Rules: doc.Rules, Tests: doc.Tests}
+	names := make(map[string]bool)
+	for i, rule := range doc.Rules {
+		if rule.Name == "" {
+			return nil, errors.Errorf("rules[%d]: missing name", i)
+		}
+		if names[rule.Name] {
+			return nil, errors.Errorf("rules[%s]: duplicate rule", rule.Name)
+		}
+		names[rule.Name] = true
+		ast, issues := env.Compile(rule.Deny)
+		if issues != nil && issues.Err() != nil {
+			return nil, errors.Errorf("rules[%s].deny: %s", rule.Name, issues.Err())
+		}
+		if t := ast.ResultType(); t.GetPrimitive() != exprpb.Type_BOOL && t.GetDyn() == nil {
+			return nil, errors.Errorf("rules[%s].deny: must be a bool expression", rule.Name)
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rules[%s].deny", rule.Name)
+		}
+		p.programs = append(p.programs, program)
+	}
+	return p, nil
+}
+
+// Evaluate decides a request. Every rule is evaluated, so all the
+// reasons a request is denied are given. A rule that can't be evaluated
+// is an error, and the request should be denied.
+func (p *Policy) Evaluate(in *Input) (*Decision, error) {
+	vars := in.vars()
+	d := &Decision{Allow: true}
+	for i, program := range p.programs {
+		rule := p.Rules[i]
+		out, _, err := program.Eval(vars)
+		if err != nil {
+			return nil, errors.Wrapf(err, "evaluating rule %s", rule.Name)
+		}
+		deny, ok := out.(types.Bool)
+		if !ok {
+			return nil, errors.Errorf("evaluating rule %s: got %s, not a bool", rule.Name, out.Type())
+		}
+		if deny {
+			reason := rule.Reason
+			if reason == "" {
+				reason = "denied by policy rule " + rule.Name
+			}
+			d.Allow = false
+			d.DeniedBy = append(d.DeniedBy, rule.Name)
+			d.Reasons = append(d.Reasons, reason)
+		}
+	}
+	return d, nil
+}
+
+// String describes a decision in a line.
+func (d *Decision) String() string {
+	if d.Allow {
+		return "allow"
+	}
+	return fmt.Sprintf("deny (%s)", strings.Join(d.Reasons, "; "))
+}
+
+// unmarshalStrict unmarshals YAML or JSON, rejecting unknown fields, so
+// that a misspelt rule field isn't silently ignored.
+func unmarshalStrict(data []byte, v interface{}) error {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
@@ -0,0 +1,130 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+rules:
+  - name: approvals
+    deny: size(missing_approvals) > 0
+    reason: not enough approvals
+  - name: prod-security
+    deny: >
+      environment.startsWith("prod") && !("security" in approvals)
+      && !source.details_uri.contains("/hotfix/")
+    reason: prod needs security approval, unless it's a hotfix
+  - name: business-hours
+    deny: break_glass && now.getHours("Australia/Sydney") < 7
+tests:
+  - name: hotfix without security approval
+    input:
+      environment: prod
+      role: deployment
+      required_approvals: {ops: 1}
+      approvers: [{username: jonesa, groups: [ops]}]
+      source: {details_uri: "https://gitlab.example.com/app/-/merge_requests/hotfix/123"}
+    allow: true
+  - name: change without security approval
+    input:
+      environment: prod
+      role: deployment
+    allow: false
+    denied_by: [prod-security]
+`
+
+func TestPolicy_Evaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	assert.NoError(t, err)
+	assert.Len(t, p.Rules, 3)
+
+	in := &Input{
+		Environment:       "prod",
+		Role:              "deployment",
+		Requester:         Requester{Username: "smithb12"},
+		RequiredApprovals: map[string]int{"ops": 2},
+		Approvers:         []Approver{{Username: "jonesa", Groups: []string{"ops", "security"}}},
+		Time:              time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC),
+	}
+	d, err := p.Evaluate(in)
+	assert.NoError(t, err)
+	assert.Equal(t, &Decision{DeniedBy: []string{"approvals"}, Reasons: []string{"not enough approvals"}}, d)
+	assert.Equal(t, "deny (not enough approvals)", d.String())
+
+	in.Approvers = append(in.Approvers, Approver{Username: "brownc", Groups: []string{"ops"}})
+	d, err = p.Evaluate(in)
+	assert.NoError(t, err)
+	assert.Equal(t, &Decision{Allow: true}, d)
+	assert.Equal(t, "allow", d.String())
+
+	// 9am UTC is 8pm in Sydney, but 6pm UTC is 5am the next day
+	in.BreakGlass = true
+	in.Approvers = nil
+	in.Time = time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)
+	d, err = p.Evaluate(in)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"approvals", "prod-security", "business-hours"}, d.DeniedBy)
+	assert.Equal(t, "denied by policy rule business-hours", d.Reasons[2])
+}
+
+func TestPolicy_RunTests(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	assert.NoError(t, err)
+	results := p.RunTests(p.Tests)
+	if assert.Len(t, results, 2) {
+		assert.True(t, results[0].Passed, results[0].Message)
+		assert.True(t, results[1].Passed, results[1].Message)
+	}
+
+	tests, err := ParseTests([]byte(`
+tests:
+  - name: wrong
+    input: {environment: prod}
+    allow: true
+  - name: wrong rule
+    input: {environment: prod}
+    allow: false
+    denied_by: [approvals]
+`))
+	assert.NoError(t, err)
+	results = p.RunTests(tests)
+	assert.False(t, results[0].Passed)
+	assert.Equal(t, "want allow, got deny (prod needs security approval, unless it's a hotfix)", results[0].Message)
+	assert.False(t, results[1].Passed)
+	assert.Equal(t, "want denied by approvals, got prod-security", results[1].Message)
+
+	_, err = ParseTests([]byte(`tests: [{name: x, inptu: {}}]`))
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{"syntax", `rules: [{name: x, deny: "role =="}]`, "rules[x].deny: ERROR: <input>:1:8: Syntax error"},
+		{"unknown variable", `rules: [{name: x, deny: "team == 'a'"}]`, "undeclared reference to 'team'"},
+		{"not bool", `rules: [{name: x, deny: "role"}]`, "rules[x].deny: must be a bool expression"},
+		{"no name", `rules: [{deny: "true"}]`, "rules[0]: missing name"},
+		{"duplicate", `rules: [{name: x, deny: "true"}, {name: x, deny: "false"}]`, "rules[x]: duplicate rule"},
+		{"unknown field", `rules: [{name: x, denny: "true"}]`, "parsing policy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.policy))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.err)
+			}
+		})
+	}
+
+	// A rule that fails at runtime is an error, not a decision
+	p, err := Parse([]byte(`rules: [{name: x, deny: "requester.ci_claims['project_path'][0] == 'a'"}]`))
+	assert.NoError(t, err)
+	_, err = p.Evaluate(&Input{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Test is an input a policy is expected to allow or deny.
+type Test struct {
+	Name  string `json:"name"`
+	Input Input  `json:"input"`
+	Allow bool   `json:"allow"`
+	// DeniedBy, if given, are the rules expected to deny the input
+	DeniedBy []string `json:"denied_by,omitempty"`
+}
+
+// TestResult is the outcome of a test.
+type TestResult struct {
+	Name     string
+	Passed   bool
+	Decision *Decision
+	// Why the test failed, if it did
+	Message string
+}
+
+// ParseTests parses a file of tests, as the tests of a policy document.
+func ParseTests(data []byte) ([]Test, error) {
+	var doc struct {
+		Tests []Test `json:"tests"`
+	}
+	if err := unmarshalStrict(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing policy tests")
+	}
+	return doc.Tests, nil
+}
+
+// RunTests evaluates tests against the policy.
+func (p *Policy) RunTests(tests []Test) []TestResult {
+	results := make([]TestResult, 0, len(tests))
+	for i := range tests {
+		results = append(results, p.runTest(&tests[i]))
+	}
+	return results
+}
+
+func (p *Policy) runTest(t *Test) TestResult {
+	r := TestResult{Name: t.Name}
+	d, err := p.Evaluate(&t.Input)
+	if err != nil {
+		r.Message = err.Error()
+		return r
+	}
+	r.Decision = d
+	want := "allow"
+	if !t.Allow {
+		want = "deny"
+	}
+	switch {
+	case d.Allow != t.Allow:
+		r.Message = fmt.Sprintf("want %s, got %s", want, d)
+	case len(t.DeniedBy) > 0 && !sameRules(t.DeniedBy, d.DeniedBy):
+		r.Message = fmt.Sprintf("want denied by %s, got %s",
+			strings.Join(t.DeniedBy, ", "), strings.Join(d.DeniedBy, ", "))
+	default:
+		r.Passed = true
+	}
+	return r
+}
+
+func sameRules(a, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
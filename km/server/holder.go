@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/jonboulle/clockwork"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultConfigTTL is how long a loaded configuration is served before
+// its source is checked for changes.
+const DefaultConfigTTL = 60 * time.Second
+
+// ConfigHolder keeps a configured Server for the life of the process, so
+// that the configuration (and the idp processors built from it) are not
+// loaded again for every request. Once the TTL has passed the source (and
+// any includes) is checked for a new version, and reloaded if it has
+// changed. If a reload fails the last good configuration is served.
+type ConfigHolder struct {
+	// Source is the configuration, anything util.Load can load
+	Source string
+	// Overlay names the overlay of the configuration to serve, if any
+	Overlay string
+	TTL     time.Duration
+	Clock   clockwork.Clock
+	// LoadVersion returns the version of the source, util.LoadVersion
+	// unless set for testing.
+	LoadVersion func(source string) (string, error)
+
+	mu        sync.Mutex
+	server    *Server
+	sources   []string
+	version   string
+	checkedAt time.Time
+}
+
+func NewConfigHolder(source string) *ConfigHolder {
+	return &ConfigHolder{
+		Source:      source,
+		TTL:         DefaultConfigTTL,
+		Clock:       clockwork.NewRealClock(),
+		LoadVersion: util.LoadVersion,
+	}
+}
+
+// Server returns a server configured from the current configuration.
+// An error is only returned if no configuration has been loaded yet.
+func (h *ConfigHolder) Server() (*Server, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.Clock.Now()
+	if h.server != nil && now.Sub(h.checkedAt) < h.TTL {
+		return h.server, nil
+	}
+	sources := h.sources
+	if sources == nil {
+		sources = []string{h.Source}
+	}
+	version, err := h.sourcesVersion(sources)
+	if err != nil {
+		if h.server == nil {
+			return nil, err
+		}
+		log.Printf("error checking configuration version, serving last good configuration: %v", err)
+		h.checkedAt = now
+		return h.server, nil
+	}
+	h.checkedAt = now
+	// Literal configuration (an empty version) never changes
+	if h.server != nil && (version == "" || version == h.version) {
+		return h.server, nil
+	}
+
+	s := new(Server)
+	err = s.ConfigureOverlay(h.Source, h.Overlay)
+	if err != nil {
+		if h.server == nil {
+			return nil, err
+		}
+		log.Printf("error reloading configuration, serving last good configuration: %v", err)
+		return h.server, nil
+	}
+	if h.server != nil {
+		log.Printf("reloaded configuration: %s (version %s)", s.Config.Name, version)
+		// Keep counting limits where they were, which for a memory
+		// store is the old server's
+		if s.Config.Limits == h.server.Config.Limits {
+			s.Limits = h.server.Limits
+		}
+		// and keep the audit chain going, as a new logger starts a new
+		// chain, and deleting a whole chain or its tail goes unnoticed
+		if s.Config.Audit == h.server.Config.Audit && h.server.Audit != nil {
+			if c, ok := s.Audit.Sink.(io.Closer); ok {
+				c.Close()
+			}
+			s.Audit = h.server.Audit
+		}
+	}
+	if len(s.ConfigSources) != len(sources) {
+		// The includes weren't known until the config was loaded
+		if v, err := h.sourcesVersion(s.ConfigSources); err == nil {
+			version = v
+		}
+	}
+	h.server = s
+	h.sources = s.ConfigSources
+	h.version = version
+	return s, nil
+}
+
+// sourcesVersion is the combined version of the configuration sources,
+// empty if they are all literals.
+func (h *ConfigHolder) sourcesVersion(sources []string) (string, error) {
+	versions := make([]string, len(sources))
+	changes := false
+	for i, source := range sources {
+		v, err := h.LoadVersion(source)
+		if err != nil {
+			return "", err
+		}
+		versions[i] = v
+		changes = changes || v != ""
+	}
+	if !changes {
+		return "", nil
+	}
+	return strings.Join(versions, ","), nil
+}
+
+// Dispatch routes a request envelope to the current server.
+func (h *ConfigHolder) Dispatch(req *api.Request) (interface{}, error) {
+	s, err := h.Server()
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeConfiguration, "error loading km api configuration")
+	}
+	return s.Dispatch(req)
+}
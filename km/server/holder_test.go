@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+)
+
+// testConfigHolder returns a holder that always serves the given server.
+func testConfigHolder(s *Server) *ConfigHolder {
+	return &ConfigHolder{
+		TTL:   DefaultConfigTTL,
+		Clock: clockwork.NewFakeClock(),
+		LoadVersion: func(string) (string, error) {
+			return "", nil
+		},
+		server: s,
+	}
+}
+
+const testHolderConfig = `
+name: %s
+version: "1.0"
+workflow:
+  base_url: https://workflow.example.com/
+  policies:
+  - name: auto
+roles:
+- name: deployment
+  workflow: auto
+  valid_for_seconds: 3600
+`
+
+func writeTestConfig(t *testing.T, path string, name string, mtime time.Time) {
+	config := []byte(fmt.Sprintf(testHolderConfig, name))
+	assert.NoError(t, ioutil.WriteFile(path, config, 0600))
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestConfigHolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km-holder-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	mtime := time.Now().Add(-time.Hour)
+
+	clock := clockwork.NewFakeClock()
+	h := NewConfigHolder("file://" + path)
+	h.Clock = clock
+
+	// Nothing to serve yet
+	_, err = h.Server()
+	assert.Error(t, err)
+
+	writeTestConfig(t, path, "first", mtime)
+	s1, err := h.Server()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", s1.Config.Name)
+
+	// Cached within the TTL, even though the file changed
+	writeTestConfig(t, path, "second", mtime.Add(time.Minute))
+	s2, err := h.Server()
+	assert.NoError(t, err)
+	assert.True(t, s1 == s2)
+
+	// Reloaded after the TTL
+	clock.Advance(DefaultConfigTTL)
+	s3, err := h.Server()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", s3.Config.Name)
+	// with the same limits store and audit chain
+	assert.True(t, s1.Limits == s3.Limits)
+	assert.True(t, s1.Audit == s3.Audit)
+
+	// Unchanged version is not reloaded
+	clock.Advance(DefaultConfigTTL)
+	s4, err := h.Server()
+	assert.NoError(t, err)
+	assert.True(t, s3 == s4)
+
+	// Broken or missing configuration keeps the last good one
+	assert.NoError(t, ioutil.WriteFile(path, []byte("roles: [broken"), 0600))
+	assert.NoError(t, os.Chtimes(path, mtime.Add(2*time.Minute), mtime.Add(2*time.Minute)))
+	clock.Advance(DefaultConfigTTL)
+	s5, err := h.Server()
+	assert.NoError(t, err)
+	assert.True(t, s3 == s5)
+
+	assert.NoError(t, os.Remove(path))
+	clock.Advance(DefaultConfigTTL)
+	s6, err := h.Server()
+	assert.NoError(t, err)
+	assert.True(t, s3 == s6)
+}
+
+func TestConfigHolderIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km-holder-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	basePath := filepath.Join(dir, "base.yaml")
+	mtime := time.Now().Add(-time.Hour)
+	writeTestConfig(t, basePath, "base", mtime)
+	config := "include: [base.yaml]\noverlays:\n  prod: {name: prod}\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	assert.NoError(t, os.Chtimes(path, mtime, mtime))
+
+	clock := clockwork.NewFakeClock()
+	h := NewConfigHolder("file://" + path)
+	h.Clock = clock
+	s1, err := h.Server()
+	assert.NoError(t, err)
+	assert.Equal(t, "base", s1.Config.Name)
+	assert.Equal(t, []string{"file://" + path, "file://" + basePath}, s1.ConfigSources)
+
+	// A change to an include reloads the configuration
+	writeTestConfig(t, basePath, "changed", mtime.Add(time.Minute))
+	clock.Advance(DefaultConfigTTL)
+	s2, err := h.Server()
+	assert.NoError(t, err)
+	assert.Equal(t, "changed", s2.Config.Name)
+
+	h = NewConfigHolder("file://" + path)
+	h.Overlay = "prod"
+	s3, err := h.Server()
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", s3.Config.Name)
+}
+
+func TestServerCachesKeySources(t *testing.T) {
+	s := &Server{}
+	k1, err := s.keySource("gitlab", "", "", "https://gitlab.example.com/-/jwks")
+	assert.NoError(t, err)
+	k2, err := s.keySource("gitlab", "", "", "https://gitlab.example.com/-/jwks")
+	assert.NoError(t, err)
+	assert.True(t, k1 == k2)
+}
+
+func TestConfigHolderAuditChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "km-holder-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	mtime := time.Now().Add(-time.Hour)
+
+	clock := clockwork.NewFakeClock()
+	h := NewConfigHolder("file://" + path)
+	h.Clock = clock
+	writeTestConfig(t, path, "first", mtime)
+	s1, err := h.Server()
+	assert.NoError(t, err)
+
+	// Audited elsewhere, there's a new chain
+	config := fmt.Sprintf(testHolderConfig, "second") + "audit:\n  sink: file://" + filepath.Join(dir, "audit.jsonl") + "\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	assert.NoError(t, os.Chtimes(path, mtime.Add(time.Minute), mtime.Add(time.Minute)))
+	clock.Advance(DefaultConfigTTL)
+	s2, err := h.Server()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", s2.Config.Name)
+	assert.False(t, s1.Audit == s2.Audit)
+}
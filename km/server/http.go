@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bsycorp/keymaster/km/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxRequestBytes limits the size of a request envelope served over HTTP.
+const MaxRequestBytes = 10 << 20
+
+// HttpHandler serves the api.Request envelope over HTTP: requests are
+// POSTed to any path, and GET /healthz is answered for load balancers.
+// Failed requests are answered with an api.ErrorResponse.
+type HttpHandler struct {
+	Config *ConfigHolder
+}
+
+func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == "/healthz" {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHttpResponse(w, http.StatusMethodNotAllowed,
+			errorBody(api.NewError(api.ErrorCodeBadRequest, "method not allowed: %s", r.Method)))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxRequestBytes))
+	if err != nil {
+		writeHttpResponse(w, http.StatusRequestEntityTooLarge,
+			errorBody(api.WrapError(err, api.ErrorCodeBadRequest, "reading request")))
+		return
+	}
+	status, respBody := h.Config.handleEnvelope(body)
+	log.Printf("%s %s %s: %d", r.RemoteAddr, r.Method, r.URL.Path, status)
+	writeHttpResponse(w, status, respBody)
+}
+
+func writeHttpResponse(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// HandleApiGatewayProxy serves the api.Request envelope in the body of
+// an API Gateway lambda proxy integration event.
+func (h *ConfigHolder) HandleApiGatewayProxy(event *events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if event.HTTPMethod != http.MethodPost {
+		return apiGatewayResponse(http.StatusMethodNotAllowed,
+			errorBody(api.NewError(api.ErrorCodeBadRequest, "method not allowed: %s", event.HTTPMethod)))
+	}
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(event.Body)
+		if err != nil {
+			return apiGatewayResponse(http.StatusBadRequest,
+				errorBody(api.WrapError(err, api.ErrorCodeBadRequest, "decoding request")))
+		}
+		body = decoded
+	}
+	return apiGatewayResponse(h.handleEnvelope(body))
+}
+
+func apiGatewayResponse(status int, body []byte) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
+
+// handleEnvelope decodes and dispatches a request envelope, returning
+// the HTTP status and body to respond with.
+func (h *ConfigHolder) handleEnvelope(body []byte) (int, []byte) {
+	var req api.Request
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		apiErr := api.WrapError(err, api.ErrorCodeBadRequest, "decoding request")
+		return http.StatusBadRequest, errorBody(apiErr)
+	}
+	resp, err := h.Dispatch(&req)
+	if err != nil {
+		log.Printf("%s request failed: %v", req.Type, err)
+		apiErr := api.AsError(err)
+		return api.ErrorStatus(apiErr.Code), errorBody(apiErr)
+	}
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		return http.StatusInternalServerError, errorBody(api.AsError(err))
+	}
+	return http.StatusOK, respBody
+}
+
+func errorBody(err *api.Error) []byte {
+	b, _ := json.Marshal(&api.ErrorResponse{Error: err})
+	return b
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHttpClient(t *testing.T, s *Server) (*api.Client, func()) {
+	srv := httptest.NewTLSServer(&HttpHandler{Config: testConfigHolder(s)})
+	client := &api.Client{
+		Target: srv.URL,
+		Transport: &api.HttpTransport{
+			URL:        srv.URL,
+			HttpClient: srv.Client(),
+		},
+	}
+	return client, srv.Close
+}
+
+func TestHttpHandler(t *testing.T) {
+	s, key := testGitlabServer(t)
+	client, closeServer := testHttpClient(t, s)
+	defer closeServer()
+
+	discoveryResp, err := client.Negotiate(api.RequestTypeConfig,
+		api.RequestTypeWorkflowStart, api.RequestTypeWorkflowAuth)
+	assert.NoError(t, err)
+	assert.True(t, discoveryResp.HasFeature(api.FeatureCIIdentity))
+	assert.Equal(t, api.ApiVersions[0], client.ApiVersion)
+
+	configResp, err := client.GetConfig(&api.ConfigRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "test", configResp.Config.Name)
+	assert.NotNil(t, configResp.Config.FindRoleByName("deployment"))
+
+	startResp, err := client.WorkflowStart(&api.WorkflowStartRequest{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, startResp.IssuingNonce)
+
+	authResp, err := client.WorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IssuingNonce:  startResp.IssuingNonce,
+		IdpNonce:      startResp.IdpNonce,
+		IdentityToken: gitlabToken(t, key, "group/project", "true"),
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, authResp)
+
+	// Server errors make it back to the client, typed
+	_, err = client.WorkflowAuth(&api.WorkflowAuthRequest{Role: "nope"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "requested role not found: nope")
+	assert.Equal(t, api.ErrorCodeRoleNotFound, api.ErrorCode(err))
+	assert.Equal(t, "nope", api.AsError(err).Details.Role)
+
+	_, err = client.WorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "other/project", "true"),
+	})
+	assert.Equal(t, api.ErrorCodeIdentityRejected, api.ErrorCode(err))
+	assert.False(t, api.IsRetryable(err))
+}
+
+func TestHttpHandlerBadRequests(t *testing.T) {
+	s, _ := testGitlabServer(t)
+	handler := &HttpHandler{Config: testConfigHolder(s)}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"type":"nope","payload":{}}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var errResp api.ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, api.ErrorCodeBadRequest, errResp.Error.Code)
+	assert.Contains(t, errResp.Error.Message, "unknown operation type: nope")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"type":"config","api_version":"999","payload":{}}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, api.ErrorCodeIncompatible, errResp.Error.Code)
+}
+
+func TestHandleApiGatewayProxy(t *testing.T) {
+	s, _ := testGitlabServer(t)
+	h := testConfigHolder(s)
+	body := `{"type":"config","payload":{}}`
+
+	resp := h.HandleApiGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodPost,
+		Body:       body,
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var configResp api.ConfigResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &configResp))
+	assert.Equal(t, "test", configResp.Config.Name)
+
+	resp = h.HandleApiGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod:      http.MethodPost,
+		Body:            base64.StdEncoding.EncodeToString([]byte(body)),
+		IsBase64Encoded: true,
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = h.HandleApiGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodGet,
+	})
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHandleApiGatewayProxyErrors(t *testing.T) {
+	s, _ := testGitlabServer(t)
+	h := testConfigHolder(s)
+
+	resp := h.HandleApiGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodPost,
+		Body:       `{"type":"workflow_auth","api_version":"2","payload":{"role":"nope"}}`,
+	})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var errResp api.ErrorResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &errResp))
+	assert.Equal(t, api.ErrorCodeRoleNotFound, errResp.Error.Code)
+}
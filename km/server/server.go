@@ -1,60 +1,175 @@
 package server
 
 import (
-	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/audit"
 	"github.com/bsycorp/keymaster/km/creds"
+	"github.com/bsycorp/keymaster/km/idp/github"
+	"github.com/bsycorp/keymaster/km/idp/gitlab"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
 	"github.com/bsycorp/keymaster/km/idp/saml"
+	"github.com/bsycorp/keymaster/km/ip_oracle"
+	"github.com/bsycorp/keymaster/km/limits"
+	"github.com/bsycorp/keymaster/km/policy"
 	"github.com/bsycorp/keymaster/km/util"
-	"github.com/ghodss/yaml"
 	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Server struct {
 	Config api.Config
+	// ConfigSources are the references the config was rendered from:
+	// the config itself, then its includes.
+	ConfigSources []string
+	// Audit records issuance decisions, if set
+	Audit *audit.Logger
+	// Clock is what role schedules are checked against, the real clock
+	// unless set (e.g. by tests)
+	Clock clockwork.Clock
+	// Reviews keeps the reviews break-glass requests open, if set
+	Reviews audit.ReviewStore
+	// Policy has the last word on requests, if set
+	Policy *policy.Policy
+	// Limits counts issuances against role limits
+	Limits *limits.Limiter
+
+	// newNotifier makes break-glass notifiers, audit.NewNotifier unless
+	// set (by tests)
+	newNotifier func(target string) (audit.Notifier, error)
+
+	// Per-idp processors, built on first use and kept for as long as
+	// the server (and so its configuration) is.
+	mu             sync.Mutex
+	samlProcessors map[string]*saml.AssertionProcessor
+	keySources     map[string]idtoken.KeySource
 }
 
 func (s *Server) Configure(config string) error {
-	var err error
-	var tmpConfig api.Config
+	return s.ConfigureOverlay(config, "")
+}
 
+// ConfigureOverlay configures the server with an overlay of the config,
+// if one is named (see api.ConfigRenderer).
+func (s *Server) ConfigureOverlay(config string, overlay string) error {
 	// Load config, maybe "by reference" (config env var might be a
-	// literal or a reference to a bucket or file).
-	// Then we load as YAML or JSON.
-	configData, err := util.Load(config)
+	// literal or a reference to a bucket or file), as YAML or JSON.
+	// Then we render its includes, vars and overlay.
+	renderer := &api.ConfigRenderer{Overlay: overlay}
+	configData, err := renderer.Render(config)
+	if err != nil {
+		return err
+	}
+	tmpConfig, err := api.ParseConfig(configData)
+	if err != nil {
+		return err
+	}
+	err = tmpConfig.NormaliseAndLoad()
+	if err != nil {
+		return err
+	}
+	err = tmpConfig.Validate()
 	if err != nil {
 		return err
 	}
-	if strings.HasPrefix(string(configData), "{") {
-		err = json.Unmarshal(configData, &tmpConfig)
+	// Refuse configs with CA keys we couldn't issue with
+	if problems := tmpConfig.CheckCAKeys(creds.DefaultCAKeyLoader().Check); len(problems) > 0 {
+		return api.ConfigErrors(problems)
+	}
+	sink, err := audit.NewSink(tmpConfig.Audit.Sink)
+	if err != nil {
+		return err
+	}
+	var hmacKey []byte
+	if tmpConfig.Audit.HmacKey != "" {
+		hmacKey, err = util.Load(tmpConfig.Audit.HmacKey)
 		if err != nil {
-			return err
+			return errors.Wrap(err, "loading audit hmac key")
 		}
-	} else {
-		err = yaml.Unmarshal(configData, &tmpConfig)
+	}
+	var reviews audit.ReviewStore
+	if tmpConfig.Audit.Reviews != "" {
+		reviews, err = audit.NewReviewStore(tmpConfig.Audit.Reviews)
 		if err != nil {
 			return err
 		}
 	}
-
-	err = tmpConfig.NormaliseAndLoad()
-	if err != nil {
-		return err
+	var p *policy.Policy
+	if tmpConfig.Policy.Enabled() {
+		p, err = policy.Load(tmpConfig.Policy.Rules)
+		if err != nil {
+			return err
+		}
 	}
-	err = tmpConfig.Validate()
+	store, err := limits.NewStore(tmpConfig.Limits.Store)
 	if err != nil {
 		return err
 	}
-	s.Config = tmpConfig
+	s.Config = *tmpConfig
+	s.ConfigSources = renderer.Sources
+	s.Audit = audit.NewLogger(sink, hmacKey)
+	s.Reviews = reviews
+	s.Policy = p
+	s.Limits = limits.NewLimiter(store)
 	return nil
 }
 
+// Dispatch routes a request envelope to its handler, checking the api
+// version the client negotiated.
+func (s *Server) Dispatch(req *api.Request) (interface{}, error) {
+	if req.ApiVersion != "" {
+		err := api.CheckApiVersions([]string{req.ApiVersion})
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch r := req.Payload.(type) {
+	case *api.DiscoveryRequest:
+		return s.HandleDiscovery(r)
+	case *api.ConfigRequest:
+		return s.HandleConfig(r)
+	case *api.DirectSamlAuthRequest:
+		return s.HandleDirectSamlAuth(r)
+	case *api.DirectOidcAuthRequest:
+		return s.HandleDirectOidcAuth(r)
+	case *api.WorkflowStartRequest:
+		return s.HandleWorkflowStart(r)
+	case *api.WorkflowAuthRequest:
+		return s.HandleWorkflowAuth(r)
+	default:
+		return nil, api.NewError(api.ErrorCodeBadRequest, "unexpected request")
+	}
+}
+
 func (s *Server) HandleDiscovery(req *api.DiscoveryRequest) (*api.DiscoveryResponse, error) {
-	var resp api.DiscoveryResponse
-	return &resp, nil
+	err := api.CheckApiVersions(req.ApiVersions)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DiscoveryResponse{
+		ServerVersion: api.Version,
+		ApiVersions:   api.ApiVersions,
+		RequestTypes: []string{
+			api.RequestTypeDiscovery,
+			api.RequestTypeConfig,
+			api.RequestTypeWorkflowStart,
+			api.RequestTypeWorkflowAuth,
+		},
+		CredentialTypes: creds.SupportedTypes,
+		IdpTypes:        []string{"saml", "gitlab_jwt", "github_oidc"},
+		Features: map[string]bool{
+			api.FeatureKmsWrapping: false,
+			api.FeatureCsr:         false,
+			api.FeatureDirectAuth:  false,
+			api.FeatureCIIdentity:  true,
+			api.FeatureBreakGlass:  true,
+		},
+	}, nil
 }
 
 func (s *Server) HandleConfig(req *api.ConfigRequest) (*api.ConfigResponse, error) {
@@ -63,18 +178,50 @@ func (s *Server) HandleConfig(req *api.ConfigRequest) (*api.ConfigResponse, erro
 	resp.Config = api.ConfigPublic{
 		Name:     s.Config.Name,
 		Idp:      s.Config.Idp,
-		Roles:    s.Config.Roles,
+		Roles:    publicRoles(s.Config.Roles),
 		Workflow: s.Config.Workflow,
 	}
+	if ipOracle := s.Config.AccessControl.IPOracle; ipOracle.Enforced() {
+		resp.Config.IPOracle = &api.IPOraclePublicConfig{
+			SignUrl: ipOracle.SignUrl,
+		}
+		if ipOracle.Signer == "" || ipOracle.Signer == "kms" {
+			resp.Config.IPOracle.KeyId = ipOracle.Key
+		}
+		if ipOracle.BindAudience {
+			resp.Config.IPOracle.Audience = s.Config.Name
+		}
+	}
+	for _, c := range s.Config.Credentials {
+		resp.Config.Credentials = append(resp.Config.Credentials, api.CredentialsPublicConfig{
+			Name: c.Name,
+			Type: c.Type,
+		})
+	}
 	return &resp, nil
 }
 
+// publicRoles copies roles without what clients shouldn't see, e.g.
+// webhook urls.
+func publicRoles(roles []api.RoleConfig) []api.RoleConfig {
+	public := make([]api.RoleConfig, len(roles))
+	copy(public, roles)
+	for i := range public {
+		if bg := public[i].BreakGlass; bg != nil {
+			publicBreakGlass := *bg
+			publicBreakGlass.Notify = nil
+			public[i].BreakGlass = &publicBreakGlass
+		}
+	}
+	return public
+}
+
 func (s *Server) HandleDirectSamlAuth(eq *api.DirectSamlAuthRequest) (*api.DirectAuthResponse, error) {
-	return nil, errors.New("Not implemented")
+	return nil, api.NewError(api.ErrorCodeNotImplemented, "Not implemented")
 }
 
 func (s *Server) HandleDirectOidcAuth(req *api.DirectOidcAuthRequest) (*api.DirectAuthResponse, error) {
-	return nil, errors.New("Not implemented")
+	return nil, api.NewError(api.ErrorCodeNotImplemented, "Not implemented")
 }
 
 func (s *Server) HandleWorkflowStart(req *api.WorkflowStartRequest) (*api.WorkflowStartResponse, error) {
@@ -88,63 +235,199 @@ func (s *Server) HandleWorkflowStart(req *api.WorkflowStartRequest) (*api.Workfl
 }
 
 func (s *Server) HandleWorkflowAuth(req *api.WorkflowAuthRequest) (*api.WorkflowAuthResponse, error) {
+	event := &audit.Event{
+		Environment: s.Config.Name,
+		Role:        req.Role,
+		Requester:   audit.Requester{Username: req.Username},
+	}
+	resp, err := s.workflowAuth(req, event)
+	if err != nil {
+		event.Type = audit.EventDenied
+		event.ErrorCode = api.AsError(err).Code
+		event.Reason = err.Error()
+		s.audit(event)
+		s.notifyBreakGlass(event)
+		return nil, err
+	}
+	event.Type = audit.EventIssued
+	if event.BreakGlass != nil {
+		event.BreakGlass.ReviewId = uuid.New().String()
+	}
+	err = s.audit(event)
+	if err != nil {
+		// Credentials are only handed out if their issue was audited
+		return nil, api.WrapError(err, api.ErrorCodeInternal, "audit error").WithRetryable(true)
+	}
+	if event.BreakGlass != nil {
+		// Nor are break-glass credentials unless they will be reviewed
+		err = s.openReview(event)
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeInternal, "opening break-glass review").WithRetryable(true)
+		}
+		s.notifyBreakGlass(event)
+	}
+	return resp, nil
+}
+
+// workflowAuth issues credentials for a workflow, recording what it
+// finds out about the request in the audit event as it goes.
+func (s *Server) workflowAuth(req *api.WorkflowAuthRequest, event *audit.Event) (*api.WorkflowAuthResponse, error) {
 	// Find the requested role
 	role := s.Config.FindRoleByName(req.Role)
 	if role == nil {
-		return nil, errors.Errorf("requested role not found: %s", req.Role)
+		return nil, api.NewError(api.ErrorCodeRoleNotFound, "requested role not found: %s", req.Role).
+			WithDetails(&api.ErrorDetails{Role: req.Role})
 	}
 	// Find the workflow policy for the requested role
 	rolePolicy := s.Config.Workflow.FindPolicyByName(role.Workflow)
 	if rolePolicy == nil {
-		return nil, errors.Errorf("requested role policy not found: %s", role.Workflow)
+		return nil, api.NewError(api.ErrorCodeConfiguration, "requested role policy not found: %s", role.Workflow)
 	}
-	// Validate that there are no identify roles
-	if len(rolePolicy.IdentifyRoles) > 0 {
-		return nil, errors.New("requested role requires identification; not supported")
+	var approverRoles map[string]int
+	validFor := role.ValidForSeconds
+	var err error
+	if req.BreakGlass != nil {
+		// Break-glass requests bypass the workflow policy and schedule
+		approverRoles, err = s.breakGlass(role, req.BreakGlass, event)
+		if err != nil {
+			return nil, err
+		}
+		validFor = role.BreakGlass.ValidForSeconds(role)
+	} else {
+		// Validate that there are no identify roles
+		if len(rolePolicy.IdentifyRoles) > 0 {
+			return nil, api.NewError(api.ErrorCodeNotImplemented, "requested role requires identification; not supported")
+		}
+		// Validate that there is just one approval role
+		if len(rolePolicy.ApproverRoles) > 1 {
+			return nil, api.NewError(api.ErrorCodeNotImplemented, "multiple approver support not implemented")
+		}
+		// Roles may only be usable at some times, or need more approvals
+		// at others
+		var escalated bool
+		approverRoles, escalated, err = role.ApproverRolesAt(rolePolicy, s.now())
+		if err != nil {
+			return nil, err
+		}
+		if escalated {
+			event.Escalation = "outside role time windows"
+		}
 	}
-	// Validate that there is just one approval role
-	if len(rolePolicy.ApproverRoles) > 1 {
-		return nil, errors.New("multiple approver support not implemented")
+	// There should be no more IDP assertions than approvals, plus one
+	// from the requester if they must identify
+	maxAssertions := 0
+	for _, n := range approverRoles {
+		maxAssertions += n
 	}
-	// There should be as many IDP assertions as approvers
-	if len(req.Assertions) != len(rolePolicy.ApproverRoles) {
-		return nil, errors.New("wrong number of saml assertions submitted")
+	if role.Eligibility != nil && role.Eligibility.NeedsIdentity() {
+		maxAssertions++
 	}
-	// Ensure there is just 1 IDP in configuration
-	if len(s.Config.Idp) > 1 {
-		return nil, errors.New("multiple IDP support not implemented")
+	if len(req.Assertions) > maxAssertions {
+		return nil, api.NewError(api.ErrorCodeBadRequest, "wrong number of saml assertions submitted")
 	}
 
 	// TODO: verify issuing nonce
 	// TODO: verify idp nonce
 
-	idpConfig := s.Config.Idp[0]
-	idpSamlConfig := idpConfig.Config.(*api.IdpConfigSaml)
-	sp := &saml.AssertionProcessor{
-		CAData:       []byte(idpSamlConfig.Certificate),
-		Audience:     idpSamlConfig.Audience,
-		UsernameAttr: idpSamlConfig.UsernameAttr,
-		EmailAttr:    idpSamlConfig.EmailAttr,
-		GroupsAttr:   idpSamlConfig.GroupsAttr,
-		RedirectURI:  idpSamlConfig.RedirectURI,
-		DisableNameIDValidation: true,
+	// Roles may require the requester to prove their identity with a
+	// CI job token, in which case that identity replaces the username
+	// supplied in the request.
+	username := req.Username
+	var identity *idtoken.Identity
+	var identityIdp string
+	if role.CIIdentity != nil {
+		identity, err = s.verifyCIIdentity(role.CIIdentity, req.IdentityToken)
+		if err != nil {
+			return nil, err
+		}
+		identityIdp = role.CIIdentity.IdpName
+	} else if role.Eligibility != nil && req.IdentityToken != "" {
+		identity, identityIdp, err = s.eligibleCIIdentity(role.Eligibility, req.IdentityToken)
+		if err != nil {
+			return nil, err
+		}
 	}
-	err := sp.Init()
-	if err != nil {
-		return nil, errors.Wrap(err, "saml init error")
+	if identity != nil {
+		log.Println("Verified CI identity:", identity.Username, identity.Subject)
+		username = identity.Username
+		event.Requester.Username = identity.Username
+		event.Requester.CIIdentity = identity.Subject
 	}
-	userInfos, err := sp.Process(req.IdpNonce, req.Assertions)
-	if err != nil {
-		return nil, errors.Wrap(err, "saml validation error")
+
+	// Issuers enforcing source address whitelists need the requester's
+	// address vouched for by the ip oracle.
+	if s.Config.AccessControl.IPOracle.Enforced() {
+		sourceIp, err := s.verifySourceIp(role, req.IpToken, req.IssuingNonce)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Verified source ip:", sourceIp)
+		event.Requester.SourceIp = sourceIp
 	}
 
-	// Count approvals from IDP assertions
+	var userInfos []saml.UserInfo
+	if len(req.Assertions) > 0 {
+		idpConfig := s.Config.FindIdpByName(rolePolicy.IdpName)
+		if idpConfig == nil {
+			return nil, api.NewError(api.ErrorCodeConfiguration, "requested role policy idp not found: %s", rolePolicy.IdpName)
+		}
+		idpSamlConfig, ok := idpConfig.Config.(*api.IdpConfigSaml)
+		if !ok {
+			return nil, api.NewError(api.ErrorCodeConfiguration, "requested role policy idp is not a saml idp: %s", rolePolicy.IdpName)
+		}
+		sp, err := s.samlProcessor(idpConfig.Name, idpSamlConfig)
+		if err != nil {
+			return nil, err
+		}
+		userInfos, err = sp.Process(req.IdpNonce, req.Assertions)
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, "saml validation error")
+		}
+	}
+
+	// Roles may only be requested by some people
+	var identifiedAs string
+	if role.Eligibility != nil {
+		requester := &api.Requester{}
+		if identity != nil {
+			requester.CIIdpName = identityIdp
+			requester.CIClaims = identity.Claims.Strings
+		}
+		// The requester identifies with an assertion of their own, which
+		// isn't an approval unless the policy says so
+		for i, userInfo := range userInfos {
+			if role.Eligibility.NeedsIdentity() && strings.EqualFold(userInfo.Username, username) {
+				log.Println("Requester identified:", userInfo)
+				requester.Identified = true
+				identifiedAs = userInfo.Username
+				requester.Groups = userInfo.Groups
+				event.Requester.Groups = userInfo.Groups
+				if !rolePolicy.RequesterCanApprove {
+					userInfos = append(userInfos[:i:i], userInfos[i+1:]...)
+				}
+				break
+			}
+		}
+		if err := role.Eligibility.Check(role.Name, requester); err != nil {
+			return nil, err
+		}
+	}
+
+	// Count approvals from IDP assertions, unless the policy does
+	policyApprovals := s.Policy != nil && s.Config.Policy.Approvals == api.PolicyApprovalsPolicy
 	approvals := make(map[string]int)
 	for _, userInfo := range userInfos {
 		log.Println("Processing assertion from:", userInfo)
+		event.Approvers = append(event.Approvers, audit.Approver{
+			Username: userInfo.Username,
+			Groups:   userInfo.Groups,
+		})
+		if policyApprovals {
+			continue
+		}
 		approvalsFromUser := 0
 		for _, groupName := range userInfo.Groups {
-			_, found := rolePolicy.ApproverRoles[groupName]
+			_, found := approverRoles[groupName]
 			if found {
 				approvals[groupName]++
 				approvalsFromUser++
@@ -153,42 +436,482 @@ func (s *Server) HandleWorkflowAuth(req *api.WorkflowAuthRequest) (*api.Workflow
 		// One assertion should represent just 1 approval from relevant group
 		if approvalsFromUser == 0 {
 			i := 0
-			requiredGroups := make([]string, len(rolePolicy.ApproverRoles))
-			for k := range rolePolicy.ApproverRoles {
+			requiredGroups := make([]string, len(approverRoles))
+			for k := range approverRoles {
 				requiredGroups[i] = k
 				i++
 			}
-			return nil, errors.Errorf("assertion with no valid approval groups from: %s got: %s want: %s",
-				userInfo.Username, userInfo.Groups, requiredGroups)
+			return nil, api.NewError(api.ErrorCodeInvalidAssertion, "assertion with no valid approval groups from: %s got: %s want: %s",
+				userInfo.Username, userInfo.Groups, requiredGroups).
+				WithDetails(&api.ErrorDetails{Role: req.Role, ApproverGroups: requiredGroups})
 		}
 		if approvalsFromUser > 1 {
-			return nil, errors.Errorf("assertion meets more than 1 approval group from: %s", userInfo.Username)
+			return nil, api.NewError(api.ErrorCodeInvalidAssertion, "assertion meets more than 1 approval group from: %s", userInfo.Username)
 		}
 	}
 	// Validate that the required number of approvals were met
-	for groupName, requiredApprovals := range rolePolicy.ApproverRoles {
+	for groupName, requiredApprovals := range approverRoles {
+		if policyApprovals {
+			break
+		}
 		actualApprovals := approvals[groupName]
 		if actualApprovals < requiredApprovals {
-			return nil, errors.Errorf("not enough approvals, want: %d, got: %d",
-				requiredApprovals, actualApprovals)
+			return nil, api.NewError(api.ErrorCodeNotEnoughApprovals, "not enough approvals, want: %d, got: %d",
+				requiredApprovals, actualApprovals).
+				WithDetails(&api.ErrorDetails{
+					Role:             req.Role,
+					MissingApprovals: map[string]int{groupName: requiredApprovals - actualApprovals},
+				})
+		}
+	}
+	// The issuer's policy has the last word
+	if s.Policy != nil {
+		if err := s.checkPolicy(req, approverRoles, identity, event); err != nil {
+			return nil, err
 		}
 	}
 
 	userInfo := api.AuthInfo{
 		Environment: s.Config.Name,
 		Role:        req.Role,
-		Username:    req.Username,
-		ValidFor:    role.ValidForSeconds,
+		Username:    username,
+		ValidFor:    validFor,
 	}
 	credIssuer, err := creds.NewFromConfig(role, &s.Config)
 	if err != nil {
-		return nil, errors.Wrap(err, "during issuer configuration")
+		return nil, api.WrapError(err, api.ErrorCodeConfiguration, "during issuer configuration")
+	}
+	event.ValidForSeconds = validFor
+	// Only so many credentials are issued for a role, and to each
+	// requester. Credentials that are issued but then not handed out
+	// (e.g. because they couldn't be audited) still count.
+	roleLimits, err := s.takeLimits(role, limitsRequester(identity, identifiedAs), validFor)
+	if err != nil {
+		return nil, err
 	}
 	issuedCreds, err := credIssuer.IssueFor(&userInfo)
 	if err != nil {
-		return nil, errors.Wrap(err, "during issuance")
+		s.releaseLimits(roleLimits)
+		return nil, api.WrapError(err, api.ErrorCodeIssuance, "during issuance").
+			WithRetryable(isRetryableIssuanceError(err))
 	}
+	event.Credentials = audit.Credentials(issuedCreds)
 	return &api.WorkflowAuthResponse{
 		Credentials: issuedCreds,
 	}, nil
 }
+
+// issuanceLimits are a role's limits, with the requester's keyed by the
+// identity they proved.
+type issuanceLimits struct {
+	id     string
+	limits []limits.Limit
+}
+
+// limitsRequester is who a requester is counted as by per requester
+// limits: the subject of their verified CI identity, or the username
+// they identified as with an assertion. Requesters who proved neither
+// can't be told apart, as the username in a request is only a claim.
+func limitsRequester(identity *idtoken.Identity, identifiedAs string) string {
+	if identity != nil {
+		return "ci:" + identity.Subject
+	}
+	if identifiedAs != "" {
+		return "user:" + strings.ToLower(identifiedAs)
+	}
+	return ""
+}
+
+// takeLimits counts an issuance of credentials valid for validFor
+// seconds against the role's limits, refusing it if it would exceed any.
+func (s *Server) takeLimits(role *api.RoleConfig, requester string, validFor int) (*issuanceLimits, error) {
+	if role.Limits == nil {
+		return nil, nil
+	}
+	if s.Limits == nil {
+		return nil, api.NewError(api.ErrorCodeConfiguration, "role has limits, but there is no limits store")
+	}
+	if role.Limits.PerRequester != nil && requester == "" {
+		return nil, api.NewError(api.ErrorCodeConfiguration, "role has per requester limits, but the requester isn't identified")
+	}
+	roleKey := s.Config.Name + "/" + role.Name
+	il := &issuanceLimits{id: uuid.New().String()}
+	for _, l := range []struct {
+		key   string
+		limit *api.LimitConfig
+	}{
+		{roleKey, role.Limits.PerRole},
+		{roleKey + "/" + requester, role.Limits.PerRequester},
+	} {
+		if l.limit != nil {
+			il.limits = append(il.limits, limits.Limit{
+				Key:              l.key,
+				IssuancesPerHour: l.limit.IssuancesPerHour,
+				MaxActive:        l.limit.MaxActive,
+			})
+		}
+	}
+	now := s.now()
+	err := s.Limits.Take(il.limits, il.id, now, now.Add(time.Duration(validFor)*time.Second))
+	if exceeded, ok := err.(*limits.ExceededError); ok {
+		return nil, api.NewError(api.ErrorCodeRateLimited, "rate limited: %s", exceeded).
+			WithRetryAfter(exceeded.RetryAfter).
+			WithDetails(&api.ErrorDetails{Role: role.Name})
+	}
+	if err != nil {
+		// Not knowing whether the limits are met isn't the requester's
+		// fault, and may pass
+		return nil, api.WrapError(err, api.ErrorCodeInternal, "counting limits").WithRetryable(true)
+	}
+	return il, nil
+}
+
+// releaseLimits forgets an issuance that didn't happen after all.
+func (s *Server) releaseLimits(il *issuanceLimits) {
+	if il == nil {
+		return
+	}
+	if err := s.Limits.Release(il.limits, il.id, s.now()); err != nil {
+		log.Println("Error releasing limits:", err)
+	}
+}
+
+// checkPolicy asks the issuer's policy about a request, as far as it has
+// been audited.
+func (s *Server) checkPolicy(req *api.WorkflowAuthRequest, approverRoles map[string]int,
+	identity *idtoken.Identity, event *audit.Event) error {
+	in := &policy.Input{
+		Environment: s.Config.Name,
+		Role:        req.Role,
+		Requester: policy.Requester{
+			Username:   event.Requester.Username,
+			Groups:     event.Requester.Groups,
+			CIIdentity: event.Requester.CIIdentity,
+			SourceIp:   event.Requester.SourceIp,
+		},
+		RequiredApprovals: approverRoles,
+		Time:              s.now(),
+	}
+	for _, a := range event.Approvers {
+		in.Approvers = append(in.Approvers, policy.Approver{Username: a.Username, Groups: a.Groups})
+	}
+	if identity != nil {
+		in.Requester.CIClaims = make(map[string][]string)
+		for name := range identity.Claims {
+			if values := identity.Claims.Strings(name); len(values) > 0 {
+				in.Requester.CIClaims[name] = values
+			}
+		}
+	}
+	if req.Source != nil {
+		in.Source = policy.Source{Description: req.Source.Description, DetailsURI: req.Source.DetailsURI}
+	}
+	if req.BreakGlass != nil {
+		in.BreakGlass = true
+		in.Justification = req.BreakGlass.Justification
+	}
+	d, err := s.Policy.Evaluate(in)
+	if err != nil {
+		return api.WrapError(err, api.ErrorCodeConfiguration, "evaluating policy")
+	}
+	if !d.Allow {
+		return api.NewError(api.ErrorCodePolicyDenied, "denied by policy: %s", strings.Join(d.Reasons, "; ")).
+			WithDetails(&api.ErrorDetails{Role: req.Role, PolicyReasons: d.Reasons})
+	}
+	return nil
+}
+
+// eligibleCIIdentity verifies a CI identity token against a role's
+// eligible CI identities, returning the first that matches.
+func (s *Server) eligibleCIIdentity(e *api.RoleEligibilityConfig, token string) (*idtoken.Identity, string, error) {
+	var err error
+	for i := range e.CIIdentities {
+		var identity *idtoken.Identity
+		identity, err = s.verifyCIIdentity(&e.CIIdentities[i], token)
+		if err == nil {
+			return identity, e.CIIdentities[i].IdpName, nil
+		}
+	}
+	return nil, "", err
+}
+
+func (s *Server) verifyCIIdentity(ciIdentity *api.RoleCIIdentityConfig, token string) (*idtoken.Identity, error) {
+	idpConfig := s.Config.FindIdpByName(ciIdentity.IdpName)
+	if idpConfig == nil {
+		return nil, api.NewError(api.ErrorCodeConfiguration, "requested role ci identity idp not found: %s", ciIdentity.IdpName)
+	}
+	if token == "" {
+		return nil, api.NewError(api.ErrorCodeIdentityRejected, "requested role requires a ci identity token")
+	}
+	var identity *idtoken.Identity
+	switch c := idpConfig.Config.(type) {
+	case *api.IdpConfigGitlabJwt:
+		issuer := c.IssuerOrDefault()
+		keys, err := s.keySource(idpConfig.Name, c.Jwks, c.JwksUrl, gitlab.JwksURL(issuer))
+		if err != nil {
+			return nil, err
+		}
+		tp := &gitlab.TokenProcessor{
+			Verifier: &idtoken.Verifier{
+				Issuer:   issuer,
+				Audience: c.Audience,
+				Keys:     keys,
+			},
+		}
+		identity, err = tp.Process(token)
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeIdentityRejected, "invalid ci identity token")
+		}
+	case *api.IdpConfigGithubOidc:
+		issuer := c.IssuerOrDefault()
+		keys, err := s.keySource(idpConfig.Name, c.Jwks, c.JwksUrl, github.JwksURL(issuer))
+		if err != nil {
+			return nil, err
+		}
+		tp := &github.TokenProcessor{
+			Verifier: &idtoken.Verifier{
+				Issuer:   issuer,
+				Audience: c.Audience,
+				Keys:     keys,
+			},
+		}
+		identity, err = tp.Process(token)
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeIdentityRejected, "invalid ci identity token")
+		}
+	default:
+		return nil, api.NewError(api.ErrorCodeConfiguration, "idp does not support ci identity tokens: %s", ciIdentity.IdpName)
+	}
+	err := idtoken.MatchClaims(identity.Claims, ciIdentity.Claims)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeIdentityRejected, "ci identity not permitted for requested role")
+	}
+	return identity, nil
+}
+
+// breakGlass checks a break-glass request for a role, returning the
+// approvals it needs.
+func (s *Server) breakGlass(role *api.RoleConfig, req *api.BreakGlassRequest, event *audit.Event) (map[string]int, error) {
+	if role.BreakGlass == nil {
+		return nil, api.NewError(api.ErrorCodeBreakGlassNotAllowed, "role %s has no break-glass policy", role.Name).
+			WithDetails(&api.ErrorDetails{Role: role.Name})
+	}
+	justification := strings.TrimSpace(req.Justification)
+	event.BreakGlass = &audit.BreakGlass{Justification: justification}
+	if len(justification) < api.MinJustificationLength {
+		return nil, api.NewError(api.ErrorCodeBadRequest, "break-glass requests need a justification of at least %d characters",
+			api.MinJustificationLength)
+	}
+	if s.Reviews == nil {
+		return nil, api.NewError(api.ErrorCodeConfiguration, "break-glass needs an audit reviews store")
+	}
+	log.Warnf("BREAK GLASS requested for role %s by %s: %s", role.Name, event.Requester.Username, justification)
+	return role.BreakGlass.ApproverRoles, nil
+}
+
+// openReview opens the review of an issued break-glass request.
+func (s *Server) openReview(event *audit.Event) error {
+	review, err := audit.NewReview(event)
+	if err != nil {
+		return err
+	}
+	return s.Reviews.Put(review)
+}
+
+// notifyBreakGlass announces a break-glass request to the role's notify
+// targets. Failures are logged, but don't fail the request.
+func (s *Server) notifyBreakGlass(event *audit.Event) {
+	if event.BreakGlass == nil {
+		return
+	}
+	role := s.Config.FindRoleByName(event.Role)
+	if role == nil || role.BreakGlass == nil {
+		return
+	}
+	newNotifier := s.newNotifier
+	if newNotifier == nil {
+		newNotifier = audit.NewNotifier
+	}
+	for _, target := range role.BreakGlass.Notify {
+		notifier, err := newNotifier(target)
+		if err == nil {
+			err = notifier.Notify(event)
+		}
+		if err != nil {
+			log.Errorf("notifying %s of break-glass request: %v", target, err)
+		}
+	}
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+// audit records an issuance decision, if auditing is configured.
+func (s *Server) audit(event *audit.Event) error {
+	if s.Audit == nil {
+		return nil
+	}
+	err := s.Audit.Log(event)
+	if err != nil {
+		log.Errorf("error writing audit event: %v", err)
+	}
+	return err
+}
+
+// isRetryableIssuanceError reports whether issuance failed because of a
+// transient AWS error, such as throttling.
+func isRetryableIssuanceError(err error) bool {
+	cause := errors.Cause(err)
+	return request.IsErrorRetryable(cause) || request.IsErrorThrottle(cause)
+}
+
+// samlProcessor returns the assertion processor for a SAML IDP.
+func (s *Server) samlProcessor(name string, c *api.IdpConfigSaml) (*saml.AssertionProcessor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sp, ok := s.samlProcessors[name]; ok {
+		return sp, nil
+	}
+	sp := &saml.AssertionProcessor{
+		CAData:                  []byte(c.Certificate),
+		Audience:                c.Audience,
+		UsernameAttr:            c.UsernameAttr,
+		EmailAttr:               c.EmailAttr,
+		GroupsAttr:              c.GroupsAttr,
+		RedirectURI:             c.RedirectURI,
+		DisableNameIDValidation: true,
+	}
+	err := sp.Init()
+	if err != nil {
+		return nil, errors.Wrap(err, "saml init error")
+	}
+	if s.samlProcessors == nil {
+		s.samlProcessors = make(map[string]*saml.AssertionProcessor)
+	}
+	s.samlProcessors[name] = sp
+	return sp, nil
+}
+
+// verifySourceIp verifies an ip oracle token, and checks the source
+// addresses it vouches for are allowed for the role. A role's own
+// whitelist replaces the access control whitelist, its deny list adds to
+// the access control deny list.
+func (s *Server) verifySourceIp(role *api.RoleConfig, token string, nonce string) (string, error) {
+	if token == "" {
+		return "", api.NewError(api.ErrorCodeSourceNotAllowed, "issuer requires an ip oracle token")
+	}
+	if nonce == "" {
+		return "", api.NewError(api.ErrorCodeSourceNotAllowed, "ip oracle tokens must be for the request's issuing nonce, which is missing")
+	}
+	claims, err := s.verifyIPToken(token, nonce)
+	if err != nil {
+		return "", api.WrapError(err, api.ErrorCodeSourceNotAllowed, "invalid ip oracle token")
+	}
+	policy, err := s.ipOraclePolicy(role)
+	if err != nil {
+		return "", api.WrapError(err, api.ErrorCodeConfiguration, "invalid ip oracle policy")
+	}
+	decision := policy.Check(claims)
+	if !decision.Allowed {
+		return "", api.NewError(api.ErrorCodeSourceNotAllowed,
+			"source ip %s is not whitelisted for role %s: %s", decision.Address, role.Name, decision.Reason).
+			WithDetails(&api.ErrorDetails{Role: role.Name})
+	}
+	log.Printf("source ip %s for role %s: %s", decision.Address, role.Name, decision.Reason)
+	return claims.SourceIp, nil
+}
+
+// ipOraclePolicy returns the source address policy for a role.
+func (s *Server) ipOraclePolicy(role *api.RoleConfig) (*ip_oracle.Policy, error) {
+	ipOracle := s.Config.AccessControl.IPOracle
+	allow := ipOracle.WhiteListCidrs
+	deny := ipOracle.DenyListCidrs
+	if role.IPOracle != nil {
+		allow = role.IPOracle.WhiteListCidrs
+		deny = append(append([]string{}, deny...), role.IPOracle.DenyListCidrs...)
+	}
+	return ip_oracle.NewPolicy(allow, deny, ipOracle.Ranges)
+}
+
+// verifyIPToken checks an ip oracle token, offline against the oracle's
+// JWKS or local public key where configured, otherwise with KMS. The
+// token must carry the nonce, so it isn't one replayed from another
+// request.
+func (s *Server) verifyIPToken(token string, nonce string) (*ip_oracle.IPOracleClaims, error) {
+	ipOracle := s.Config.AccessControl.IPOracle
+	verifier := &ip_oracle.Verifier{Issuer: ipOracle.Issuer, Nonce: nonce}
+	if ipOracle.BindAudience {
+		verifier.Audience = s.Config.Name
+	}
+	switch {
+	case ipOracle.JwksUrl != "":
+		keys, err := s.keySource(ipOracleKeySource, "", ipOracle.JwksUrl, "")
+		if err != nil {
+			return nil, err
+		}
+		verifier.Keys = keys
+	case ipOracle.Signer == "local":
+		keys, err := s.ipOracleKeys()
+		if err != nil {
+			return nil, err
+		}
+		verifier.Keys = keys
+	default:
+		verifier.Method = ip_oracle.NewSigningMethodKMS(ipOracle.Key)
+	}
+	return verifier.Verify(token)
+}
+
+// ipOracleKeySource names the ip oracle's keys amongst the idp key sources.
+const ipOracleKeySource = "access_control.ip_oracle"
+
+// ipOracleKeys returns the configured local signer public key.
+func (s *Server) ipOracleKeys() (idtoken.KeySource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keys, ok := s.keySources[ipOracleKeySource]; ok {
+		return keys, nil
+	}
+	keys, err := ip_oracle.LoadPublicKeySet(s.Config.AccessControl.IPOracle.Key)
+	if err != nil {
+		return nil, err
+	}
+	if s.keySources == nil {
+		s.keySources = make(map[string]idtoken.KeySource)
+	}
+	s.keySources[ipOracleKeySource] = keys
+	return keys, nil
+}
+
+// keySource returns the JWKS for an IDP. Keys given in configuration take
+// precedence over a configured URL, which takes precedence over the IDP's
+// default URL. Remote key sets are kept so their keys are cached.
+func (s *Server) keySource(name string, jwks string, jwksUrl string, defaultUrl string) (idtoken.KeySource, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if keys, ok := s.keySources[name]; ok {
+		return keys, nil
+	}
+	var keys idtoken.KeySource
+	if jwks != "" {
+		keySet, err := idtoken.ParseKeySet([]byte(jwks))
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading idp jwks")
+		}
+		keys = keySet
+	} else {
+		if jwksUrl == "" {
+			jwksUrl = defaultUrl
+		}
+		keys = idtoken.NewRemoteKeySet(jwksUrl)
+	}
+	if s.keySources == nil {
+		s.keySources = make(map[string]idtoken.KeySource)
+	}
+	s.keySources[name] = keys
+	return keys, nil
+}
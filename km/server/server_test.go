@@ -1,2 +1,746 @@
 package server
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/audit"
+	"github.com/bsycorp/keymaster/km/idp/idtoken"
+	"github.com/bsycorp/keymaster/km/ip_oracle"
+	"github.com/bsycorp/keymaster/km/limits"
+	"github.com/bsycorp/keymaster/km/policy"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testGitlabServer(t *testing.T) (*Server, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwks, err := json.Marshal(idtoken.NewKeySet(idtoken.Key{KeyId: "k1", Public: &key.PublicKey}))
+	assert.NoError(t, err)
+
+	s := &Server{
+		Config: api.Config{
+			Name:    "test",
+			Version: "1.0",
+			Idp: []api.IdpConfig{
+				{
+					Name: "gitlab",
+					Type: "gitlab_jwt",
+					Config: &api.IdpConfigGitlabJwt{
+						Issuer: "gitlab.example.com",
+						Jwks:   string(jwks),
+					},
+				},
+			},
+			Roles: []api.RoleConfig{
+				{
+					Name:            "deployment",
+					Workflow:        "auto",
+					ValidForSeconds: 3600,
+					CIIdentity: &api.RoleCIIdentityConfig{
+						IdpName: "gitlab",
+						Claims: map[string][]string{
+							"project_path":  {"group/*"},
+							"ref_protected": {"true"},
+						},
+					},
+				},
+			},
+			Workflow: api.WorkflowConfig{
+				Policies: []api.WorkflowPolicyConfig{
+					{Name: "auto"},
+				},
+			},
+		},
+	}
+	return s, key
+}
+
+func gitlabToken(t *testing.T, key *rsa.PrivateKey, projectPath string, refProtected string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":           "gitlab.example.com",
+		"sub":           "job_1",
+		"exp":           time.Now().Add(time.Minute).Unix(),
+		"user_login":    "smithb12",
+		"project_path":  projectPath,
+		"ref_protected": refProtected,
+	})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestHandleWorkflowAuthWithCIIdentity(t *testing.T) {
+	s, key := testGitlabServer(t)
+
+	resp, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Username:      "someone-else",
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "group/project", "true"),
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	// Claims don't match the role's restrictions
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "group/project", "false"),
+	})
+	assert.Error(t, err)
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "other/project", "true"),
+	})
+	assert.Error(t, err)
+
+	// No token
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role: "deployment",
+	})
+	assert.Error(t, err)
+
+	// Token from someone else's gitlab
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, otherKey, "group/project", "true"),
+	})
+	assert.Error(t, err)
+
+	// An idp without an issuer only accepts gitlab.com's tokens
+	s.Config.Idp[0].Config.(*api.IdpConfigGitlabJwt).Issuer = ""
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "group/project", "true"),
+	})
+	assert.Equal(t, api.ErrorCodeIdentityRejected, api.ErrorCode(err))
+}
+
+func TestHandleWorkflowAuthWithGithubIdentity(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwks, err := json.Marshal(idtoken.NewKeySet(idtoken.Key{KeyId: "k1", Public: &key.PublicKey}))
+	assert.NoError(t, err)
+
+	s := &Server{
+		Config: api.Config{
+			Name:    "test",
+			Version: "1.0",
+			Idp: []api.IdpConfig{
+				{
+					Name: "github",
+					Type: "github_oidc",
+					Config: &api.IdpConfigGithubOidc{
+						Audience: "keymaster",
+						Jwks:     string(jwks),
+					},
+				},
+			},
+			Roles: []api.RoleConfig{
+				{
+					Name:     "deployment",
+					Workflow: "auto",
+					CIIdentity: &api.RoleCIIdentityConfig{
+						IdpName: "github",
+						Claims: map[string][]string{
+							"repository":  {"bsycorp/keymaster"},
+							"environment": {"prod"},
+						},
+					},
+				},
+			},
+			Workflow: api.WorkflowConfig{
+				Policies: []api.WorkflowPolicyConfig{
+					{Name: "auto"},
+				},
+			},
+		},
+	}
+	githubToken := func(environment string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":         "https://token.actions.githubusercontent.com",
+			"aud":         "keymaster",
+			"exp":         time.Now().Add(time.Minute).Unix(),
+			"actor":       "smithb12",
+			"repository":  "bsycorp/keymaster",
+			"environment": environment,
+		})
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return signed
+	}
+
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: githubToken("prod"),
+	})
+	assert.NoError(t, err)
+
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: githubToken("staging"),
+	})
+	assert.Error(t, err)
+}
+
+func TestHandleDiscovery(t *testing.T) {
+	s := &Server{}
+	resp, err := s.HandleDiscovery(&api.DiscoveryRequest{
+		ClientVersion: "test",
+		ApiVersions:   api.ApiVersions,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, api.ApiVersions, resp.ApiVersions)
+	assert.Contains(t, resp.RequestTypes, api.RequestTypeWorkflowAuth)
+	assert.Contains(t, resp.IdpTypes, "gitlab_jwt")
+	assert.True(t, resp.HasFeature(api.FeatureCIIdentity))
+
+	// The client can use what the server offers
+	version, err := resp.Negotiate(api.ApiVersions, api.RequestTypeConfig,
+		api.RequestTypeWorkflowStart, api.RequestTypeWorkflowAuth)
+	assert.NoError(t, err)
+	assert.Equal(t, api.ApiVersions[0], version)
+
+	// Clients from before the handshake are treated as version 1
+	_, err = s.HandleDiscovery(&api.DiscoveryRequest{})
+	assert.NoError(t, err)
+
+	_, err = s.HandleDiscovery(&api.DiscoveryRequest{ApiVersions: []string{"999"}})
+	assert.Error(t, err)
+}
+
+type failingSink struct{}
+
+func (failingSink) Write(e *audit.Event) error {
+	return errors.New("sink unavailable")
+}
+
+func TestHandleWorkflowAuthAudit(t *testing.T) {
+	s, key := testGitlabServer(t)
+	var buf bytes.Buffer
+	s.Audit = audit.NewLogger(&audit.WriterSink{W: &buf}, []byte("audit-key"))
+
+	_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Username:      "someone-else",
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "group/project", "true"),
+	})
+	assert.NoError(t, err)
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Username: "someone-else",
+		Role:     "nope",
+	})
+	assert.Error(t, err)
+
+	events, err := audit.ReadEvents(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, audit.EventIssued, events[0].Type)
+	assert.Equal(t, "smithb12", events[0].Requester.Username)
+	assert.Equal(t, "job_1", events[0].Requester.CIIdentity)
+	assert.Equal(t, 3600, events[0].ValidForSeconds)
+	assert.Equal(t, audit.EventDenied, events[1].Type)
+	assert.Equal(t, api.ErrorCodeRoleNotFound, events[1].ErrorCode)
+	assert.Equal(t, "someone-else", events[1].Requester.Username)
+	assert.Empty(t, audit.Verify(events, []byte("audit-key")))
+
+	// Nothing is handed out unless it was audited
+	s.Audit = audit.NewLogger(failingSink{}, nil)
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "group/project", "true"),
+	})
+	assert.Error(t, err)
+	assert.True(t, api.IsRetryable(err))
+}
+
+func TestHandleWorkflowAuthWithSchedule(t *testing.T) {
+	s, key := testGitlabServer(t)
+	var buf bytes.Buffer
+	s.Audit = audit.NewLogger(&audit.WriterSink{W: &buf}, []byte("audit-key"))
+	s.Config.Roles[0].Schedule = &api.RoleScheduleConfig{
+		Timezone:  "Australia/Sydney",
+		Windows:   []api.TimeWindowConfig{{Days: []string{"mon-fri"}, Start: "09:00", End: "17:00"}},
+		Blackouts: []api.BlackoutConfig{{Name: "change freeze", Start: "2026-12-21", End: "2027-01-04"}},
+	}
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	assert.NoError(t, err)
+	request := func() error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Role:          "deployment",
+			IdentityToken: gitlabToken(t, key, "group/project", "true"),
+		})
+		return err
+	}
+
+	// A Monday morning
+	s.Clock = clockwork.NewFakeClockAt(time.Date(2026, 11, 2, 10, 0, 0, 0, sydney))
+	assert.NoError(t, request())
+
+	// Saturday
+	s.Clock = clockwork.NewFakeClockAt(time.Date(2026, 11, 7, 10, 0, 0, 0, sydney))
+	err = request()
+	assert.EqualError(t, err, "role deployment can't be used outside its time windows")
+	assert.Equal(t, api.ErrorCodeOutsideSchedule, api.ErrorCode(err))
+
+	// Unless it's escalated
+	s.Config.Roles[0].Schedule.OutsideWindows = &api.RoleEscalationConfig{ApproverRoles: map[string]int{"ops": 1}}
+	err = request()
+	assert.Equal(t, api.ErrorCodeNotEnoughApprovals, api.ErrorCode(err))
+	assert.Equal(t, map[string]int{"ops": 1}, errors.Cause(err).(*api.Error).Details.MissingApprovals)
+
+	// Not even escalation gets around a blackout
+	s.Clock = clockwork.NewFakeClockAt(time.Date(2026, 12, 22, 10, 0, 0, 0, sydney))
+	err = request()
+	assert.Equal(t, api.ErrorCodeOutsideSchedule, api.ErrorCode(err))
+	assert.Contains(t, err.Error(), "change freeze")
+
+	events, err := audit.ReadEvents(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, 4)
+	assert.Equal(t, audit.EventIssued, events[0].Type)
+	assert.Equal(t, api.ErrorCodeOutsideSchedule, events[1].ErrorCode)
+	assert.Equal(t, "outside role time windows", events[2].Escalation)
+	assert.Empty(t, events[3].Escalation)
+}
+
+func TestHandleWorkflowAuthWithEligibility(t *testing.T) {
+	s, key := testGitlabServer(t)
+	var buf bytes.Buffer
+	s.Audit = audit.NewLogger(&audit.WriterSink{W: &buf}, []byte("audit-key"))
+	// Anyone can ask, as long as they're a protected pipeline of a
+	// project in the group
+	s.Config.Roles[0].CIIdentity = nil
+	s.Config.Roles[0].Eligibility = &api.RoleEligibilityConfig{
+		CIIdentities: []api.RoleCIIdentityConfig{
+			{IdpName: "gitlab", Claims: map[string][]string{"project_path": {"group/*"}, "ref_protected": {"true"}}},
+		},
+	}
+	request := func(token string) error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Username:      "smithb12",
+			Role:          "deployment",
+			IdentityToken: token,
+		})
+		return err
+	}
+
+	assert.NoError(t, request(gitlabToken(t, key, "group/project", "true")))
+
+	err := request("")
+	assert.Equal(t, api.ErrorCodeNotEligible, api.ErrorCode(err))
+	assert.EqualError(t, err, "requester is not eligible for role deployment, "+
+		"they must present a matching CI identity token from idp gitlab")
+
+	err = request(gitlabToken(t, key, "other/project", "true"))
+	assert.Equal(t, api.ErrorCodeIdentityRejected, api.ErrorCode(err))
+
+	// Group members must identify, which they haven't
+	s.Config.Roles[0].Eligibility = &api.RoleEligibilityConfig{
+		AllowGroups: []string{"engineers"},
+		DenyGroups:  []string{"contractors"},
+	}
+	err = request("")
+	assert.Equal(t, api.ErrorCodeNotEligible, api.ErrorCode(err))
+	assert.Equal(t, []string{"engineers"}, errors.Cause(err).(*api.Error).Details.EligibleGroups)
+
+	events, err := audit.ReadEvents(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, 4)
+	assert.Equal(t, audit.EventIssued, events[0].Type)
+	assert.Equal(t, "job_1", events[0].Requester.CIIdentity)
+	assert.Equal(t, api.ErrorCodeNotEligible, events[1].ErrorCode)
+	assert.Equal(t, api.ErrorCodeNotEligible, events[3].ErrorCode)
+}
+
+func TestHandleWorkflowAuthWithPolicy(t *testing.T) {
+	s, key := testGitlabServer(t)
+	var buf bytes.Buffer
+	s.Audit = audit.NewLogger(&audit.WriterSink{W: &buf}, []byte("audit-key"))
+	p, err := policy.Parse([]byte(`
+rules:
+  - name: approvals
+    deny: size(missing_approvals) > 0 && !source.details_uri.contains("/hotfix/")
+    reason: not enough approvals, and not a hotfix
+  - name: project
+    deny: requester.ci_claims["project_path"][0] == "group/frozen"
+    reason: group/frozen is frozen
+`))
+	assert.NoError(t, err)
+	s.Policy = p
+	request := func(project string, source *api.RequestSource) error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Role:          "deployment",
+			IdentityToken: gitlabToken(t, key, project, "true"),
+			Source:        source,
+		})
+		return err
+	}
+
+	assert.NoError(t, request("group/project", nil))
+	err = request("group/frozen", nil)
+	assert.EqualError(t, err, "denied by policy: group/frozen is frozen")
+	assert.Equal(t, api.ErrorCodePolicyDenied, api.ErrorCode(err))
+	assert.Equal(t, []string{"group/frozen is frozen"}, errors.Cause(err).(*api.Error).Details.PolicyReasons)
+
+	// Approvals are counted before the policy, unless the policy decides
+	s.Config.Workflow.Policies[0].ApproverRoles = map[string]int{"ops": 1}
+	hotfix := &api.RequestSource{DetailsURI: "https://gitlab.example.com/group/project/-/tree/hotfix/123"}
+	err = request("group/project", hotfix)
+	assert.Equal(t, api.ErrorCodeNotEnoughApprovals, api.ErrorCode(err))
+	s.Config.Policy.Approvals = api.PolicyApprovalsPolicy
+	assert.NoError(t, request("group/project", hotfix))
+	err = request("group/project", nil)
+	assert.EqualError(t, err, "denied by policy: not enough approvals, and not a hotfix")
+
+	// Rules that can't be evaluated deny
+	s.Policy, err = policy.Parse([]byte(`rules: [{name: broken, deny: "requester.ci_claims['nope'][0] == 'x'"}]`))
+	assert.NoError(t, err)
+	err = request("group/project", hotfix)
+	assert.Equal(t, api.ErrorCodeConfiguration, api.ErrorCode(err))
+
+	events, err := audit.ReadEvents(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, 6)
+	assert.Equal(t, audit.EventIssued, events[0].Type)
+	assert.Equal(t, api.ErrorCodePolicyDenied, events[1].ErrorCode)
+	assert.Equal(t, "denied by policy: group/frozen is frozen", events[1].Reason)
+}
+
+func TestHandleWorkflowAuthWithLimits(t *testing.T) {
+	s, key := testGitlabServer(t)
+	var buf bytes.Buffer
+	s.Audit = audit.NewLogger(&audit.WriterSink{W: &buf}, []byte("audit-key"))
+	clock := clockwork.NewFakeClockAt(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	s.Clock = clock
+	s.Config.Roles[0].Limits = &api.RoleLimitsConfig{
+		PerRequester: &api.LimitConfig{IssuancesPerHour: 1},
+		PerRole:      &api.LimitConfig{MaxActive: 5},
+	}
+	request := func(username string) error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Username:      username,
+			Role:          "deployment",
+			IdentityToken: gitlabToken(t, key, "group/project", "true"),
+		})
+		return err
+	}
+
+	// Limits need somewhere to be counted
+	assert.Equal(t, api.ErrorCodeConfiguration, api.ErrorCode(request("")))
+	s.Limits = limits.NewLimiter(limits.NewMemoryStore())
+
+	assert.NoError(t, request("smithb12"))
+	clock.Advance(10 * time.Minute)
+	// Claiming to be someone else doesn't get around the requester limit
+	err := request("jonesa01")
+	assert.EqualError(t, err, "rate limited: limit of 1 issuances per hour for test/deployment/ci:job_1 reached, retry after 50m0s")
+	assert.Equal(t, api.ErrorCodeRateLimited, api.ErrorCode(err))
+	assert.True(t, api.IsRetryable(err))
+	assert.Equal(t, 50*time.Minute, api.RetryAfter(err))
+
+	clock.Advance(50 * time.Minute)
+	assert.NoError(t, request("smithb12"))
+
+	// Requesters who don't prove who they are can't be counted apart
+	s.Config.Roles[0].CIIdentity = nil
+	err = request("smithb12")
+	assert.EqualError(t, err, "role has per requester limits, but the requester isn't identified")
+	assert.Equal(t, api.ErrorCodeConfiguration, api.ErrorCode(err))
+
+	events, err := audit.ReadEvents(&buf)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 5) {
+		assert.Equal(t, api.ErrorCodeRateLimited, events[2].ErrorCode)
+		assert.Equal(t, audit.EventIssued, events[3].Type)
+	}
+}
+
+func TestLimitsRequester(t *testing.T) {
+	assert.Equal(t, "ci:job_1", limitsRequester(&idtoken.Identity{Subject: "job_1", Username: "smithb12"}, ""))
+	assert.Equal(t, "user:smithb12", limitsRequester(nil, "SmithB12"))
+	assert.Equal(t, "", limitsRequester(nil, ""))
+}
+
+// memoryReviews is a review store for tests.
+type memoryReviews struct {
+	reviews map[string]*audit.Review
+	err     error
+}
+
+func (m *memoryReviews) Put(r *audit.Review) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.reviews[r.Id] = r
+	return nil
+}
+
+func (m *memoryReviews) Get(id string) (*audit.Review, error) {
+	r, ok := m.reviews[id]
+	if !ok {
+		return nil, errors.Errorf("no such review: %s", id)
+	}
+	return r, nil
+}
+
+func (m *memoryReviews) List() ([]*audit.Review, error) {
+	var reviews []*audit.Review
+	for _, r := range m.reviews {
+		reviews = append(reviews, r)
+	}
+	return reviews, nil
+}
+
+type notifierFunc func(e *audit.Event) error
+
+func (f notifierFunc) Notify(e *audit.Event) error {
+	return f(e)
+}
+
+func TestHandleWorkflowAuthBreakGlass(t *testing.T) {
+	s, key := testGitlabServer(t)
+	var buf bytes.Buffer
+	s.Audit = audit.NewLogger(&audit.WriterSink{W: &buf}, nil)
+	reviews := &memoryReviews{reviews: make(map[string]*audit.Review)}
+	s.Reviews = reviews
+	var notified []*audit.Event
+	s.newNotifier = func(target string) (audit.Notifier, error) {
+		assert.Equal(t, "sns://arn:aws:sns:ap-southeast-2:123456789012:break-glass", target)
+		return notifierFunc(func(e *audit.Event) error {
+			notified = append(notified, e)
+			// Notification failures don't fail the request
+			return errors.New("sns is down too")
+		}), nil
+	}
+	request := func(justification string) error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Role:          "deployment",
+			IdentityToken: gitlabToken(t, key, "group/project", "true"),
+			BreakGlass:    &api.BreakGlassRequest{Justification: justification},
+		})
+		return err
+	}
+
+	err := request("workflow is down, INC-123")
+	assert.Equal(t, api.ErrorCodeBreakGlassNotAllowed, api.ErrorCode(err))
+
+	role := &s.Config.Roles[0]
+	role.BreakGlass = &api.RoleBreakGlassConfig{
+		MaxValidForSeconds: 900,
+		Notify:             []string{"sns://arn:aws:sns:ap-southeast-2:123456789012:break-glass"},
+	}
+	// Break-glass ignores the role's schedule
+	role.Schedule = &api.RoleScheduleConfig{
+		Blackouts: []api.BlackoutConfig{{Name: "freeze", Start: "2000-01-01", End: "2100-01-01"}},
+	}
+	err = request("because")
+	assert.Equal(t, api.ErrorCodeBadRequest, api.ErrorCode(err))
+	assert.NoError(t, request("workflow is down, INC-123"))
+
+	events, err := audit.ReadEvents(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+	issued := events[2]
+	assert.Equal(t, audit.EventIssued, issued.Type)
+	assert.Equal(t, 900, issued.ValidForSeconds)
+	if assert.NotNil(t, issued.BreakGlass) {
+		assert.Equal(t, "workflow is down, INC-123", issued.BreakGlass.Justification)
+		review, err := reviews.Get(issued.BreakGlass.ReviewId)
+		if assert.NoError(t, err) {
+			assert.Equal(t, audit.ReviewPending, review.Status)
+			assert.Equal(t, "smithb12", review.Requester.Username)
+			assert.Equal(t, issued.Hash, review.EventHash)
+		}
+	}
+	// Denied break-glass requests are announced too
+	assert.Len(t, notified, 2)
+	assert.Equal(t, audit.EventDenied, notified[0].Type)
+	assert.Equal(t, issued.Hash, notified[1].Hash)
+
+	// Break-glass approvals replace the workflow policy's
+	role.BreakGlass.ApproverRoles = map[string]int{"ops": 1}
+	err = request("workflow is down, INC-123")
+	assert.Equal(t, api.ErrorCodeNotEnoughApprovals, api.ErrorCode(err))
+	role.BreakGlass.ApproverRoles = nil
+
+	// Nothing is handed out unless it will be reviewed
+	reviews.err = errors.New("s3 is down")
+	err = request("workflow is down, INC-123")
+	assert.Error(t, err)
+	assert.True(t, api.IsRetryable(err))
+
+	// Clients aren't told where break-glass requests are announced
+	resp, err := s.HandleConfig(&api.ConfigRequest{})
+	assert.NoError(t, err)
+	assert.Nil(t, resp.Config.Roles[0].BreakGlass.Notify)
+	assert.Equal(t, 900, resp.Config.Roles[0].BreakGlass.MaxValidForSeconds)
+	assert.NotNil(t, s.Config.Roles[0].BreakGlass.Notify)
+}
+
+// testIPOracleSigner returns a local ip oracle signer, and its PEM
+// public key.
+func testIPOracleSigner(t *testing.T) (*ip_oracle.LocalSigner, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ip_oracle.NewLocalSigner(key)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	assert.NoError(t, err)
+	return signer, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestHandleWorkflowAuthWithIPOracle(t *testing.T) {
+	s, key := testGitlabServer(t)
+	signer, publicKey := testIPOracleSigner(t)
+	s.Config.AccessControl.IPOracle = api.IPOracleConfig{
+		WhiteListCidrs: []string{"10.0.0.0/8"},
+		SignUrl:        "https://ip-oracle.example.com/sign",
+		Signer:         "local",
+		Key:            publicKey,
+	}
+
+	configResp, err := s.HandleConfig(&api.ConfigRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, &api.IPOraclePublicConfig{
+		SignUrl: "https://ip-oracle.example.com/sign",
+	}, configResp.Config.IPOracle)
+
+	auth := func(ipToken string) error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Role:          "deployment",
+			IssuingNonce:  "nonce-1",
+			IdentityToken: gitlabToken(t, key, "group/project", "true"),
+			IpToken:       ipToken,
+		})
+		return err
+	}
+	ipToken := func(sourceIp string, signer jwt.SigningMethod) string {
+		token, err := (&ip_oracle.TokenIssuer{Method: signer}).Issue(sourceIp, "", "nonce-1")
+		assert.NoError(t, err)
+		return token
+	}
+
+	assert.NoError(t, auth(ipToken("10.1.2.3", signer)))
+
+	err = auth("")
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(err))
+	// Tokens are for one request, by its issuing nonce
+	replayed, err := (&ip_oracle.TokenIssuer{Method: signer}).Issue("10.1.2.3", "", "nonce-0")
+	assert.NoError(t, err)
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(auth(replayed)))
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:          "deployment",
+		IdentityToken: gitlabToken(t, key, "group/project", "true"),
+		IpToken:       ipToken("10.1.2.3", signer),
+	})
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(err))
+	err = auth("not-a-token")
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(err))
+	err = auth(ipToken("192.168.1.1", signer))
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(err))
+	assert.Contains(t, err.Error(), "source ip 192.168.1.1 is not whitelisted for role deployment")
+
+	otherSigner, _ := testIPOracleSigner(t)
+	err = auth(ipToken("10.1.2.3", otherSigner))
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(err))
+
+	// A role's own whitelist replaces the access control whitelist
+	s.Config.Roles[0].IPOracle = &api.RoleIPOracleConfig{
+		WhiteListCidrs: []string{"192.168.0.0/16", "2001:db8::/32"},
+	}
+	assert.NoError(t, auth(ipToken("192.168.1.1", signer)))
+	assert.NoError(t, auth(ipToken("2001:db8::1", signer)))
+	err = auth(ipToken("10.1.2.3", signer))
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(err))
+
+	// Deny lists add up, and named ranges can be used in either list
+	s.Config.AccessControl.IPOracle.Ranges = map[string][]string{
+		"ci-egress": {"192.168.10.0/24", "2001:db8:c1::/48"},
+	}
+	s.Config.AccessControl.IPOracle.DenyListCidrs = []string{"192.168.66.0/24"}
+	s.Config.Roles[0].IPOracle = &api.RoleIPOracleConfig{
+		WhiteListCidrs: []string{"ci-egress", "192.168.0.0/16"},
+		DenyListCidrs:  []string{"192.168.10.99"},
+	}
+	assert.NoError(t, auth(ipToken("192.168.10.1", signer)))
+	err = auth(ipToken("192.168.66.1", signer))
+	assert.Contains(t, err.Error(), "denied by 192.168.66.0/24")
+	err = auth(ipToken("192.168.10.99", signer))
+	assert.Contains(t, err.Error(), "denied by 192.168.10.99")
+
+	// Every address in the token must be allowed
+	issuer := &ip_oracle.TokenIssuer{Method: signer}
+	token, err := issuer.IssueAddresses([]string{"192.168.10.1", "2001:db8:c1::1"}, "", "nonce-1")
+	assert.NoError(t, err)
+	assert.NoError(t, auth(token))
+	token, err = issuer.IssueAddresses([]string{"192.168.10.1", "2001:db9::1"}, "", "nonce-1")
+	assert.NoError(t, err)
+	err = auth(token)
+	assert.Contains(t, err.Error(), "source ip 2001:db9::1 is not whitelisted")
+}
+
+func TestHandleWorkflowAuthWithIPOracleJwks(t *testing.T) {
+	s, key := testGitlabServer(t)
+	signer, _ := testIPOracleSigner(t)
+	jwks, err := ip_oracle.JWKS(signer)
+	assert.NoError(t, err)
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer oracle.Close()
+	s.Config.AccessControl.IPOracle = api.IPOracleConfig{
+		WhiteListCidrs: []string{"10.0.0.0/8"},
+		SignUrl:        oracle.URL + "/sign",
+		Key:            "alias/ip-oracle",
+		JwksUrl:        oracle.URL + "/jwks",
+		Issuer:         "https://ip-oracle.example.com",
+		BindAudience:   true,
+	}
+
+	configResp, err := s.HandleConfig(&api.ConfigRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, &api.IPOraclePublicConfig{
+		SignUrl:  oracle.URL + "/sign",
+		KeyId:    "alias/ip-oracle",
+		Audience: "test",
+	}, configResp.Config.IPOracle)
+
+	auth := func(ipToken string) error {
+		_, err := s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+			Role:          "deployment",
+			IssuingNonce:  "nonce-1",
+			IdentityToken: gitlabToken(t, key, "group/project", "true"),
+			IpToken:       ipToken,
+		})
+		return err
+	}
+	issuer := &ip_oracle.TokenIssuer{Method: signer, Issuer: "https://ip-oracle.example.com"}
+	ipToken, err := issuer.Issue("10.1.2.3", "test", "nonce-1")
+	assert.NoError(t, err)
+	assert.NoError(t, auth(ipToken))
+
+	// Tokens for another environment, or from another issuer
+	ipToken, err = issuer.Issue("10.1.2.3", "prod", "nonce-1")
+	assert.NoError(t, err)
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(auth(ipToken)))
+	ipToken, err = ip_oracle.MakeIPJWT("10.1.2.3", signer)
+	assert.NoError(t, err)
+	assert.Equal(t, api.ErrorCodeSourceNotAllowed, api.ErrorCode(auth(ipToken)))
+}
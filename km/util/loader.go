@@ -0,0 +1,268 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+)
+
+// Loader loads things that may be given by reference, e.g. in config:
+//
+//   s3://bucket/key                   an S3 object
+//   file:///path                      a file
+//   data://base64                     base64 encoded data
+//   ssm:///parameter/name             an SSM parameter, decrypted
+//   secretsmanager://secret-id[#key]  a secret, or one key of a JSON secret
+//   env://NAME                        an environment variable
+//   kms+data://base64                 ciphertext, decrypted with KMS
+//
+// Anything else is literal data. AWS clients are created on first use,
+// unless they are set (e.g. by tests).
+type Loader struct {
+	S3             s3iface.S3API
+	SSM            ssmiface.SSMAPI
+	SecretsManager secretsmanageriface.SecretsManagerAPI
+	KMS            kmsiface.KMSAPI
+	// LookupEnv defaults to os.LookupEnv
+	LookupEnv func(string) (string, bool)
+
+	mu   sync.Mutex
+	sess *session.Session
+}
+
+// DefaultLoader is the Loader used by Load and LoadVersion.
+var DefaultLoader = &Loader{}
+
+func (l *Loader) session() *session.Session {
+	if l.sess == nil {
+		l.sess = session.Must(session.NewSession())
+	}
+	return l.sess
+}
+
+func (l *Loader) s3() s3iface.S3API {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.S3 == nil {
+		l.S3 = s3.New(l.session())
+	}
+	return l.S3
+}
+
+func (l *Loader) ssm() ssmiface.SSMAPI {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.SSM == nil {
+		l.SSM = ssm.New(l.session())
+	}
+	return l.SSM
+}
+
+func (l *Loader) secretsManager() secretsmanageriface.SecretsManagerAPI {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.SecretsManager == nil {
+		l.SecretsManager = secretsmanager.New(l.session())
+	}
+	return l.SecretsManager
+}
+
+func (l *Loader) kms() kmsiface.KMSAPI {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.KMS == nil {
+		l.KMS = kms.New(l.session())
+	}
+	return l.KMS
+}
+
+// Load loads s, by reference if it is one.
+func (l *Loader) Load(s string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(s, "s3://"):
+		return l.loadS3(s)
+	case strings.HasPrefix(s, "file://"):
+		return ioutil.ReadFile(s[7:])
+	case strings.HasPrefix(s, "data://"):
+		return base64.StdEncoding.DecodeString(s[7:])
+	case strings.HasPrefix(s, "ssm://"):
+		return l.loadSSM(s)
+	case strings.HasPrefix(s, "secretsmanager://"):
+		return l.loadSecret(s)
+	case strings.HasPrefix(s, "env://"):
+		return l.loadEnv(s)
+	case strings.HasPrefix(s, "kms+data://"):
+		return l.loadKMS(s)
+	}
+	return []byte(s), nil
+}
+
+// LoadVersion returns an opaque version for something Load can load, that
+// changes when it does: the ETag of an s3 object, the modification time
+// and size of a file, or the version of an SSM parameter or secret.
+// Literals (and environment variables) never change, and have an empty
+// version.
+func (l *Loader) LoadVersion(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "s3://"):
+		bucket, key, err := parseS3Uri(s)
+		if err != nil {
+			return "", err
+		}
+		resp, err := l.s3().HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(resp.ETag), nil
+	case strings.HasPrefix(s, "file://"):
+		fi, err := os.Stat(s[7:])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size()), nil
+	case strings.HasPrefix(s, "ssm://"):
+		resp, err := l.getParameter(s)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(aws.Int64Value(resp.Parameter.Version)), nil
+	case strings.HasPrefix(s, "secretsmanager://"):
+		resp, _, err := l.getSecret(s)
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(resp.VersionId), nil
+	}
+	return "", nil
+}
+
+func parseS3Uri(s3uri string) (string, string, error) {
+	u, err := url.Parse(s3uri)
+	if err != nil {
+		return "", "", err
+	}
+	return u.Host, strings.TrimLeft(u.Path, "/"), nil
+}
+
+func (l *Loader) loadS3(s3uri string) ([]byte, error) {
+	bucket, key, err := parseS3Uri(s3uri)
+	if err != nil {
+		return nil, err
+	}
+	buf := &aws.WriteAtBuffer{}
+	downloader := s3manager.NewDownloaderWithClient(l.s3())
+	_, err = downloader.Download(buf,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (l *Loader) getParameter(s string) (*ssm.GetParameterOutput, error) {
+	// ssm:///path/name is the parameter /path/name, ssm://name is name
+	name := s[6:]
+	resp, err := l.ssm().GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting ssm parameter %s", name)
+	}
+	return resp, nil
+}
+
+func (l *Loader) loadSSM(s string) ([]byte, error) {
+	resp, err := l.getParameter(s)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(aws.StringValue(resp.Parameter.Value)), nil
+}
+
+// getSecret gets a secret, returning the JSON key wanted from it, if any.
+func (l *Loader) getSecret(s string) (*secretsmanager.GetSecretValueOutput, string, error) {
+	secretId := s[17:]
+	var jsonKey string
+	if i := strings.LastIndex(secretId, "#"); i >= 0 {
+		secretId, jsonKey = secretId[:i], secretId[i+1:]
+	}
+	resp, err := l.secretsManager().GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+	})
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "getting secret %s", secretId)
+	}
+	return resp, jsonKey, nil
+}
+
+func (l *Loader) loadSecret(s string) ([]byte, error) {
+	resp, jsonKey, err := l.getSecret(s)
+	if err != nil {
+		return nil, err
+	}
+	value := resp.SecretBinary
+	if resp.SecretString != nil {
+		value = []byte(*resp.SecretString)
+	}
+	if jsonKey == "" {
+		return value, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, errors.Wrapf(err, "secret %s is not a JSON object", aws.StringValue(resp.Name))
+	}
+	field, ok := fields[jsonKey].(string)
+	if !ok {
+		return nil, errors.Errorf("secret %s has no string key %s", aws.StringValue(resp.Name), jsonKey)
+	}
+	return []byte(field), nil
+}
+
+func (l *Loader) loadEnv(s string) ([]byte, error) {
+	lookupEnv := l.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	value, ok := lookupEnv(s[6:])
+	if !ok {
+		return nil, errors.Errorf("environment variable %s is not set", s[6:])
+	}
+	return []byte(value), nil
+}
+
+func (l *Loader) loadKMS(s string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(s[11:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding kms ciphertext")
+	}
+	resp, err := l.kms().Decrypt(&kms.DecryptInput{CiphertextBlob: ciphertext})
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypting with kms")
+	}
+	return resp.Plaintext, nil
+}
@@ -0,0 +1,139 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	params map[string]string
+}
+
+func (f *fakeSSM) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	value, ok := f.params[aws.StringValue(in.Name)]
+	if !ok || !aws.BoolValue(in.WithDecryption) {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{
+		Parameter: &ssm.Parameter{Value: aws.String(value), Version: aws.Int64(3)},
+	}, nil
+}
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]*secretsmanager.GetSecretValueOutput
+}
+
+func (f *fakeSecretsManager) GetSecretValue(in *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	secret, ok := f.secrets[aws.StringValue(in.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return secret, nil
+}
+
+type fakeKMS struct {
+	kmsiface.KMSAPI
+}
+
+func (f *fakeKMS) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if !bytes.HasPrefix(in.CiphertextBlob, []byte("encrypted:")) {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{Plaintext: in.CiphertextBlob[10:]}, nil
+}
+
+func TestLoaderSchemes(t *testing.T) {
+	l := &Loader{
+		SSM: &fakeSSM{params: map[string]string{
+			"/keymaster/ca.key": "ssm-key",
+			"ca-key":            "ssm-name-key",
+		}},
+		SecretsManager: &fakeSecretsManager{secrets: map[string]*secretsmanager.GetSecretValueOutput{
+			"keymaster/ca": {
+				Name:         aws.String("keymaster/ca"),
+				SecretString: aws.String(`{"key": "json-key", "n": 1}`),
+				VersionId:    aws.String("v2"),
+			},
+			"keymaster/binary": {
+				Name:         aws.String("keymaster/binary"),
+				SecretBinary: []byte("binary-key"),
+			},
+		}},
+		KMS: &fakeKMS{},
+		LookupEnv: func(name string) (string, bool) {
+			if name == "CA_KEY" {
+				return "env-key", true
+			}
+			return "", false
+		},
+	}
+	tests := []struct {
+		ref      string
+		expected string
+		err      string
+	}{
+		{ref: "literal", expected: "literal"},
+		{ref: "data://YmFuYW5h", expected: "banana"},
+		{ref: "file://testdata/load_data.txt", expected: "sasquatch"},
+		{ref: "ssm:///keymaster/ca.key", expected: "ssm-key"},
+		{ref: "ssm://ca-key", expected: "ssm-name-key"},
+		{ref: "ssm:///nope", err: "getting ssm parameter /nope: ParameterNotFound"},
+		{ref: "secretsmanager://keymaster/ca", expected: `{"key": "json-key", "n": 1}`},
+		{ref: "secretsmanager://keymaster/ca#key", expected: "json-key"},
+		{ref: "secretsmanager://keymaster/ca#n", err: "secret keymaster/ca has no string key n"},
+		{ref: "secretsmanager://keymaster/binary", expected: "binary-key"},
+		{ref: "secretsmanager://keymaster/binary#key", err: "secret keymaster/binary is not a JSON object"},
+		{ref: "secretsmanager://nope", err: "getting secret nope: ResourceNotFoundException"},
+		{ref: "env://CA_KEY", expected: "env-key"},
+		{ref: "env://NOPE", err: "environment variable NOPE is not set"},
+		{ref: "kms+data://" + base64.StdEncoding.EncodeToString([]byte("encrypted:kms-key")), expected: "kms-key"},
+		{ref: "kms+data://" + base64.StdEncoding.EncodeToString([]byte("plaintext")), err: "decrypting with kms"},
+		{ref: "kms+data://!!!", err: "decoding kms ciphertext"},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			v, err := l.Load(test.ref)
+			if test.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), test.err)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(v))
+		})
+	}
+}
+
+func TestLoaderVersions(t *testing.T) {
+	l := &Loader{
+		SSM: &fakeSSM{params: map[string]string{"/keymaster/ca.key": "ssm-key"}},
+		SecretsManager: &fakeSecretsManager{secrets: map[string]*secretsmanager.GetSecretValueOutput{
+			"keymaster/ca": {SecretString: aws.String("key"), VersionId: aws.String("v2")},
+		}},
+	}
+	v, err := l.LoadVersion("ssm:///keymaster/ca.key")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", v)
+	v, err = l.LoadVersion("secretsmanager://keymaster/ca#key")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", v)
+	v, err = l.LoadVersion("env://CA_KEY")
+	assert.NoError(t, err)
+	assert.Equal(t, "", v)
+	_, err = l.LoadVersion("ssm:///nope")
+	assert.Error(t, err)
+}
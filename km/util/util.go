@@ -1,13 +1,11 @@
 package util
 
 import (
-	"encoding/base64"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
-	"io/ioutil"
 	"net/url"
 	"os"
 	"runtime"
@@ -27,18 +25,16 @@ func UserHomeDir() (string, error) {
 	return "", errors.New("could not find user home directory, please set $HOME")
 }
 
+// Load loads s with the DefaultLoader, by reference (s3:// file://
+// data:// ssm:// secretsmanager:// env:// kms+data://) if it is one, or
+// else as literal data.
 func Load(s string) ([]byte, error) {
-	if strings.HasPrefix(s, "s3://") {
-		sess := session.Must(session.NewSession())
-		return LoadFromS3(sess, s)
-	} else if strings.HasPrefix(s, "file://") {
-		b, err := ioutil.ReadFile(s[7:])
-		return b, err
-	} else if strings.HasPrefix(s, "data://") {
-		b, err := base64.StdEncoding.DecodeString(s[7:])
-		return b, err
-	}
-	return []byte(s), nil
+	return DefaultLoader.Load(s)
+}
+
+// LoadVersion returns the version of s, as per Loader.LoadVersion.
+func LoadVersion(s string) (string, error) {
+	return DefaultLoader.LoadVersion(s)
 }
 
 func LoadFromS3(sess *session.Session, s3uri string) ([]byte, error) {
@@ -13,4 +13,17 @@ func TestLoad(t *testing.T) {
 	v, err = Load("file://testdata/load_data.txt")
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("sasquatch"), v)
-}
\ No newline at end of file
+}
+
+func TestLoadVersion(t *testing.T) {
+	v, err := LoadVersion("data://YmFuYW5h")
+	assert.NoError(t, err)
+	assert.Equal(t, "", v)
+
+	v, err = LoadVersion("file://testdata/load_data.txt")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, v)
+
+	_, err = LoadVersion("file://testdata/nope.txt")
+	assert.Error(t, err)
+}
@@ -20,6 +20,51 @@ data "aws_iam_policy_document" "km" {
     resources = var.s3_readable_objects
     effect = "Allow"
   }
+  dynamic "statement" {
+    for_each = length(var.ssm_readable_parameters) > 0 ? [1] : []
+    content {
+      sid = "ReadFromSSM"
+      actions = [
+        "ssm:GetParameter",
+      ]
+      resources = var.ssm_readable_parameters
+      effect = "Allow"
+    }
+  }
+  dynamic "statement" {
+    for_each = length(var.readable_secrets) > 0 ? [1] : []
+    content {
+      sid = "ReadSecrets"
+      actions = [
+        "secretsmanager:GetSecretValue",
+      ]
+      resources = var.readable_secrets
+      effect = "Allow"
+    }
+  }
+  dynamic "statement" {
+    for_each = length(var.decrypt_kms_keys) > 0 ? [1] : []
+    content {
+      sid = "DecryptWithKMS"
+      actions = [
+        "kms:Decrypt",
+      ]
+      resources = var.decrypt_kms_keys
+      effect = "Allow"
+    }
+  }
+  dynamic "statement" {
+    for_each = length(var.ca_signing_kms_keys) > 0 ? [1] : []
+    content {
+      sid = "SignWithCAKeys"
+      actions = [
+        "kms:Sign",
+        "kms:GetPublicKey",
+      ]
+      resources = var.ca_signing_kms_keys
+      effect = "Allow"
+    }
+  }
   statement {
     sid = "WriteLogs"
     actions = [
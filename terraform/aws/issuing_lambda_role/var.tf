@@ -20,3 +20,27 @@ variable "s3_readable_objects" {
   type = list(string)
   default = []
 }
+
+variable "ssm_readable_parameters" {
+  description = "List of SSM parameter ARNs (ssm:// config references) which issuing lambda may read"
+  type = list(string)
+  default = []
+}
+
+variable "readable_secrets" {
+  description = "List of Secrets Manager secret ARNs (secretsmanager:// config references) which issuing lambda may read"
+  type = list(string)
+  default = []
+}
+
+variable "decrypt_kms_keys" {
+  description = "List of KMS key ARNs which issuing lambda may decrypt with (kms+data:// config references, encrypted SSM parameters and secrets)"
+  type = list(string)
+  default = []
+}
+
+variable "ca_signing_kms_keys" {
+  description = "List of asymmetric KMS key ARNs used as SSH or kubernetes CA keys (kms:// ca_key), which issuing lambda may sign with"
+  type = list(string)
+  default = []
+}